@@ -6,8 +6,12 @@ import (
 	"errors"
 	"fmt"
 	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/m-lab/go/rtx"
 	"github.com/m-lab/tcp-info/inetdiag"
 )
 
@@ -17,6 +21,18 @@ var (
 	// functioning fine, but one or more of the annotations you asked for could
 	// not be performed.
 	ErrNoAnnotation = errors.New("Could not annotate IP address")
+
+	// ErrUnknownDirection is for when neither end of a connection is one of
+	// the local IPs, so we can not tell which end is the server.
+	ErrUnknownDirection = errors.New("Unknown direction")
+
+	// ErrInvalidIP is for when an IP address (or netblock) could not be parsed.
+	ErrInvalidIP = errors.New("Invalid IP address")
+
+	// ErrLookupFailed is for when the database of an annotator could not be
+	// searched, e.g. because it is not loaded or is corrupt, as opposed to
+	// not containing the IP.
+	ErrLookupFailed = errors.New("Database lookup failed")
 )
 
 // The Geolocation struct contains all the information needed for the
@@ -44,7 +60,24 @@ type Geolocation struct {
 	Longitude        float64 `json:",omitempty"` // Longitude
 	AccuracyRadiusKm int64   `json:",omitempty"` // Geo2: Accuracy Radius (since 2018)
 
+	// CoordinatesAreApproximate is true when there is no city-level data, so
+	// the Latitude and Longitude are a country or continent centroid.
+	CoordinatesAreApproximate bool `json:",omitempty"`
+
+	// TimeZone is the IANA time zone of the location, e.g. "America/Chicago".
+	TimeZone string `json:",omitempty"`
+
+	// ApproxUTCOffset is a rough UTC offset like "+02:00", computed from the
+	// Longitude alone for locations without a TimeZone. It ignores
+	// political boundaries and daylight saving time, so may be off by hours.
+	ApproxUTCOffset string `json:",omitempty"`
+
 	Missing bool `json:",omitempty"` // True when the Geolocation data is missing from MaxMind.
+
+	// Reserved is true, along with Missing, when the IP is a private,
+	// loopback, link-local, or documentation address, which no dataset can
+	// locate.
+	Reserved bool `json:",omitempty"`
 }
 
 // We currently use CAIDA RouteViews data to populate ASN annotations.
@@ -70,6 +103,68 @@ type Network struct {
 	ASName   string `json:",omitempty"` // AS name for that number, data from IPinfo.io
 	Missing  bool   `json:",omitempty"` // True when the ASN data is missing from RouteViews.
 
+	// Reserved is true, along with Missing, when the IP is a private,
+	// loopback, link-local, or documentation address, which is never routed
+	// on the public Internet.
+	Reserved bool `json:",omitempty"`
+
+	// AnnouncedCIDR is only set for server networks, whose CIDR is the site's
+	// allocation from siteinfo. It is the RouteViews prefix that contains the
+	// server IP, which may be larger than the allocation.
+	AnnouncedCIDR string `json:",omitempty"`
+
+	// V4CIDR and V6CIDR are the IPv4 and IPv6 blocks of the site from
+	// siteinfo, whatever the family of the connection. They are only set for
+	// server networks, when configured.
+	V4CIDR string `json:",omitempty"`
+	V6CIDR string `json:",omitempty"`
+
+	// ASNameSource is "ipinfo" or "cymru", when a secondary AS name source
+	// is configured, or "maxmind" for networks that are only in the MaxMind
+	// ASN database.
+	ASNameSource string `json:",omitempty"`
+
+	// ASNameAll is every distinct name of ASNumber, starting with ASName,
+	// when additional AS name sources are configured.
+	ASNameAll []string `json:",omitempty"`
+
+	// ASDomain is the domain of the first ASN, and ASType its type, e.g.
+	// "isp", "hosting", "business" or "education", when the IPInfo.io AS
+	// names data has them.
+	ASDomain string `json:",omitempty"`
+	ASType   string `json:",omitempty"`
+
+	// Country is the country of the prefix in IPInfo.io data, only set when
+	// IPInfo.io data is used instead of RouteViews.
+	Country string `json:",omitempty"`
+
+	// TransitionAddress is "teredo" or "6to4" when the IP is a transition
+	// address that was annotated using its embedded IPv4 address, in which
+	// case CIDR is the IPv4 prefix containing the embedded address.
+	TransitionAddress string `json:",omitempty"`
+
+	// AllocatedCountry is the country the prefix was allocated to by its
+	// Regional Internet Registry, independent of geolocation.
+	AllocatedCountry string `json:",omitempty"`
+
+	// ConeSize is the number of ASes in the CAIDA AS Rank customer cone of
+	// the first ASN, including itself, or zero when unknown.
+	ConeSize int64 `json:",omitempty"`
+
+	// Organization is the name of the organization that operates the first
+	// ASN, and OrgID its CAIDA AS-to-Organization ID, which is shared by
+	// sibling ASes. Both are empty when unknown.
+	Organization string `json:",omitempty"`
+	OrgID        string `json:",omitempty"`
+
+	// Visibility is the number of RouteViews peers that observed the CIDR, as
+	// a confidence signal, or zero when the RouteViews data does not have it.
+	Visibility int64 `json:",omitempty"`
+
+	// RouteViewDate is the date, as YYYY-MM-DD, in the name of the RouteViews
+	// file that CIDR was found in, when it is known and enabled.
+	RouteViewDate string `json:",omitempty"`
+
 	// Systems may contain data for Multi-Origin ASNs. Typically, RouteViews
 	// records a single ASN per netblock.
 	Systems []System `json:",omitempty"`
@@ -93,6 +188,11 @@ func (n *Network) FirstASN() uint32 {
 type ClientAnnotations struct {
 	Geo     *Geolocation `json:",omitempty"` // Holds the Client geolocation data
 	Network *Network     `json:",omitempty"` // Holds the Autonomous System data.
+
+	// IPHash is the hex HMAC-SHA256 of the client IP with a secret key, to
+	// join rows from the same client without storing its IP. It is only
+	// populated if the handler is configured to do so.
+	IPHash string `json:",omitempty"`
 }
 
 // ServerAnnotations are server-specific fields populated by the uuid-annotator.
@@ -101,6 +201,38 @@ type ServerAnnotations struct {
 	Machine string       `json:",omitempty"` // Specific M-Lab machine at a site, i.e. "mlab1", "mlab2", etc.
 	Geo     *Geolocation `json:",omitempty"` // Holds the Server geolocation data.
 	Network *Network     `json:",omitempty"` // Holds the Autonomous System data.
+
+	// LocalIP is the local IP that matched the server end of the connection.
+	// It is only populated if the handler is configured to do so.
+	LocalIP string `json:",omitempty"`
+}
+
+// DataVersions identifies the snapshots of the backing datasets that were
+// used to produce the annotations, so that rows produced by a known-bad
+// snapshot can be found later.
+type DataVersions struct {
+	MaxMind      string `json:",omitempty"` // Build date of the MaxMind database.
+	RouteViewsV4 string `json:",omitempty"` // MD5 of the IPv4 RouteViews snapshot.
+	RouteViewsV6 string `json:",omitempty"` // MD5 of the IPv6 RouteViews snapshot.
+}
+
+// AnnotatorError describes the failure of one annotator for a connection.
+type AnnotatorError struct {
+	Annotator string // The name of the annotator from NameOf, e.g. "geo".
+	Error     string
+}
+
+// Debug contains details of how the annotations were produced, to make
+// incomplete annotations self-describing.
+type Debug struct {
+	Errors []AnnotatorError `json:",omitempty"`
+}
+
+// Metadata is a fact about a connection from the source of its event, rather
+// than from an annotator, e.g. an RTT observed when the connection opened.
+type Metadata struct {
+	Key   string
+	Value string
 }
 
 // Annotations contains the standard columns we would like to add as annotations for every UUID.
@@ -109,6 +241,35 @@ type Annotations struct {
 	Timestamp time.Time
 	Server    ServerAnnotations `json:",omitempty" bigquery:"server"` // Use Standard Top-Level Column names.
 	Client    ClientAnnotations `json:",omitempty" bigquery:"client"` // Use Standard Top-Level Column names.
+
+	// DataVersions is only populated by annotators configured to report them.
+	DataVersions *DataVersions `json:",omitempty"`
+
+	// Metadata is only populated for connections whose event source passed
+	// it along with the connection.
+	Metadata []Metadata `json:",omitempty"`
+
+	// SameCountry is true if the client and server geolocations have the same
+	// CountryCode, and false if they differ. It is only populated if the
+	// handler is configured to do so, and both countries are known.
+	SameCountry *bool `json:",omitempty"`
+
+	// PayloadHash is the SHA-256 of the annotations excluding UUID, Timestamp,
+	// Metadata, Debug, and PayloadHash itself. Identical payloads have
+	// identical hashes, which allows downstream dedupe. It is only populated
+	// if the handler is configured to do so.
+	PayloadHash string `json:",omitempty"`
+
+	// Debug is only populated if the handler is configured to do so.
+	Debug *Debug `json:",omitempty"`
+}
+
+// Versions returns the DataVersions of the annotations, creating it if needed.
+func (a *Annotations) Versions() *DataVersions {
+	if a.DataVersions == nil {
+		a.DataVersions = &DataVersions{}
+	}
+	return a.DataVersions
 }
 
 // Annotator is the interface that all systems that want to add metadata should implement.
@@ -116,6 +277,95 @@ type Annotator interface {
 	Annotate(ID *inetdiag.SockID, annotations *Annotations) error
 }
 
+// Namer is implemented by annotators with a stable name, used to label their
+// errors.
+type Namer interface {
+	Name() string
+}
+
+// NameOf returns the name of the annotator, or its Go type if it does not
+// implement Namer.
+func NameOf(a Annotator) string {
+	if n, ok := a.(Namer); ok {
+		return n.Name()
+	}
+	return fmt.Sprintf("%T", a)
+}
+
+// LocalIPUpdater is implemented by annotators whose local IPs can be replaced
+// after construction, e.g. when the public IP of a virtual site changes.
+type LocalIPUpdater interface {
+	UpdateLocalIPs(localIPs []net.IP)
+}
+
+// LocalNetUpdater is implemented by annotators that can find the direction of
+// connections from local netblocks, for servers whose addresses are not exactly
+// one of the local IPs.
+type LocalNetUpdater interface {
+	UpdateLocalNets(localNets []net.IPNet)
+}
+
+// ReloadLimiter is implemented by annotators whose Reload can skip calls that
+// arrive too soon after the previous reload, so that reloads triggered from
+// outside the regular schedule cannot check the backing data over and over.
+type ReloadLimiter interface {
+	SetMinReloadInterval(d time.Duration)
+}
+
+// ReloadForcer is implemented by annotators whose next Reload can be made to
+// run regardless of the minimum reload interval, e.g. when an operator asks
+// for fresh data.
+type ReloadForcer interface {
+	ForceReload()
+}
+
+// ReloadGuard implements ReloadLimiter for the annotators that embed it. Its
+// zero value allows every reload.
+type ReloadGuard struct {
+	mu   sync.Mutex
+	min  time.Duration
+	last time.Time
+	prev time.Time // The last reload before last, restored by ReloadFailed.
+}
+
+// SetMinReloadInterval makes Reload skip calls sooner than d after the
+// previous reload. Values of d less than or equal to zero allow every reload.
+func (g *ReloadGuard) SetMinReloadInterval(d time.Duration) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.min = d
+}
+
+// AllowReload returns true, and records the time as the last reload, unless
+// the previous reload was less than the minimum interval ago. Callers should
+// call ReloadFailed if the reload then fails.
+func (g *ReloadGuard) AllowReload() bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	now := time.Now()
+	if g.min > 0 && !g.last.IsZero() && now.Sub(g.last) < g.min {
+		return false
+	}
+	g.prev, g.last = g.last, now
+	return true
+}
+
+// ForceReload makes the next AllowReload return true, however recent the last
+// reload was.
+func (g *ReloadGuard) ForceReload() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.last = time.Time{}
+}
+
+// ReloadFailed forgets the reload last allowed, so that a reload that failed
+// may be retried without waiting for the minimum interval.
+func (g *ReloadGuard) ReloadFailed() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.last = g.prev
+}
+
 // Direction gives us an enum to keep track of which end of the connection is
 // the server, because we are informed of connections without regard to which
 // end is the local server.
@@ -130,14 +380,197 @@ const (
 
 // FindDirection determines whether the IPs in the given ID map to the server or client annotations.
 // FindDirection returns the corresponding "src" and "dst" annotation fields from the given annotator.Annotations.
+// FindDirection scans every local IP, so callers on a hot path should use a LocalIPSet instead.
+// IPs are parsed and compared by value, so that differences in their textual
+// form, like case or zero compression in IPv6, do not matter.
 func FindDirection(ID *inetdiag.SockID, localIPs []net.IP) (Direction, error) {
+	src := net.ParseIP(ID.SrcIP)
+	dst := net.ParseIP(ID.DstIP)
 	for _, local := range localIPs {
-		if ID.SrcIP == local.String() {
+		if src != nil && src.Equal(local) {
 			return SrcIsServer, nil
 		}
-		if ID.DstIP == local.String() {
+		if dst != nil && dst.Equal(local) {
 			return DstIsServer, nil
 		}
 	}
-	return Unknown, fmt.Errorf("Can't annotate connection: Unknown direction for %+v", ID)
+	return Unknown, fmt.Errorf("Can't annotate connection: %w for %+v", ErrUnknownDirection, ID)
+}
+
+// FindDirectionInNets determines the direction of the connection like
+// FindDirection, but an endpoint is the server if its IP is contained in one
+// of the local netblocks, instead of being exactly one of the local IPs. This
+// recognizes servers whose addresses differ from the configured IPs, e.g.
+// behind a load balancer or NAT, or IPv6 addresses reported with a zone.
+func FindDirectionInNets(ID *inetdiag.SockID, localNets []net.IPNet) (Direction, error) {
+	src := parseZonedIP(ID.SrcIP)
+	dst := parseZonedIP(ID.DstIP)
+	for _, local := range localNets {
+		if src != nil && local.Contains(src) {
+			return SrcIsServer, nil
+		}
+		if dst != nil && local.Contains(dst) {
+			return DstIsServer, nil
+		}
+	}
+	return Unknown, fmt.Errorf("Can't annotate connection: %w for %+v", ErrUnknownDirection, ID)
+}
+
+// parseZonedIP parses an IP that may have an IPv6 zone, e.g. "fe80::1%eth0",
+// ignoring the zone. It returns nil for invalid IPs.
+func parseZonedIP(s string) net.IP {
+	if i := strings.IndexByte(s, '%'); i >= 0 {
+		s = s[:i]
+	}
+	return net.ParseIP(s)
+}
+
+// IsLocal returns true when the IP is one of the local IPs. IPs are compared
+// in their canonical string form, like FindDirection does, so an IPv4-mapped
+// IPv6 address matches the IPv4 address.
+func IsLocal(ip net.IP, localIPs []net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	s := ip.String()
+	for _, local := range localIPs {
+		if local != nil && s == local.String() {
+			return true
+		}
+	}
+	return false
+}
+
+// documentationNets are the address blocks reserved for use in documentation
+// by RFC 5737 and RFC 3849.
+var documentationNets = []*net.IPNet{
+	mustParseCIDR("192.0.2.0/24"),
+	mustParseCIDR("198.51.100.0/24"),
+	mustParseCIDR("203.0.113.0/24"),
+	mustParseCIDR("2001:db8::/32"),
+}
+
+func mustParseCIDR(s string) *net.IPNet {
+	_, n, err := net.ParseCIDR(s)
+	rtx.Must(err, "Could not parse CIDR %q", s)
+	return n
+}
+
+// IsReserved returns true when the IP is a private, loopback, link-local, or
+// documentation address. Annotators mark such IPs Reserved instead of
+// searching their data, so they are not mistaken for public IPs that are
+// missing from the data.
+func IsReserved(ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	if ip.IsPrivate() || ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() {
+		return true
+	}
+	for _, n := range documentationNets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// LocalIPSet is a precomputed set of local IPs. Annotators should build one at
+// construction time, because its FindDirection method does a constant number
+// of map lookups per connection, instead of scanning every local IP.
+type LocalIPSet struct {
+	// index maps the string form of each local IP to its position in the list
+	// of IPs it was built from, so that results match FindDirection exactly.
+	index atomic.Pointer[map[string]int]
+	// nets are the local netblocks, searched for connections without a local
+	// IP.
+	nets atomic.Pointer[[]net.IPNet]
+}
+
+// NewLocalIPSet creates a LocalIPSet containing the given IPs.
+func NewLocalIPSet(localIPs []net.IP) *LocalIPSet {
+	s := &LocalIPSet{}
+	s.Update(localIPs)
+	return s
+}
+
+// Update replaces the IPs in the set. It is safe to call concurrently with
+// Contains and FindDirection.
+func (s *LocalIPSet) Update(localIPs []net.IP) {
+	index := make(map[string]int, len(localIPs))
+	for i, local := range localIPs {
+		k := local.String()
+		if _, ok := index[k]; !ok {
+			index[k] = i
+		}
+	}
+	s.index.Store(&index)
+}
+
+// UpdateNets replaces the local netblocks of the set. Connections with neither
+// endpoint in the set have their direction found with FindDirectionInNets and
+// these netblocks, so that servers whose addresses are not exactly one of the
+// local IPs are recognized. It is safe to call concurrently with FindDirection.
+func (s *LocalIPSet) UpdateNets(localNets []net.IPNet) {
+	nets := append([]net.IPNet(nil), localNets...)
+	s.nets.Store(&nets)
+}
+
+// canonicalIP returns the canonical string form of the IP, or the string
+// itself if it is not a valid IP.
+func canonicalIP(s string) string {
+	if ip := net.ParseIP(s); ip != nil {
+		return ip.String()
+	}
+	return s
+}
+
+// lookup returns the position of the IP in the set, if present. The IP is
+// canonicalized first, so any textual form of a local IP is found.
+func (s *LocalIPSet) lookup(ip string) (int, bool) {
+	if s == nil {
+		return 0, false
+	}
+	index := s.index.Load()
+	if index == nil {
+		return 0, false
+	}
+	i, ok := (*index)[canonicalIP(ip)]
+	return i, ok
+}
+
+// Contains returns true when the given IP string is one of the local IPs.
+func (s *LocalIPSet) Contains(ip string) bool {
+	_, ok := s.lookup(ip)
+	return ok
+}
+
+// IsLocal returns true when the IP is in the set, with the same results as the
+// package-level IsLocal called with the IPs the set was built from.
+func (s *LocalIPSet) IsLocal(ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	return s.Contains(ip.String())
+}
+
+// FindDirection determines whether the IPs in the given ID map to the server
+// or client annotations. It returns the same results as the package-level
+// FindDirection called with the IPs the set was built from, unless neither IP
+// is in the set and local netblocks were given to UpdateNets.
+func (s *LocalIPSet) FindDirection(ID *inetdiag.SockID) (Direction, error) {
+	src, srcOK := s.lookup(ID.SrcIP)
+	dst, dstOK := s.lookup(ID.DstIP)
+	switch {
+	case srcOK && (!dstOK || src <= dst):
+		return SrcIsServer, nil
+	case dstOK:
+		return DstIsServer, nil
+	}
+	if s != nil {
+		if nets := s.nets.Load(); nets != nil && len(*nets) > 0 {
+			return FindDirectionInNets(ID, *nets)
+		}
+	}
+	return Unknown, fmt.Errorf("Can't annotate connection: %w for %+v", ErrUnknownDirection, ID)
 }
@@ -2,8 +2,10 @@ package annotator
 
 import (
 	"encoding/json"
+	"errors"
 	"net"
 	"testing"
+	"time"
 
 	"github.com/m-lab/go/rtx"
 	"github.com/m-lab/tcp-info/inetdiag"
@@ -44,6 +46,28 @@ func TestFindDirection(t *testing.T) {
 			},
 			want: DstIsServer,
 		},
+		{
+			name: "success-ipv6-leading-zeros",
+			ID: &inetdiag.SockID{
+				SrcIP: "2001:0db8::1",
+				DstIP: "2001:db8::2",
+			},
+			localIPs: []net.IP{
+				net.ParseIP("2001:db8::1"),
+			},
+			want: SrcIsServer,
+		},
+		{
+			name: "success-ipv6-mixed-case",
+			ID: &inetdiag.SockID{
+				SrcIP: "2001:db8::2",
+				DstIP: "2001:DB8:0:0::1",
+			},
+			localIPs: []net.IP{
+				net.ParseIP("2001:db8::1"),
+			},
+			want: DstIsServer,
+		},
 		{
 			name: "error-unknown-direction",
 			ID: &inetdiag.SockID{
@@ -67,6 +91,139 @@ func TestFindDirection(t *testing.T) {
 			if tt.want != dir {
 				t.Errorf("Direction() wrong; got = %d, want %d", dir, tt.want)
 			}
+			if tt.wantErr && !errors.Is(err, ErrUnknownDirection) {
+				t.Errorf("Direction() error = %v, want %v", err, ErrUnknownDirection)
+			}
+		})
+	}
+}
+
+func mustParseCIDRs(cidrs ...string) []net.IPNet {
+	nets := []net.IPNet{}
+	for _, c := range cidrs {
+		_, n, err := net.ParseCIDR(c)
+		rtx.Must(err, "Could not parse %q", c)
+		nets = append(nets, *n)
+	}
+	return nets
+}
+
+func TestFindDirectionInNets(t *testing.T) {
+	tests := []struct {
+		name      string
+		ID        *inetdiag.SockID
+		localNets []net.IPNet
+		want      Direction
+		wantErr   bool
+	}{
+		{
+			name:      "ipv4-src-is-server",
+			ID:        &inetdiag.SockID{SrcIP: "1.0.0.1", DstIP: "9.0.0.9"},
+			localNets: mustParseCIDRs("1.0.0.1/32"),
+			want:      SrcIsServer,
+		},
+		{
+			name:      "ipv4-dst-inside-netblock",
+			ID:        &inetdiag.SockID{SrcIP: "9.0.0.9", DstIP: "1.0.0.37"},
+			localNets: mustParseCIDRs("1.0.0.0/26"),
+			want:      DstIsServer,
+		},
+		{
+			name:      "ipv6-src-is-server",
+			ID:        &inetdiag.SockID{SrcIP: "2001:db8::10", DstIP: "2001:4860::1"},
+			localNets: mustParseCIDRs("1.0.0.0/26", "2001:db8::/64"),
+			want:      SrcIsServer,
+		},
+		{
+			name:      "ipv6-with-zone",
+			ID:        &inetdiag.SockID{SrcIP: "fe80::2", DstIP: "fe80::1%eth0"},
+			localNets: mustParseCIDRs("fe80::1/128"),
+			want:      DstIsServer,
+		},
+		{
+			name:      "error-outside-netblock",
+			ID:        &inetdiag.SockID{SrcIP: "9.0.0.9", DstIP: "1.0.0.64"},
+			localNets: mustParseCIDRs("1.0.0.0/26"),
+			want:      Unknown,
+			wantErr:   true,
+		},
+		{
+			name:      "error-invalid-ips",
+			ID:        &inetdiag.SockID{SrcIP: "not-an-ip", DstIP: ""},
+			localNets: mustParseCIDRs("0.0.0.0/0"),
+			want:      Unknown,
+			wantErr:   true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir, err := FindDirectionInNets(tt.ID, tt.localNets)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("FindDirectionInNets() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if tt.want != dir {
+				t.Errorf("FindDirectionInNets() wrong; got = %d, want %d", dir, tt.want)
+			}
+			if tt.wantErr && !errors.Is(err, ErrUnknownDirection) {
+				t.Errorf("FindDirectionInNets() error = %v, want %v", err, ErrUnknownDirection)
+			}
+		})
+	}
+}
+
+func TestIsLocal(t *testing.T) {
+	localIPs := []net.IP{
+		nil,
+		net.ParseIP("1.0.0.1"),
+		net.ParseIP("2001:db8::1"),
+	}
+	tests := []struct {
+		name string
+		ip   net.IP
+		want bool
+	}{
+		{
+			name: "ipv4",
+			ip:   net.ParseIP("1.0.0.1"),
+			want: true,
+		},
+		{
+			name: "ipv4-4-byte-form",
+			ip:   net.IPv4(1, 0, 0, 1).To4(),
+			want: true,
+		},
+		{
+			name: "ipv4-mapped-ipv6",
+			ip:   net.ParseIP("::ffff:1.0.0.1"),
+			want: true,
+		},
+		{
+			name: "ipv6-non-canonical",
+			ip:   net.ParseIP("2001:0DB8:0000:0000:0000:0000:0000:0001"),
+			want: true,
+		},
+		{
+			name: "ipv6-other",
+			ip:   net.ParseIP("2001:db8::2"),
+		},
+		{
+			name: "ipv4-other",
+			ip:   net.ParseIP("1.0.0.2"),
+		},
+		{
+			name: "nil",
+		},
+	}
+	set := NewLocalIPSet(localIPs)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := IsLocal(tt.ip, localIPs); got != tt.want {
+				t.Errorf("IsLocal(%v) = %v, want %v", tt.ip, got, tt.want)
+			}
+			if got := set.IsLocal(tt.ip); got != tt.want {
+				t.Errorf("LocalIPSet.IsLocal(%v) = %v, want %v", tt.ip, got, tt.want)
+			}
 		})
 	}
 }
@@ -113,3 +270,203 @@ func TestNetwork_FirstASN(t *testing.T) {
 		})
 	}
 }
+
+func TestLocalIPSet_FindDirection(t *testing.T) {
+	localIPs := []net.IP{
+		net.ParseIP("1.0.0.1"),
+		net.ParseIP("2001:db8::1"),
+		net.ParseIP("1.0.0.1"), // duplicates are allowed.
+	}
+	ids := []*inetdiag.SockID{
+		{SrcIP: "1.0.0.1", DstIP: "9.0.0.9"},
+		{SrcIP: "9.0.0.9", DstIP: "1.0.0.1"},
+		{SrcIP: "2001:db8::1", DstIP: "2001:db8::2"},
+		{SrcIP: "2001:db8::2", DstIP: "2001:db8::1"},
+		{SrcIP: "9.0.0.9", DstIP: "8.0.0.8"},
+		{SrcIP: "2001:db8::1", DstIP: "1.0.0.1"}, // both are local.
+		{SrcIP: "1.0.0.1", DstIP: "2001:db8::1"}, // both are local.
+		{SrcIP: "1.0.0.1", DstIP: "1.0.0.1"},     // both are local.
+		{SrcIP: "not an IP", DstIP: ""},
+		{SrcIP: "2001:0db8::1", DstIP: "9.0.0.9"},
+		{SrcIP: "9.0.0.9", DstIP: "2001:DB8:0::1"},
+	}
+	s := NewLocalIPSet(localIPs)
+	for _, ID := range ids {
+		want, wantErr := FindDirection(ID, localIPs)
+		got, err := s.FindDirection(ID)
+		if got != want || (err != nil) != (wantErr != nil) {
+			t.Errorf("LocalIPSet.FindDirection(%+v) = %d, %v; want %d, %v", ID, got, err, want, wantErr)
+		}
+		if err != nil && !errors.Is(err, ErrUnknownDirection) {
+			t.Errorf("LocalIPSet.FindDirection(%+v) error = %v, want %v", ID, err, ErrUnknownDirection)
+		}
+	}
+
+	if !s.Contains("2001:db8::1") || !s.Contains("2001:0DB8::0001") || s.Contains("9.0.0.9") {
+		t.Error("LocalIPSet.Contains() returned the wrong value")
+	}
+
+	// A nil set contains no IPs.
+	var empty *LocalIPSet
+	if empty.Contains("1.0.0.1") {
+		t.Error("nil LocalIPSet.Contains() should always be false")
+	}
+	if _, err := empty.FindDirection(ids[0]); !errors.Is(err, ErrUnknownDirection) {
+		t.Errorf("nil LocalIPSet.FindDirection() error = %v, want %v", err, ErrUnknownDirection)
+	}
+}
+
+func TestLocalIPSet_Update(t *testing.T) {
+	s := NewLocalIPSet([]net.IP{net.ParseIP("1.0.0.1")})
+	s.Update([]net.IP{net.ParseIP("2.0.0.2")})
+	if s.Contains("1.0.0.1") || !s.Contains("2.0.0.2") {
+		t.Error("LocalIPSet.Update() did not replace the IPs")
+	}
+	ID := &inetdiag.SockID{SrcIP: "3.0.0.3", DstIP: "2.0.0.2"}
+	if got, err := s.FindDirection(ID); got != DstIsServer || err != nil {
+		t.Errorf("LocalIPSet.FindDirection() after Update() = %d, %v; want %d", got, err, DstIsServer)
+	}
+}
+
+func TestLocalIPSet_UpdateNets(t *testing.T) {
+	s := NewLocalIPSet([]net.IP{net.ParseIP("1.0.0.1")})
+	inside := &inetdiag.SockID{SrcIP: "9.0.0.9", DstIP: "2.0.0.37"}
+	if _, err := s.FindDirection(inside); !errors.Is(err, ErrUnknownDirection) {
+		t.Errorf("LocalIPSet.FindDirection() without nets error = %v, want %v", err, ErrUnknownDirection)
+	}
+	s.UpdateNets(mustParseCIDRs("2.0.0.0/26", "9.0.0.0/8"))
+	if got, err := s.FindDirection(inside); got != DstIsServer || err != nil {
+		t.Errorf("LocalIPSet.FindDirection() inside nets = %d, %v; want %d", got, err, DstIsServer)
+	}
+	// The local IPs still take precedence over the netblocks.
+	exact := &inetdiag.SockID{SrcIP: "9.0.0.9", DstIP: "1.0.0.1"}
+	if got, err := s.FindDirection(exact); got != DstIsServer || err != nil {
+		t.Errorf("LocalIPSet.FindDirection() with a local IP = %d, %v; want %d", got, err, DstIsServer)
+	}
+	if s.Contains("2.0.0.37") {
+		t.Error("LocalIPSet.Contains() should only match the local IPs")
+	}
+}
+
+// benchmarkIPs returns a list of local IPs like those on a real M-Lab machine
+// and a set of connections, half in each direction.
+func benchmarkIPs() ([]net.IP, []*inetdiag.SockID) {
+	localIPs := []net.IP{
+		net.ParseIP("127.0.0.1"),
+		net.ParseIP("::1"),
+		net.ParseIP("10.0.0.1"),
+		net.ParseIP("fe80::1"),
+		net.ParseIP("64.86.148.137"),
+		net.ParseIP("2001:5a0:4300::137"),
+	}
+	ids := make([]*inetdiag.SockID, 1000)
+	for i := range ids {
+		client := net.IPv4(100, byte(i>>8), byte(i), 1).String()
+		if i%2 == 0 {
+			ids[i] = &inetdiag.SockID{SrcIP: "64.86.148.137", DstIP: client}
+		} else {
+			ids[i] = &inetdiag.SockID{SrcIP: client, DstIP: "2001:5a0:4300::137"}
+		}
+	}
+	return localIPs, ids
+}
+
+func BenchmarkFindDirection(b *testing.B) {
+	localIPs, ids := benchmarkIPs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		FindDirection(ids[i%len(ids)], localIPs)
+	}
+}
+
+func BenchmarkLocalIPSet_FindDirection(b *testing.B) {
+	localIPs, ids := benchmarkIPs()
+	s := NewLocalIPSet(localIPs)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		s.FindDirection(ids[i%len(ids)])
+	}
+}
+
+func TestReloadGuard(t *testing.T) {
+	g := &ReloadGuard{}
+	if !g.AllowReload() || !g.AllowReload() {
+		t.Error("The zero ReloadGuard should allow every reload")
+	}
+	g.SetMinReloadInterval(50 * time.Millisecond)
+	if g.AllowReload() {
+		t.Error("AllowReload() right after a reload should be false")
+	}
+	time.Sleep(60 * time.Millisecond)
+	if !g.AllowReload() {
+		t.Error("AllowReload() after the minimum interval should be true")
+	}
+	if g.AllowReload() {
+		t.Error("AllowReload() right after a reload should be false")
+	}
+	// A failed reload may be retried immediately, but only once.
+	g.ReloadFailed()
+	if !g.AllowReload() {
+		t.Error("AllowReload() right after a failed reload should be true")
+	}
+	if g.AllowReload() {
+		t.Error("AllowReload() right after a reload should be false")
+	}
+	// A forced reload is allowed immediately, but only once.
+	g.ForceReload()
+	if !g.AllowReload() {
+		t.Error("AllowReload() right after ForceReload() should be true")
+	}
+	if g.AllowReload() {
+		t.Error("AllowReload() right after a reload should be false")
+	}
+}
+
+func TestIsReserved(t *testing.T) {
+	tests := []struct {
+		ip   string
+		want bool
+	}{
+		{ip: "10.1.2.3", want: true},
+		{ip: "172.16.0.1", want: true},
+		{ip: "192.168.1.1", want: true},
+		{ip: "127.0.0.1", want: true},
+		{ip: "::1", want: true},
+		{ip: "169.254.169.254", want: true},
+		{ip: "fe80::1", want: true},
+		{ip: "192.0.2.7", want: true},
+		{ip: "198.51.100.1", want: true},
+		{ip: "203.0.113.1", want: true},
+		{ip: "2001:db8::1", want: true},
+		{ip: "fd00::1", want: true},
+		{ip: "::ffff:10.0.0.1", want: true},
+		{ip: "1.0.0.1", want: false},
+		{ip: "2.125.160.216", want: false},
+		{ip: "2001:200::1", want: false},
+		{ip: "192.0.3.1", want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.ip, func(t *testing.T) {
+			if got := IsReserved(net.ParseIP(tt.ip)); got != tt.want {
+				t.Errorf("IsReserved(%s) = %v, want %v", tt.ip, got, tt.want)
+			}
+		})
+	}
+	if IsReserved(nil) {
+		t.Error("IsReserved(nil) = true, want false")
+	}
+}
+
+type namedAnnotator struct{ nopAnnotator }
+
+func (namedAnnotator) Name() string { return "named" }
+
+func TestNameOf(t *testing.T) {
+	if got := NameOf(namedAnnotator{}); got != "named" {
+		t.Errorf("NameOf() = %q, want named", got)
+	}
+	// Annotators without a Name are named by their type.
+	if got := NameOf(nopAnnotator{}); got != "annotator.nopAnnotator" {
+		t.Errorf("NameOf() = %q, want annotator.nopAnnotator", got)
+	}
+}
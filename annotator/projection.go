@@ -0,0 +1,128 @@
+package annotator
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+// ErrUnknownField is returned for field names that are not in Annotations.
+var ErrUnknownField = errors.New("unknown annotation field")
+
+// fieldTree holds the names of the fields to keep in a struct, and the fields
+// to keep within each of them. A nil fieldTree keeps every field.
+type fieldTree map[string]fieldTree
+
+// Projection selects a subset of the fields of Annotations, to reduce the size
+// of the output for consumers that only need some of them.
+type Projection struct {
+	keep fieldTree
+}
+
+// NewProjection creates a Projection that keeps the given fields, named by
+// their path from Annotations, e.g. "Client.Network.ASNumber" or "Server.Geo".
+// Naming a struct keeps all of its fields. UUID and Timestamp are always kept.
+func NewProjection(fields []string) (*Projection, error) {
+	p := &Projection{
+		keep: fieldTree{"UUID": nil, "Timestamp": nil},
+	}
+	for _, field := range fields {
+		path := strings.Split(field, ".")
+		if !hasField(reflect.TypeOf(Annotations{}), path) {
+			return nil, fmt.Errorf("%w: %q", ErrUnknownField, field)
+		}
+		t := p.keep
+		for i, name := range path {
+			sub, ok := t[name]
+			if ok && sub == nil {
+				break // The whole field is already kept.
+			}
+			if i == len(path)-1 {
+				t[name] = nil
+				break
+			}
+			if !ok {
+				sub = fieldTree{}
+				t[name] = sub
+			}
+			t = sub
+		}
+	}
+	return p, nil
+}
+
+// hasField returns true if the path names a field within the type, looking
+// through pointers and slices.
+func hasField(t reflect.Type, path []string) bool {
+	for _, name := range path {
+		for t.Kind() == reflect.Ptr || t.Kind() == reflect.Slice {
+			t = t.Elem()
+		}
+		if t.Kind() != reflect.Struct {
+			return false
+		}
+		f, ok := t.FieldByName(name)
+		if !ok {
+			return false
+		}
+		t = f.Type
+	}
+	return true
+}
+
+// Apply zeroes every field of the annotations that the projection does not
+// keep. Pointers and slices are copied before they are changed, because the
+// annotators may share them between annotations. Structs that are left empty
+// are removed, so that they are omitted from the JSON output.
+func (p *Projection) Apply(a *Annotations) {
+	project(reflect.ValueOf(a).Elem(), p.keep)
+}
+
+// project zeroes the fields of the struct v that are not in keep, and returns
+// true if any field is left non-zero.
+func project(v reflect.Value, keep fieldTree) bool {
+	kept := false
+	for i := 0; i < v.NumField(); i++ {
+		f := v.Field(i)
+		sub, ok := keep[v.Type().Field(i).Name]
+		switch {
+		case !ok:
+			f.Set(reflect.Zero(f.Type()))
+		case sub != nil:
+			projectValue(f, sub)
+		}
+		kept = kept || !f.IsZero()
+	}
+	return kept
+}
+
+// projectValue applies keep to the struct, struct pointer, or slice of structs
+// in v.
+func projectValue(v reflect.Value, keep fieldTree) {
+	switch v.Kind() {
+	case reflect.Struct:
+		project(v, keep)
+	case reflect.Ptr:
+		if v.IsNil() {
+			return
+		}
+		c := reflect.New(v.Type().Elem())
+		c.Elem().Set(v.Elem())
+		if project(c.Elem(), keep) {
+			v.Set(c)
+		} else {
+			v.Set(reflect.Zero(v.Type()))
+		}
+	case reflect.Slice:
+		if v.IsNil() {
+			return
+		}
+		c := reflect.MakeSlice(v.Type(), v.Len(), v.Len())
+		reflect.Copy(c, v)
+		for i := 0; i < c.Len(); i++ {
+			projectValue(c.Index(i), keep)
+		}
+		v.Set(c)
+	}
+}
@@ -0,0 +1,109 @@
+package annotator
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/go-test/deep"
+	"github.com/m-lab/go/rtx"
+)
+
+func TestProjection_Apply(t *testing.T) {
+	serverGeo := &Geolocation{City: "New York", CountryCode: "US"}
+	full := func() *Annotations {
+		return &Annotations{
+			UUID:      "UUID",
+			Timestamp: time.Date(2009, 3, 18, 1, 2, 3, 0, time.UTC),
+			Server: ServerAnnotations{
+				Site: "lga03",
+				Geo:  serverGeo,
+			},
+			Client: ClientAnnotations{
+				Geo: &Geolocation{City: "London", CountryCode: "GB", Latitude: 51.5},
+				Network: &Network{
+					CIDR:     "2.125.160.0/19",
+					ASNumber: 5607,
+					ASName:   "Sky UK Limited",
+					Systems:  []System{{ASNs: []uint32{5607}}},
+				},
+			},
+			PayloadHash: "abc",
+		}
+	}
+	tests := []struct {
+		name   string
+		fields []string
+		want   *Annotations
+	}{
+		{
+			name:   "asn-and-country",
+			fields: []string{"Client.Network.ASNumber", "Client.Geo.CountryCode"},
+			want: &Annotations{
+				UUID:      "UUID",
+				Timestamp: time.Date(2009, 3, 18, 1, 2, 3, 0, time.UTC),
+				Client: ClientAnnotations{
+					Geo:     &Geolocation{CountryCode: "GB"},
+					Network: &Network{ASNumber: 5607},
+				},
+			},
+		},
+		{
+			name:   "whole-struct-and-overlapping-fields",
+			fields: []string{"Server.Geo.City", "Server.Geo", "Client.Network.Systems.ASNs"},
+			want: &Annotations{
+				UUID:      "UUID",
+				Timestamp: time.Date(2009, 3, 18, 1, 2, 3, 0, time.UTC),
+				Server: ServerAnnotations{
+					Geo: serverGeo,
+				},
+				Client: ClientAnnotations{
+					Network: &Network{Systems: []System{{ASNs: []uint32{5607}}}},
+				},
+			},
+		},
+		{
+			name: "nothing",
+			want: &Annotations{
+				UUID:      "UUID",
+				Timestamp: time.Date(2009, 3, 18, 1, 2, 3, 0, time.UTC),
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, err := NewProjection(tt.fields)
+			rtx.Must(err, "Could not create projection")
+			a := full()
+			p.Apply(a)
+			if diff := deep.Equal(a, tt.want); diff != nil {
+				t.Errorf("Apply() wrong annotations; got!=want %v", diff)
+			}
+			// Shared data is never changed.
+			if serverGeo.City != "New York" || serverGeo.CountryCode != "US" {
+				t.Errorf("Apply() changed shared data: %+v", serverGeo)
+			}
+		})
+	}
+
+	// Fields that are left out are absent from the JSON.
+	p, err := NewProjection([]string{"Client.Network.ASNumber", "Client.Geo.CountryCode"})
+	rtx.Must(err, "Could not create projection")
+	a := full()
+	p.Apply(a)
+	b, err := json.Marshal(a)
+	rtx.Must(err, "Could not marshal")
+	want := `{"UUID":"UUID","Timestamp":"2009-03-18T01:02:03Z","Server":{},"Client":{"Geo":{"CountryCode":"GB"},"Network":{"ASNumber":5607}}}`
+	if string(b) != want {
+		t.Errorf("Apply() JSON = %s, want %s", b, want)
+	}
+}
+
+func TestNewProjection_unknownField(t *testing.T) {
+	for _, field := range []string{"Client.Nope", "UUID.Length", "", "Client..Geo"} {
+		if _, err := NewProjection([]string{field}); !errors.Is(err, ErrUnknownField) {
+			t.Errorf("NewProjection(%q) error = %v, want %v", field, err, ErrUnknownField)
+		}
+	}
+}
@@ -0,0 +1,46 @@
+package annotator
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+)
+
+// Constructor creates a custom Annotator for a server with the given local IPs.
+type Constructor func(ctx context.Context, localIPs []net.IP) (Annotator, error)
+
+var (
+	registryMu sync.Mutex
+	registry   = map[string]Constructor{}
+)
+
+// Register makes a custom annotator available to the uuid-annotator binary,
+// which runs it after the built-in annotators. Downstream builds can add their
+// own annotators without changing main.go, by calling Register in an init
+// function of a package that is imported from a build-tagged file in package
+// main. Register panics if it is called twice with the same name. Custom
+// annotators should implement Namer, usually with the name they are registered
+// with, so that their errors are labeled with a stable name.
+func Register(name string, c Constructor) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	if c == nil {
+		panic("annotator: Register constructor is nil for " + name)
+	}
+	if _, dup := registry[name]; dup {
+		panic(fmt.Sprintf("annotator: Register called twice for %q", name))
+	}
+	registry[name] = c
+}
+
+// Registered returns a copy of all registered constructors, keyed by name.
+func Registered() map[string]Constructor {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	r := make(map[string]Constructor, len(registry))
+	for name, c := range registry {
+		r[name] = c
+	}
+	return r
+}
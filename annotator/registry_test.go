@@ -0,0 +1,56 @@
+package annotator
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/m-lab/tcp-info/inetdiag"
+)
+
+type nopAnnotator struct{}
+
+func (nopAnnotator) Annotate(ID *inetdiag.SockID, annotations *Annotations) error { return nil }
+
+func nopConstructor(ctx context.Context, localIPs []net.IP) (Annotator, error) {
+	return nopAnnotator{}, nil
+}
+
+func TestRegister(t *testing.T) {
+	Register("TestRegister", nopConstructor)
+	got := Registered()
+	if _, ok := got["TestRegister"]; !ok {
+		t.Fatalf("Registered() = %v, want TestRegister", got)
+	}
+	// Modifying the copy does not change the registry.
+	delete(got, "TestRegister")
+	if _, ok := Registered()["TestRegister"]; !ok {
+		t.Error("Registered() should return a copy")
+	}
+}
+
+func TestRegisterPanics(t *testing.T) {
+	Register("TestRegisterPanics", nopConstructor)
+	tests := []struct {
+		name string
+		c    Constructor
+	}{
+		{
+			name: "TestRegisterPanics", // Duplicate.
+			c:    nopConstructor,
+		},
+		{
+			name: "nil-constructor",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("Register(%q) should panic", tt.name)
+				}
+			}()
+			Register(tt.name, tt.c)
+		})
+	}
+}
@@ -0,0 +1,65 @@
+// Package as2org parses the AS-to-Organization files published by CAIDA, which
+// map AS numbers to the organizations that operate them, so that sibling ASes
+// of one organization can be grouped. See the format documentation at:
+// https://publicdata.caida.org/datasets/as-organizations/README.txt
+package as2org
+
+import (
+	"bufio"
+	"bytes"
+	"log"
+	"strconv"
+	"strings"
+)
+
+// Organization is the organization that operates an AS.
+type Organization struct {
+	ID   string // The CAIDA org_id, e.g. "LVLT-ARIN".
+	Name string
+}
+
+// Organizations maps AS numbers to their organizations.
+type Organizations map[uint32]Organization
+
+// Parse reads an as2org file. It has a section of organizations, with the
+// fields org_id|changed|org_name|country|source, followed by a section of ASes,
+// with the fields aut|changed|aut_name|org_id|opaque_id|source. Comment and
+// malformed lines are skipped, as are ASes whose organization is not listed.
+func Parse(data []byte) (Organizations, error) {
+	names := map[string]string{}
+	orgIDs := map[uint32]string{}
+	s := bufio.NewScanner(bytes.NewReader(data))
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		// The sections are told apart by their number of fields.
+		fields := strings.Split(line, "|")
+		switch len(fields) {
+		case 5:
+			names[fields[0]] = fields[2]
+		case 6:
+			asn, err := strconv.ParseUint(fields[0], 10, 32)
+			if err != nil {
+				log.Println("Bad as2org row:", err, line)
+				continue
+			}
+			orgIDs[uint32(asn)] = fields[3]
+		default:
+			log.Println("Bad as2org row:", line)
+		}
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	orgs := make(Organizations, len(orgIDs))
+	for asn, id := range orgIDs {
+		name, ok := names[id]
+		if !ok {
+			continue
+		}
+		orgs[asn] = Organization{ID: id, Name: name}
+	}
+	return orgs, nil
+}
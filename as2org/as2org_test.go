@@ -0,0 +1,33 @@
+package as2org
+
+import (
+	"os"
+	"testing"
+
+	"github.com/go-test/deep"
+	"github.com/m-lab/go/rtx"
+)
+
+func TestParse(t *testing.T) {
+	data, err := os.ReadFile("../testdata/as2org.txt")
+	rtx.Must(err, "Could not read testdata")
+	got, err := Parse(data)
+	rtx.Must(err, "Could not parse organizations")
+	sky := Organization{ID: "SKYUK-RIPE", Name: "Sky UK Limited"}
+	want := Organizations{
+		5607:  sky,
+		5608:  sky, // Siblings share their organization.
+		13335: {ID: "CLOUD14-ARIN", Name: "Cloudflare, Inc."},
+	}
+	if diff := deep.Equal(got, want); diff != nil {
+		t.Error("Parse() got!=want", diff)
+	}
+}
+
+func TestParse_malformed(t *testing.T) {
+	got, err := Parse([]byte("ORG|1|Name|US|ARIN\n1|2|3\n7|1|AS7|ORG||ARIN\n"))
+	rtx.Must(err, "Could not parse organizations")
+	if diff := deep.Equal(got, Organizations{7: {ID: "ORG", Name: "Name"}}); diff != nil {
+		t.Error("Parse() got!=want", diff)
+	}
+}
@@ -2,19 +2,26 @@ package asnannotator
 
 import (
 	"context"
+	"crypto/md5"
+	"fmt"
 	"log"
 	"net"
 	"sync"
+	"time"
 
 	"github.com/m-lab/go/content"
 	"github.com/m-lab/go/rtx"
 
 	"github.com/m-lab/tcp-info/inetdiag"
 	"github.com/m-lab/uuid-annotator/annotator"
+	"github.com/m-lab/uuid-annotator/as2org"
+	"github.com/m-lab/uuid-annotator/asrank"
 	"github.com/m-lab/uuid-annotator/ipinfo"
 	"github.com/m-lab/uuid-annotator/metrics"
+	"github.com/m-lab/uuid-annotator/rir"
 	"github.com/m-lab/uuid-annotator/routeview"
 	"github.com/m-lab/uuid-annotator/tarreader"
+	geoip2 "github.com/oschwald/geoip2-golang"
 )
 
 // ASNAnnotator is just a regular annotator with a Reload method and an AnnotateIP method.
@@ -22,18 +29,208 @@ type ASNAnnotator interface {
 	annotator.Annotator
 	Reload(context.Context)
 	AnnotateIP(src string) *annotator.Network
+
+	// ASName returns the name of the AS number in the loaded data, or "" when
+	// it is unknown.
+	ASName(asn uint32) string
+
+	// Lookup returns the RouteViews prefix containing the IP as it was parsed,
+	// with its unparsed systems, and false if there is none.
+	Lookup(src string) (routeview.IPNet, bool)
+
+	// Warm loads and validates the latest data into a staging slot without
+	// making it live, and Commit makes the staged data live.
+	Warm(context.Context) error
+	Commit()
+}
+
+// SplitReloader is implemented by ASNAnnotators whose AS names can be reloaded
+// on a different schedule than the rest of their data. Reload is equivalent
+// to calling both methods at once. Callers that use ReloadNames should call
+// ReloadPrefixes instead of Reload, so that the names are only reloaded on
+// their own schedule.
+type SplitReloader interface {
+	// ReloadPrefixes reloads every dataset except the AS names.
+	ReloadPrefixes(context.Context)
+	// ReloadNames reloads only the AS names, including any additional names.
+	ReloadNames(context.Context)
 }
 
 // asnAnnotator is the central struct for this module.
 type asnAnnotator struct {
 	m          sync.RWMutex
-	localIPs   []net.IP
+	localIPs   *annotator.LocalIPSet
 	as4        content.Provider
 	as6        content.Provider
 	asnamedata content.Provider
-	asn4       routeview.Index
-	asn6       routeview.Index
-	asnames    ipinfo.ASNames
+	asn4       routeview.Searcher
+	asn6       routeview.Searcher
+	asnames    ipinfo.ASInfos
+	staged     *stagedData
+
+	// The MD5 of the RouteViews snapshots that asn4 and asn6 were loaded from,
+	// and the dates in their file names, if known.
+	asn4version string
+	asn6version string
+	asn4date    string
+	asn6date    string
+
+	// Optional data sources and behavior, enabled with Options.
+	rirdata       content.Provider
+	rir           rir.Index
+	conedata      content.Provider
+	cones         asrank.ConeSizes
+	orgdata       content.Provider
+	orgs          as2org.Organizations
+	mmasndata     content.Provider
+	mmasn         *geoip2.Reader
+	extraNamedata []content.Provider
+	extraNames    []ipinfo.ASInfos
+	allNames      bool
+	resolver      *cachedResolver
+	compact       bool
+	versions      bool
+	transition    bool
+	prefixLengths bool
+	failClosed    bool
+	dates         bool
+	unnamed       string
+	cache         *networkCache
+	generation    uint64 // Counts the times the cache was cleared.
+
+	annotator.ReloadGuard
+	namesGuard annotator.ReloadGuard
+}
+
+// stagedData holds a complete set of loaded data that is not yet live.
+type stagedData struct {
+	asn4        routeview.Searcher
+	asn6        routeview.Searcher
+	asn4version string
+	asn6version string
+	asn4date    string
+	asn6date    string
+	asnames     ipinfo.ASInfos
+	rir         rir.Index
+	cones       asrank.ConeSizes
+	orgs        as2org.Organizations
+	mmasn       *geoip2.Reader
+	extraNames  []ipinfo.ASInfos
+}
+
+// Option enables optional data sources in New.
+type Option func(*asnAnnotator)
+
+// WithRIRDelegations annotates each Network with the country its matched prefix
+// was allocated to, using the given RIR delegated-extended statistics file.
+func WithRIRDelegations(rirdata content.Provider) Option {
+	return func(a *asnAnnotator) {
+		a.rirdata = rirdata
+	}
+}
+
+// WithConeSizes annotates each Network with the customer cone size of its first
+// ASN, using the given CAIDA AS Rank "ppdc-ases" file.
+func WithConeSizes(conedata content.Provider) Option {
+	return func(a *asnAnnotator) {
+		a.conedata = conedata
+	}
+}
+
+// WithOrganizations annotates each Network with the organization of its first
+// ASN, using the given CAIDA AS-to-Organization file.
+func WithOrganizations(orgdata content.Provider) Option {
+	return func(a *asnAnnotator) {
+		a.orgdata = orgdata
+	}
+}
+
+// WithMaxMindASN looks up the IPs that are not in the RouteViews data in the
+// given MaxMind GeoLite2-ASN database, either a .mmdb file or a .tar.gz like
+// the ones MaxMind distributes, before annotating them as Missing. Networks
+// found there have no CIDR, and their ASName is the MaxMind organization.
+func WithMaxMindASN(mmasndata content.Provider) Option {
+	return func(a *asnAnnotator) {
+		a.mmasndata = mmasndata
+	}
+}
+
+// WithFailClosed makes Annotate return an error, without a Network, for IPs of
+// an address family whose RouteViews data is not loaded, instead of annotating
+// them as Missing like IPs that are not in the data.
+func WithFailClosed() Option {
+	return func(a *asnAnnotator) {
+		a.failClosed = true
+	}
+}
+
+// WithNameResolver looks up the names of AS numbers that are missing from the
+// AS names data with the given resolver, spending at most timeout on each AS.
+// Every result is cached for the lifetime of the annotator.
+func WithNameResolver(r NameResolver, timeout time.Duration) Option {
+	return func(a *asnAnnotator) {
+		a.resolver = newCachedResolver(r, timeout)
+	}
+}
+
+// WithAllASNames annotates each Network with ASNameAll, every distinct name of
+// its first ASN, starting with its ASName and followed by the names in the
+// given additional AS names files, in order. The files have the same format as
+// the AS names data. Like the AS names, they are optional: a file that can not
+// be loaded contributes no names.
+func WithAllASNames(extra ...content.Provider) Option {
+	return func(a *asnAnnotator) {
+		a.allNames = true
+		a.extraNamedata = extra
+	}
+}
+
+// WithUnnamedPlaceholder sets the ASName of Networks whose ASN has no name in
+// any AS names source, including AS0, to placeholder, e.g. "unknown", so that
+// they can be told apart from Missing Networks, whose ASName is always empty.
+func WithUnnamedPlaceholder(placeholder string) Option {
+	return func(a *asnAnnotator) {
+		a.unnamed = placeholder
+	}
+}
+
+// WithCache remembers the Networks of the size most recently annotated IPs, so
+// that annotating them again skips the search of the RouteViews data. Cached
+// annotations are counted in metrics.ASNCacheLookups, not metrics.ASNSearches.
+// The cache is emptied whenever the data is reloaded. A size of zero disables
+// the cache.
+func WithCache(size int) Option {
+	return func(a *asnAnnotator) {
+		if size > 0 {
+			a.cache = newNetworkCache(size)
+		}
+	}
+}
+
+// WithTransitionAddresses annotates Teredo and 6to4 addresses using the
+// IPv4 data for their embedded IPv4 address, instead of the IPv6 data, and
+// records the kind of transition address in the Network.
+func WithTransitionAddresses() Option {
+	return func(a *asnAnnotator) {
+		a.transition = true
+	}
+}
+
+// WithPrefixLengthMetrics observes the length of every matched RouteViews
+// prefix in the metrics.ASNPrefixLengths histogram.
+func WithPrefixLengthMetrics() Option {
+	return func(a *asnAnnotator) {
+		a.prefixLengths = true
+	}
+}
+
+// observePrefixLength records the length of the matched prefix, when enabled.
+func (a *asnAnnotator) observePrefixLength(family string, ipnet routeview.IPNet) {
+	if !a.prefixLengths {
+		return
+	}
+	ones, _ := ipnet.Mask.Size()
+	metrics.ASNPrefixLengths.WithLabelValues(family).Observe(float64(ones))
 }
 
 // NewIPv4 makes a new IPv4-only Annotator that uses IP addresses to lookup ASN metadata for
@@ -43,147 +240,829 @@ func NewIPv4(ctx context.Context, as4 content.Provider) ASNAnnotator {
 		as4: as4,
 	}
 	var err error
-	a.asn4, err = load(ctx, as4, nil)
+	a.asn4, a.asn4version, a.asn4date, err = a.load(ctx, as4, nil, "", "")
 	rtx.Must(err, "Could not load Routeviews IPv4 ASN db")
 	return a
 }
 
+// WithCompactRouteViews stores the RouteViews data in a routeview.CompactIndex,
+// which uses much less memory, for memory-constrained nodes.
+func WithCompactRouteViews() Option {
+	return func(a *asnAnnotator) {
+		a.compact = true
+	}
+}
+
+// WithDataVersions records the MD5 of the RouteViews snapshots in the
+// DataVersions of every annotation.
+func WithDataVersions() Option {
+	return func(a *asnAnnotator) {
+		a.versions = true
+	}
+}
+
+// WithRouteViewDates records the date of the RouteViews snapshot that each
+// Network was found in as its RouteViewDate. The date is taken from the name of
+// the file, e.g. routeviews-rv2-20230101-1200.pfx2as.gz, so it is only known
+// for providers that have a Name method, like those of dirprovider.
+func WithRouteViewDates() Option {
+	return func(a *asnAnnotator) {
+		a.dates = true
+	}
+}
+
 // New makes a new Annotator that uses IP addresses to lookup ASN metadata for
 // that IP based on the current copy of RouteViews data stored in the given providers.
-func New(ctx context.Context, as4 content.Provider, as6 content.Provider, asnamedata content.Provider, localIPs []net.IP) ASNAnnotator {
+//
+// AS names are optional: asnamedata may be nil, and if the names can not be
+// loaded then the annotator logs a warning and annotates AS numbers without
+// their names.
+func New(ctx context.Context, as4 content.Provider, as6 content.Provider, asnamedata content.Provider, localIPs []net.IP, opts ...Option) ASNAnnotator {
 	a := &asnAnnotator{
 		as4:        as4,
 		as6:        as6,
 		asnamedata: asnamedata,
-		localIPs:   localIPs,
+		localIPs:   annotator.NewLocalIPSet(localIPs),
+	}
+	for _, opt := range opts {
+		opt(a)
+	}
+	// The RouteViews data and AS names are the largest datasets, so they
+	// are downloaded and parsed concurrently.
+	var err4, err6, errNames error
+	parallel(
+		func() { a.asn4, a.asn4version, a.asn4date, err4 = a.load(ctx, as4, nil, "", "") },
+		func() { a.asn6, a.asn6version, a.asn6date, err6 = a.load(ctx, as6, nil, "", "") },
+		func() { a.asnames, errNames = loadNames(ctx, asnamedata, nil) },
+	)
+	rtx.Must(err4, "Could not load Routeviews IPv4 ASN db")
+	rtx.Must(err6, "Could not load Routeviews IPv6 ASN db")
+	metrics.ASNDatasetAge.Loaded()
+	if errNames != nil {
+		log.Println("WARNING: Could not load IPinfo.io AS name db, AS names will be blank:", errNames)
+	} else if asnamedata != nil {
+		metrics.ASNameDatasetAge.Loaded()
 	}
+	a.extraNames = a.loadExtraNames(ctx, nil)
 	var err error
-	a.asn4, err = load(ctx, as4, nil)
-	rtx.Must(err, "Could not load Routeviews IPv4 ASN db")
-	a.asn6, err = load(ctx, as6, nil)
-	rtx.Must(err, "Could not load Routeviews IPv6 ASN db")
-	a.asnames, err = loadNames(ctx, asnamedata, nil)
-	rtx.Must(err, "Could not load IPinfo.io AS name db")
+	if a.rirdata != nil {
+		a.rir, err = loadRIR(ctx, a.rirdata, nil)
+		rtx.Must(err, "Could not load RIR delegation db")
+	}
+	if a.conedata != nil {
+		a.cones, err = loadCones(ctx, a.conedata, nil)
+		rtx.Must(err, "Could not load customer cone db")
+	}
+	if a.orgdata != nil {
+		a.orgs, err = loadOrgs(ctx, a.orgdata, nil)
+		rtx.Must(err, "Could not load AS organization db")
+	}
+	if a.mmasndata != nil {
+		a.mmasn, err = loadMaxMindASN(ctx, a.mmasndata, nil)
+		rtx.Must(err, "Could not load MaxMind ASN db")
+	}
 	return a
 }
 
+// UpdateLocalIPs replaces the local IPs used to find the client of each
+// connection.
+func (a *asnAnnotator) UpdateLocalIPs(localIPs []net.IP) {
+	a.localIPs.Update(localIPs)
+}
+
+// UpdateLocalNets replaces the local netblocks used to find the client of
+// connections without a local IP.
+func (a *asnAnnotator) UpdateLocalNets(localNets []net.IPNet) {
+	a.localIPs.UpdateNets(localNets)
+}
+
+// Name returns "asn".
+func (*asnAnnotator) Name() string { return "asn" }
+
 // Annotate puts ASN data into the given annotations.
 func (a *asnAnnotator) Annotate(ID *inetdiag.SockID, annotations *annotator.Annotations) error {
+	client, ann, gen, err := a.annotateClient(ID, annotations)
+	if err != nil {
+		return err
+	}
+	annotations.Client.Network = a.resolveName(context.Background(), client, ann, gen)
+	return nil
+}
+
+// annotateClient finds the client of the connection, and annotates it from the
+// loaded data. The AS name of the returned Network may still need resolving.
+func (a *asnAnnotator) annotateClient(ID *inetdiag.SockID, annotations *annotator.Annotations) (string, *annotator.Network, uint64, error) {
 	a.m.RLock()
 	defer a.m.RUnlock()
 
-	dir, err := annotator.FindDirection(ID, a.localIPs)
+	dir, err := a.localIPs.FindDirection(ID)
 	if err != nil {
-		return err
+		return "", nil, 0, err
 	}
 
 	// TODO: annotate the server IP with siteinfo data.
-	switch dir {
-	case annotator.DstIsServer:
-		annotations.Client.Network = a.annotateIPHoldingLock(ID.SrcIP)
-	case annotator.SrcIsServer:
-		annotations.Client.Network = a.annotateIPHoldingLock(ID.DstIP)
+	client := ID.DstIP
+	if dir == annotator.DstIsServer {
+		client = ID.SrcIP
 	}
-	return nil
+	if a.failClosed && !a.loadedHoldingLock(client) {
+		metrics.ASNSearches.WithLabelValues("no-data").Inc()
+		return "", nil, 0, fmt.Errorf("%w: %w: no RouteViews data for %q", annotator.ErrNoAnnotation, annotator.ErrLookupFailed, client)
+	}
+	if a.versions {
+		v := annotations.Versions()
+		v.RouteViewsV4 = a.asn4version
+		v.RouteViewsV6 = a.asn6version
+	}
+	return client, a.annotateIPHoldingLock(client), a.generation, nil
+}
+
+// loadedHoldingLock returns true unless the IP is valid, and the RouteViews
+// data of its address family is not loaded.
+func (a *asnAnnotator) loadedHoldingLock(src string) bool {
+	ip := net.ParseIP(src)
+	switch {
+	case ip == nil:
+		return true
+	case ip.To4() != nil:
+		return a.asn4 != nil
+	default:
+		return a.asn6 != nil
+	}
+}
+
+// search is like s.Search, but treats a nil Searcher as empty.
+func search(s routeview.Searcher, src string) (routeview.IPNet, error) {
+	if s == nil {
+		return routeview.IPNet{}, routeview.ErrNoASNFound
+	}
+	return s.Search(src)
 }
 
 func (a *asnAnnotator) AnnotateIP(src string) *annotator.Network {
+	ann, gen := a.annotateIP(src)
+	return a.resolveName(context.Background(), src, ann, gen)
+}
+
+// annotateIP is annotateIPHoldingLock under the read lock, which is released
+// even if the annotation panics, so that a caller that recovers does not
+// block every later reload. It also returns the generation of the data the
+// Network was found in.
+func (a *asnAnnotator) annotateIP(src string) (*annotator.Network, uint64) {
+	a.m.RLock()
+	defer a.m.RUnlock()
+	return a.annotateIPHoldingLock(src), a.generation
+}
+
+// resolveName adds the AS name of the Network from the resolver, when the AS
+// names data lacks it and the resolver has no answer cached. The lock must not
+// be held, so that reloads are not blocked while the network is queried. The
+// Network is only cached if the data of generation gen, that it was found in,
+// has not been replaced in the meantime.
+func (a *asnAnnotator) resolveName(ctx context.Context, src string, ann *annotator.Network, gen uint64) *annotator.Network {
+	if !a.needsResolver(ann) {
+		return ann
+	}
+	if _, ok := a.resolver.cached(ann.ASNumber); ok {
+		return ann
+	}
+	name := a.resolver.lookup(ctx, ann.ASNumber)
+	if name == "" {
+		return ann
+	}
+	a.m.RLock()
+	defer a.m.RUnlock()
+	ann.ASName, ann.ASNameSource = name, "cymru"
+	a.annotateAllNamesHoldingLock(ann)
+	if a.cache != nil && a.generation == gen {
+		a.cache.add(src, ann)
+	}
+	return ann
+}
+
+// needsResolver returns true if the AS name of the Network is left to the
+// resolver.
+func (a *asnAnnotator) needsResolver(ann *annotator.Network) bool {
+	return a.resolver != nil && ann.ASNumber != 0 && ann.ASNameSource == ""
+}
+
+// ASName returns the name of the AS number in the AS names data, without the
+// secondary sources of annotations.
+func (a *asnAnnotator) ASName(asn uint32) string {
+	a.m.RLock()
+	defer a.m.RUnlock()
+	return a.asnames[asn].Name
+}
+
+// Lookup searches the RouteViews data of the address family of the IP. Unlike
+// AnnotateIP, it does not search the embedded IPv4 address of transition
+// addresses, and is not counted in the search metrics.
+func (a *asnAnnotator) Lookup(src string) (routeview.IPNet, bool) {
+	ip := net.ParseIP(src)
+	if ip == nil {
+		return routeview.IPNet{}, false
+	}
 	a.m.RLock()
 	defer a.m.RUnlock()
-	return a.annotateIPHoldingLock(src)
+	s := a.asn6
+	if ip.To4() != nil {
+		s = a.asn4
+	}
+	ipnet, err := search(s, src)
+	return ipnet, err == nil
 }
 
 func (a *asnAnnotator) annotateIPHoldingLock(src string) *annotator.Network {
+	if a.cache == nil {
+		return a.searchIPHoldingLock(src)
+	}
+	if ann, ok := a.cache.get(src); ok {
+		return ann
+	}
+	ann := a.searchIPHoldingLock(src)
+	// Networks still without the name from the resolver are cached once it
+	// is found.
+	if !a.needsResolver(ann) {
+		a.cache.add(src, ann)
+	}
+	return ann
+}
+
+// searchIPHoldingLock annotates the IP from the datasets, without the cache.
+func (a *asnAnnotator) searchIPHoldingLock(src string) *annotator.Network {
 	ann := &annotator.Network{}
-	// Check IPv4 first.
-	ipnet, err := a.asn4.Search(src)
-	// NOTE: ignore errors on the first attempt.
-	if err == nil {
-		ann.Systems = routeview.ParseSystems(ipnet.Systems)
-		ann.ASNumber = ann.FirstASN()
-		ann.CIDR = ipnet.String()
-		if a.asnames != nil {
-			ann.ASName = a.asnames[ann.ASNumber]
+	ip := net.ParseIP(src)
+	if ip == nil {
+		ann.Missing = true
+		metrics.ASNSearches.WithLabelValues("bad-ip").Inc()
+		return ann
+	}
+	if annotator.IsReserved(ip) {
+		ann.Missing, ann.Reserved = true, true
+		metrics.ASNSearches.WithLabelValues("reserved").Inc()
+		return ann
+	}
+	// Search only the index of the address family. IPv4-mapped IPv6 addresses
+	// are IPv4 addresses.
+	if ip.To4() != nil {
+		ipnet, err := search(a.asn4, src)
+		if err != nil {
+			if !a.annotateMaxMindHoldingLock(ip, ann) {
+				ann.Missing = true
+				metrics.ASNSearches.WithLabelValues("missing").Inc()
+			}
+			return ann
 		}
+		a.annotateNetHoldingLock(ipnet, ann)
+		a.annotateDateHoldingLock(a.asn4date, ann)
 		// The annotation succeeded with IPv4.
+		a.observePrefixLength("ipv4", ipnet)
 		metrics.ASNSearches.WithLabelValues("ipv4-success").Inc()
 		return ann
 	}
-	if a.asn6 == nil {
-		ann.Missing = true
-		return ann
+	if a.transition {
+		if v4, kind := embeddedIPv4(src); v4 != nil {
+			ipnet, err := search(a.asn4, v4.String())
+			if err == nil {
+				ann.TransitionAddress = kind
+				a.annotateNetHoldingLock(ipnet, ann)
+				a.annotateDateHoldingLock(a.asn4date, ann)
+				// The annotation succeeded with the embedded IPv4.
+				a.observePrefixLength("ipv4", ipnet)
+				metrics.ASNSearches.WithLabelValues("transition-success").Inc()
+				return ann
+			}
+		}
 	}
-
-	ipnet, err = a.asn6.Search(src)
+	ipnet, err := search(a.asn6, src)
 	if err != nil {
-		// In this case, the search has failed twice.
-		ann.Missing = true
-		metrics.ASNSearches.WithLabelValues("missing").Inc()
+		if !a.annotateMaxMindHoldingLock(ip, ann) {
+			ann.Missing = true
+			metrics.ASNSearches.WithLabelValues("missing").Inc()
+		}
 		return ann
 	}
+	a.annotateNetHoldingLock(ipnet, ann)
+	a.annotateDateHoldingLock(a.asn6date, ann)
+	// The annotation succeeded with IPv6.
+	a.observePrefixLength("ipv6", ipnet)
+	metrics.ASNSearches.WithLabelValues("ipv6-success").Inc()
+	return ann
+}
 
+// annotateNetHoldingLock adds the annotations of the RouteViews prefix found
+// for an IP.
+func (a *asnAnnotator) annotateNetHoldingLock(ipnet routeview.IPNet, ann *annotator.Network) {
 	ann.Systems = routeview.ParseSystems(ipnet.Systems)
 	ann.ASNumber = ann.FirstASN()
+	ann.CIDR = ipnet.String()
+	a.annotateNameHoldingLock(ann)
+	a.annotateAllNamesHoldingLock(ann)
+	// The placeholder is not a name, so it is not in ASNameAll.
+	if ann.ASName == "" {
+		ann.ASName = a.unnamed
+	}
+	a.annotateRIRHoldingLock(ipnet.IP, ann)
+	ann.ConeSize = a.cones[ann.ASNumber]
+	if org, ok := a.orgs[ann.ASNumber]; ok {
+		ann.Organization = org.Name
+		ann.OrgID = org.ID
+	}
+	ann.Visibility = int64(ipnet.Visibility)
+}
+
+// annotateMaxMindHoldingLock adds the ASN of an IP that is not in the RouteViews
+// data from the MaxMind ASN database, if enabled, and returns whether it was
+// found there.
+func (a *asnAnnotator) annotateMaxMindHoldingLock(ip net.IP, ann *annotator.Network) bool {
+	if a.mmasn == nil {
+		return false
+	}
+	r, err := a.mmasn.ASN(ip)
+	if err != nil || r.AutonomousSystemNumber == 0 {
+		return false
+	}
+	ann.ASNumber = uint32(r.AutonomousSystemNumber)
+	ann.ASName = r.AutonomousSystemOrganization
+	ann.ASNameSource = "maxmind"
+	ann.Systems = []annotator.System{{ASNs: []uint32{ann.ASNumber}}}
+	if ann.ASName == "" {
+		ann.ASName = a.unnamed
+	}
+	metrics.ASNSearches.WithLabelValues("maxmind-success").Inc()
+	return true
+}
+
+// annotateDateHoldingLock adds the RouteViewDate, if enabled.
+func (a *asnAnnotator) annotateDateHoldingLock(date string, ann *annotator.Network) {
+	if a.dates {
+		ann.RouteViewDate = date
+	}
+}
+
+// annotateAllNamesHoldingLock adds ASNameAll, if enabled.
+func (a *asnAnnotator) annotateAllNamesHoldingLock(ann *annotator.Network) {
+	if !a.allNames {
+		return
+	}
+	var all []string
+	add := func(name string) {
+		if name == "" {
+			return
+		}
+		for _, n := range all {
+			if n == name {
+				return
+			}
+		}
+		all = append(all, name)
+	}
+	add(ann.ASName)
+	for _, names := range a.extraNames {
+		add(names[ann.ASNumber].Name)
+	}
+	ann.ASNameAll = all
+}
+
+// annotateNameHoldingLock adds the AS name, from the names cached by the
+// resolver if the AS names data lacks the AS number and a resolver is
+// configured. Names not cached yet are added by resolveName.
+func (a *asnAnnotator) annotateNameHoldingLock(ann *annotator.Network) {
 	if a.asnames != nil {
-		ann.ASName = a.asnames[ann.ASNumber]
+		info := a.asnames[ann.ASNumber]
+		ann.ASName, ann.ASDomain, ann.ASType = info.Name, info.Domain, info.Type
 	}
-	ann.CIDR = ipnet.String()
-	// The annotation succeeded with IPv6.
-	metrics.ASNSearches.WithLabelValues("ipv6-success").Inc()
-	return ann
+	if a.resolver == nil {
+		return
+	}
+	if ann.ASName != "" {
+		ann.ASNameSource = "ipinfo"
+		return
+	}
+	if ann.ASNumber == 0 {
+		return
+	}
+	if name, _ := a.resolver.cached(ann.ASNumber); name != "" {
+		ann.ASName, ann.ASNameSource = name, "cymru"
+	}
+}
+
+// annotateRIRHoldingLock adds the allocated country of the prefix starting at
+// the given IP, when RIR delegation data is available.
+func (a *asnAnnotator) annotateRIRHoldingLock(prefix net.IP, ann *annotator.Network) {
+	if a.rir == nil {
+		return
+	}
+	d, err := a.rir.Search(prefix)
+	if err != nil {
+		return
+	}
+	ann.AllocatedCountry = d.Country
+}
+
+// SetMinReloadInterval makes Reload and ReloadPrefixes skip calls sooner than
+// d after the previous one, and ReloadNames skip calls sooner than d after the
+// previous ReloadNames.
+func (a *asnAnnotator) SetMinReloadInterval(d time.Duration) {
+	a.ReloadGuard.SetMinReloadInterval(d)
+	a.namesGuard.SetMinReloadInterval(d)
+}
+
+// ForceReload makes the next Reload or ReloadPrefixes, and the next
+// ReloadNames, run regardless of the minimum reload interval.
+func (a *asnAnnotator) ForceReload() {
+	a.ReloadGuard.ForceReload()
+	a.namesGuard.ForceReload()
 }
 
 // Reload is intended to be regularly called in a loop. It should check whether
 // the data in GCS is newer than the local data, and, if it is, then download
 // and load that new data into memory and then replace it in the annotator.
 func (a *asnAnnotator) Reload(ctx context.Context) {
-	new4, err := load(ctx, a.as4, a.asn4)
-	if err != nil {
-		log.Println("Could not reload v4 routeviews:", err)
+	if !a.AllowReload() {
 		return
 	}
-	var new6 routeview.Index
-	var newnames ipinfo.ASNames
+	start := time.Now()
+	defer func() { metrics.ReloadDuration.WithLabelValues("asn").Observe(time.Since(start).Seconds()) }()
+	if !a.reload(ctx, true) {
+		a.ReloadFailed()
+	}
+}
+
+// ReloadPrefixes is like Reload, but keeps the loaded AS names.
+func (a *asnAnnotator) ReloadPrefixes(ctx context.Context) {
+	if !a.AllowReload() {
+		return
+	}
+	start := time.Now()
+	defer func() { metrics.ReloadDuration.WithLabelValues("asn").Observe(time.Since(start).Seconds()) }()
+	if !a.reload(ctx, false) {
+		a.ReloadFailed()
+	}
+}
+
+// ReloadNames reloads the AS names, and any additional names, without checking
+// the RouteViews data or the other datasets. Names that can not be reloaded
+// are kept.
+func (a *asnAnnotator) ReloadNames(ctx context.Context) {
+	if !a.namesGuard.AllowReload() {
+		return
+	}
+	start := time.Now()
+	defer func() { metrics.ReloadDuration.WithLabelValues("asname").Observe(time.Since(start).Seconds()) }()
+	newnames, err := loadNames(ctx, a.asnamedata, a.asnames)
+	if err != nil {
+		log.Println("Could not reload asnames from ipinfo:", err)
+		newnames = a.asnames
+		a.namesGuard.ReloadFailed()
+	} else if a.asnamedata != nil {
+		metrics.ASNameDatasetAge.Loaded()
+	}
+	newextra := a.loadExtraNames(ctx, a.extraNames)
+	a.m.Lock()
+	defer a.m.Unlock()
+	a.asnames = newnames
+	a.extraNames = newextra
+	a.clearCacheHoldingLock()
+}
+
+// reload replaces the data of the annotator, including the AS names only if
+// names is true. It returns false if the data could not be loaded.
+func (a *asnAnnotator) reload(ctx context.Context, names bool) bool {
+	old := a.snapshot()
+	var new4, new6 routeview.Searcher
+	var new4version, new6version string
+	var new4date, new6date string
+	var newnames ipinfo.ASInfos
+	var err4, err6, errNames error
+	loads := []func(){
+		func() {
+			new4, new4version, new4date, err4 = a.load(ctx, a.as4, old.asn4, old.asn4version, old.asn4date)
+		},
+	}
 	if a.as6 != nil {
-		new6, err = load(ctx, a.as6, a.asn6)
+		loads = append(loads,
+			func() {
+				new6, new6version, new6date, err6 = a.load(ctx, a.as6, old.asn6, old.asn6version, old.asn6date)
+			},
+		)
+		if names {
+			loads = append(loads,
+				func() { newnames, errNames = loadNames(ctx, a.asnamedata, old.asnames) },
+			)
+		}
+	}
+	parallel(loads...)
+	if err4 != nil {
+		log.Println("Could not reload v4 routeviews:", err4)
+		return false
+	}
+	if err6 != nil {
+		log.Println("Could not reload v6 routeviews:", err6)
+		return false
+	}
+	if errNames != nil {
+		// AS names are optional, so keep the old names on failure.
+		log.Println("Could not reload asnames from ipinfo:", errNames)
+		newnames = old.asnames
+	}
+	var err error
+	var newrir rir.Index
+	if a.rirdata != nil {
+		newrir, err = loadRIR(ctx, a.rirdata, old.rir)
 		if err != nil {
-			log.Println("Could not reload v6 routeviews:", err)
-			return
+			log.Println("Could not reload RIR delegations:", err)
+			return false
 		}
-		newnames, err = loadNames(ctx, a.asnamedata, a.asnames)
+	}
+	var newcones asrank.ConeSizes
+	if a.conedata != nil {
+		newcones, err = loadCones(ctx, a.conedata, old.cones)
 		if err != nil {
-			log.Println("Could not reload asnames from ipinfo:", err)
-			return
+			log.Println("Could not reload customer cones:", err)
+			return false
+		}
+	}
+	var neworgs as2org.Organizations
+	if a.orgdata != nil {
+		neworgs, err = loadOrgs(ctx, a.orgdata, old.orgs)
+		if err != nil {
+			log.Println("Could not reload AS organizations:", err)
+			return false
 		}
 	}
+	var newmmasn *geoip2.Reader
+	if a.mmasndata != nil {
+		newmmasn, err = loadMaxMindASN(ctx, a.mmasndata, old.mmasn)
+		if err != nil {
+			log.Println("Could not reload MaxMind ASN db:", err)
+			return false
+		}
+	}
+	var newextra []ipinfo.ASInfos
+	if names {
+		newextra = a.loadExtraNames(ctx, old.extraNames)
+	}
 	// Don't acquire the lock until after the data is in RAM.
 	a.m.Lock()
 	defer a.m.Unlock()
 	a.asn4 = new4
 	a.asn6 = new6
-	a.asnames = newnames
+	a.asn4version = new4version
+	a.asn6version = new6version
+	a.asn4date = new4date
+	a.asn6date = new6date
+	if names {
+		a.asnames = newnames
+		a.extraNames = newextra
+	}
+	a.rir = newrir
+	a.cones = newcones
+	a.orgs = neworgs
+	a.mmasn = newmmasn
+	a.clearCacheHoldingLock()
+	metrics.ASNDatasetAge.Loaded()
+	// The names are only loaded along with v6 RouteViews.
+	if names && a.as6 != nil && a.asnamedata != nil && errNames == nil {
+		metrics.ASNameDatasetAge.Loaded()
+	}
+	return true
+}
+
+// Warm loads all datasets into the staging slot, without replacing the data in
+// the annotator. The staged data only becomes live after a call to Commit. If
+// any dataset can not be loaded, Warm returns an error and leaves the staging
+// slot unchanged.
+func (a *asnAnnotator) Warm(ctx context.Context) error {
+	old := a.snapshot()
+	s := &stagedData{}
+	var err error
+	s.asn4, s.asn4version, s.asn4date, err = a.load(ctx, a.as4, old.asn4, old.asn4version, old.asn4date)
+	if err != nil {
+		return fmt.Errorf("could not load v4 routeviews: %w", err)
+	}
+	if a.as6 != nil {
+		s.asn6, s.asn6version, s.asn6date, err = a.load(ctx, a.as6, old.asn6, old.asn6version, old.asn6date)
+		if err != nil {
+			return fmt.Errorf("could not load v6 routeviews: %w", err)
+		}
+		s.asnames, err = loadNames(ctx, a.asnamedata, old.asnames)
+		if err != nil {
+			return fmt.Errorf("could not load asnames from ipinfo: %w", err)
+		}
+	}
+	if a.rirdata != nil {
+		s.rir, err = loadRIR(ctx, a.rirdata, old.rir)
+		if err != nil {
+			return fmt.Errorf("could not load RIR delegations: %w", err)
+		}
+	}
+	if a.conedata != nil {
+		s.cones, err = loadCones(ctx, a.conedata, old.cones)
+		if err != nil {
+			return fmt.Errorf("could not load customer cones: %w", err)
+		}
+	}
+	if a.orgdata != nil {
+		s.orgs, err = loadOrgs(ctx, a.orgdata, old.orgs)
+		if err != nil {
+			return fmt.Errorf("could not load AS organizations: %w", err)
+		}
+	}
+	if a.mmasndata != nil {
+		s.mmasn, err = loadMaxMindASN(ctx, a.mmasndata, old.mmasn)
+		if err != nil {
+			return fmt.Errorf("could not load MaxMind ASN db: %w", err)
+		}
+	}
+	s.extraNames = a.loadExtraNames(ctx, old.extraNames)
+	a.m.Lock()
+	defer a.m.Unlock()
+	a.staged = s
+	return nil
+}
+
+// Commit replaces the live datasets with the ones loaded by Warm. If nothing
+// has been staged, Commit does nothing.
+func (a *asnAnnotator) Commit() {
+	a.m.Lock()
+	defer a.m.Unlock()
+	if a.staged == nil {
+		return
+	}
+	a.asn4 = a.staged.asn4
+	a.asn6 = a.staged.asn6
+	a.asn4version = a.staged.asn4version
+	a.asn6version = a.staged.asn6version
+	a.asn4date = a.staged.asn4date
+	a.asn6date = a.staged.asn6date
+	a.asnames = a.staged.asnames
+	a.rir = a.staged.rir
+	a.cones = a.staged.cones
+	a.orgs = a.staged.orgs
+	a.mmasn = a.staged.mmasn
+	a.extraNames = a.staged.extraNames
+	a.staged = nil
+	a.clearCacheHoldingLock()
+}
+
+// snapshot returns the live data, to be passed to the loaders as the values
+// to keep when a source has not changed, without holding the lock while they
+// load.
+func (a *asnAnnotator) snapshot() *stagedData {
+	a.m.RLock()
+	defer a.m.RUnlock()
+	return &stagedData{
+		asn4:        a.asn4,
+		asn6:        a.asn6,
+		asn4version: a.asn4version,
+		asn6version: a.asn6version,
+		asn4date:    a.asn4date,
+		asn6date:    a.asn6date,
+		asnames:     a.asnames,
+		rir:         a.rir,
+		cones:       a.cones,
+		orgs:        a.orgs,
+		mmasn:       a.mmasn,
+		extraNames:  a.extraNames,
+	}
+}
+
+// clearCacheHoldingLock empties the cache, if any, once the data its Networks
+// were found in has been replaced.
+func (a *asnAnnotator) clearCacheHoldingLock() {
+	a.generation++
+	if a.cache != nil {
+		a.cache.clear()
+	}
+}
+
+// parallel calls every function concurrently, and returns when they are all
+// done.
+func parallel(fs ...func()) {
+	wg := sync.WaitGroup{}
+	for _, f := range fs {
+		wg.Add(1)
+		go func(f func()) {
+			defer wg.Done()
+			f()
+		}(f)
+	}
+	wg.Wait()
 }
 
-func load(ctx context.Context, src content.Provider, oldvalue routeview.Index) (routeview.Index, error) {
+// namer is implemented by providers that know the name of the file they last
+// returned, like those of dirprovider.
+type namer interface {
+	Name() string
+}
+
+// load returns the RouteViews data from src along with the MD5 of the raw
+// snapshot and the date in the name of its file, if src is a namer, or the old
+// values if the data has not changed.
+func (a *asnAnnotator) load(ctx context.Context, src content.Provider, oldvalue routeview.Searcher, oldversion, olddate string) (routeview.Searcher, string, string, error) {
 	gz, err := src.Get(ctx)
 	if err == content.ErrNoChange {
-		return oldvalue, nil
+		return oldvalue, oldversion, olddate, nil
 	}
 	if err != nil {
-		return nil, err
+		return nil, "", "", err
+	}
+	ix, err := loadGZ(gz)
+	if err != nil {
+		return nil, "", "", err
+	}
+	version := fmt.Sprintf("%x", md5.Sum(gz))
+	date := ""
+	if n, ok := src.(namer); ok {
+		date = routeview.FileDate(n.Name())
+	}
+	if a.compact {
+		return ix.Compact(), version, date, nil
 	}
-	return loadGZ(gz)
+	return ix, version, date, nil
 }
 
 func loadGZ(gz []byte) (routeview.Index, error) {
 	data, err := tarreader.FromGZ(gz)
 	if err != nil {
-		return nil, err
+		return routeview.Index{}, err
 	}
 	return routeview.ParseRouteView(data), nil
 }
 
-func loadNames(ctx context.Context, src content.Provider, oldvalue ipinfo.ASNames) (ipinfo.ASNames, error) {
+func loadNames(ctx context.Context, src content.Provider, oldvalue ipinfo.ASInfos) (ipinfo.ASInfos, error) {
+	if src == nil {
+		return nil, nil
+	}
+	data, err := src.Get(ctx)
+	if err == content.ErrNoChange {
+		return oldvalue, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return ipinfo.ParseInfo(data)
+}
+
+// loadExtraNames loads every additional AS names file, keeping the old names
+// of a file that has not changed or can not be loaded.
+func (a *asnAnnotator) loadExtraNames(ctx context.Context, oldvalue []ipinfo.ASInfos) []ipinfo.ASInfos {
+	if len(a.extraNamedata) == 0 {
+		return nil
+	}
+	extra := make([]ipinfo.ASInfos, len(a.extraNamedata))
+	for i, src := range a.extraNamedata {
+		var old ipinfo.ASInfos
+		if i < len(oldvalue) {
+			old = oldvalue[i]
+		}
+		names, err := loadNames(ctx, src, old)
+		if err != nil {
+			log.Println("Could not load additional AS names:", err)
+			names = old
+		}
+		extra[i] = names
+	}
+	return extra
+}
+
+func loadRIR(ctx context.Context, src content.Provider, oldvalue rir.Index) (rir.Index, error) {
+	data, err := src.Get(ctx)
+	if err == content.ErrNoChange {
+		return oldvalue, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return rir.Parse(data)
+}
+
+func loadCones(ctx context.Context, src content.Provider, oldvalue asrank.ConeSizes) (asrank.ConeSizes, error) {
+	data, err := src.Get(ctx)
+	if err == content.ErrNoChange {
+		return oldvalue, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return asrank.Parse(data)
+}
+
+func loadOrgs(ctx context.Context, src content.Provider, oldvalue as2org.Organizations) (as2org.Organizations, error) {
+	data, err := src.Get(ctx)
+	if err == content.ErrNoChange {
+		return oldvalue, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return as2org.Parse(data)
+}
+
+// loadMaxMindASN reads a GeoLite2-ASN database, or the .mmdb file in a .tar.gz
+// archive of one.
+func loadMaxMindASN(ctx context.Context, src content.Provider, oldvalue *geoip2.Reader) (*geoip2.Reader, error) {
 	data, err := src.Get(ctx)
 	if err == content.ErrNoChange {
 		return oldvalue, nil
@@ -191,7 +1070,13 @@ func loadNames(ctx context.Context, src content.Provider, oldvalue ipinfo.ASName
 	if err != nil {
 		return nil, err
 	}
-	return ipinfo.Parse(data)
+	if len(data) >= 2 && data[0] == 0x1f && data[1] == 0x8b {
+		data, err = tarreader.FromTarGZ(data, ".mmdb")
+		if err != nil {
+			return nil, err
+		}
+	}
+	return geoip2.FromBytes(data)
 }
 
 // fakeASNAnnotator is just a real asnAnnotator that has a fixed dataset and
@@ -202,6 +1087,14 @@ type fakeASNAnnotator struct {
 
 func (*fakeASNAnnotator) Reload(ctx context.Context) {}
 
+func (*fakeASNAnnotator) ReloadPrefixes(ctx context.Context) {}
+
+func (*fakeASNAnnotator) ReloadNames(ctx context.Context) {}
+
+func (*fakeASNAnnotator) Warm(ctx context.Context) error { return nil }
+
+func (*fakeASNAnnotator) Commit() {}
+
 // NewFake returns an annotator that know about just one v4 IP (1.2.3.4) and one
 // v6 IP (1111:2222:3333:4444:5555:6666:7777:8888). This is useful for testing
 // other components when you don't want to carry around canonical datafiles, or
@@ -218,7 +1111,7 @@ func NewFake() ASNAnnotator {
 	rtx.Must(err, "Could not parse fixed string")
 	asn4Entry.IPNet = *v4net
 	asn4Entry.Systems = "5"
-	f.asn4 = routeview.Index{routeview.NetIndex{asn4Entry}}
+	f.asn4 = routeview.NewIndex([]routeview.IPNet{asn4Entry})
 
 	// Set up v6 data for 1111:2222:3333:4444:5555:6666:7777:8888.
 	asn6Entry := routeview.IPNet{}
@@ -226,12 +1119,12 @@ func NewFake() ASNAnnotator {
 	rtx.Must(err, "Could not parse fixed string")
 	asn6Entry.IPNet = *v6net
 	asn6Entry.Systems = "9"
-	f.asn6 = routeview.Index{routeview.NetIndex{asn6Entry}}
+	f.asn6 = routeview.NewIndex([]routeview.IPNet{asn6Entry})
 
 	// Set up AS name entries for AS5 and AS9
-	f.asnames = ipinfo.ASNames{
-		5: "Test Number Five",
-		9: "Test Number Nine",
+	f.asnames = ipinfo.ASInfos{
+		5: {Name: "Test Number Five"},
+		9: {Name: "Test Number Nine"},
 	}
 	return f
 }
@@ -1,19 +1,34 @@
 package asnannotator
 
 import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
 	"context"
+	"crypto/md5"
 	"errors"
+	"fmt"
+	"io/ioutil"
 	"log"
 	"net"
 	"net/url"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/go-test/deep"
 	"github.com/m-lab/go/content"
 	"github.com/m-lab/go/rtx"
 	"github.com/m-lab/tcp-info/inetdiag"
 	"github.com/m-lab/uuid-annotator/annotator"
+	"github.com/m-lab/uuid-annotator/dirprovider"
+	"github.com/m-lab/uuid-annotator/metrics"
+	"github.com/m-lab/uuid-annotator/routeview"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
 )
 
 var local4Rawfile content.Provider
@@ -47,6 +62,23 @@ func setUp() {
 	log.SetFlags(log.Lshortfile | log.LstdFlags)
 }
 
+// setUpTiny is like setUp, but with the small RouteViews files, for tests
+// that do not need the full datasets and would otherwise spend most of their
+// time loading them.
+func setUpTiny() {
+	setUp()
+	var err error
+	u4, err := url.Parse("file:../testdata/RouteViewIPv4.tiny.gz")
+	rtx.Must(err, "Could not parse URL")
+	local4Rawfile, err = content.FromURL(context.Background(), u4)
+	rtx.Must(err, "Could not create content.Provider")
+
+	u6, err := url.Parse("file:../testdata/RouteViewIPv6.tiny.gz")
+	rtx.Must(err, "Could not parse URL")
+	local6Rawfile, err = content.FromURL(context.Background(), u6)
+	rtx.Must(err, "Could not create content.Provider")
+}
+
 func Test_asnAnnotator_Annotate(t *testing.T) {
 	setUp()
 	localV4 := "9.0.0.9"
@@ -196,6 +228,190 @@ func Test_asnAnnotator_AnnotateIP(t *testing.T) {
 	}
 }
 
+// panicSearcher is a routeview.Searcher that must never be searched.
+type panicSearcher struct{}
+
+func (panicSearcher) Search(s string) (routeview.IPNet, error) {
+	panic("unexpected search for " + s)
+}
+
+func Test_asnAnnotator_AnnotateIP_familyDispatch(t *testing.T) {
+	_, v6, err := net.ParseCIDR("2001:200::/32")
+	rtx.Must(err, "Could not parse CIDR")
+	_, v4, err := net.ParseCIDR("1.0.0.0/24")
+	rtx.Must(err, "Could not parse CIDR")
+	ix6 := routeview.NewIndex([]routeview.IPNet{{IPNet: *v6, Systems: "2500"}})
+	ix4 := routeview.NewIndex([]routeview.IPNet{{IPNet: *v4, Systems: "13335"}})
+
+	// An IPv6 lookup never searches the IPv4 index, and vice versa.
+	a := &asnAnnotator{asn4: panicSearcher{}, asn6: ix6}
+	if got := a.AnnotateIP("2001:200::1"); got.ASNumber != 2500 {
+		t.Errorf("AnnotateIP(IPv6) = %+v, want AS2500", got)
+	}
+	if got := a.AnnotateIP("2001:ff00::1"); !got.Missing {
+		t.Errorf("AnnotateIP(missing IPv6) = %+v, want Missing", got)
+	}
+	a = &asnAnnotator{asn4: ix4, asn6: panicSearcher{}}
+	for _, ip := range []string{"1.0.0.1", "::ffff:1.0.0.1"} {
+		if got := a.AnnotateIP(ip); got.ASNumber != 13335 {
+			t.Errorf("AnnotateIP(%q) = %+v, want AS13335", ip, got)
+		}
+	}
+	if got := a.AnnotateIP("9.0.0.9"); !got.Missing {
+		t.Errorf("AnnotateIP(missing IPv4) = %+v, want Missing", got)
+	}
+
+	// Invalid IPs search neither index.
+	a = &asnAnnotator{asn4: panicSearcher{}, asn6: panicSearcher{}}
+	before := testutil.ToFloat64(metrics.ASNSearches.WithLabelValues("bad-ip"))
+	if got := a.AnnotateIP("not-an-ip"); !got.Missing {
+		t.Errorf("AnnotateIP(invalid) = %+v, want Missing", got)
+	}
+	if got := testutil.ToFloat64(metrics.ASNSearches.WithLabelValues("bad-ip")) - before; got != 1 {
+		t.Errorf("ASNSearches{bad-ip} increased by %v, want 1", got)
+	}
+}
+
+func Test_asnAnnotator_AnnotateIP_panicReleasesLock(t *testing.T) {
+	a := &asnAnnotator{asn4: panicSearcher{}, asn6: panicSearcher{}}
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Error("AnnotateIP() did not panic")
+			}
+		}()
+		a.AnnotateIP("1.0.0.1")
+	}()
+	// A recovered panic must not leave the read lock held, which would block
+	// every later reload.
+	locked := make(chan struct{})
+	go func() {
+		a.m.Lock()
+		a.m.Unlock()
+		close(locked)
+	}()
+	select {
+	case <-locked:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the lock was still held after a panic in AnnotateIP()")
+	}
+}
+
+func Test_asnAnnotator_AnnotateIP_reserved(t *testing.T) {
+	// The index contains every IP, so only the reserved check makes them Missing.
+	_, all4, err := net.ParseCIDR("0.0.0.0/0")
+	rtx.Must(err, "Could not parse CIDR")
+	_, all6, err := net.ParseCIDR("::/0")
+	rtx.Must(err, "Could not parse CIDR")
+	a := &asnAnnotator{
+		asn4: routeview.NewIndex([]routeview.IPNet{{IPNet: *all4, Systems: "1"}}),
+		asn6: routeview.NewIndex([]routeview.IPNet{{IPNet: *all6, Systems: "1"}}),
+	}
+	before := testutil.ToFloat64(metrics.ASNSearches.WithLabelValues("reserved"))
+	ips := []string{"10.0.0.1", "127.0.0.1", "::1", "169.254.1.1", "192.0.2.1"}
+	for _, ip := range ips {
+		if diff := deep.Equal(a.AnnotateIP(ip), &annotator.Network{Missing: true, Reserved: true}); diff != nil {
+			t.Errorf("AnnotateIP(%s) differs: %v", ip, diff)
+		}
+	}
+	if got := testutil.ToFloat64(metrics.ASNSearches.WithLabelValues("reserved")) - before; got != float64(len(ips)) {
+		t.Errorf("ASNSearches{reserved} increased by %v, want %d", got, len(ips))
+	}
+	if got := a.AnnotateIP("1.0.0.1"); got.Reserved || got.ASNumber != 1 {
+		t.Errorf("AnnotateIP(1.0.0.1) = %+v, want AS1", got)
+	}
+}
+
+func Test_asnAnnotator_Lookup(t *testing.T) {
+	_, v4, err := net.ParseCIDR("1.0.0.0/24")
+	rtx.Must(err, "Could not parse CIDR")
+	_, v6, err := net.ParseCIDR("2001:200::/32")
+	rtx.Must(err, "Could not parse CIDR")
+	net4 := routeview.IPNet{IPNet: *v4, Systems: "13335_2500,7"}
+	net6 := routeview.IPNet{IPNet: *v6, Systems: "2500"}
+	a := &asnAnnotator{
+		asn4:       routeview.NewIndex([]routeview.IPNet{net4}),
+		asn6:       routeview.NewIndex([]routeview.IPNet{net6}),
+		transition: true,
+	}
+	tests := []struct {
+		name   string
+		ip     string
+		want   routeview.IPNet
+		wantOK bool
+	}{
+		{name: "ipv4", ip: "1.0.0.1", want: net4, wantOK: true},
+		{name: "ipv6", ip: "2001:200::1", want: net6, wantOK: true},
+		{name: "missing", ip: "9.0.0.9"},
+		{name: "6to4-not-followed", ip: "2002:100:1::1"},
+		{name: "bad-ip", ip: "not-an-ip"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := a.Lookup(tt.ip)
+			if ok != tt.wantOK {
+				t.Errorf("Lookup(%q) ok = %v, want %v", tt.ip, ok, tt.wantOK)
+			}
+			if diff := deep.Equal(got, tt.want); diff != nil {
+				t.Errorf("Lookup(%q) = %v, diff %v", tt.ip, got, diff)
+			}
+		})
+	}
+}
+
+func Test_asnAnnotator_WithFailClosed(t *testing.T) {
+	_, v4, err := net.ParseCIDR("1.0.0.0/24")
+	rtx.Must(err, "Could not parse CIDR")
+	ix4 := routeview.NewIndex([]routeview.IPNet{{IPNet: *v4, Systems: "13335"}})
+	server := inetdiag.SockID{SrcIP: "1.0.0.1"}
+	tests := []struct {
+		name       string
+		opts       []Option
+		client     string
+		wantErr    error
+		wantClient *annotator.Network
+	}{
+		{
+			name:       "open-missing-family",
+			client:     "2001:200::1",
+			wantClient: &annotator.Network{Missing: true},
+		},
+		{
+			name:    "closed-missing-family",
+			opts:    []Option{WithFailClosed()},
+			client:  "2001:200::1",
+			wantErr: annotator.ErrLookupFailed,
+		},
+		{
+			name:       "closed-not-found",
+			opts:       []Option{WithFailClosed()},
+			client:     "9.0.0.9",
+			wantClient: &annotator.Network{Missing: true},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := &asnAnnotator{
+				localIPs: annotator.NewLocalIPSet([]net.IP{net.ParseIP("1.0.0.1")}),
+				asn4:     ix4,
+			}
+			for _, opt := range tt.opts {
+				opt(a)
+			}
+			ID := server
+			ID.DstIP = tt.client
+			ann := &annotator.Annotations{}
+			err := a.Annotate(&ID, ann)
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("Annotate() error = %v, want %v", err, tt.wantErr)
+			}
+			if diff := deep.Equal(ann.Client.Network, tt.wantClient); diff != nil {
+				t.Errorf("Annotate() Client.Network differs: %v", diff)
+			}
+		})
+	}
+}
+
 type badProvider struct {
 	err error
 }
@@ -272,7 +488,7 @@ func Test_asnAnnotator_Reload(t *testing.T) {
 			ctx := context.Background()
 			// NOTE: we don't use New() to allow injecting bad providers.
 			a := &asnAnnotator{
-				localIPs:   localIPs,
+				localIPs:   annotator.NewLocalIPSet(localIPs),
 				as4:        tt.as4,
 				as6:        tt.as6,
 				asnamedata: tt.asnamedata,
@@ -306,6 +522,30 @@ func TestNewFake(t *testing.T) {
 	}
 }
 
+func Test_asnAnnotator_ASName(t *testing.T) {
+	f := NewFake()
+	tests := []struct {
+		asn  uint32
+		want string
+	}{
+		{asn: 5, want: "Test Number Five"},
+		{asn: 9, want: "Test Number Nine"},
+		{asn: 7, want: ""},
+		{asn: 0, want: ""},
+	}
+	for _, tt := range tests {
+		if got := f.ASName(tt.asn); got != tt.want {
+			t.Errorf("ASName(%d) = %q, want %q", tt.asn, got, tt.want)
+		}
+	}
+
+	// Without AS names data, every name is unknown.
+	a := &asnAnnotator{}
+	if got := a.ASName(5); got != "" {
+		t.Errorf("ASName() without names = %q, want \"\"", got)
+	}
+}
+
 func Test_IPv4Annotator_AnnotateIP(t *testing.T) {
 	setUp()
 	tests := []struct {
@@ -343,3 +583,1018 @@ func Test_IPv4Annotator_AnnotateIP(t *testing.T) {
 		})
 	}
 }
+
+func Test_asnAnnotator_WarmAndCommit(t *testing.T) {
+	setUpTiny()
+	ctx := context.Background()
+	a := &asnAnnotator{
+		as4:        local4Rawfile,
+		as6:        local6Rawfile,
+		asnamedata: localASNamesfile,
+	}
+
+	// Warm should load the data, but not make it live.
+	rtx.Must(a.Warm(ctx), "Could not warm the annotator")
+	if got := a.AnnotateIP("1.0.0.1"); !got.Missing {
+		t.Errorf("Staged data should not be used before Commit(); got %+v", got)
+	}
+
+	// Commit should make the staged data live.
+	a.Commit()
+	want := annotator.Network{
+		CIDR:     "1.0.0.0/24",
+		ASNumber: 13335,
+		ASName:   "Cloudflare, Inc.",
+		Systems: []annotator.System{
+			{ASNs: []uint32{13335}},
+		},
+	}
+	if diff := deep.Equal(*a.AnnotateIP("1.0.0.1"), want); diff != nil {
+		t.Error("AnnotateIP() after Commit() wrong value; got!=want", diff)
+	}
+	if a.staged != nil {
+		t.Error("Commit() should empty the staging slot")
+	}
+}
+
+func Test_asnAnnotator_WarmDuringCommit(t *testing.T) {
+	setUpTiny()
+	ctx := context.Background()
+	a := &asnAnnotator{
+		as4:        local4Rawfile,
+		as6:        local6Rawfile,
+		asnamedata: localASNamesfile,
+	}
+	rtx.Must(a.Warm(ctx), "Could not warm the annotator")
+
+	// Warm reads the live data as the values to keep, so it must not race
+	// with the Commit and Reload calls that replace it. Run with -race.
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 3; i++ {
+			rtx.Must(a.Warm(ctx), "Could not warm the annotator")
+		}
+	}()
+	for i := 0; i < 3; i++ {
+		a.Commit()
+		a.Reload(ctx)
+	}
+	wg.Wait()
+	a.Commit()
+	if got := a.AnnotateIP("1.0.0.1"); got.ASNumber != 13335 {
+		t.Errorf("AnnotateIP() after Commit() wrong ASN; got %d, want 13335", got.ASNumber)
+	}
+}
+
+func Test_asnAnnotator_WarmWithBadData(t *testing.T) {
+	setUpTiny()
+	tests := []struct {
+		name       string
+		as4        content.Provider
+		as6        content.Provider
+		asnamedata content.Provider
+	}{
+		{
+			name:       "corrupt-v4",
+			as4:        corruptFile,
+			as6:        local6Rawfile,
+			asnamedata: localASNamesfile,
+		},
+		{
+			name:       "bad-v6-provider",
+			as4:        local4Rawfile,
+			as6:        badProvider{errors.New("fake v6 error")},
+			asnamedata: localASNamesfile,
+		},
+		{
+			name:       "bad-names-provider",
+			as4:        local4Rawfile,
+			as6:        local6Rawfile,
+			asnamedata: badProvider{errors.New("fake names error")},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setUpTiny()
+			f := NewFake().(*fakeASNAnnotator)
+			a := &f.asnAnnotator
+			a.as4, a.as6, a.asnamedata = tt.as4, tt.as6, tt.asnamedata
+			if err := a.Warm(context.Background()); err == nil {
+				t.Error("Warm() should have returned an error")
+			}
+			a.Commit()
+			if got := a.AnnotateIP("1.2.3.4"); got.ASName != "Test Number Five" {
+				t.Errorf("Bad data should never be swapped in; got %+v", got)
+			}
+		})
+	}
+}
+
+func Test_asnAnnotator_WithRIRDelegations(t *testing.T) {
+	setUpTiny()
+	u, err := url.Parse("file:../testdata/delegated-extended.txt")
+	rtx.Must(err, "Could not parse URL")
+	rirfile, err := content.FromURL(context.Background(), u)
+	rtx.Must(err, "Could not create content.Provider")
+
+	ctx := context.Background()
+	a := New(ctx, local4Rawfile, local6Rawfile, localASNamesfile, localIPs, WithRIRDelegations(rirfile))
+	tests := []struct {
+		name string
+		addr string
+		want string
+	}{
+		{
+			name: "ipv4",
+			addr: "2.125.160.216",
+			want: "GB",
+		},
+		{
+			name: "ipv6",
+			addr: "2001:200::1",
+			want: "JP",
+		},
+		{
+			name: "no-delegation",
+			addr: "1.0.0.1",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := a.AnnotateIP(tt.addr)
+			if got.AllocatedCountry != tt.want {
+				t.Errorf("AnnotateIP(%q).AllocatedCountry = %q, want %q", tt.addr, got.AllocatedCountry, tt.want)
+			}
+		})
+	}
+
+	// Reloading unchanged data should keep the delegations.
+	a.Reload(ctx)
+	if got := a.AnnotateIP("2.125.160.216"); got.AllocatedCountry != "GB" {
+		t.Errorf("AnnotateIP() after Reload() = %+v, want AllocatedCountry GB", got)
+	}
+
+	// A failure to reload the delegations should not change the live data.
+	a.(*asnAnnotator).rirdata = badProvider{errors.New("fake rir error")}
+	a.Reload(ctx)
+	if err := a.Warm(ctx); err == nil {
+		t.Error("Warm() should fail when the RIR delegations can not be loaded")
+	}
+	if got := a.AnnotateIP("2.125.160.216"); got.AllocatedCountry != "GB" {
+		t.Errorf("AnnotateIP() after failed Reload() = %+v, want AllocatedCountry GB", got)
+	}
+}
+
+func TestNew_withoutNames(t *testing.T) {
+	tests := []struct {
+		name       string
+		asnamedata content.Provider
+	}{
+		{
+			name:       "failing-names-provider",
+			asnamedata: badProvider{errors.New("fake names error")},
+		},
+		{
+			name:       "nil-names-provider",
+			asnamedata: nil,
+		},
+	}
+	want := annotator.Network{
+		CIDR:     "1.0.0.0/24",
+		ASNumber: 13335,
+		Systems: []annotator.System{
+			{ASNs: []uint32{13335}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setUpTiny()
+			ctx := context.Background()
+			a := New(ctx, local4Rawfile, local6Rawfile, tt.asnamedata, localIPs)
+			if diff := deep.Equal(*a.AnnotateIP("1.0.0.1"), want); diff != nil {
+				t.Error("AnnotateIP() without names wrong value; got!=want", diff)
+			}
+			a.Reload(ctx) // no crash == success
+		})
+	}
+}
+
+func Test_asnAnnotator_WithCompactRouteViews(t *testing.T) {
+	setUpTiny()
+	ctx := context.Background()
+	a := New(ctx, local4Rawfile, local6Rawfile, localASNamesfile, localIPs, WithCompactRouteViews())
+	setUpTiny()
+	b := New(ctx, local4Rawfile, local6Rawfile, localASNamesfile, localIPs)
+	for _, ip := range []string{"1.0.0.1", "223.252.176.1", "2001:200::1", "9.0.0.9", "this-is-not-an-ip"} {
+		if diff := deep.Equal(a.AnnotateIP(ip), b.AnnotateIP(ip)); diff != nil {
+			t.Errorf("AnnotateIP(%q) differs with a compact index: %v", ip, diff)
+		}
+	}
+}
+
+func Test_asnAnnotator_WithDataVersions(t *testing.T) {
+	md5file := func(name string) string {
+		b, err := ioutil.ReadFile(name)
+		rtx.Must(err, "Could not read "+name)
+		return fmt.Sprintf("%x", md5.Sum(b))
+	}
+	want := &annotator.DataVersions{
+		RouteViewsV4: md5file("../testdata/RouteViewIPv4.tiny.gz"),
+		RouteViewsV6: md5file("../testdata/RouteViewIPv6.tiny.gz"),
+	}
+	local := []net.IP{net.ParseIP("1.0.0.1")}
+	id := &inetdiag.SockID{SrcIP: "1.0.0.1", DstIP: "223.252.176.1"}
+	ctx := context.Background()
+
+	setUpTiny()
+	a := New(ctx, local4Rawfile, local6Rawfile, localASNamesfile, local, WithDataVersions())
+	ann := &annotator.Annotations{}
+	rtx.Must(a.Annotate(id, ann), "Could not annotate")
+	if diff := deep.Equal(ann.DataVersions, want); diff != nil {
+		t.Error("Annotate() wrong DataVersions; got!=want", diff)
+	}
+
+	// Reloading unchanged data keeps the versions.
+	a.Reload(ctx)
+	ann = &annotator.Annotations{}
+	rtx.Must(a.Annotate(id, ann), "Could not annotate")
+	if diff := deep.Equal(ann.DataVersions, want); diff != nil {
+		t.Error("Annotate() after Reload() wrong DataVersions; got!=want", diff)
+	}
+
+	// Versions are not reported unless enabled.
+	setUpTiny()
+	b := New(ctx, local4Rawfile, local6Rawfile, localASNamesfile, local)
+	ann = &annotator.Annotations{}
+	rtx.Must(b.Annotate(id, ann), "Could not annotate")
+	if ann.DataVersions != nil {
+		t.Errorf("Annotate() without WithDataVersions() = %+v, want nil", ann.DataVersions)
+	}
+}
+
+func Test_asnAnnotator_WithRouteViewDates(t *testing.T) {
+	dir := t.TempDir()
+	copyTo := func(src, name string) {
+		b, err := ioutil.ReadFile(src)
+		rtx.Must(err, "Could not read "+src)
+		rtx.Must(ioutil.WriteFile(dir+"/"+name, b, 0644), "Could not write "+name)
+	}
+	copyTo("../testdata/RouteViewIPv4.tiny.gz", "routeviews-rv2-20230102-1200.pfx2as.gz")
+	copyTo("../testdata/RouteViewIPv6.tiny.gz", "routeviews-rv6-20230103-1200.pfx2as.gz")
+	p4, err := dirprovider.New(dir, "routeviews-rv2-*.pfx2as.gz")
+	rtx.Must(err, "Could not create v4 provider")
+	p6, err := dirprovider.New(dir, "routeviews-rv6-*.pfx2as.gz")
+	rtx.Must(err, "Could not create v6 provider")
+	ctx := context.Background()
+	a := New(ctx, p4, p6, nil, nil, WithRouteViewDates())
+
+	check := func(ip, want string) {
+		t.Helper()
+		if got := a.AnnotateIP(ip); got.Missing || got.RouteViewDate != want {
+			t.Errorf("AnnotateIP(%s) = %+v, want RouteViewDate %q", ip, got, want)
+		}
+	}
+	check("1.0.0.1", "2023-01-02")
+	check("2001:4:112::1", "2023-01-03")
+
+	// A newer snapshot brings its date, and unchanged data keeps its date.
+	copyTo("../testdata/RouteViewIPv4.tiny.gz", "routeviews-rv2-20230109-1200.pfx2as.gz")
+	a.Reload(ctx)
+	check("1.0.0.1", "2023-01-09")
+	check("2001:4:112::1", "2023-01-03")
+
+	// Missing IPs have no date.
+	if got := a.AnnotateIP("9.0.0.9"); got.RouteViewDate != "" {
+		t.Errorf("AnnotateIP(missing) = %+v, want no RouteViewDate", got)
+	}
+
+	// Dates are not annotated unless enabled, or when the provider has no name.
+	setUpTiny()
+	b := New(ctx, local4Rawfile, local6Rawfile, nil, nil, WithRouteViewDates())
+	if got := b.AnnotateIP("1.0.0.1"); got.RouteViewDate != "" {
+		t.Errorf("AnnotateIP() without a named provider = %+v, want no RouteViewDate", got)
+	}
+	p4, err = dirprovider.New(dir, "routeviews-rv2-*.pfx2as.gz")
+	rtx.Must(err, "Could not create v4 provider")
+	c := NewIPv4(ctx, p4)
+	if got := c.AnnotateIP("1.0.0.1"); got.RouteViewDate != "" {
+		t.Errorf("AnnotateIP() without WithRouteViewDates() = %+v, want no RouteViewDate", got)
+	}
+}
+
+func Test_asnAnnotator_WithConeSizes(t *testing.T) {
+	setUpTiny()
+	u, err := url.Parse("file:../testdata/ppdc-ases.txt")
+	rtx.Must(err, "Could not parse URL")
+	conefile, err := content.FromURL(context.Background(), u)
+	rtx.Must(err, "Could not create content.Provider")
+
+	ctx := context.Background()
+	a := New(ctx, local4Rawfile, local6Rawfile, localASNamesfile, localIPs, WithConeSizes(conefile))
+	tests := []struct {
+		name string
+		addr string
+		want int64
+	}{
+		{
+			name: "ipv4",
+			addr: "2.125.160.216", // AS5607
+			want: 3,
+		},
+		{
+			name: "ipv6",
+			addr: "2001:200::1", // AS2500
+			want: 3,
+		},
+		{
+			name: "unknown-asn",
+			addr: "223.252.176.1",
+		},
+		{
+			name: "missing",
+			addr: "9.0.0.9",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := a.AnnotateIP(tt.addr)
+			if got.ConeSize != tt.want {
+				t.Errorf("AnnotateIP(%q).ConeSize = %d, want %d", tt.addr, got.ConeSize, tt.want)
+			}
+		})
+	}
+
+	// Reloading unchanged data should keep the cone sizes.
+	a.Reload(ctx)
+	if got := a.AnnotateIP("2.125.160.216"); got.ConeSize != 3 {
+		t.Errorf("AnnotateIP() after Reload() = %+v, want ConeSize 3", got)
+	}
+
+	// A failure to reload the cones should not change the live data.
+	a.(*asnAnnotator).conedata = badProvider{errors.New("fake cone error")}
+	a.Reload(ctx)
+	if err := a.Warm(ctx); err == nil {
+		t.Error("Warm() should fail when the customer cones can not be loaded")
+	}
+	if got := a.AnnotateIP("2.125.160.216"); got.ConeSize != 3 {
+		t.Errorf("AnnotateIP() after failed Reload() = %+v, want ConeSize 3", got)
+	}
+}
+
+func Test_asnAnnotator_WithOrganizations(t *testing.T) {
+	setUpTiny()
+	u, err := url.Parse("file:../testdata/as2org.txt")
+	rtx.Must(err, "Could not parse URL")
+	orgfile, err := content.FromURL(context.Background(), u)
+	rtx.Must(err, "Could not create content.Provider")
+
+	ctx := context.Background()
+	a := New(ctx, local4Rawfile, local6Rawfile, localASNamesfile, localIPs, WithOrganizations(orgfile))
+	tests := []struct {
+		name    string
+		addr    string
+		wantOrg string
+		wantID  string
+	}{
+		{
+			name:    "sky",
+			addr:    "2.125.160.216", // AS5607
+			wantOrg: "Sky UK Limited",
+			wantID:  "SKYUK-RIPE",
+		},
+		{
+			name:    "cloudflare",
+			addr:    "1.0.0.1", // AS13335
+			wantOrg: "Cloudflare, Inc.",
+			wantID:  "CLOUD14-ARIN",
+		},
+		{
+			name: "unknown-asn",
+			addr: "223.252.176.1",
+		},
+		{
+			name: "missing",
+			addr: "9.0.0.9",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := a.AnnotateIP(tt.addr)
+			if got.Organization != tt.wantOrg || got.OrgID != tt.wantID {
+				t.Errorf("AnnotateIP(%q) organization = %q, %q, want %q, %q", tt.addr, got.Organization, got.OrgID, tt.wantOrg, tt.wantID)
+			}
+		})
+	}
+
+	// A failure to reload the organizations should not change the live data.
+	a.(*asnAnnotator).orgdata = badProvider{errors.New("fake org error")}
+	a.Reload(ctx)
+	if err := a.Warm(ctx); err == nil {
+		t.Error("Warm() should fail when the organizations can not be loaded")
+	}
+	if got := a.AnnotateIP("2.125.160.216"); got.OrgID != "SKYUK-RIPE" {
+		t.Errorf("AnnotateIP() after failed Reload() = %+v, want OrgID SKYUK-RIPE", got)
+	}
+}
+
+// transitionV6 returns IPv6 RouteViews data with the 6to4 relay prefix.
+func transitionV6() content.Provider {
+	return &bytesProvider{data: gzipped("2001:200::\t32\t2500\n2002::\t16\t6939_1103_29432\n")}
+}
+
+func Test_asnAnnotator_WithTransitionAddresses(t *testing.T) {
+	setUpTiny()
+	ctx := context.Background()
+	a := New(ctx, local4Rawfile, transitionV6(), localASNamesfile, localIPs, WithTransitionAddresses())
+	tests := []struct {
+		name string
+		addr string
+		want annotator.Network
+	}{
+		{
+			name: "6to4",
+			addr: "2002:100:1::1", // Embeds 1.0.0.1
+			want: annotator.Network{
+				CIDR:              "1.0.0.0/24",
+				ASNumber:          13335,
+				ASName:            "Cloudflare, Inc.",
+				TransitionAddress: "6to4",
+				Systems: []annotator.System{
+					{ASNs: []uint32{13335}},
+				},
+			},
+		},
+		{
+			name: "teredo",
+			addr: "2001:0:4136:e378:8000:63bf:feff:fffe", // Embeds 1.0.0.1
+			want: annotator.Network{
+				CIDR:              "1.0.0.0/24",
+				ASNumber:          13335,
+				ASName:            "Cloudflare, Inc.",
+				TransitionAddress: "teredo",
+				Systems: []annotator.System{
+					{ASNs: []uint32{13335}},
+				},
+			},
+		},
+		{
+			// Falls back to the IPv6 data, which has the 6to4 relay prefix.
+			name: "embedded-ipv4-missing",
+			addr: "2002:900:9::1", // Embeds 9.0.0.9
+			want: annotator.Network{
+				CIDR:     "2002::/16",
+				ASNumber: 6939,
+				ASName:   "Hurricane Electric LLC",
+				Systems: []annotator.System{
+					{ASNs: []uint32{6939}}, {ASNs: []uint32{1103}}, {ASNs: []uint32{29432}},
+				},
+			},
+		},
+		{
+			name: "native-ipv6",
+			addr: "2001:200::1",
+			want: annotator.Network{
+				CIDR:     "2001:200::/32",
+				ASNumber: 2500,
+				ASName:   "WIDE Project",
+				Systems: []annotator.System{
+					{ASNs: []uint32{2500}},
+				},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := a.AnnotateIP(tt.addr)
+			if diff := deep.Equal(*got, tt.want); diff != nil {
+				t.Errorf("AnnotateIP(%q) = %+v, diff %v", tt.addr, got, diff)
+			}
+		})
+	}
+
+	// Without the option, the 6to4 address is only searched in the IPv6 data.
+	setUpTiny()
+	b := New(ctx, local4Rawfile, transitionV6(), localASNamesfile, localIPs)
+	if got := b.AnnotateIP("2002:100:1::1"); got.TransitionAddress != "" || got.ASNumber != 6939 {
+		t.Errorf("AnnotateIP() without WithTransitionAddresses() = %+v", got)
+	}
+}
+
+func Test_asnAnnotator_WithAllASNames(t *testing.T) {
+	setUpTiny()
+	ctx := context.Background()
+	extra1 := &bytesProvider{data: []byte("asn,name\nAS13335,CLOUDFLARENET\nAS2500,WIDE Project\n")}
+	extra2 := &bytesProvider{data: []byte("asn,name\nAS13335,\"Cloudflare, Inc.\"\nAS13335,Cloudflare\n")}
+	broken := badProvider{errors.New("an error for testing")}
+	a := New(ctx, local4Rawfile, local6Rawfile, localASNamesfile, localIPs, WithAllASNames(extra1, broken, extra2))
+
+	tests := []struct {
+		addr     string
+		wantName string
+		wantAll  []string
+	}{
+		{
+			// Duplicates across sources are dropped, and later rows of one
+			// source replace earlier ones, as with the AS names data.
+			addr:     "1.0.0.1",
+			wantName: "Cloudflare, Inc.",
+			wantAll:  []string{"Cloudflare, Inc.", "CLOUDFLARENET", "Cloudflare"},
+		},
+		{
+			addr:     "2001:200::1",
+			wantName: "WIDE Project",
+			wantAll:  []string{"WIDE Project"},
+		},
+	}
+	check := func(a ASNAnnotator) {
+		for _, tt := range tests {
+			got := a.AnnotateIP(tt.addr)
+			if got.ASName != tt.wantName {
+				t.Errorf("AnnotateIP(%q).ASName = %q, want %q", tt.addr, got.ASName, tt.wantName)
+			}
+			if diff := deep.Equal(got.ASNameAll, tt.wantAll); diff != nil {
+				t.Errorf("AnnotateIP(%q).ASNameAll = %q, diff %v", tt.addr, got.ASNameAll, diff)
+			}
+		}
+	}
+	check(a)
+
+	// Unchanged sources keep their names after a reload.
+	a.Reload(ctx)
+	check(a)
+
+	// Without the option, only the primary name is annotated.
+	setUpTiny()
+	b := New(ctx, local4Rawfile, local6Rawfile, localASNamesfile, localIPs)
+	if got := b.AnnotateIP("1.0.0.1"); got.ASName != "Cloudflare, Inc." || got.ASNameAll != nil {
+		t.Errorf("AnnotateIP() without WithAllASNames() = %+v", got)
+	}
+}
+
+func Test_asnAnnotator_ASDomainAndType(t *testing.T) {
+	setUpTiny()
+	ctx := context.Background()
+	names := &bytesProvider{data: []byte("asn,name,country,domain,type\nAS13335,\"Cloudflare, Inc.\",US,cloudflare.com,hosting\n")}
+	a := New(ctx, local4Rawfile, local6Rawfile, names, localIPs)
+	want := &annotator.Network{ASName: "Cloudflare, Inc.", ASDomain: "cloudflare.com", ASType: "hosting"}
+	got := a.AnnotateIP("1.0.0.1")
+	if diff := deep.Equal(&annotator.Network{ASName: got.ASName, ASDomain: got.ASDomain, ASType: got.ASType}, want); diff != nil {
+		t.Errorf("AnnotateIP() with domains and types = %+v, diff %v", got, diff)
+	}
+
+	// The AS names data in the repo has neither column.
+	setUpTiny()
+	b := New(ctx, local4Rawfile, local6Rawfile, localASNamesfile, localIPs)
+	if got := b.AnnotateIP("1.0.0.1"); got.ASName != "Cloudflare, Inc." || got.ASDomain != "" || got.ASType != "" {
+		t.Errorf("AnnotateIP() without domains and types = %+v", got)
+	}
+}
+
+// gzipped returns the gzip compressed data, like that of a RouteViews file.
+func gzipped(data string) []byte {
+	buf := &bytes.Buffer{}
+	w := gzip.NewWriter(buf)
+	_, err := w.Write([]byte(data))
+	rtx.Must(err, "Could not write gzipped data")
+	rtx.Must(w.Close(), "Could not close gzip writer")
+	return buf.Bytes()
+}
+
+func Test_asnAnnotator_WithUnnamedPlaceholder(t *testing.T) {
+	routeviews := gzipped("1.0.0.0\t24\t13335\n1.0.4.0\t22\t56203\n1.0.8.0\t24\t0\n")
+	names := []byte("asn,name\nAS13335,\"Cloudflare, Inc.\"\n")
+
+	tests := []struct {
+		name        string
+		addr        string
+		placeholder string
+		want        annotator.Network
+	}{
+		{
+			name:        "named",
+			addr:        "1.0.0.1",
+			placeholder: "unknown",
+			want:        annotator.Network{ASNumber: 13335, ASName: "Cloudflare, Inc."},
+		},
+		{
+			name:        "unnamed",
+			addr:        "1.0.4.1",
+			placeholder: "unknown",
+			want:        annotator.Network{ASNumber: 56203, ASName: "unknown"},
+		},
+		{
+			name:        "as0",
+			addr:        "1.0.8.1",
+			placeholder: "unknown",
+			want:        annotator.Network{ASNumber: 0, ASName: "unknown"},
+		},
+		{
+			name:        "missing",
+			addr:        "9.0.0.9",
+			placeholder: "unknown",
+			want:        annotator.Network{Missing: true},
+		},
+		{
+			name: "unnamed-without-placeholder",
+			addr: "1.0.4.1",
+			want: annotator.Network{ASNumber: 56203},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setUpTiny()
+			opts := []Option{}
+			if tt.placeholder != "" {
+				opts = append(opts, WithUnnamedPlaceholder(tt.placeholder))
+			}
+			a := New(context.Background(), &bytesProvider{data: routeviews}, local6Rawfile, &bytesProvider{data: names}, localIPs, opts...)
+			got := a.AnnotateIP(tt.addr)
+			if diff := deep.Equal(annotator.Network{ASNumber: got.ASNumber, ASName: got.ASName, Missing: got.Missing}, tt.want); diff != nil {
+				t.Errorf("AnnotateIP(%q) = %+v, diff %v", tt.addr, got, diff)
+			}
+		})
+	}
+}
+
+func Test_asnAnnotator_WithMaxMindASN(t *testing.T) {
+	mmdb, err := ioutil.ReadFile("../testdata/GeoLite2-ASN-Test.mmdb")
+	rtx.Must(err, "Could not read MaxMind ASN db")
+	tests := []struct {
+		name string
+		addr string
+		want *annotator.Network
+	}{
+		{
+			name: "routeviews-hit", // The MaxMind data has AS64499 for 1.0.0.0/24.
+			addr: "1.0.0.1",
+			want: &annotator.Network{
+				CIDR:     "1.0.0.0/24",
+				ASNumber: 13335,
+				ASName:   "Cloudflare, Inc.",
+				Systems:  []annotator.System{{ASNs: []uint32{13335}}},
+			},
+		},
+		{
+			name: "maxmind-hit-ipv4",
+			addr: "9.1.2.3",
+			want: &annotator.Network{
+				ASNumber:     64496,
+				ASName:       "Example Networks",
+				ASNameSource: "maxmind",
+				Systems:      []annotator.System{{ASNs: []uint32{64496}}},
+			},
+		},
+		{
+			name: "maxmind-hit-ipv6",
+			addr: "2001:2::1",
+			want: &annotator.Network{
+				ASNumber:     64500,
+				ASName:       "Example Networks v6",
+				ASNameSource: "maxmind",
+				Systems:      []annotator.System{{ASNs: []uint32{64500}}},
+			},
+		},
+		{
+			name: "both-miss",
+			addr: "9.0.0.9",
+			want: &annotator.Network{Missing: true},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setUpTiny()
+			mm := &bytesProvider{data: mmdb}
+			a := New(context.Background(), local4Rawfile, local6Rawfile, localASNamesfile, localIPs, WithMaxMindASN(mm))
+			before := testutil.ToFloat64(metrics.ASNSearches.WithLabelValues("maxmind-success"))
+			got := a.AnnotateIP(tt.addr)
+			if diff := deep.Equal(got, tt.want); diff != nil {
+				t.Errorf("AnnotateIP(%q) = %+v, diff %v", tt.addr, got, diff)
+			}
+			hits := testutil.ToFloat64(metrics.ASNSearches.WithLabelValues("maxmind-success")) - before
+			want := 0.0
+			if tt.want.ASNameSource == "maxmind" {
+				want = 1
+			}
+			if hits != want {
+				t.Errorf("AnnotateIP(%q) counted %v MaxMind hits, want %v", tt.addr, hits, want)
+			}
+		})
+	}
+
+	// MaxMind distributes the database in a .tar.gz.
+	buf := &bytes.Buffer{}
+	gz := gzip.NewWriter(buf)
+	tw := tar.NewWriter(gz)
+	rtx.Must(tw.WriteHeader(&tar.Header{Name: "GeoLite2-ASN_20230103/GeoLite2-ASN.mmdb", Mode: 0644, Size: int64(len(mmdb))}), "Could not write tar header")
+	_, err = tw.Write(mmdb)
+	rtx.Must(err, "Could not write tar file")
+	rtx.Must(tw.Close(), "Could not close tar writer")
+	rtx.Must(gz.Close(), "Could not close gzip writer")
+	r, err := loadMaxMindASN(context.Background(), &bytesProvider{data: buf.Bytes()}, nil)
+	rtx.Must(err, "Could not load MaxMind ASN db from a .tar.gz")
+	if _, err := loadMaxMindASN(context.Background(), &bytesProvider{}, r); err != nil {
+		t.Errorf("loadMaxMindASN() without changes = %v, want nil", err)
+	}
+	if _, err := loadMaxMindASN(context.Background(), badProvider{errors.New("bad")}, r); err == nil {
+		t.Error("loadMaxMindASN() with a bad provider should return an error")
+	}
+	if _, err := loadMaxMindASN(context.Background(), &bytesProvider{data: []byte("not an mmdb")}, nil); err == nil {
+		t.Error("loadMaxMindASN() with corrupt data should return an error")
+	}
+}
+
+func Test_asnAnnotator_WithCache(t *testing.T) {
+	setUpTiny()
+	ctx := context.Background()
+	p4 := &bytesProvider{data: gzipped("1.0.0.0\t24\t13335\n")}
+	a := New(ctx, p4, local6Rawfile, nil, localIPs, WithCache(10))
+	hit := metrics.ASNCacheLookups.WithLabelValues("hit")
+	searches := metrics.ASNSearches.WithLabelValues("ipv4-success")
+
+	first := a.AnnotateIP("1.0.0.1")
+	hits, searched := testutil.ToFloat64(hit), testutil.ToFloat64(searches)
+	// Changes to an annotation do not change the cached one.
+	first.Systems[0].ASNs[0] = 1
+	second := a.AnnotateIP("1.0.0.1")
+	if second.ASNumber != 13335 || second.Systems[0].ASNs[0] != 13335 {
+		t.Errorf("AnnotateIP() from the cache = %+v, want AS13335", second)
+	}
+	if testutil.ToFloat64(hit) != hits+1 || testutil.ToFloat64(searches) != searched {
+		t.Error("AnnotateIP() of a cached IP should be a cache hit, not a search")
+	}
+
+	// The cache is emptied when the data is reloaded.
+	p4.data = gzipped("1.0.0.0\t24\t64496\n")
+	a.Reload(ctx)
+	if got := a.AnnotateIP("1.0.0.1"); got.ASNumber != 64496 {
+		t.Errorf("AnnotateIP() after Reload = %+v, want AS64496", got)
+	}
+	p4.data = gzipped("1.0.0.0\t24\t64497\n")
+	rtx.Must(a.(*asnAnnotator).Warm(ctx), "Could not warm the annotator")
+	if got := a.AnnotateIP("1.0.0.1"); got.ASNumber != 64496 {
+		t.Errorf("AnnotateIP() after Warm = %+v, want AS64496", got)
+	}
+	a.(*asnAnnotator).Commit()
+	if got := a.AnnotateIP("1.0.0.1"); got.ASNumber != 64497 {
+		t.Errorf("AnnotateIP() after Commit = %+v, want AS64497", got)
+	}
+
+	// A size of zero disables the cache.
+	setUpTiny()
+	b := New(ctx, local4Rawfile, local6Rawfile, nil, localIPs, WithCache(0))
+	if b.(*asnAnnotator).cache != nil {
+		t.Error("WithCache(0) should not create a cache")
+	}
+}
+
+// BenchmarkAnnotateIP compares annotating the same few IPs repeatedly, as on a
+// busy node, with and without the cache.
+func BenchmarkAnnotateIP(b *testing.B) {
+	ips := []string{"1.0.0.1", "1.0.4.1", "12.81.90.1", "2001:4:112::1", "9.0.0.9"}
+	for _, bb := range []struct {
+		name string
+		opts []Option
+	}{
+		{name: "uncached"},
+		{name: "cached", opts: []Option{WithCache(100)}},
+	} {
+		b.Run(bb.name, func(b *testing.B) {
+			setUp()
+			a := New(context.Background(), local4Rawfile, local6Rawfile, localASNamesfile, localIPs, bb.opts...)
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				a.AnnotateIP(ips[i%len(ips)])
+			}
+		})
+	}
+}
+
+func Test_asnAnnotator_Visibility(t *testing.T) {
+	setUpTiny()
+	u, err := url.Parse("file:../testdata/RouteViewVisibility.pfx2as.gz")
+	rtx.Must(err, "Could not parse URL")
+	ctx := context.Background()
+	mixed, err := content.FromURL(ctx, u)
+	rtx.Must(err, "Could not create content.Provider")
+	a := New(ctx, mixed, local6Rawfile, localASNamesfile, localIPs)
+	if got := a.AnnotateIP("1.0.0.1"); got.Visibility != 42 {
+		t.Errorf("AnnotateIP(1.0.0.1).Visibility = %d, want 42", got.Visibility)
+	}
+	// The IPv6 data has no visibility column.
+	if got := a.AnnotateIP("2001:200::1"); got.ASNumber != 2500 || got.Visibility != 0 {
+		t.Errorf("AnnotateIP(2001:200::1) = %+v, want AS2500 without Visibility", got)
+	}
+}
+
+// sampleCount returns the number of observations of the histogram.
+func sampleCount(o prometheus.Observer) uint64 {
+	m := &dto.Metric{}
+	rtx.Must(o.(prometheus.Metric).Write(m), "Could not read histogram")
+	return m.GetHistogram().GetSampleCount()
+}
+
+func Test_asnAnnotator_WithPrefixLengthMetrics(t *testing.T) {
+	setUpTiny()
+	ctx := context.Background()
+	v4 := metrics.ASNPrefixLengths.WithLabelValues("ipv4")
+	v6 := metrics.ASNPrefixLengths.WithLabelValues("ipv6")
+
+	// Without the option, nothing is observed.
+	b := New(ctx, local4Rawfile, local6Rawfile, localASNamesfile, localIPs)
+	before4, before6 := sampleCount(v4), sampleCount(v6)
+	b.AnnotateIP("1.0.0.1")
+	if sampleCount(v4) != before4 {
+		t.Error("AnnotateIP() without WithPrefixLengthMetrics() observed a prefix length")
+	}
+
+	setUpTiny()
+	a := New(ctx, local4Rawfile, local6Rawfile, localASNamesfile, localIPs, WithPrefixLengthMetrics())
+	for _, ip := range []string{"1.0.0.1", "2.125.160.216", "2001:200::1", "9.0.0.9"} {
+		a.AnnotateIP(ip)
+	}
+	if got := sampleCount(v4) - before4; got != 2 {
+		t.Errorf("ipv4 prefix lengths observed = %d, want 2", got)
+	}
+	if got := sampleCount(v6) - before6; got != 1 {
+		t.Errorf("ipv6 prefix lengths observed = %d, want 1", got)
+	}
+}
+
+// slowProvider is a slow download, that records whether the other downloads
+// in its group started before it finished.
+type slowProvider struct {
+	p       content.Provider
+	started *int32
+	group   int32
+	overlap *int32
+}
+
+func (s *slowProvider) Get(ctx context.Context) ([]byte, error) {
+	atomic.AddInt32(s.started, 1)
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		if atomic.LoadInt32(s.started) >= s.group {
+			atomic.AddInt32(s.overlap, 1)
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	return s.p.Get(ctx)
+}
+
+func Test_New_concurrentLoads(t *testing.T) {
+	setUpTiny()
+	var started, overlap int32
+	slow := func(p content.Provider) content.Provider {
+		return &slowProvider{p: p, started: &started, group: 3, overlap: &overlap}
+	}
+	ctx := context.Background()
+	a := New(ctx, slow(local4Rawfile), slow(local6Rawfile), slow(localASNamesfile), localIPs)
+	if overlap != 3 {
+		t.Errorf("New() ran %d of 3 loads concurrently with the others", overlap)
+	}
+	if got := a.AnnotateIP("2001:200::1"); got.ASName != "WIDE Project" {
+		t.Errorf("AnnotateIP() = %+v, want WIDE Project", got)
+	}
+
+	// Reload loads concurrently too.
+	started, overlap = 0, 0
+	a.Reload(ctx)
+	if overlap != 3 {
+		t.Errorf("Reload() ran %d of 3 loads concurrently with the others", overlap)
+	}
+}
+
+// countingProvider counts the calls to Get of the provider it wraps.
+type countingProvider struct {
+	p     content.Provider
+	calls int
+}
+
+func (c *countingProvider) Get(ctx context.Context) ([]byte, error) {
+	c.calls++
+	return c.p.Get(ctx)
+}
+
+func Test_asnAnnotator_ReloadNames(t *testing.T) {
+	ctx := context.Background()
+	as4 := &countingProvider{p: &bytesProvider{data: gzipped("1.0.0.0\t24\t13335\n")}}
+	as6 := &countingProvider{p: &bytesProvider{data: gzipped("2001:200::\t32\t2500\n")}}
+	names := &countingProvider{p: &bytesProvider{data: []byte("asn,name\nAS13335,Cloudflare\n")}}
+	extra := &countingProvider{p: &bytesProvider{data: []byte("asn,name\nAS13335,CLOUDFLARENET\n")}}
+	a := New(ctx, as4, as6, names, localIPs, WithAllASNames(extra))
+	if as4.calls != 1 || as6.calls != 1 || names.calls != 1 || extra.calls != 1 {
+		t.Fatalf("New() read RouteViews %d and %d times and the names %d and %d times, want once each",
+			as4.calls, as6.calls, names.calls, extra.calls)
+	}
+	r, ok := a.(SplitReloader)
+	if !ok {
+		t.Fatal("New() did not return a SplitReloader")
+	}
+
+	names.p.(*bytesProvider).data = []byte("asn,name\nAS13335,\"Cloudflare, Inc.\"\n")
+	extra.p.(*bytesProvider).data = []byte("asn,name\nAS13335,CLOUDFLARE\n")
+	r.ReloadNames(ctx)
+	if as4.calls != 1 || as6.calls != 1 {
+		t.Errorf("ReloadNames() read RouteViews %d and %d times, want no reads", as4.calls-1, as6.calls-1)
+	}
+	if names.calls != 2 || extra.calls != 2 {
+		t.Errorf("ReloadNames() read the names %d and %d times, want once each", names.calls-1, extra.calls-1)
+	}
+	want := &annotator.Network{
+		CIDR:      "1.0.0.0/24",
+		ASNumber:  13335,
+		ASName:    "Cloudflare, Inc.",
+		ASNameAll: []string{"Cloudflare, Inc.", "CLOUDFLARE"},
+		Systems:   []annotator.System{{ASNs: []uint32{13335}}},
+	}
+	if diff := deep.Equal(a.AnnotateIP("1.0.0.1"), want); diff != nil {
+		t.Errorf("AnnotateIP() after ReloadNames() differs: %v", diff)
+	}
+
+	// ReloadPrefixes checks RouteViews but leaves the names alone.
+	names.p.(*bytesProvider).data = []byte("asn,name\nAS13335,Not Cloudflare\n")
+	r.ReloadPrefixes(ctx)
+	if as4.calls != 2 || as6.calls != 2 {
+		t.Errorf("ReloadPrefixes() read RouteViews %d and %d times, want once each", as4.calls-1, as6.calls-1)
+	}
+	if got := a.ASName(13335); got != "Cloudflare, Inc." {
+		t.Errorf("ASName() after ReloadPrefixes() = %q, want %q", got, "Cloudflare, Inc.")
+	}
+	if names.calls != 2 || extra.calls != 2 {
+		t.Errorf("ReloadPrefixes() read the names %d and %d times, want no reads", names.calls-2, extra.calls-2)
+	}
+}
+
+func Test_asnAnnotator_ForceReload(t *testing.T) {
+	ctx := context.Background()
+	as4 := &countingProvider{p: &bytesProvider{data: gzipped("1.0.0.0\t24\t13335\n")}}
+	as6 := &countingProvider{p: &bytesProvider{data: gzipped("2001:200::\t32\t2500\n")}}
+	names := &countingProvider{p: &bytesProvider{data: []byte("asn,name\nAS13335,Cloudflare\n")}}
+	a := New(ctx, as4, as6, names, localIPs)
+	r := a.(SplitReloader)
+	a.(annotator.ReloadLimiter).SetMinReloadInterval(time.Hour)
+	r.ReloadPrefixes(ctx)
+	r.ReloadNames(ctx)
+	// The first reloads run, and the next ones are skipped until forced.
+	r.ReloadPrefixes(ctx)
+	r.ReloadNames(ctx)
+	if as4.calls != 2 || names.calls != 2 {
+		t.Fatalf("Reloads read RouteViews %d times and the names %d times, want once each", as4.calls-1, names.calls-1)
+	}
+	a.(annotator.ReloadForcer).ForceReload()
+	r.ReloadPrefixes(ctx)
+	r.ReloadNames(ctx)
+	if as4.calls != 3 || names.calls != 3 {
+		t.Errorf("Forced reloads read RouteViews %d times and the names %d times, want once each", as4.calls-2, names.calls-2)
+	}
+}
+
+func Test_asnAnnotator_ReloadMetrics(t *testing.T) {
+	ctx := context.Background()
+	names := &bytesProvider{data: []byte("asn,name\nAS13335,Cloudflare\n")}
+	a := New(ctx, &bytesProvider{data: gzipped("1.0.0.0\t24\t13335\n")}, &bytesProvider{data: gzipped("2001:200::\t32\t2500\n")}, names, localIPs).(*asnAnnotator)
+	reloads := metrics.ReloadDuration.WithLabelValues("asn")
+	nameReloads := metrics.ReloadDuration.WithLabelValues("asname")
+
+	// A successful reload resets the age, even if nothing changed.
+	time.Sleep(50 * time.Millisecond)
+	age := testutil.ToFloat64(metrics.ASNDatasetAge)
+	if age < 0.05 {
+		t.Fatalf("ASNDatasetAge = %v 50ms after New(), want at least 0.05", age)
+	}
+	before := sampleCount(reloads)
+	a.Reload(ctx)
+	if got := testutil.ToFloat64(metrics.ASNDatasetAge); got >= age {
+		t.Errorf("ASNDatasetAge = %v after Reload(), want less than %v", got, age)
+	}
+	if got := sampleCount(reloads) - before; got != 1 {
+		t.Errorf("Reload() observed %d durations, want 1", got)
+	}
+
+	// A failed reload is timed, but leaves the age growing.
+	a.as4 = badProvider{errors.New("an error for testing")}
+	time.Sleep(50 * time.Millisecond)
+	before = sampleCount(reloads)
+	a.Reload(ctx)
+	if got := testutil.ToFloat64(metrics.ASNDatasetAge); got < 0.05 {
+		t.Errorf("ASNDatasetAge = %v after a failed Reload(), want at least 0.05", got)
+	}
+	if got := sampleCount(reloads) - before; got != 1 {
+		t.Errorf("failed Reload() observed %d durations, want 1", got)
+	}
+
+	// The names have their own age, reset by ReloadNames.
+	age = testutil.ToFloat64(metrics.ASNameDatasetAge)
+	before = sampleCount(nameReloads)
+	a.ReloadNames(ctx)
+	if got := testutil.ToFloat64(metrics.ASNameDatasetAge); got >= age {
+		t.Errorf("ASNameDatasetAge = %v after ReloadNames(), want less than %v", got, age)
+	}
+	if got := sampleCount(nameReloads) - before; got != 1 {
+		t.Errorf("ReloadNames() observed %d durations, want 1", got)
+	}
+}
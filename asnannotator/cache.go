@@ -0,0 +1,84 @@
+package asnannotator
+
+import (
+	"container/list"
+	"sync"
+
+	"github.com/m-lab/uuid-annotator/annotator"
+	"github.com/m-lab/uuid-annotator/metrics"
+)
+
+// networkCache remembers the Networks of a bounded number of recently
+// annotated IPs. Once full, the least recently used IP is forgotten for every
+// new one. It holds copies, so callers may modify the Networks they add or get.
+type networkCache struct {
+	mu    sync.Mutex
+	size  int
+	items map[string]*list.Element
+	order *list.List // Of *cacheEntry, most recently used first.
+}
+
+type cacheEntry struct {
+	ip  string
+	ann *annotator.Network
+}
+
+func newNetworkCache(size int) *networkCache {
+	return &networkCache{
+		size:  size,
+		items: make(map[string]*list.Element, size),
+		order: list.New(),
+	}
+}
+
+// get returns a copy of the Network of the IP, if it is in the cache.
+func (c *networkCache) get(ip string) (*annotator.Network, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.items[ip]
+	if !ok {
+		metrics.ASNCacheLookups.WithLabelValues("miss").Inc()
+		return nil, false
+	}
+	metrics.ASNCacheLookups.WithLabelValues("hit").Inc()
+	c.order.MoveToFront(e)
+	return cloneNetwork(e.Value.(*cacheEntry).ann), true
+}
+
+// add remembers a copy of the Network of the IP.
+func (c *networkCache) add(ip string, ann *annotator.Network) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.items[ip]; ok {
+		e.Value.(*cacheEntry).ann = cloneNetwork(ann)
+		c.order.MoveToFront(e)
+		return
+	}
+	if c.order.Len() >= c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.items, oldest.Value.(*cacheEntry).ip)
+	}
+	c.items[ip] = c.order.PushFront(&cacheEntry{ip: ip, ann: cloneNetwork(ann)})
+}
+
+// clear forgets every IP, e.g. once the data they were found in is replaced.
+func (c *networkCache) clear() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.items = make(map[string]*list.Element, c.size)
+	c.order.Init()
+}
+
+// cloneNetwork returns a copy of the Network that shares no slices with it.
+func cloneNetwork(n *annotator.Network) *annotator.Network {
+	c := *n
+	c.ASNameAll = append([]string(nil), n.ASNameAll...)
+	if n.Systems != nil {
+		c.Systems = make([]annotator.System, len(n.Systems))
+		for i, s := range n.Systems {
+			c.Systems[i].ASNs = append([]uint32(nil), s.ASNs...)
+		}
+	}
+	return &c
+}
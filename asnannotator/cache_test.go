@@ -0,0 +1,74 @@
+package asnannotator
+
+import (
+	"testing"
+
+	"github.com/go-test/deep"
+	"github.com/m-lab/uuid-annotator/annotator"
+	"github.com/m-lab/uuid-annotator/metrics"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func Test_networkCache(t *testing.T) {
+	c := newNetworkCache(2)
+	n1 := &annotator.Network{ASNumber: 1, Systems: []annotator.System{{ASNs: []uint32{1, 2}}}, ASNameAll: []string{"one"}}
+	c.add("1.0.0.1", n1)
+	c.add("2.0.0.1", &annotator.Network{ASNumber: 2})
+
+	// Using 1.0.0.1 makes 2.0.0.1 the least recently used.
+	hits := testutil.ToFloat64(metrics.ASNCacheLookups.WithLabelValues("hit"))
+	got, ok := c.get("1.0.0.1")
+	if !ok {
+		t.Fatal("get(1.0.0.1) missed")
+	}
+	if diff := deep.Equal(got, n1); diff != nil {
+		t.Errorf("get(1.0.0.1) = %+v, diff %v", got, diff)
+	}
+	if testutil.ToFloat64(metrics.ASNCacheLookups.WithLabelValues("hit")) != hits+1 {
+		t.Error("get(1.0.0.1) was not counted as a hit")
+	}
+	c.add("3.0.0.1", &annotator.Network{ASNumber: 3})
+	if _, ok := c.get("2.0.0.1"); ok {
+		t.Error("get(2.0.0.1) should miss once it is evicted")
+	}
+	if _, ok := c.get("3.0.0.1"); !ok {
+		t.Error("get(3.0.0.1) missed")
+	}
+
+	// Networks are copied in and out of the cache.
+	n1.Systems[0].ASNs[0] = 99
+	got.ASNameAll[0] = "changed"
+	got.Systems[0].ASNs[1] = 99
+	again, _ := c.get("1.0.0.1")
+	want := &annotator.Network{ASNumber: 1, Systems: []annotator.System{{ASNs: []uint32{1, 2}}}, ASNameAll: []string{"one"}}
+	if diff := deep.Equal(again, want); diff != nil {
+		t.Errorf("get(1.0.0.1) after changes = %+v, diff %v", again, diff)
+	}
+
+	// Adding an IP again replaces its Network.
+	c.add("1.0.0.1", &annotator.Network{Missing: true})
+	if got, _ := c.get("1.0.0.1"); !got.Missing {
+		t.Errorf("get(1.0.0.1) after add = %+v, want Missing", got)
+	}
+
+	c.clear()
+	if _, ok := c.get("1.0.0.1"); ok {
+		t.Error("get(1.0.0.1) should miss after clear")
+	}
+	c.add("1.0.0.1", n1)
+	if _, ok := c.get("1.0.0.1"); !ok {
+		t.Error("get(1.0.0.1) missed after clear and add")
+	}
+}
+
+func Test_cloneNetwork(t *testing.T) {
+	for _, n := range []*annotator.Network{
+		{},
+		{Missing: true},
+		{CIDR: "1.0.0.0/24", ASNumber: 13335, ASNameAll: []string{"a", "b"}, Systems: []annotator.System{{ASNs: []uint32{13335}}, {ASNs: []uint32{1, 2}}}},
+	} {
+		if diff := deep.Equal(cloneNetwork(n), n); diff != nil {
+			t.Errorf("cloneNetwork(%+v) differs: %v", n, diff)
+		}
+	}
+}
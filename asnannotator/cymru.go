@@ -0,0 +1,130 @@
+package asnannotator
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/sync/singleflight"
+)
+
+// ErrNoName is returned by a NameResolver that has no name for an AS.
+var ErrNoName = errors.New("no AS name found")
+
+// NameResolver looks up AS names from a secondary source, for AS numbers that
+// are missing from the AS names data.
+type NameResolver interface {
+	LookupASName(ctx context.Context, asn uint32) (string, error)
+}
+
+// cymruResolver looks up AS names in the TXT records of asn.cymru.com. See:
+// https://www.team-cymru.com/ip-asn-mapping
+type cymruResolver struct {
+	lookupTXT func(ctx context.Context, name string) ([]string, error)
+}
+
+// NewCymruResolver returns a NameResolver that uses the Team Cymru DNS service.
+func NewCymruResolver() NameResolver {
+	return &cymruResolver{
+		lookupTXT: net.DefaultResolver.LookupTXT,
+	}
+}
+
+// LookupASName returns the name from a record like
+// "23028 | US | arin | 2002-01-04 | TEAMCYMRU - SAUNET, ZA".
+func (c *cymruResolver) LookupASName(ctx context.Context, asn uint32) (string, error) {
+	records, err := c.lookupTXT(ctx, fmt.Sprintf("AS%d.asn.cymru.com", asn))
+	if err != nil {
+		return "", err
+	}
+	for _, r := range records {
+		fields := strings.Split(r, "|")
+		if len(fields) < 5 {
+			continue
+		}
+		if name := strings.TrimSpace(fields[len(fields)-1]); name != "" {
+			return name, nil
+		}
+	}
+	return "", ErrNoName
+}
+
+// failureTTL is how long a failed lookup is remembered before the AS is looked
+// up again.
+const failureTTL = 5 * time.Minute
+
+// cachedResolver bounds the time spent on each lookup of a NameResolver, and
+// remembers the names found until restart, and failures for failureTTL, so
+// that each AS is rarely looked up. Concurrent lookups of the same AS share
+// one query.
+type cachedResolver struct {
+	r          NameResolver
+	timeout    time.Duration
+	failureTTL time.Duration
+	group      singleflight.Group
+	mu         sync.Mutex
+	names      map[uint32]string
+	failed     map[uint32]time.Time // When each failure expires.
+}
+
+func newCachedResolver(r NameResolver, timeout time.Duration) *cachedResolver {
+	return &cachedResolver{
+		r:          r,
+		timeout:    timeout,
+		failureTTL: failureTTL,
+		names:      map[uint32]string{},
+		failed:     map[uint32]time.Time{},
+	}
+}
+
+// cached returns the name of the AS, or the empty string after a recent
+// failure, and false if the AS has to be looked up. It never waits for a
+// lookup.
+func (c *cachedResolver) cached(asn uint32) (string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if name, ok := c.names[asn]; ok {
+		return name, true
+	}
+	if expiry, ok := c.failed[asn]; ok {
+		if time.Now().Before(expiry) {
+			return "", true
+		}
+		delete(c.failed, asn)
+	}
+	return "", false
+}
+
+// lookup returns the name of the AS, or the empty string if it has none,
+// spending at most the timeout of the resolver unless ctx ends sooner.
+func (c *cachedResolver) lookup(ctx context.Context, asn uint32) string {
+	if name, ok := c.cached(asn); ok {
+		return name
+	}
+	v, _, _ := c.group.Do(strconv.FormatUint(uint64(asn), 10), func() (interface{}, error) {
+		lctx, cancel := context.WithTimeout(ctx, c.timeout)
+		defer cancel()
+		name, err := c.r.LookupASName(lctx, asn)
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		switch {
+		case err == nil:
+			c.names[asn] = name
+			delete(c.failed, asn)
+		case ctx.Err() == nil:
+			// Only failures of the lookup itself are remembered, not the
+			// end of the caller's context.
+			c.failed[asn] = time.Now().Add(c.failureTTL)
+		}
+		if err != nil {
+			return "", nil
+		}
+		return name, nil
+	})
+	return v.(string)
+}
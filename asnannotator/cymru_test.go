@@ -0,0 +1,249 @@
+package asnannotator
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/m-lab/go/content"
+	"github.com/m-lab/uuid-annotator/annotator"
+)
+
+// fakeResolver names a single AS and counts its lookups.
+type fakeResolver struct {
+	asn     uint32
+	name    string
+	lookups int64
+}
+
+func (f *fakeResolver) LookupASName(ctx context.Context, asn uint32) (string, error) {
+	atomic.AddInt64(&f.lookups, 1)
+	if asn != f.asn {
+		return "", ErrNoName
+	}
+	return f.name, nil
+}
+
+// blockingResolver waits for its context to expire.
+type blockingResolver struct{}
+
+func (blockingResolver) LookupASName(ctx context.Context, asn uint32) (string, error) {
+	<-ctx.Done()
+	return "", ctx.Err()
+}
+
+func Test_cymruResolver_LookupASName(t *testing.T) {
+	tests := []struct {
+		name    string
+		records []string
+		err     error
+		want    string
+		wantErr bool
+	}{
+		{
+			name:    "success",
+			records: []string{"23028 | US | arin | 2002-01-04 | TEAMCYMRU - SAUNET, ZA"},
+			want:    "TEAMCYMRU - SAUNET, ZA",
+		},
+		{
+			name:    "skips-malformed-records",
+			records: []string{"garbage", "5607 | GB | ripencc | 1995-08-04 | SKYUK-AS, GB"},
+			want:    "SKYUK-AS, GB",
+		},
+		{
+			name:    "error-no-name",
+			records: []string{"5607 | GB | ripencc | 1995-08-04 | "},
+			wantErr: true,
+		},
+		{
+			name:    "error-lookup",
+			err:     errors.New("fake dns error"),
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var query string
+			c := &cymruResolver{
+				lookupTXT: func(ctx context.Context, name string) ([]string, error) {
+					query = name
+					return tt.records, tt.err
+				},
+			}
+			got, err := c.LookupASName(context.Background(), 23028)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("LookupASName() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("LookupASName() = %q, want %q", got, tt.want)
+			}
+			if query != "AS23028.asn.cymru.com" {
+				t.Errorf("LookupASName() queried %q", query)
+			}
+		})
+	}
+}
+
+// resolverRouteViews returns RouteViews data for AS 13335, which is in the AS
+// names file, and AS 10060, which is not.
+func resolverRouteViews() (content.Provider, content.Provider) {
+	return &bytesProvider{data: gzipped("1.0.0.0\t24\t13335\n128.134.108.0\t24\t10060\n")},
+		&bytesProvider{data: gzipped("2001:200::\t32\t2500\n")}
+}
+
+func Test_asnAnnotator_WithNameResolver(t *testing.T) {
+	setUp()
+	ctx := context.Background()
+	// AS 10060 is not in the AS names file.
+	r := &fakeResolver{asn: 10060, name: "DACOM-BORANET-AS-KR, KR"}
+	v4, v6 := resolverRouteViews()
+	a := New(ctx, v4, v6, localASNamesfile, localIPs, WithNameResolver(r, time.Second))
+
+	got := a.AnnotateIP("128.134.108.1")
+	if got.ASNumber != 10060 || got.ASName != r.name || got.ASNameSource != "cymru" {
+		t.Errorf("AnnotateIP() = %+v, want the name from the resolver", got)
+	}
+	got = a.AnnotateIP("1.0.0.1")
+	if got.ASName != "Cloudflare, Inc." || got.ASNameSource != "ipinfo" {
+		t.Errorf("AnnotateIP() = %+v, want the name from the names file", got)
+	}
+	// Names found in the file, and repeated lookups, do not reach the resolver.
+	a.AnnotateIP("128.134.108.1")
+	if n := atomic.LoadInt64(&r.lookups); n != 1 {
+		t.Errorf("resolver called %d times, want 1", n)
+	}
+
+	// Without a resolver, the source is not tagged.
+	setUp()
+	v4, v6 = resolverRouteViews()
+	b := New(ctx, v4, v6, localASNamesfile, localIPs)
+	if got := b.AnnotateIP("128.134.108.1"); got.ASName != "" || got.ASNameSource != "" {
+		t.Errorf("AnnotateIP() without a resolver = %+v", got)
+	}
+}
+
+func Test_cachedResolver_timeout(t *testing.T) {
+	c := newCachedResolver(blockingResolver{}, time.Millisecond)
+	if got := c.lookup(context.Background(), 1); got != "" {
+		t.Errorf("lookup() = %q, want empty", got)
+	}
+	if _, ok := c.cached(1); !ok {
+		t.Errorf("lookup() did not cache the failure")
+	}
+	// Failures expire after the failure TTL.
+	c.failed[1] = time.Now().Add(-time.Second)
+	if _, ok := c.cached(1); ok {
+		t.Errorf("cached() returned an expired failure")
+	}
+
+	// The end of the caller's context is not remembered as a failure.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if got := c.lookup(ctx, 2); got != "" {
+		t.Errorf("lookup() = %q, want empty", got)
+	}
+	if _, ok := c.cached(2); ok {
+		t.Errorf("lookup() cached the end of the caller's context")
+	}
+}
+
+// gatedResolver names every AS once released, and counts its lookups.
+type gatedResolver struct {
+	started chan struct{}
+	release chan struct{}
+	lookups int64
+}
+
+func (g *gatedResolver) LookupASName(ctx context.Context, asn uint32) (string, error) {
+	if atomic.AddInt64(&g.lookups, 1) == 1 {
+		close(g.started)
+	}
+	<-g.release
+	return "GATED", nil
+}
+
+func Test_cachedResolver_concurrent(t *testing.T) {
+	g := &gatedResolver{started: make(chan struct{}), release: make(chan struct{})}
+	c := newCachedResolver(g, time.Minute)
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if got := c.lookup(context.Background(), 1); got != "GATED" {
+				t.Errorf("lookup() = %q, want GATED", got)
+			}
+		}()
+	}
+	<-g.started
+	// Give the other lookups time to join the first one.
+	time.Sleep(50 * time.Millisecond)
+	close(g.release)
+	wg.Wait()
+	if n := atomic.LoadInt64(&g.lookups); n != 1 {
+		t.Errorf("resolver called %d times, want 1", n)
+	}
+}
+
+func Test_asnAnnotator_resolveWithoutLock(t *testing.T) {
+	setUp()
+	g := &gatedResolver{started: make(chan struct{}), release: make(chan struct{})}
+	v4, v6 := resolverRouteViews()
+	a := New(context.Background(), v4, v6, localASNamesfile, localIPs, WithNameResolver(g, time.Minute)).(*asnAnnotator)
+	done := make(chan *annotator.Network)
+	go func() {
+		done <- a.AnnotateIP("128.134.108.1")
+	}()
+	<-g.started
+	// The lock must be free while the resolver is queried.
+	locked := make(chan struct{})
+	go func() {
+		a.m.Lock()
+		a.m.Unlock()
+		close(locked)
+	}()
+	select {
+	case <-locked:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the lock was held during the lookup")
+	}
+	close(g.release)
+	if got := <-done; got.ASName != "GATED" || got.ASNameSource != "cymru" {
+		t.Errorf("AnnotateIP() = %+v, want the name from the resolver", got)
+	}
+	// The resolved Network is cached.
+	if got := a.AnnotateIP("128.134.108.1"); got.ASName != "GATED" {
+		t.Errorf("AnnotateIP() = %+v, want the cached name", got)
+	}
+	if n := atomic.LoadInt64(&g.lookups); n != 1 {
+		t.Errorf("resolver called %d times, want 1", n)
+	}
+}
+
+func Test_asnAnnotator_resolveDuringCommit(t *testing.T) {
+	setUp()
+	g := &gatedResolver{started: make(chan struct{}), release: make(chan struct{})}
+	v4, v6 := resolverRouteViews()
+	a := New(context.Background(), v4, v6, localASNamesfile, localIPs, WithNameResolver(g, time.Minute), WithCache(10)).(*asnAnnotator)
+	done := make(chan *annotator.Network)
+	go func() {
+		done <- a.AnnotateIP("128.134.108.1")
+	}()
+	<-g.started
+	// The data is replaced while the resolver is queried.
+	if err := a.Warm(context.Background()); err != nil {
+		t.Fatal("Could not warm the annotator:", err)
+	}
+	a.Commit()
+	close(g.release)
+	if got := <-done; got.ASName != "GATED" {
+		t.Errorf("AnnotateIP() = %+v, want the name from the resolver", got)
+	}
+	// The Network was found in the replaced data, so it is not cached.
+	if got, ok := a.cache.get("128.134.108.1"); ok {
+		t.Errorf("cache has %+v, want no Network from the replaced data", got)
+	}
+}
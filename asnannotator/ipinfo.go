@@ -0,0 +1,198 @@
+package asnannotator
+
+import (
+	"bytes"
+	"context"
+	"log"
+	"net"
+	"strconv"
+	"sync"
+
+	"github.com/m-lab/go/content"
+	"github.com/m-lab/go/rtx"
+	"github.com/m-lab/tcp-info/inetdiag"
+
+	"github.com/m-lab/uuid-annotator/annotator"
+	"github.com/m-lab/uuid-annotator/ipinfo"
+	"github.com/m-lab/uuid-annotator/metrics"
+	"github.com/m-lab/uuid-annotator/routeview"
+	"github.com/m-lab/uuid-annotator/tarreader"
+)
+
+// ipinfoAnnotator is an ASNAnnotator backed by a single IPInfo.io file that
+// maps prefixes to their ASN, AS name, and country, instead of RouteViews and
+// a separate AS names file.
+type ipinfoAnnotator struct {
+	m        sync.RWMutex
+	localIPs *annotator.LocalIPSet
+	data     content.Provider
+	prefixes ipinfo.Prefixes
+	names    ipinfo.ASNames
+	staged   ipinfo.Prefixes
+
+	// The names of the staged prefixes.
+	stagedNames ipinfo.ASNames
+
+	annotator.ReloadGuard
+}
+
+// UpdateLocalIPs replaces the local IPs used to find the client of each
+// connection.
+func (a *ipinfoAnnotator) UpdateLocalIPs(localIPs []net.IP) {
+	a.localIPs.Update(localIPs)
+}
+
+// UpdateLocalNets replaces the local netblocks used to find the client of
+// connections without a local IP.
+func (a *ipinfoAnnotator) UpdateLocalNets(localNets []net.IPNet) {
+	a.localIPs.UpdateNets(localNets)
+}
+
+// Name returns "asn", like the RouteViews annotator.
+func (*ipinfoAnnotator) Name() string { return "asn" }
+
+// Annotate puts ASN data into the given annotations.
+func (a *ipinfoAnnotator) Annotate(ID *inetdiag.SockID, annotations *annotator.Annotations) error {
+	dir, err := a.localIPs.FindDirection(ID)
+	if err != nil {
+		return err
+	}
+	switch dir {
+	case annotator.DstIsServer:
+		annotations.Client.Network = a.AnnotateIP(ID.SrcIP)
+	case annotator.SrcIsServer:
+		annotations.Client.Network = a.AnnotateIP(ID.DstIP)
+	}
+	return nil
+}
+
+// AnnotateIP returns the Network of the prefix containing src.
+func (a *ipinfoAnnotator) AnnotateIP(src string) *annotator.Network {
+	a.m.RLock()
+	defer a.m.RUnlock()
+	ip := net.ParseIP(src)
+	if annotator.IsReserved(ip) {
+		metrics.ASNSearches.WithLabelValues("reserved").Inc()
+		return &annotator.Network{Missing: true, Reserved: true}
+	}
+	p, err := a.prefixes.Search(ip)
+	if err != nil {
+		metrics.ASNSearches.WithLabelValues("missing").Inc()
+		return &annotator.Network{Missing: true}
+	}
+	metrics.ASNSearches.WithLabelValues("ipinfo-success").Inc()
+	return &annotator.Network{
+		CIDR:     p.Network.String(),
+		ASNumber: p.ASN,
+		ASName:   p.ASName,
+		Country:  p.Country,
+		Systems: []annotator.System{
+			{ASNs: []uint32{p.ASN}},
+		},
+	}
+}
+
+// Lookup returns the prefix containing src, with its ASN as the systems, since
+// IPInfo.io data has no RouteViews systems.
+func (a *ipinfoAnnotator) Lookup(src string) (routeview.IPNet, bool) {
+	a.m.RLock()
+	defer a.m.RUnlock()
+	p, err := a.prefixes.Search(net.ParseIP(src))
+	if err != nil {
+		return routeview.IPNet{}, false
+	}
+	return routeview.IPNet{
+		IPNet:   *p.Network,
+		Systems: strconv.FormatUint(uint64(p.ASN), 10),
+	}, true
+}
+
+// ASName returns the name of the AS number in the prefixes.
+func (a *ipinfoAnnotator) ASName(asn uint32) string {
+	a.m.RLock()
+	defer a.m.RUnlock()
+	return a.names[asn]
+}
+
+// Reload loads the latest data, and replaces the data in the annotator if it
+// loaded successfully.
+func (a *ipinfoAnnotator) Reload(ctx context.Context) {
+	if !a.AllowReload() {
+		return
+	}
+	p, err := a.load(ctx)
+	if err != nil {
+		log.Println("Could not reload IPInfo.io prefixes:", err)
+		a.ReloadFailed()
+		return
+	}
+	names := p.ASNames()
+	// Don't acquire the lock until after the data is in RAM.
+	a.m.Lock()
+	defer a.m.Unlock()
+	a.prefixes, a.names = p, names
+}
+
+// Warm loads the dataset into the staging slot, without replacing the data in
+// the annotator. The staged data only becomes live after a call to Commit.
+func (a *ipinfoAnnotator) Warm(ctx context.Context) error {
+	p, err := a.load(ctx)
+	if err != nil {
+		return err
+	}
+	names := p.ASNames()
+	a.m.Lock()
+	defer a.m.Unlock()
+	a.staged, a.stagedNames = p, names
+	return nil
+}
+
+// Commit replaces the live dataset with the one loaded by Warm. If nothing has
+// been staged, Commit does nothing.
+func (a *ipinfoAnnotator) Commit() {
+	a.m.Lock()
+	defer a.m.Unlock()
+	if a.staged == nil {
+		return
+	}
+	a.prefixes, a.names = a.staged, a.stagedNames
+	a.staged, a.stagedNames = nil, nil
+}
+
+// gzipMagic starts every gzip file.
+var gzipMagic = []byte{0x1f, 0x8b}
+
+func (a *ipinfoAnnotator) load(ctx context.Context) (ipinfo.Prefixes, error) {
+	data, err := a.data.Get(ctx)
+	if err == content.ErrNoChange {
+		a.m.RLock()
+		defer a.m.RUnlock()
+		return a.prefixes, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	// IPInfo.io distributes its files both compressed and uncompressed.
+	if bytes.HasPrefix(data, gzipMagic) {
+		data, err = tarreader.FromGZ(data)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return ipinfo.ParsePrefixes(data)
+}
+
+// NewIPInfo makes a new ASNAnnotator from an IPInfo.io CSV file, optionally
+// gzipped, that maps each network to its ASN, AS name, and country. It is an
+// alternative to New for deployments that use IPInfo.io instead of RouteViews.
+func NewIPInfo(ctx context.Context, data content.Provider, localIPs []net.IP) ASNAnnotator {
+	a := &ipinfoAnnotator{
+		data:     data,
+		localIPs: annotator.NewLocalIPSet(localIPs),
+	}
+	var err error
+	a.prefixes, err = a.load(ctx)
+	rtx.Must(err, "Could not load IPInfo.io prefixes")
+	a.names = a.prefixes.ASNames()
+	return a
+}
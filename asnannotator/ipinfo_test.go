@@ -0,0 +1,170 @@
+package asnannotator
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"testing"
+
+	"github.com/go-test/deep"
+	"github.com/m-lab/go/content"
+	"github.com/m-lab/go/rtx"
+	"github.com/m-lab/tcp-info/inetdiag"
+
+	"github.com/m-lab/uuid-annotator/annotator"
+	"github.com/m-lab/uuid-annotator/ipinfo"
+)
+
+// bytesProvider returns data once, and then ErrNoChange.
+type bytesProvider struct {
+	data []byte
+}
+
+func (b *bytesProvider) Get(_ context.Context) ([]byte, error) {
+	if b.data == nil {
+		return nil, content.ErrNoChange
+	}
+	data := b.data
+	b.data = nil
+	return data, nil
+}
+
+func ipinfoFile() content.Provider {
+	u, err := url.Parse("file:../testdata/ipinfo-lite.csv")
+	rtx.Must(err, "Could not parse URL")
+	p, err := content.FromURL(context.Background(), u)
+	rtx.Must(err, "Could not create content.Provider")
+	return p
+}
+
+func TestNewIPInfo(t *testing.T) {
+	ctx := context.Background()
+	a := NewIPInfo(ctx, ipinfoFile(), []net.IP{net.ParseIP("9.0.0.9")})
+
+	tests := []struct {
+		name string
+		ID   *inetdiag.SockID
+		want *annotator.Network
+	}{
+		{
+			name: "ipv4",
+			ID:   &inetdiag.SockID{SrcIP: "9.0.0.9", DstIP: "2.125.160.216"},
+			want: &annotator.Network{
+				CIDR:     "2.125.160.0/19",
+				ASNumber: 5607,
+				ASName:   "Sky UK Limited",
+				Country:  "GB",
+				Systems:  []annotator.System{{ASNs: []uint32{5607}}},
+			},
+		},
+		{
+			name: "ipv6",
+			ID:   &inetdiag.SockID{SrcIP: "2001:200::1", DstIP: "9.0.0.9"},
+			want: &annotator.Network{
+				CIDR:     "2001:200::/32",
+				ASNumber: 2500,
+				ASName:   "WIDE Project",
+				Country:  "JP",
+				Systems:  []annotator.System{{ASNs: []uint32{2500}}},
+			},
+		},
+		{
+			name: "missing",
+			ID:   &inetdiag.SockID{SrcIP: "9.0.0.9", DstIP: "8.8.8.8"},
+			want: &annotator.Network{Missing: true},
+		},
+		{
+			name: "reserved",
+			ID:   &inetdiag.SockID{SrcIP: "9.0.0.9", DstIP: "10.0.0.1"},
+			want: &annotator.Network{Missing: true, Reserved: true},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ann := &annotator.Annotations{}
+			rtx.Must(a.Annotate(tt.ID, ann), "Could not annotate")
+			if diff := deep.Equal(ann.Client.Network, tt.want); diff != nil {
+				t.Errorf("Annotate() wrong Network; got!=want %v", diff)
+			}
+		})
+	}
+
+	if err := a.Annotate(&inetdiag.SockID{SrcIP: "1.0.0.1", DstIP: "2.125.160.216"}, &annotator.Annotations{}); !errors.Is(err, annotator.ErrUnknownDirection) {
+		t.Errorf("Annotate() error = %v, want %v", err, annotator.ErrUnknownDirection)
+	}
+	if got := a.AnnotateIP("this-is-not-an-ip"); !got.Missing {
+		t.Errorf("AnnotateIP() of a bad IP = %+v, want Missing", got)
+	}
+
+	if got := a.ASName(2500); got != "WIDE Project" {
+		t.Errorf("ASName(2500) = %q, want \"WIDE Project\"", got)
+	}
+	if got, ok := a.Lookup("2001:200::1"); !ok || got.String() != "2001:200::/32" || got.Systems != "2500" {
+		t.Errorf("Lookup(2001:200::1) = %v, %v, want 2001:200::/32 with systems 2500", got, ok)
+	}
+	if got, ok := a.Lookup("10.0.0.1"); ok {
+		t.Errorf("Lookup(10.0.0.1) = %v, want no match", got)
+	}
+	if got := a.ASName(1); got != "" {
+		t.Errorf("ASName(1) = %q, want \"\"", got)
+	}
+
+	// Unchanged data is kept on reload.
+	a.Reload(ctx)
+	if got := a.AnnotateIP("1.0.0.1"); got.ASNumber != 13335 {
+		t.Errorf("AnnotateIP() after Reload() = %+v, want AS13335", got)
+	}
+	if got := a.ASName(2500); got != "WIDE Project" {
+		t.Errorf("ASName(2500) after Reload() = %q, want \"WIDE Project\"", got)
+	}
+}
+
+func TestNewIPInfo_gzipped(t *testing.T) {
+	data, err := ioutil.ReadFile("../testdata/ipinfo-lite.csv")
+	rtx.Must(err, "Could not read test data")
+	buf := &bytes.Buffer{}
+	w := gzip.NewWriter(buf)
+	_, err = w.Write(data)
+	rtx.Must(err, "Could not compress")
+	rtx.Must(w.Close(), "Could not compress")
+
+	a := NewIPInfo(context.Background(), &bytesProvider{buf.Bytes()}, nil)
+	if got := a.AnnotateIP("1.0.0.1"); got.ASNumber != 13335 || got.Country != "AU" {
+		t.Errorf("AnnotateIP() = %+v, want AS13335 in AU", got)
+	}
+}
+
+func Test_ipinfoAnnotator_WarmAndCommit(t *testing.T) {
+	ctx := context.Background()
+	a := NewIPInfo(ctx, ipinfoFile(), nil).(*ipinfoAnnotator)
+
+	// Bad data is never staged.
+	a.data = &bytesProvider{[]byte("network,asn\n")}
+	if err := a.Warm(ctx); !errors.Is(err, ipinfo.ErrNoPrefixes) {
+		t.Errorf("Warm() error = %v, want %v", err, ipinfo.ErrNoPrefixes)
+	}
+	a.Commit()
+	a.data = badProvider{errors.New("fake load error")}
+	a.Reload(ctx)
+	if got := a.AnnotateIP("1.0.0.1"); got.ASNumber != 13335 {
+		t.Errorf("AnnotateIP() after failed loads = %+v, want AS13335", got)
+	}
+
+	// Good data only becomes live on Commit.
+	a.data = &bytesProvider{[]byte("network,asn,name,country\n1.0.0.0/24,AS1,Test,US\n")}
+	rtx.Must(a.Warm(ctx), "Could not warm")
+	if got := a.AnnotateIP("1.0.0.1"); got.ASNumber != 13335 {
+		t.Errorf("AnnotateIP() after Warm() = %+v, want AS13335", got)
+	}
+	a.Commit()
+	if got := a.AnnotateIP("1.0.0.1"); got.ASNumber != 1 || got.Country != "US" {
+		t.Errorf("AnnotateIP() after Commit() = %+v, want AS1 in US", got)
+	}
+	if got := a.ASName(1); got != "Test" {
+		t.Errorf("ASName(1) after Commit() = %q, want \"Test\"", got)
+	}
+}
@@ -0,0 +1,31 @@
+package asnannotator
+
+import "net"
+
+var (
+	teredoPrefix = &net.IPNet{IP: net.ParseIP("2001::"), Mask: net.CIDRMask(32, 128)}
+	sixToFour    = &net.IPNet{IP: net.ParseIP("2002::"), Mask: net.CIDRMask(16, 128)}
+)
+
+// embeddedIPv4 returns the IPv4 address embedded in a Teredo or 6to4 IPv6
+// address, and the kind of transition address it is. Other addresses return
+// a nil IP.
+func embeddedIPv4(src string) (net.IP, string) {
+	ip := net.ParseIP(src)
+	if ip == nil || ip.To4() != nil {
+		return nil, ""
+	}
+	switch {
+	case teredoPrefix.Contains(ip):
+		// The Teredo client address is the last 32 bits, inverted (RFC 4380).
+		v4 := make(net.IP, net.IPv4len)
+		for i := range v4 {
+			v4[i] = ^ip[12+i]
+		}
+		return v4, "teredo"
+	case sixToFour.Contains(ip):
+		// The 6to4 site address follows the 2002::/16 prefix (RFC 3056).
+		return net.IPv4(ip[2], ip[3], ip[4], ip[5]).To4(), "6to4"
+	}
+	return nil, ""
+}
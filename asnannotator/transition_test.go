@@ -0,0 +1,48 @@
+package asnannotator
+
+import (
+	"net"
+	"testing"
+)
+
+func Test_embeddedIPv4(t *testing.T) {
+	tests := []struct {
+		name     string
+		src      string
+		wantIP   net.IP
+		wantKind string
+	}{
+		{
+			name:     "6to4",
+			src:      "2002:c000:204::1",
+			wantIP:   net.ParseIP("192.0.2.4"),
+			wantKind: "6to4",
+		},
+		{
+			name:     "teredo",
+			src:      "2001:0:4136:e378:8000:63bf:3fff:fdd2", // RFC 4380 example.
+			wantIP:   net.ParseIP("192.0.2.45"),
+			wantKind: "teredo",
+		},
+		{
+			name: "native-ipv6",
+			src:  "2001:200::1",
+		},
+		{
+			name: "ipv4",
+			src:  "1.0.0.1",
+		},
+		{
+			name: "invalid",
+			src:  "not-an-ip",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ip, kind := embeddedIPv4(tt.src)
+			if !ip.Equal(tt.wantIP) || kind != tt.wantKind {
+				t.Errorf("embeddedIPv4(%q) = %v, %q, want %v, %q", tt.src, ip, kind, tt.wantIP, tt.wantKind)
+			}
+		})
+	}
+}
@@ -0,0 +1,64 @@
+// Package asrank parses the customer cone files published by CAIDA's AS Rank
+// project. A customer cone is the set of ASes that an AS can reach through its
+// customer links, and its size is a measure of the importance of the AS. See
+// the format documentation at:
+// https://publicdata.caida.org/datasets/as-relationships/README.txt
+package asrank
+
+import (
+	"bufio"
+	"bytes"
+	"log"
+	"strconv"
+	"strings"
+)
+
+// ConeSizes maps AS numbers to the number of ASes in their customer cone,
+// including the AS itself.
+type ConeSizes map[uint32]int64
+
+// Parse reads a "ppdc-ases" file, where each line is an AS followed by the ASes
+// in its customer cone, separated by spaces. Comment and malformed lines are
+// skipped.
+func Parse(data []byte) (ConeSizes, error) {
+	cones := ConeSizes{}
+	s := bufio.NewScanner(bytes.NewReader(data))
+	// Lines for the largest ASes list tens of thousands of ASes.
+	s.Buffer(make([]byte, 0, 64*1024), 16*1024*1024)
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		asn, size, err := parseLine(line)
+		if err != nil {
+			log.Println("Bad customer cone row:", err, line)
+			continue
+		}
+		cones[asn] = size
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	return cones, nil
+}
+
+// parseLine returns the AS of the line and the number of distinct ASes in its
+// cone. Since the cone always contains the AS itself, whether or not the AS is
+// repeated in its own list of members does not change the size.
+func parseLine(line string) (uint32, int64, error) {
+	fields := strings.Fields(line)
+	members := make(map[uint32]struct{}, len(fields))
+	var asn uint32
+	for i, f := range fields {
+		n, err := strconv.ParseUint(f, 10, 32)
+		if err != nil {
+			return 0, 0, err
+		}
+		if i == 0 {
+			asn = uint32(n)
+		}
+		members[uint32(n)] = struct{}{}
+	}
+	return asn, int64(len(members)), nil
+}
@@ -0,0 +1,39 @@
+package asrank
+
+import (
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/go-test/deep"
+	"github.com/m-lab/go/rtx"
+)
+
+func TestParse(t *testing.T) {
+	data, err := os.ReadFile("../testdata/ppdc-ases.txt")
+	rtx.Must(err, "Could not read testdata")
+	got, err := Parse(data)
+	rtx.Must(err, "Could not parse cone sizes")
+	want := ConeSizes{
+		23969: 1,
+		5607:  3,
+		13335: 1,
+		2500:  3, // Repeated ASes are only counted once.
+	}
+	if diff := deep.Equal(got, want); diff != nil {
+		t.Error("Parse() got!=want", diff)
+	}
+}
+
+func TestParse_longLine(t *testing.T) {
+	// The scanner must accept lines longer than its default 64KB limit.
+	members := make([]string, 20000)
+	for i := range members {
+		members[i] = "4294967295"
+	}
+	got, err := Parse([]byte("7 " + strings.Join(members, " ") + "\n"))
+	rtx.Must(err, "Could not parse a long line")
+	if got[7] != 2 {
+		t.Errorf("Parse() long line = %d, want 2", got[7])
+	}
+}
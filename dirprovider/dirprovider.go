@@ -0,0 +1,81 @@
+// Package dirprovider provides a content.Provider that reads the newest file
+// in a local directory whose name matches a pattern, so that dated data files
+// can be dropped into the directory without changing the URL of the data.
+package dirprovider
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/m-lab/go/content"
+)
+
+// ErrNoMatch is returned when no file in the directory matches the pattern.
+var ErrNoMatch = errors.New("no file matches the pattern")
+
+// provider gets the newest matching file from a directory. It remembers the
+// name and modification time of the file it read last, to avoid reading the
+// same data again.
+type provider struct {
+	dir     string
+	pattern string
+	name    string
+	mtime   time.Time
+}
+
+// New returns a content.Provider for the newest file in dir whose name matches
+// the filepath.Match pattern. The newest file is the one whose name sorts last,
+// so dated names must sort by date, e.g. RouteViewIPv4.20230102.gz.
+func New(dir, pattern string) (content.Provider, error) {
+	if _, err := filepath.Match(pattern, ""); err != nil {
+		return nil, fmt.Errorf("%w: %q", err, pattern)
+	}
+	return &provider{dir: dir, pattern: pattern}, nil
+}
+
+// Get returns the contents of the newest matching file, or content.ErrNoChange
+// if that file has not changed since the last successful Get.
+func (p *provider) Get(ctx context.Context) ([]byte, error) {
+	entries, err := os.ReadDir(p.dir)
+	if err != nil {
+		return nil, err
+	}
+	// ReadDir sorts the entries by name, so the newest match is the last.
+	name := ""
+	for _, e := range entries {
+		if e.IsDir() {
+			continue
+		}
+		// The pattern was checked by New, so Match can not fail.
+		if ok, _ := filepath.Match(p.pattern, e.Name()); ok {
+			name = e.Name()
+		}
+	}
+	if name == "" {
+		return nil, fmt.Errorf("%w: %q in %q", ErrNoMatch, p.pattern, p.dir)
+	}
+	file := filepath.Join(p.dir, name)
+	s, err := os.Stat(file)
+	if err != nil {
+		return nil, err
+	}
+	if name == p.name && s.ModTime().Equal(p.mtime) {
+		return nil, content.ErrNoChange
+	}
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	p.name, p.mtime = name, s.ModTime()
+	return b, nil
+}
+
+// Name returns the name of the file returned by the last successful Get, e.g.
+// RouteViewIPv4.20230102.gz, or "" before the first one.
+func (p *provider) Name() string {
+	return p.name
+}
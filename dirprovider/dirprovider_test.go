@@ -0,0 +1,85 @@
+package dirprovider
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/m-lab/go/content"
+	"github.com/m-lab/go/rtx"
+)
+
+func writeFile(t *testing.T, dir, name, contents string) {
+	t.Helper()
+	rtx.Must(os.WriteFile(filepath.Join(dir, name), []byte(contents), 0644), "Could not write %s", name)
+}
+
+func TestProvider(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	writeFile(t, dir, "RouteViewIPv4.20230101.gz", "first")
+	writeFile(t, dir, "RouteViewIPv4.20230103.gz", "third")
+	writeFile(t, dir, "RouteViewIPv4.20230102.gz", "second")
+	writeFile(t, dir, "RouteViewIPv6.20230104.gz", "other pattern")
+	rtx.Must(os.Mkdir(filepath.Join(dir, "RouteViewIPv4.20230105.gz"), 0755), "Could not make dir")
+
+	p, err := New(dir, "RouteViewIPv4.*.gz")
+	rtx.Must(err, "Could not create provider")
+
+	// The newest matching file is read, and then not read again.
+	b, err := p.Get(ctx)
+	rtx.Must(err, "Could not get data")
+	if string(b) != "third" {
+		t.Errorf("Get() = %q, want %q", b, "third")
+	}
+	if got := p.(*provider).Name(); got != "RouteViewIPv4.20230103.gz" {
+		t.Errorf("Name() = %q, want %q", got, "RouteViewIPv4.20230103.gz")
+	}
+	if _, err := p.Get(ctx); err != content.ErrNoChange {
+		t.Errorf("Get() of unchanged data error = %v, want %v", err, content.ErrNoChange)
+	}
+
+	// Older files do not replace it.
+	writeFile(t, dir, "RouteViewIPv4.20221231.gz", "older")
+	if _, err := p.Get(ctx); err != content.ErrNoChange {
+		t.Errorf("Get() after an older file error = %v, want %v", err, content.ErrNoChange)
+	}
+
+	// A newer file, or a rewrite of the newest file, is read.
+	writeFile(t, dir, "RouteViewIPv4.20230104.gz", "fourth")
+	b, err = p.Get(ctx)
+	rtx.Must(err, "Could not get newer data")
+	if string(b) != "fourth" {
+		t.Errorf("Get() after a newer file = %q, want %q", b, "fourth")
+	}
+	writeFile(t, dir, "RouteViewIPv4.20230104.gz", "fourth, fixed")
+	later := time.Now().Add(time.Minute)
+	rtx.Must(os.Chtimes(filepath.Join(dir, "RouteViewIPv4.20230104.gz"), later, later), "Could not change mtime")
+	b, err = p.Get(ctx)
+	rtx.Must(err, "Could not get rewritten data")
+	if string(b) != "fourth, fixed" {
+		t.Errorf("Get() after a rewrite = %q, want %q", b, "fourth, fixed")
+	}
+}
+
+func TestProvider_errors(t *testing.T) {
+	ctx := context.Background()
+	if _, err := New(t.TempDir(), "["); !errors.Is(err, filepath.ErrBadPattern) {
+		t.Errorf("New() with a bad pattern error = %v, want %v", err, filepath.ErrBadPattern)
+	}
+
+	p, err := New(t.TempDir(), "*.gz")
+	rtx.Must(err, "Could not create provider")
+	if _, err := p.Get(ctx); !errors.Is(err, ErrNoMatch) {
+		t.Errorf("Get() of an empty dir error = %v, want %v", err, ErrNoMatch)
+	}
+
+	p, err = New(filepath.Join(t.TempDir(), "missing"), "*.gz")
+	rtx.Must(err, "Could not create provider")
+	if _, err := p.Get(ctx); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Get() of a missing dir error = %v, want %v", err, os.ErrNotExist)
+	}
+}
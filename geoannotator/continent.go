@@ -0,0 +1,76 @@
+package geoannotator
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"sort"
+
+	"github.com/m-lab/go/content"
+	"github.com/m-lab/go/rtx"
+
+	"github.com/m-lab/uuid-annotator/annotator"
+)
+
+// parseContinents builds a csvIndex from a CSV file with a header row naming
+// its network and continent_code columns. Rows that can not be parsed, or that
+// have no continent, are logged and skipped.
+func parseContinents(data []byte) (csvIndex, error) {
+	rows, err := csv.NewReader(bytes.NewReader(data)).ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	if len(rows) == 0 {
+		return nil, io.ErrUnexpectedEOF
+	}
+	cols := csvColumns{}
+	for i, name := range rows[0] {
+		cols[name] = i
+	}
+	for _, name := range []string{"network", "continent_code"} {
+		if _, ok := cols[name]; !ok {
+			return nil, fmt.Errorf("%w: no %s column", ErrNoNetworks, name)
+		}
+	}
+	ix := csvIndex{}
+	for _, row := range rows[1:] {
+		continent := cols.get(row, "continent_code")
+		if continent == "" {
+			log.Printf("Skipping continent row %q: no continent\n", row)
+			continue
+		}
+		b, err := parseBlock(csvColumns{"network": cols["network"]}, row, nil)
+		if err != nil {
+			log.Printf("Skipping continent row %q: %v\n", row, err)
+			continue
+		}
+		b.geo.ContinentCode = continent
+		ix = append(ix, b)
+	}
+	if len(ix) == 0 {
+		return nil, ErrNoNetworks
+	}
+	sort.Slice(ix, func(i, j int) bool {
+		return bytes.Compare(ix[i].start, ix[j].start) < 0
+	})
+	return ix, nil
+}
+
+// NewContinent makes a new GeoAnnotator from a small CSV file mapping each
+// network to its continent_code, for nodes too constrained for even a country
+// database. It only annotates the ContinentCode of each Geolocation.
+func NewContinent(ctx context.Context, geo content.Provider, localIPs []net.IP) GeoAnnotator {
+	g := &csvannotator{
+		backingDataSource: geo,
+		localIPs:          annotator.NewLocalIPSet(localIPs),
+		parse:             parseContinents,
+	}
+	var err error
+	g.index, err = g.load(ctx)
+	rtx.Must(err, "Could not load continent annotation db")
+	return g
+}
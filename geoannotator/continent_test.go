@@ -0,0 +1,99 @@
+package geoannotator
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/url"
+	"testing"
+
+	"github.com/go-test/deep"
+	"github.com/m-lab/go/content"
+	"github.com/m-lab/go/rtx"
+	"github.com/m-lab/uuid-annotator/annotator"
+)
+
+func TestContinentAnnotateIP(t *testing.T) {
+	u, err := url.Parse("file:../testdata/continents.csv")
+	rtx.Must(err, "Could not parse URL")
+	p, err := content.FromURL(context.Background(), u)
+	rtx.Must(err, "Could not create content.Provider")
+	g := NewContinent(context.Background(), p, nil)
+	tests := []struct {
+		name string
+		ip   string
+		want *annotator.Geolocation
+	}{
+		{
+			name: "ipv4",
+			ip:   "2.125.160.216",
+			want: &annotator.Geolocation{ContinentCode: "EU"},
+		},
+		{
+			name: "ipv6",
+			ip:   "2001:200::1",
+			want: &annotator.Geolocation{ContinentCode: "AS"},
+		},
+		{
+			name: "reserved",
+			ip:   "10.0.0.1",
+			want: &annotator.Geolocation{Missing: true, Reserved: true},
+		},
+		{
+			name: "missing",
+			ip:   "9.0.0.9",
+			want: &annotator.Geolocation{Missing: true},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got *annotator.Geolocation
+			rtx.Must(g.AnnotateIP(net.ParseIP(tt.ip), &got), "Could not annotate %s", tt.ip)
+			if diff := deep.Equal(got, tt.want); diff != nil {
+				t.Errorf("AnnotateIP(%s) = %+v, diff %v", tt.ip, got, diff)
+			}
+		})
+	}
+
+	// Reloading unchanged data keeps the continents.
+	g.Reload(context.Background())
+	var got *annotator.Geolocation
+	rtx.Must(g.AnnotateIP(net.ParseIP("1.0.0.1"), &got), "Could not annotate after Reload")
+	if got.ContinentCode != "OC" {
+		t.Errorf("AnnotateIP() after Reload() = %+v, want ContinentCode OC", got)
+	}
+}
+
+func Test_parseContinents_errors(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+	}{
+		{
+			name: "empty",
+			data: "",
+		},
+		{
+			name: "no-continent-column",
+			data: "network,country_code\n1.0.0.0/24,AU\n",
+		},
+		{
+			name: "no-valid-rows",
+			data: "network,continent_code\nnot-a-network,EU\n",
+		},
+		{
+			name: "bad-csv",
+			data: "network,continent_code\n\"1.0.0.0/24,OC\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := parseContinents([]byte(tt.data)); err == nil {
+				t.Error("parseContinents() = nil, want error")
+			}
+		})
+	}
+	if _, err := parseContinents([]byte("network,continent_code\n")); !errors.Is(err, ErrNoNetworks) {
+		t.Errorf("parseContinents() = %v, want %v", err, ErrNoNetworks)
+	}
+}
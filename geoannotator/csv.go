@@ -0,0 +1,311 @@
+package geoannotator
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+
+	"github.com/m-lab/go/content"
+	"github.com/m-lab/go/rtx"
+	"github.com/m-lab/tcp-info/inetdiag"
+
+	"github.com/m-lab/uuid-annotator/annotator"
+	"github.com/m-lab/uuid-annotator/tarreader"
+)
+
+// ErrNoNetworks is returned when a MaxMind CSV archive contains no usable networks.
+var ErrNoNetworks = errors.New("no networks found in MaxMind CSV data")
+
+// csvBlock is one network from the blocks files of the MaxMind CSV
+// distribution, joined with its location.
+type csvBlock struct {
+	start net.IP // The first IP of the network, in 16-byte form.
+	end   net.IP // The last IP of the network, in 16-byte form.
+	geo   annotator.Geolocation
+}
+
+// csvIndex holds blocks sorted by start. MaxMind networks do not overlap, so
+// the only network that can contain an IP is the last one starting at or
+// before it.
+type csvIndex []csvBlock
+
+func (ix csvIndex) search(ip net.IP) (*annotator.Geolocation, bool) {
+	ip = ip.To16()
+	i := sort.Search(len(ix), func(i int) bool {
+		return bytes.Compare(ix[i].start, ip) > 0
+	})
+	if i == 0 || bytes.Compare(ip, ix[i-1].end) > 0 {
+		return nil, false
+	}
+	geo := ix[i-1].geo
+	return &geo, true
+}
+
+// csvColumns maps the names in a CSV header to their column numbers.
+type csvColumns map[string]int
+
+func (c csvColumns) get(row []string, name string) string {
+	i, ok := c[name]
+	if !ok || i >= len(row) {
+		return ""
+	}
+	return row[i]
+}
+
+// readCSV reads the named CSV file from the zip archive, and returns its
+// column names and rows.
+func readCSV(zipdata []byte, name string) (csvColumns, [][]string, error) {
+	data, err := tarreader.FromZip(zipdata, name)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%s: %w", name, err)
+	}
+	rows, err := csv.NewReader(bytes.NewReader(data)).ReadAll()
+	if err != nil {
+		return nil, nil, fmt.Errorf("%s: %w", name, err)
+	}
+	if len(rows) == 0 {
+		return nil, nil, fmt.Errorf("%s: %w", name, io.ErrUnexpectedEOF)
+	}
+	cols := csvColumns{}
+	for i, name := range rows[0] {
+		cols[name] = i
+	}
+	return cols, rows[1:], nil
+}
+
+// parseCSV builds a csvIndex from the zip archive of the GeoIP2 or GeoLite2
+// City CSV distribution. Rows that can not be parsed are logged and skipped.
+func parseCSV(zipdata []byte) (csvIndex, error) {
+	cols, rows, err := readCSV(zipdata, "City-Locations-en.csv")
+	if err != nil {
+		return nil, err
+	}
+	locations := map[string]annotator.Geolocation{}
+	for _, row := range rows {
+		metro, _ := strconv.ParseInt(cols.get(row, "metro_code"), 10, 64)
+		locations[cols.get(row, "geoname_id")] = annotator.Geolocation{
+			ContinentCode:       cols.get(row, "continent_code"),
+			CountryCode:         cols.get(row, "country_iso_code"),
+			CountryName:         cols.get(row, "country_name"),
+			Subdivision1ISOCode: cols.get(row, "subdivision_1_iso_code"),
+			Subdivision1Name:    cols.get(row, "subdivision_1_name"),
+			Subdivision2ISOCode: cols.get(row, "subdivision_2_iso_code"),
+			Subdivision2Name:    cols.get(row, "subdivision_2_name"),
+			City:                cols.get(row, "city_name"),
+			MetroCode:           metro,
+		}
+	}
+
+	ix := csvIndex{}
+	for _, name := range []string{"City-Blocks-IPv4.csv", "City-Blocks-IPv6.csv"} {
+		cols, rows, err := readCSV(zipdata, name)
+		if err != nil {
+			return nil, err
+		}
+		for _, row := range rows {
+			b, err := parseBlock(cols, row, locations)
+			if err != nil {
+				log.Printf("Skipping %s row %q: %v\n", name, row, err)
+				continue
+			}
+			ix = append(ix, b)
+		}
+	}
+	if len(ix) == 0 {
+		return nil, ErrNoNetworks
+	}
+	sort.Slice(ix, func(i, j int) bool {
+		return bytes.Compare(ix[i].start, ix[j].start) < 0
+	})
+	return ix, nil
+}
+
+func parseBlock(cols csvColumns, row []string, locations map[string]annotator.Geolocation) (csvBlock, error) {
+	_, n, err := net.ParseCIDR(cols.get(row, "network"))
+	if err != nil {
+		return csvBlock{}, fmt.Errorf("%w: %w", annotator.ErrInvalidIP, err)
+	}
+	b := csvBlock{
+		start: n.IP.To16(),
+		end:   make(net.IP, net.IPv6len),
+	}
+	mask := n.Mask
+	if len(mask) == net.IPv4len {
+		mask = append(net.CIDRMask(96, 128)[:12], mask...)
+	}
+	for i := range b.start {
+		b.end[i] = b.start[i] | ^mask[i]
+	}
+
+	// Networks without a city-level location still have a country.
+	id := cols.get(row, "geoname_id")
+	if id == "" {
+		id = cols.get(row, "registered_country_geoname_id")
+	}
+	b.geo = locations[id]
+	b.geo.PostalCode = cols.get(row, "postal_code")
+	if s := cols.get(row, "latitude"); s != "" {
+		if b.geo.Latitude, err = strconv.ParseFloat(s, 64); err != nil {
+			return csvBlock{}, err
+		}
+	}
+	if s := cols.get(row, "longitude"); s != "" {
+		if b.geo.Longitude, err = strconv.ParseFloat(s, 64); err != nil {
+			return csvBlock{}, err
+		}
+	}
+	if s := cols.get(row, "accuracy_radius"); s != "" {
+		if b.geo.AccuracyRadiusKm, err = strconv.ParseInt(s, 10, 64); err != nil {
+			return csvBlock{}, err
+		}
+	}
+	if b.geo.City == "" && (b.geo.Latitude != 0 || b.geo.Longitude != 0) {
+		b.geo.CoordinatesAreApproximate = true
+	}
+	return b, nil
+}
+
+// csvannotator is a GeoAnnotator backed by the MaxMind CSV distribution, or
+// by another dataset that parse converts to a csvIndex.
+type csvannotator struct {
+	mut               sync.RWMutex
+	localIPs          *annotator.LocalIPSet
+	backingDataSource content.Provider
+	parse             func([]byte) (csvIndex, error)
+	index             csvIndex
+	staged            csvIndex
+
+	annotator.ReloadGuard
+}
+
+// UpdateLocalIPs replaces the local IPs used to find the client of each
+// connection.
+func (g *csvannotator) UpdateLocalIPs(localIPs []net.IP) {
+	g.localIPs.Update(localIPs)
+}
+
+// UpdateLocalNets replaces the local netblocks used to find the client of
+// connections without a local IP.
+func (g *csvannotator) UpdateLocalNets(localNets []net.IPNet) {
+	g.localIPs.UpdateNets(localNets)
+}
+
+// Name returns "geo", like the annotator of the MaxMind database.
+func (*csvannotator) Name() string { return "geo" }
+
+// Annotate assigns client geolocation data to the passed-in annotations.
+func (g *csvannotator) Annotate(ID *inetdiag.SockID, annotations *annotator.Annotations) error {
+	dir, err := g.localIPs.FindDirection(ID)
+	if err != nil {
+		return err
+	}
+	src := ID.DstIP
+	if dir == annotator.DstIsServer {
+		src = ID.SrcIP
+	}
+	ip := net.ParseIP(src)
+	if ip == nil {
+		return fmt.Errorf("%w: %w: failed to parse IP %q", annotator.ErrNoAnnotation, annotator.ErrInvalidIP, src)
+	}
+	return g.AnnotateIP(ip, &annotations.Client.Geo)
+}
+
+// AnnotateIP assigns the geolocation of the given IP.
+func (g *csvannotator) AnnotateIP(ip net.IP, geo **annotator.Geolocation) error {
+	if ip == nil {
+		return fmt.Errorf("%w: can't annotate nil IP", annotator.ErrInvalidIP)
+	}
+	if annotator.IsReserved(ip) {
+		*geo = &annotator.Geolocation{Missing: true, Reserved: true}
+		return nil
+	}
+	g.mut.RLock()
+	defer g.mut.RUnlock()
+	result, ok := g.index.search(ip)
+	if !ok {
+		result = &annotator.Geolocation{
+			Missing: true,
+		}
+	}
+	*geo = result
+	return nil
+}
+
+// Reload loads the latest data, and replaces the data in the annotator if it
+// loaded successfully.
+func (g *csvannotator) Reload(ctx context.Context) {
+	if !g.AllowReload() {
+		return
+	}
+	ix, err := g.load(ctx)
+	if err != nil {
+		log.Println("Could not reload CSV dataset:", err)
+		g.ReloadFailed()
+		return
+	}
+	// Don't acquire the lock until after the data is in RAM.
+	g.mut.Lock()
+	defer g.mut.Unlock()
+	g.index = ix
+}
+
+// Warm loads the dataset into the staging slot, without replacing the data in
+// the annotator. The staged data only becomes live after a call to Commit.
+func (g *csvannotator) Warm(ctx context.Context) error {
+	ix, err := g.load(ctx)
+	if err != nil {
+		return err
+	}
+	g.mut.Lock()
+	defer g.mut.Unlock()
+	g.staged = ix
+	return nil
+}
+
+// Commit replaces the live dataset with the one loaded by Warm. If nothing has
+// been staged, Commit does nothing.
+func (g *csvannotator) Commit() {
+	g.mut.Lock()
+	defer g.mut.Unlock()
+	if g.staged == nil {
+		return
+	}
+	g.index = g.staged
+	g.staged = nil
+}
+
+func (g *csvannotator) load(ctx context.Context) (csvIndex, error) {
+	data, err := g.backingDataSource.Get(ctx)
+	if err == content.ErrNoChange {
+		g.mut.RLock()
+		defer g.mut.RUnlock()
+		return g.index, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return g.parse(data)
+}
+
+// NewCSV makes a new GeoAnnotator from the zip archive of the MaxMind GeoIP2 or
+// GeoLite2 City CSV distribution, for deployments that do not have the mmdb
+// distribution used by New.
+func NewCSV(ctx context.Context, geo content.Provider, localIPs []net.IP) GeoAnnotator {
+	g := &csvannotator{
+		backingDataSource: geo,
+		localIPs:          annotator.NewLocalIPSet(localIPs),
+		parse:             parseCSV,
+	}
+	var err error
+	g.index, err = g.load(ctx)
+	rtx.Must(err, "Could not load CSV annotation db")
+	return g
+}
@@ -0,0 +1,267 @@
+package geoannotator
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"sync/atomic"
+	"testing"
+
+	"github.com/go-test/deep"
+	"github.com/m-lab/go/content"
+	"github.com/m-lab/go/rtx"
+	"github.com/m-lab/tcp-info/inetdiag"
+	"github.com/m-lab/uuid-annotator/annotator"
+	"github.com/m-lab/uuid-annotator/httpprovider"
+	"github.com/m-lab/uuid-annotator/tarreader"
+)
+
+func csvProvider() content.Provider {
+	u, err := url.Parse("file:../testdata/GeoLite2-City-CSV.zip")
+	rtx.Must(err, "Could not parse URL")
+	p, err := content.FromURL(context.Background(), u)
+	rtx.Must(err, "Could not create content.Provider")
+	return p
+}
+
+// zipOf creates a zip archive containing the given files.
+func zipOf(files map[string]string) []byte {
+	buf := &bytes.Buffer{}
+	zw := zip.NewWriter(buf)
+	for name, contents := range files {
+		w, err := zw.Create(name)
+		rtx.Must(err, "Could not create %s", name)
+		_, err = w.Write([]byte(contents))
+		rtx.Must(err, "Could not write %s", name)
+	}
+	rtx.Must(zw.Close(), "Could not close zip")
+	return buf.Bytes()
+}
+
+func TestCSVAnnotateIP(t *testing.T) {
+	g := NewCSV(context.Background(), csvProvider(), nil)
+	tests := []struct {
+		name string
+		ip   string
+		want *annotator.Geolocation
+	}{
+		{
+			name: "city",
+			ip:   "2.125.160.216",
+			want: &annotator.Geolocation{
+				ContinentCode:       "EU",
+				CountryCode:         "GB",
+				CountryName:         "United Kingdom",
+				Subdivision1ISOCode: "ENG",
+				Subdivision1Name:    "England",
+				Subdivision2ISOCode: "WBK",
+				Subdivision2Name:    "West Berkshire",
+				City:                "Boxford",
+				PostalCode:          "OX1",
+				Latitude:            51.75,
+				Longitude:           -1.25,
+				AccuracyRadiusKm:    100,
+			},
+		},
+		{
+			name: "city-last-ip-of-network",
+			ip:   "216.160.83.63",
+			want: &annotator.Geolocation{
+				ContinentCode:       "NA",
+				CountryCode:         "US",
+				CountryName:         "United States",
+				Subdivision1ISOCode: "WA",
+				Subdivision1Name:    "Washington",
+				City:                "Milton",
+				MetroCode:           819,
+				PostalCode:          "98354",
+				Latitude:            47.2513,
+				Longitude:           -122.3149,
+				AccuracyRadiusKm:    22,
+			},
+		},
+		{
+			name: "country-only-ipv6",
+			ip:   "2001:218::1",
+			want: &annotator.Geolocation{
+				ContinentCode:             "AS",
+				CountryCode:               "JP",
+				CountryName:               "Japan",
+				Latitude:                  35.6854,
+				Longitude:                 139.7531,
+				AccuracyRadiusKm:          100,
+				CoordinatesAreApproximate: true,
+			},
+		},
+		{
+			name: "missing-after-network",
+			ip:   "216.160.83.64",
+			want: &annotator.Geolocation{Missing: true},
+		},
+		{
+			name: "missing-before-all-networks",
+			ip:   "1.0.0.1",
+			want: &annotator.Geolocation{Missing: true},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got *annotator.Geolocation
+			rtx.Must(g.AnnotateIP(net.ParseIP(tt.ip), &got), "Could not annotate IP")
+			if diff := deep.Equal(got, tt.want); diff != nil {
+				t.Errorf("AnnotateIP(%s) got!=want: %v", tt.ip, diff)
+			}
+		})
+	}
+	if err := g.AnnotateIP(nil, new(*annotator.Geolocation)); !errors.Is(err, annotator.ErrInvalidIP) {
+		t.Errorf("AnnotateIP(nil) error = %v, want %v", err, annotator.ErrInvalidIP)
+	}
+}
+
+func TestCSVAnnotate(t *testing.T) {
+	g := NewCSV(context.Background(), csvProvider(), []net.IP{net.ParseIP(localIP)})
+	ann := &annotator.Annotations{}
+	rtx.Must(g.Annotate(&inetdiag.SockID{SrcIP: "67.43.156.1", DstIP: localIP}, ann), "Could not annotate")
+	if ann.Client.Geo == nil || ann.Client.Geo.CountryCode != "BT" {
+		t.Errorf("Annotate() = %+v, want CountryCode BT", ann.Client.Geo)
+	}
+
+	err := g.Annotate(&inetdiag.SockID{SrcIP: "1.0.0.1", DstIP: "1.0.0.2"}, ann)
+	if !errors.Is(err, annotator.ErrUnknownDirection) {
+		t.Errorf("Annotate() error = %v, want %v", err, annotator.ErrUnknownDirection)
+	}
+	err = g.Annotate(&inetdiag.SockID{SrcIP: "not-an-ip", DstIP: localIP}, ann)
+	if !errors.Is(err, annotator.ErrInvalidIP) || !errors.Is(err, annotator.ErrNoAnnotation) {
+		t.Errorf("Annotate() error = %v, want %v and %v", err, annotator.ErrInvalidIP, annotator.ErrNoAnnotation)
+	}
+}
+
+func TestCSVReloadWarmCommit(t *testing.T) {
+	ctx := context.Background()
+	g := NewCSV(ctx, csvProvider(), nil).(*csvannotator)
+	live := g.index
+
+	// The file provider reports no change, so the data stays the same.
+	g.Reload(ctx)
+	if len(g.index) != len(live) {
+		t.Errorf("Reload() with no change replaced the data")
+	}
+
+	// A failed reload or warm keeps the live data.
+	g.backingDataSource = badProvider{errors.New("fake error")}
+	g.Reload(ctx)
+	if err := g.Warm(ctx); err == nil {
+		t.Error("Warm() should fail when the data can not be loaded")
+	}
+	g.Commit()
+	if len(g.index) != len(live) {
+		t.Errorf("failed Reload() or Warm() replaced the data")
+	}
+
+	g.backingDataSource = csvProvider()
+	rtx.Must(g.Warm(ctx), "Could not warm")
+	if g.staged == nil {
+		t.Fatal("Warm() should stage the data")
+	}
+	g.Commit()
+	if g.staged != nil || len(g.index) != len(live) {
+		t.Error("Commit() should swap in the staged data")
+	}
+}
+
+func TestCSVFromHTTP(t *testing.T) {
+	data, err := os.ReadFile("../testdata/GeoLite2-City-CSV.zip")
+	rtx.Must(err, "Could not read zip")
+	// The first download is the real zip, and every later one is truncated.
+	var gets int32
+	srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if atomic.AddInt32(&gets, 1) == 1 {
+			rw.Header().Set("ETag", `"v1"`)
+			rw.Write(data)
+			return
+		}
+		rw.Header().Set("ETag", `"v2"`)
+		rw.Write(data[:len(data)/2])
+	}))
+	defer srv.Close()
+
+	u, err := url.Parse(srv.URL + "/GeoLite2-City-CSV.zip")
+	rtx.Must(err, "Could not parse URL")
+	ctx := context.Background()
+	g := NewCSV(ctx, httpprovider.New(u), nil)
+	var geo *annotator.Geolocation
+	rtx.Must(g.AnnotateIP(net.ParseIP("2.125.160.216"), &geo), "Could not annotate")
+	if geo.CountryCode != "GB" {
+		t.Errorf("AnnotateIP() = %+v, want GB", geo)
+	}
+
+	// A truncated zip is an error, and keeps the live data.
+	if err := g.Warm(ctx); !errors.Is(err, zip.ErrFormat) {
+		t.Errorf("Warm() with a truncated zip = %v, want %v", err, zip.ErrFormat)
+	}
+	g.Reload(ctx)
+	rtx.Must(g.AnnotateIP(net.ParseIP("2.125.160.216"), &geo), "Could not annotate")
+	if geo.CountryCode != "GB" {
+		t.Errorf("AnnotateIP() after a truncated Reload() = %+v, want GB", geo)
+	}
+}
+
+func Test_parseCSV_errors(t *testing.T) {
+	const header = "network,geoname_id,registered_country_geoname_id,postal_code,latitude,longitude,accuracy_radius\n"
+	const locations = "geoname_id,country_iso_code\n"
+	tests := []struct {
+		name    string
+		data    []byte
+		wantErr error
+	}{
+		{
+			name: "missing-blocks",
+			data: zipOf(map[string]string{
+				"GeoLite2-City-Locations-en.csv": locations,
+			}),
+			wantErr: tarreader.ErrFileNotFound,
+		},
+		{
+			name: "missing-locations",
+			data: zipOf(map[string]string{
+				"GeoLite2-City-Blocks-IPv4.csv": header,
+				"GeoLite2-City-Blocks-IPv6.csv": header,
+			}),
+			wantErr: tarreader.ErrFileNotFound,
+		},
+		{
+			name: "only-bad-rows",
+			data: zipOf(map[string]string{
+				"GeoLite2-City-Locations-en.csv": locations,
+				"GeoLite2-City-Blocks-IPv4.csv":  header + "not-a-network,1,1,,0,0,1\n1.0.0.0/24,1,1,,not-a-float,0,1\n",
+				"GeoLite2-City-Blocks-IPv6.csv":  header + "::/64,1,1,,0,not-a-float,1\n::/64,1,1,,0,0,not-an-int\n",
+			}),
+			wantErr: ErrNoNetworks,
+		},
+		{
+			name: "empty-file",
+			data: zipOf(map[string]string{
+				"GeoLite2-City-Locations-en.csv": "",
+			}),
+			wantErr: io.ErrUnexpectedEOF,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := parseCSV(tt.data)
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("parseCSV() error = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+	if _, err := parseCSV([]byte("not a zip")); err == nil {
+		t.Error("parseCSV() should fail when the data is not a zip archive")
+	}
+}
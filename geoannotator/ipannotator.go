@@ -5,8 +5,10 @@ import (
 	"errors"
 	"fmt"
 	"log"
+	"math"
 	"net"
 	"sync"
+	"time"
 
 	"github.com/m-lab/go/content"
 	"github.com/m-lab/go/rtx"
@@ -14,30 +16,136 @@ import (
 
 	"github.com/m-lab/tcp-info/inetdiag"
 	"github.com/m-lab/uuid-annotator/annotator"
+	"github.com/m-lab/uuid-annotator/metrics"
 	"github.com/m-lab/uuid-annotator/tarreader"
 )
 
+// ErrNoData is returned, along with a Missing annotation, when no MaxMind data
+// has been loaded.
+var ErrNoData = errors.New("no MaxMind data loaded")
+
+// mmdbNames are the names of the mmdb file in the free GeoLite2 and the
+// commercial GeoIP2 archives, in the order they are looked for.
+var mmdbNames = []string{"GeoLite2-City.mmdb", "GeoIP2-City.mmdb"}
+
 // GeoAnnotator is just a regular annotator with a Reload method and an AnnotateIP method.
 type GeoAnnotator interface {
 	annotator.Annotator
 	Reload(context.Context)
 	AnnotateIP(ip net.IP, geo **annotator.Geolocation) error
+
+	// Warm loads and validates the latest data into a staging slot without
+	// making it live, and Commit makes the staged data live.
+	Warm(context.Context) error
+	Commit()
 }
 
 // geoannotator is the central struct for this module.
 type geoannotator struct {
 	mut               sync.RWMutex
-	localIPs          []net.IP
+	localIPs          *annotator.LocalIPSet
 	backingDataSource content.Provider
 	maxmind           *geoip2.Reader
+	staged            *geoip2.Reader
+
+	// versions enables reporting the MaxMind build date in every annotation.
+	versions bool
+	// approxOffsets enables computing ApproxUTCOffset.
+	approxOffsets bool
+	// failClosed disables annotating Missing when no data is loaded.
+	failClosed bool
+	// language is the preferred language of place names, or empty for English.
+	language string
+	// mmdbName is the name of the mmdb file in the archive, or empty to look
+	// for any of mmdbNames.
+	mmdbName string
+
+	annotator.ReloadGuard
+}
+
+// Option configures optional behavior in New.
+type Option func(*geoannotator)
+
+// WithDataVersions records the build date of the MaxMind database in the
+// DataVersions of every annotation.
+func WithDataVersions() Option {
+	return func(g *geoannotator) {
+		g.versions = true
+	}
+}
+
+// WithApproxUTCOffset sets the ApproxUTCOffset of locations that have
+// coordinates but no time zone in the MaxMind data.
+func WithApproxUTCOffset() Option {
+	return func(g *geoannotator) {
+		g.approxOffsets = true
+	}
+}
+
+// WithFailClosed returns an error, without a Missing annotation, when there is
+// no MaxMind data to search, so that a lookup failure can not be mistaken for
+// an IP that is not in the data.
+func WithFailClosed() Option {
+	return func(g *geoannotator) {
+		g.failClosed = true
+	}
+}
+
+// WithLanguage selects the language, e.g. "de" or "zh-CN", of the country, city
+// and subdivision names. Names that the MaxMind data does not have in that
+// language are given in English.
+func WithLanguage(language string) Option {
+	return func(g *geoannotator) {
+		g.language = language
+	}
 }
 
+// WithMMDBName reads the mmdb file with the given name from the archive, e.g.
+// "GeoIP2-Enterprise.mmdb", instead of a GeoLite2-City.mmdb or
+// GeoIP2-City.mmdb file.
+func WithMMDBName(name string) Option {
+	return func(g *geoannotator) {
+		g.mmdbName = name
+	}
+}
+
+// name returns the name in the preferred language, falling back to English.
+func (g *geoannotator) name(names map[string]string) string {
+	if n, ok := names[g.language]; ok && g.language != "" {
+		return n
+	}
+	return names["en"]
+}
+
+// approxUTCOffset returns the offset of the nominal time zone for the
+// longitude, which is 15 degrees wide and centered on a multiple of 15.
+func approxUTCOffset(longitude float64) string {
+	hours := math.Round(longitude / 15)
+	hours = math.Max(-12, math.Min(12, hours))
+	return fmt.Sprintf("%+03d:00", int(hours))
+}
+
+// UpdateLocalIPs replaces the local IPs used to find the client of each
+// connection.
+func (g *geoannotator) UpdateLocalIPs(localIPs []net.IP) {
+	g.localIPs.Update(localIPs)
+}
+
+// UpdateLocalNets replaces the local netblocks used to find the client of
+// connections without a local IP.
+func (g *geoannotator) UpdateLocalNets(localNets []net.IPNet) {
+	g.localIPs.UpdateNets(localNets)
+}
+
+// Name returns "geo".
+func (*geoannotator) Name() string { return "geo" }
+
 // Annotate assignes client geolocation data to the passed-in annotations.
 func (g *geoannotator) Annotate(ID *inetdiag.SockID, annotations *annotator.Annotations) error {
 	g.mut.RLock()
 	defer g.mut.RUnlock()
 
-	dir, err := annotator.FindDirection(ID, g.localIPs)
+	dir, err := g.localIPs.FindDirection(ID)
 	if err != nil {
 		return err
 	}
@@ -49,17 +157,25 @@ func (g *geoannotator) Annotate(ID *inetdiag.SockID, annotations *annotator.Anno
 		err = g.annotateHoldingLock(ID.DstIP, &annotations.Client.Geo)
 	}
 	if err != nil {
-		return annotator.ErrNoAnnotation
+		return fmt.Errorf("%w: %w", annotator.ErrNoAnnotation, err)
+	}
+	if g.versions && g.maxmind != nil {
+		annotations.Versions().MaxMind = buildDate(g.maxmind)
 	}
 	return nil
 }
 
+// buildDate returns the date the given MaxMind database was built.
+func buildDate(mm *geoip2.Reader) string {
+	return time.Unix(int64(mm.Metadata().BuildEpoch), 0).UTC().Format("2006-01-02")
+}
+
 var emptyResult = geoip2.City{}
 
 func (g *geoannotator) annotateHoldingLock(src string, geo **annotator.Geolocation) error {
 	ip := net.ParseIP(src)
 	if ip == nil {
-		return fmt.Errorf("failed to parse IP %q", src)
+		return fmt.Errorf("%w: failed to parse IP %q", annotator.ErrInvalidIP, src)
 	}
 	return g.annotateIPHoldingLock(ip, geo)
 }
@@ -72,18 +188,25 @@ func (g *geoannotator) AnnotateIP(ip net.IP, geo **annotator.Geolocation) error
 
 func (g *geoannotator) annotateIPHoldingLock(ip net.IP, geo **annotator.Geolocation) error {
 	if ip == nil {
-		return errors.New("can't annotate nil IP")
+		return fmt.Errorf("%w: can't annotate nil IP", annotator.ErrInvalidIP)
+	}
+	if annotator.IsReserved(ip) {
+		*geo = &annotator.Geolocation{Missing: true, Reserved: true}
+		return nil
 	}
 	if g.maxmind == nil {
-		log.Println("No maxmind DB present. This should only occur during testing.")
+		if g.failClosed {
+			return fmt.Errorf("%w: %w", annotator.ErrLookupFailed, ErrNoData)
+		}
+		// Callers keep the Missing annotation, and only log or count the error.
 		*geo = &annotator.Geolocation{
 			Missing: true,
 		}
-		return nil
+		return ErrNoData
 	}
 	record, err := g.maxmind.City(ip)
 	if err != nil {
-		return err
+		return fmt.Errorf("%w: %w", annotator.ErrLookupFailed, err)
 	}
 
 	// Check for empty results because "not found" is not an error. Instead the
@@ -102,21 +225,29 @@ func (g *geoannotator) annotateIPHoldingLock(ip net.IP, geo **annotator.Geolocat
 	tmp := &annotator.Geolocation{
 		ContinentCode:    record.Continent.Code,
 		CountryCode:      record.Country.IsoCode,
-		CountryName:      record.Country.Names["en"],
+		CountryName:      g.name(record.Country.Names),
 		MetroCode:        int64(record.Location.MetroCode),
-		City:             record.City.Names["en"],
+		City:             g.name(record.City.Names),
 		PostalCode:       record.Postal.Code,
 		Latitude:         record.Location.Latitude,
 		Longitude:        record.Location.Longitude,
 		AccuracyRadiusKm: int64(record.Location.AccuracyRadius),
+		TimeZone:         record.Location.TimeZone,
+	}
+	// Without a city, any coordinates are those of the country or continent.
+	if record.City.GeoNameID == 0 && (record.Location.Latitude != 0 || record.Location.Longitude != 0) {
+		tmp.CoordinatesAreApproximate = true
+	}
+	if g.approxOffsets && record.Location.TimeZone == "" && (record.Location.Latitude != 0 || record.Location.Longitude != 0) {
+		tmp.ApproxUTCOffset = approxUTCOffset(record.Location.Longitude)
 	}
 	// Collect subdivision information, if found.
 	if len(record.Subdivisions) > 0 {
 		tmp.Subdivision1ISOCode = record.Subdivisions[0].IsoCode
-		tmp.Subdivision1Name = record.Subdivisions[0].Names["en"]
+		tmp.Subdivision1Name = g.name(record.Subdivisions[0].Names)
 		if len(record.Subdivisions) > 1 {
 			tmp.Subdivision2ISOCode = record.Subdivisions[1].IsoCode
-			tmp.Subdivision2Name = record.Subdivisions[1].Names["en"]
+			tmp.Subdivision2Name = g.name(record.Subdivisions[1].Names)
 		}
 	}
 	*geo = tmp
@@ -131,15 +262,54 @@ func isEmpty(r *geoip2.City) bool {
 // the data in GCS is newer than the local data, and, if it is, then download
 // and load that new data into memory and then replace it in the annotator.
 func (g *geoannotator) Reload(ctx context.Context) {
+	if !g.AllowReload() {
+		return
+	}
+	start := time.Now()
+	defer func() { metrics.ReloadDuration.WithLabelValues("geo").Observe(time.Since(start).Seconds()) }()
 	newMM, err := g.load(ctx)
 	if err != nil {
 		log.Println("Could not reload dataset:", err)
+		g.ReloadFailed()
 		return
 	}
 	// Don't acquire the lock until after the data is in RAM.
 	g.mut.Lock()
 	defer g.mut.Unlock()
 	g.maxmind = newMM
+	metrics.GeoDatasetAge.Loaded()
+}
+
+// Warm loads the dataset into the staging slot, without replacing the data in
+// the annotator. The staged data only becomes live after a call to Commit. If
+// the new data can not be loaded or is not a usable City database, Warm
+// returns an error and leaves the staging slot unchanged.
+func (g *geoannotator) Warm(ctx context.Context) error {
+	newMM, err := g.load(ctx)
+	if err != nil {
+		return err
+	}
+	// Verify that the new database can actually answer the queries we make.
+	// Databases of the wrong type load fine, but fail every lookup.
+	if _, err = newMM.City(net.IPv4(127, 0, 0, 1)); err != nil {
+		return err
+	}
+	g.mut.Lock()
+	defer g.mut.Unlock()
+	g.staged = newMM
+	return nil
+}
+
+// Commit replaces the live dataset with the one loaded by Warm. If nothing has
+// been staged, Commit does nothing.
+func (g *geoannotator) Commit() {
+	g.mut.Lock()
+	defer g.mut.Unlock()
+	if g.staged == nil {
+		return
+	}
+	g.maxmind = g.staged
+	g.staged = nil
 }
 
 // load unconditionally loads datasets and returns them.
@@ -151,7 +321,17 @@ func (g *geoannotator) load(ctx context.Context) (*geoip2.Reader, error) {
 	if err != nil {
 		return nil, err
 	}
-	data, err := tarreader.FromTarGZ(tgz, "GeoLite2-City.mmdb")
+	names := mmdbNames
+	if g.mmdbName != "" {
+		names = []string{g.mmdbName}
+	}
+	var data []byte
+	for _, name := range names {
+		data, err = tarreader.FromTarGZ(tgz, name)
+		if !errors.Is(err, tarreader.ErrFileNotFound) && !errors.Is(err, tarreader.ErrNotRegularFile) {
+			break
+		}
+	}
 	if err != nil {
 		return nil, err
 	}
@@ -161,14 +341,18 @@ func (g *geoannotator) load(ctx context.Context) (*geoip2.Reader, error) {
 // New makes a new Annotator that uses IP addresses to generate geolocation and
 // ASNumber metadata for that IP based on the current copy of MaxMind data
 // stored in GCS.
-func New(ctx context.Context, geo content.Provider, localIPs []net.IP) GeoAnnotator {
+func New(ctx context.Context, geo content.Provider, localIPs []net.IP, opts ...Option) GeoAnnotator {
 	g := &geoannotator{
 		backingDataSource: geo,
-		localIPs:          localIPs,
+		localIPs:          annotator.NewLocalIPSet(localIPs),
+	}
+	for _, opt := range opts {
+		opt(g)
 	}
 	var err error
 	g.maxmind, err = g.load(ctx)
 	rtx.Must(err, "Could not load annotation db")
+	metrics.GeoDatasetAge.Loaded()
 	return g
 }
 
@@ -179,6 +363,21 @@ type fakegeoannotator struct {
 // Reload does nothing because you can't reload a fake.
 func (*fakegeoannotator) Reload(ctx context.Context) {}
 
+// Warm does nothing because you can't reload a fake.
+func (*fakegeoannotator) Warm(ctx context.Context) error { return nil }
+
+// Commit does nothing because you can't reload a fake.
+func (*fakegeoannotator) Commit() {}
+
+// AnnotateIP annotates every valid IP as Missing, without an error, because a
+// fake has no data to load.
+func (f *fakegeoannotator) AnnotateIP(ip net.IP, geo **annotator.Geolocation) error {
+	if err := f.geoannotator.AnnotateIP(ip, geo); err != ErrNoData {
+		return err
+	}
+	return nil
+}
+
 // NewFake creates a fake GeoAnnotator that contains no data. This is to aid
 // others in creating their own annotation services for testing.
 //
@@ -8,6 +8,7 @@ import (
 	"net"
 	"net/url"
 	"testing"
+	"time"
 
 	"github.com/go-test/deep"
 	"github.com/m-lab/go/content"
@@ -15,8 +16,11 @@ import (
 	"github.com/m-lab/go/rtx"
 	"github.com/m-lab/tcp-info/inetdiag"
 	"github.com/m-lab/uuid-annotator/annotator"
+	"github.com/m-lab/uuid-annotator/metrics"
+	"github.com/m-lab/uuid-annotator/retryprovider"
 	"github.com/m-lab/uuid-annotator/tarreader"
 	geoip2 "github.com/oschwald/geoip2-golang"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 )
 
 var localRawfile content.Provider
@@ -72,6 +76,9 @@ func TestIPAnnotationS2C(t *testing.T) {
 	if math.Abs(ann.Client.Geo.Latitude-51.75) > .01 {
 		t.Error("Bad Client latitude:", ann.Client.Geo.Latitude, "!~=", 51.75)
 	}
+	if ann.Client.Geo.TimeZone != "Europe/London" {
+		t.Errorf("Bad Client time zone: %q != %q", ann.Client.Geo.TimeZone, "Europe/London")
+	}
 
 	ann2 := &annotator.Annotations{}
 	g.AnnotateIP(net.ParseIP(remoteIP), &ann2.Client.Geo)
@@ -83,8 +90,8 @@ func TestIPAnnotationS2C(t *testing.T) {
 	// Test nil IP
 	ann3 := &annotator.Annotations{}
 	err := g.AnnotateIP(nil, &ann3.Client.Geo)
-	if err == nil {
-		t.Error("Should have had a non-nil error from a nil IP")
+	if !errors.Is(err, annotator.ErrInvalidIP) {
+		t.Errorf("AnnotateIP(nil) error = %v, want %v", err, annotator.ErrInvalidIP)
 	}
 }
 
@@ -138,6 +145,9 @@ func TestIPAnnotationBadIP(t *testing.T) {
 	if err == nil {
 		t.Errorf("Annotate succeeded with a bad IP: %q", conn.SrcIP)
 	}
+	if !errors.Is(err, annotator.ErrNoAnnotation) || !errors.Is(err, annotator.ErrInvalidIP) {
+		t.Errorf("Annotate() error = %v, want both %v and %v", err, annotator.ErrNoAnnotation, annotator.ErrInvalidIP)
+	}
 }
 
 func TestIPAnnotationBadDst(t *testing.T) {
@@ -179,8 +189,8 @@ func TestIPAnnotationUnknownDirection(t *testing.T) {
 
 	ann := &annotator.Annotations{}
 	err := g.Annotate(conn, ann)
-	if err == nil {
-		t.Error("Should have had an error due to unknown direction")
+	if !errors.Is(err, annotator.ErrUnknownDirection) {
+		t.Errorf("Annotate() error = %v, want %v", err, annotator.ErrUnknownDirection)
 	}
 }
 
@@ -206,6 +216,38 @@ func TestIPAnnotationUnknownIP(t *testing.T) {
 	}
 }
 
+func TestIPAnnotationApproximateCoordinates(t *testing.T) {
+	setUp()
+	g := New(context.Background(), localRawfile, []net.IP{net.ParseIP(localIP)})
+	tests := []struct {
+		name string
+		ip   string
+		want bool
+	}{
+		{
+			name: "city",
+			ip:   remoteIP,
+		},
+		{
+			name: "country-only", // Bhutan, with country centroid coordinates.
+			ip:   "67.43.156.1",
+			want: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var geo *annotator.Geolocation
+			rtx.Must(g.AnnotateIP(net.ParseIP(tt.ip), &geo), "Could not annotate IP")
+			if geo.Latitude == 0 && geo.Longitude == 0 {
+				t.Fatalf("AnnotateIP(%s) should have coordinates; got %+v", tt.ip, geo)
+			}
+			if geo.CoordinatesAreApproximate != tt.want {
+				t.Errorf("AnnotateIP(%s) CoordinatesAreApproximate = %v, want %v", tt.ip, geo.CoordinatesAreApproximate, tt.want)
+			}
+		})
+	}
+}
+
 type badProvider struct {
 	err error
 }
@@ -220,7 +262,7 @@ func TestIPAnnotationLoadNoChange(t *testing.T) {
 	fakeReader := geoip2.Reader{}
 	g := geoannotator{
 		backingDataSource: badProvider{content.ErrNoChange},
-		localIPs:          []net.IP{net.ParseIP(localIP)},
+		localIPs:          annotator.NewLocalIPSet([]net.IP{net.ParseIP(localIP)}),
 		maxmind:           &fakeReader, // NOTE: fake pointer just to verify return value below.
 	}
 
@@ -237,7 +279,7 @@ func TestIPAnnotationLoadErrors(t *testing.T) {
 	ctx := context.Background()
 	g := geoannotator{
 		backingDataSource: badProvider{errors.New("Error for testing")},
-		localIPs:          []net.IP{net.ParseIP(localIP)},
+		localIPs:          annotator.NewLocalIPSet([]net.IP{net.ParseIP(localIP)}),
 	}
 	_, err := g.load(ctx)
 	if err == nil {
@@ -290,7 +332,7 @@ func TestIPAnnotationMissingCityDB(t *testing.T) {
 	ctx := context.Background()
 	g := geoannotator{
 		backingDataSource: localEmpty,
-		localIPs:          []net.IP{net.ParseIP(localIP)},
+		localIPs:          annotator.NewLocalIPSet([]net.IP{net.ParseIP(localIP)}),
 	}
 
 	mm, err := g.load(ctx)
@@ -302,6 +344,61 @@ func TestIPAnnotationMissingCityDB(t *testing.T) {
 	}
 }
 
+func TestLoadMMDBNames(t *testing.T) {
+	tests := []struct {
+		name    string
+		file    string
+		opts    []Option
+		wantErr error
+	}{
+		{
+			name: "geolite2",
+			file: "file:../testdata/fake.tar.gz",
+		},
+		{
+			name: "geoip2",
+			file: "file:../testdata/geoip2.tar.gz",
+		},
+		{
+			name: "geoip2-by-name",
+			file: "file:../testdata/geoip2.tar.gz",
+			opts: []Option{WithMMDBName("GeoIP2-City.mmdb")},
+		},
+		{
+			name:    "wrong-name",
+			file:    "file:../testdata/geoip2.tar.gz",
+			opts:    []Option{WithMMDBName("GeoLite2-City.mmdb")},
+			wantErr: tarreader.ErrFileNotFound,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			u, err := url.Parse(tt.file)
+			rtx.Must(err, "Could not parse URL")
+			p, err := content.FromURL(ctx, u)
+			rtx.Must(err, "Could not create content.Provider")
+			g := &geoannotator{backingDataSource: p}
+			for _, opt := range tt.opts {
+				opt(g)
+			}
+			mm, err := g.load(ctx)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("load() error = %v, want %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			g.maxmind = mm
+			var geo *annotator.Geolocation
+			rtx.Must(g.AnnotateIP(net.ParseIP(remoteIP), &geo), "Could not annotate IP")
+			if geo.City != "Boxford" {
+				t.Errorf("AnnotateIP(%q).City = %q, want Boxford", remoteIP, geo.City)
+			}
+		})
+	}
+}
+
 func TestNewFake(t *testing.T) {
 	f := NewFake()
 	f.Reload(context.Background()) // no crash == success
@@ -312,3 +409,396 @@ func TestNewFake(t *testing.T) {
 		t.Error("Annotation should be missing.")
 	}
 }
+
+func TestAnnotateWithoutData(t *testing.T) {
+	g := &geoannotator{
+		localIPs: annotator.NewLocalIPSet([]net.IP{net.ParseIP(localIP)}),
+	}
+	geo := &annotator.Geolocation{City: "Stale"}
+	if err := g.AnnotateIP(net.ParseIP(remoteIP), &geo); err != ErrNoData {
+		t.Errorf("AnnotateIP() error = %v, want %v", err, ErrNoData)
+	}
+	if diff := deep.Equal(geo, &annotator.Geolocation{Missing: true}); diff != nil {
+		t.Errorf("AnnotateIP() without data should be Missing: %v", diff)
+	}
+
+	ann := &annotator.Annotations{}
+	err := g.Annotate(&inetdiag.SockID{SrcIP: localIP, DstIP: remoteIP}, ann)
+	if !errors.Is(err, ErrNoData) || !errors.Is(err, annotator.ErrNoAnnotation) {
+		t.Errorf("Annotate() error = %v, want %v and %v", err, ErrNoData, annotator.ErrNoAnnotation)
+	}
+	if ann.Client.Geo == nil || !ann.Client.Geo.Missing {
+		t.Errorf("Annotate() without data should be Missing; got %+v", ann.Client.Geo)
+	}
+}
+
+func TestAnnotateReserved(t *testing.T) {
+	setUp()
+	g := New(context.Background(), localRawfile, nil)
+	for _, ip := range []string{"10.0.0.1", "127.0.0.1", "::1", "169.254.1.1", "192.0.2.1"} {
+		geo := &annotator.Geolocation{City: "Stale"}
+		rtx.Must(g.AnnotateIP(net.ParseIP(ip), &geo), "Could not annotate %s", ip)
+		if diff := deep.Equal(geo, &annotator.Geolocation{Missing: true, Reserved: true}); diff != nil {
+			t.Errorf("AnnotateIP(%s) = %+v, diff %v", ip, geo, diff)
+		}
+	}
+
+	// Without data, reserved IPs are still known to be reserved.
+	g = &geoannotator{}
+	var geo *annotator.Geolocation
+	rtx.Must(g.AnnotateIP(net.ParseIP("10.0.0.1"), &geo), "Could not annotate without data")
+	if !geo.Reserved {
+		t.Errorf("AnnotateIP() without data = %+v, want Reserved", geo)
+	}
+}
+
+func TestWithFailClosed(t *testing.T) {
+	g := &geoannotator{
+		localIPs: annotator.NewLocalIPSet([]net.IP{net.ParseIP(localIP)}),
+	}
+	WithFailClosed()(g)
+	geo := &annotator.Geolocation{City: "Stale"}
+	err := g.AnnotateIP(net.ParseIP(remoteIP), &geo)
+	if !errors.Is(err, annotator.ErrLookupFailed) || !errors.Is(err, ErrNoData) {
+		t.Errorf("AnnotateIP() error = %v, want %v and %v", err, annotator.ErrLookupFailed, ErrNoData)
+	}
+	if geo.City != "Stale" || geo.Missing {
+		t.Errorf("AnnotateIP() should not change the geolocation; got %+v", geo)
+	}
+
+	ann := &annotator.Annotations{}
+	err = g.Annotate(&inetdiag.SockID{SrcIP: localIP, DstIP: remoteIP}, ann)
+	if !errors.Is(err, annotator.ErrLookupFailed) || !errors.Is(err, annotator.ErrNoAnnotation) {
+		t.Errorf("Annotate() error = %v, want %v and %v", err, annotator.ErrLookupFailed, annotator.ErrNoAnnotation)
+	}
+	if ann.Client.Geo != nil {
+		t.Errorf("Annotate() should not annotate a failed lookup; got %+v", ann.Client.Geo)
+	}
+}
+
+func TestWarmAndCommit(t *testing.T) {
+	setUp()
+	ctx := context.Background()
+	g := &geoannotator{
+		backingDataSource: localRawfile,
+		localIPs:          annotator.NewLocalIPSet([]net.IP{net.ParseIP(localIP)}),
+	}
+
+	// Warm should load the data, but not make it live.
+	rtx.Must(g.Warm(ctx), "Could not warm the annotator")
+	if g.maxmind != nil || g.staged == nil {
+		t.Fatalf("Warm() should only stage data; got live %v, staged %v", g.maxmind, g.staged)
+	}
+	geo := &annotator.Geolocation{}
+	if err := g.AnnotateIP(net.ParseIP(remoteIP), &geo); err != ErrNoData || !geo.Missing {
+		t.Errorf("Staged data should not be used for annotation before Commit(); got %+v, %v", geo, err)
+	}
+
+	// Commit should make the staged data live.
+	g.Commit()
+	if g.maxmind == nil || g.staged != nil {
+		t.Fatalf("Commit() should swap in the staged data; got live %v, staged %v", g.maxmind, g.staged)
+	}
+	rtx.Must(g.AnnotateIP(net.ParseIP(remoteIP), &geo), "Could not annotate IP")
+	if geo.City != "Boxford" {
+		t.Errorf("AnnotateIP() after Commit() = %+v, want City Boxford", geo)
+	}
+
+	// A second Commit with nothing staged changes nothing.
+	live := g.maxmind
+	g.Commit()
+	if g.maxmind != live {
+		t.Error("Commit() with nothing staged should not change the live data")
+	}
+}
+
+func TestWarmWithBadData(t *testing.T) {
+	setUp()
+	tests := []struct {
+		name     string
+		provider content.Provider
+	}{
+		{
+			name:     "wrong-db-type",
+			provider: localWrongType,
+		},
+		{
+			name:     "missing-city-db",
+			provider: localEmpty,
+		},
+		{
+			name:     "provider-error",
+			provider: badProvider{errors.New("Error for testing")},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			live := &geoip2.Reader{}
+			g := &geoannotator{
+				backingDataSource: tt.provider,
+				maxmind:           live,
+			}
+			if err := g.Warm(context.Background()); err == nil {
+				t.Error("Warm() should have returned an error")
+			}
+			g.Commit()
+			if g.maxmind != live {
+				t.Error("Bad data should never be swapped in")
+			}
+		})
+	}
+}
+
+func TestWithDataVersions(t *testing.T) {
+	conn := &inetdiag.SockID{
+		SrcIP: localIP,
+		DstIP: remoteIP,
+	}
+	localaddrs := []net.IP{net.ParseIP(localIP)}
+
+	setUp()
+	g := New(context.Background(), localRawfile, localaddrs, WithDataVersions())
+	ann := &annotator.Annotations{}
+	rtx.Must(g.Annotate(conn, ann), "Could not annotate connection")
+	if ann.DataVersions == nil || ann.DataVersions.MaxMind == "" {
+		t.Fatalf("Annotate() did not record the MaxMind version; got %+v", ann.DataVersions)
+	}
+	if _, err := time.Parse("2006-01-02", ann.DataVersions.MaxMind); err != nil {
+		t.Errorf("Annotate() MaxMind version = %q, want a date: %v", ann.DataVersions.MaxMind, err)
+	}
+
+	setUp()
+	g = New(context.Background(), localRawfile, localaddrs)
+	ann = &annotator.Annotations{}
+	rtx.Must(g.Annotate(conn, ann), "Could not annotate connection")
+	if ann.DataVersions != nil {
+		t.Errorf("Annotate() without WithDataVersions() = %+v, want nil", ann.DataVersions)
+	}
+}
+
+func TestWithApproxUTCOffset(t *testing.T) {
+	tests := []struct {
+		name string
+		ip   string
+		want string
+	}{
+		{
+			name: "no-time-zone", // Ukraine, at longitude 32, is in UTC+2.
+			ip:   "2a02:d300::1",
+			want: "+02:00",
+		},
+		{
+			name: "has-time-zone",
+			ip:   "216.160.83.56",
+		},
+		{
+			name: "no-coordinates",
+			ip:   "50.114.0.1",
+		},
+	}
+	setUp()
+	g := New(context.Background(), localRawfile, nil, WithApproxUTCOffset())
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var geo *annotator.Geolocation
+			rtx.Must(g.AnnotateIP(net.ParseIP(tt.ip), &geo), "Could not annotate IP")
+			if geo.ApproxUTCOffset != tt.want {
+				t.Errorf("AnnotateIP(%q).ApproxUTCOffset = %q, want %q", tt.ip, geo.ApproxUTCOffset, tt.want)
+			}
+		})
+	}
+
+	// Offsets are not computed unless enabled.
+	setUp()
+	g = New(context.Background(), localRawfile, nil)
+	var geo *annotator.Geolocation
+	rtx.Must(g.AnnotateIP(net.ParseIP("2a02:d300::1"), &geo), "Could not annotate IP")
+	if geo.ApproxUTCOffset != "" {
+		t.Errorf("AnnotateIP() without WithApproxUTCOffset() = %q, want empty", geo.ApproxUTCOffset)
+	}
+}
+
+func TestWithLanguage(t *testing.T) {
+	tests := []struct {
+		name     string
+		language string
+		ip       string
+		want     annotator.Geolocation
+	}{
+		{
+			name:     "de",
+			language: "de",
+			ip:       "81.2.69.142",
+			want: annotator.Geolocation{
+				CountryName:      "Vereinigtes Königreich",
+				City:             "London",
+				Subdivision1Name: "England", // No German name.
+			},
+		},
+		{
+			name:     "ja",
+			language: "ja",
+			ip:       "175.16.199.3",
+			want: annotator.Geolocation{
+				CountryName:      "中国",
+				City:             "長春市",
+				Subdivision1Name: "Jilin Sheng", // No Japanese name.
+			},
+		},
+		{
+			name:     "ja-fallback",
+			language: "ja",
+			ip:       remoteIP,
+			want: annotator.Geolocation{
+				CountryName:      "イギリス",
+				City:             "Boxford",
+				Subdivision1Name: "England",
+				Subdivision2Name: "West Berkshire",
+			},
+		},
+		{
+			name:     "unknown-language",
+			language: "xx",
+			ip:       remoteIP,
+			want: annotator.Geolocation{
+				CountryName:      "United Kingdom",
+				City:             "Boxford",
+				Subdivision1Name: "England",
+				Subdivision2Name: "West Berkshire",
+			},
+		},
+		{
+			name: "default",
+			ip:   "175.16.199.3",
+			want: annotator.Geolocation{
+				CountryName:      "China",
+				City:             "Changchun",
+				Subdivision1Name: "Jilin Sheng",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setUp()
+			g := New(context.Background(), localRawfile, nil, WithLanguage(tt.language))
+			var geo *annotator.Geolocation
+			rtx.Must(g.AnnotateIP(net.ParseIP(tt.ip), &geo), "Could not annotate IP")
+			got := annotator.Geolocation{
+				CountryName:      geo.CountryName,
+				City:             geo.City,
+				Subdivision1Name: geo.Subdivision1Name,
+				Subdivision2Name: geo.Subdivision2Name,
+			}
+			if diff := deep.Equal(got, tt.want); diff != nil {
+				t.Errorf("AnnotateIP(%q) names differ: %v", tt.ip, diff)
+			}
+		})
+	}
+}
+
+func Test_approxUTCOffset(t *testing.T) {
+	for lon, want := range map[float64]string{
+		0:      "+00:00",
+		-1.25:  "+00:00",
+		-73.9:  "-05:00",
+		139.75: "+09:00",
+		179.9:  "+12:00",
+		-180:   "-12:00",
+	} {
+		if got := approxUTCOffset(lon); got != want {
+			t.Errorf("approxUTCOffset(%v) = %q, want %q", lon, got, want)
+		}
+	}
+}
+
+// flakyProvider fails the first failures calls to Get, then defers to p.
+type flakyProvider struct {
+	p        content.Provider
+	failures int
+}
+
+func (f *flakyProvider) Get(ctx context.Context) ([]byte, error) {
+	if f.failures > 0 {
+		f.failures--
+		return nil, errors.New("fake transient error")
+	}
+	return f.p.Get(ctx)
+}
+
+func TestNewRetriesInitialLoad(t *testing.T) {
+	setUp()
+	flaky := &flakyProvider{p: localRawfile, failures: 2}
+	g := New(context.Background(), retryprovider.New(flaky, 3, time.Millisecond), []net.IP{net.ParseIP(localIP)})
+	ann := &annotator.Annotations{}
+	rtx.Must(g.Annotate(&inetdiag.SockID{SrcIP: localIP, DstIP: remoteIP}, ann), "Could not annotate connection")
+	if ann.Client.Geo == nil || ann.Client.Geo.Missing {
+		t.Errorf("New() did not load the data after transient failures; got %+v", ann.Client.Geo)
+	}
+}
+
+// countingProvider counts the calls to Get.
+type countingProvider struct {
+	p    content.Provider
+	gets int
+}
+
+func (c *countingProvider) Get(ctx context.Context) ([]byte, error) {
+	c.gets++
+	return c.p.Get(ctx)
+}
+
+func TestReloadSkipsFrequentCalls(t *testing.T) {
+	setUp()
+	counter := &countingProvider{p: localRawfile}
+	g := New(context.Background(), counter, []net.IP{net.ParseIP(localIP)})
+	l, ok := g.(annotator.ReloadLimiter)
+	if !ok {
+		t.Fatal("The geoannotator should be an annotator.ReloadLimiter")
+	}
+	l.SetMinReloadInterval(time.Hour)
+	g.Reload(context.Background())
+	g.Reload(context.Background())
+	// One Get for New, and one for the first Reload.
+	if counter.gets != 2 {
+		t.Errorf("Get() was called %d times, want 2, since the second Reload() should be skipped", counter.gets)
+	}
+}
+
+func TestReloadRetriesAfterFailure(t *testing.T) {
+	setUp()
+	counter := &countingProvider{p: localRawfile}
+	g := New(context.Background(), counter, []net.IP{net.ParseIP(localIP)})
+	g.(annotator.ReloadLimiter).SetMinReloadInterval(time.Hour)
+	counter.p = badProvider{errors.New("an error for testing")}
+	g.Reload(context.Background())
+	// The failed Reload does not delay the next one, but a successful one does.
+	counter.p = localRawfile
+	g.Reload(context.Background())
+	g.Reload(context.Background())
+	// One Get for New, and one for each of the first two Reloads.
+	if counter.gets != 3 {
+		t.Errorf("Get() was called %d times, want 3, since only the third Reload() should be skipped", counter.gets)
+	}
+}
+
+func TestReloadDatasetAge(t *testing.T) {
+	setUp()
+	g := New(context.Background(), localRawfile, []net.IP{net.ParseIP(localIP)})
+	time.Sleep(50 * time.Millisecond)
+	age := testutil.ToFloat64(metrics.GeoDatasetAge)
+	if age < 0.05 {
+		t.Fatalf("GeoDatasetAge = %v 50ms after New(), want at least 0.05", age)
+	}
+	g.Reload(context.Background())
+	if got := testutil.ToFloat64(metrics.GeoDatasetAge); got >= age {
+		t.Errorf("GeoDatasetAge = %v after Reload(), want less than %v", got, age)
+	}
+
+	// A failed reload leaves the age growing.
+	g.(*geoannotator).backingDataSource = badProvider{errors.New("an error for testing")}
+	time.Sleep(50 * time.Millisecond)
+	g.Reload(context.Background())
+	if got := testutil.ToFloat64(metrics.GeoDatasetAge); got < 0.05 {
+		t.Errorf("GeoDatasetAge = %v after a failed Reload(), want at least 0.05", got)
+	}
+}
@@ -3,15 +3,30 @@
 package handler
 
 import (
+	"bytes"
 	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
 	"log"
+	"net"
+	"net/http"
+	"regexp"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/googleapis/google-cloud-go-testing/storage/stiface"
 	"github.com/m-lab/go/rtx"
 	"github.com/m-lab/tcp-info/eventsocket"
 	"github.com/m-lab/tcp-info/inetdiag"
 	"github.com/m-lab/uuid-annotator/annotator"
+	"github.com/m-lab/uuid-annotator/asnannotator"
 	"github.com/m-lab/uuid-annotator/metrics"
 	"github.com/spf13/afero"
 )
@@ -25,66 +40,983 @@ type job struct {
 	timestamp time.Time
 	uuid      string
 	id        *inetdiag.SockID
+	metadata  []annotator.Metadata
 }
 
-func (j *job) WriteFile(dir string, data *annotator.Annotations) error {
-	// Serialize to JSON
-	contents, err := json.Marshal(data)
+// ErrUnknownUUID is returned by Lookup for UUIDs that are not in the index.
+var ErrUnknownUUID = errors.New("UUID not found in the recent annotations index")
+
+// ErrInvalidDatatype is returned by CheckDatatype for datatypes that are not a
+// single, simple directory name.
+var ErrInvalidDatatype = errors.New("datatype must be letters, digits, '-', or '_'")
+
+var datatypeRE = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_-]*$`)
+
+// jsonBuffers holds the buffers that annotations are serialized into, so that
+// the single processing goroutine does not allocate one for every job.
+var jsonBuffers = sync.Pool{New: func() interface{} { return &bytes.Buffer{} }}
+
+// withJSON calls use with the JSON of the annotations, byte-identical to that
+// of json.Marshal, including the escaping of HTML characters. The bytes are in
+// a pooled buffer, so must not be used once use returns.
+func withJSON(data *annotator.Annotations, use func(contents []byte) error) error {
+	buf := jsonBuffers.Get().(*bytes.Buffer)
+	defer jsonBuffers.Put(buf)
+	buf.Reset()
+	err := json.NewEncoder(buf).Encode(data)
 	rtx.Must(err, "Could not serialize the Annotations struct to JSON. This should never happen.")
+	// Unlike Marshal, Encode ends the JSON with a newline.
+	return use(buf.Bytes()[:buf.Len()-1])
+}
 
-	// Create the necessary subdirectories.
-	dir = dir + j.timestamp.Format("/2006/01/02/")
-	err = fs.MkdirAll(dir, 0755)
-	if err != nil {
-		return err
-	}
+// putTimeout bounds each write to the sink, so that a stalled write to GCS can
+// not block the processing goroutine forever.
+const putTimeout = time.Minute
+
+// WriteFile writes the annotations of the job to the sink.
+func (j *job) WriteFile(sink Sink, data *annotator.Annotations) error {
+	return withJSON(data, func(contents []byte) error {
+		ctx, cancel := context.WithTimeout(context.Background(), putTimeout)
+		defer cancel()
+		return sink.Put(ctx, j.name(), contents)
+	})
+}
+
+// name returns the name of the file for the job, relative to the datadir.
+func (j *job) name() string {
+	return j.timestamp.Format("2006/01/02/") + j.uuid + ".json"
+}
 
-	// Write the serialized data
-	return fsutil.WriteFile(dir+j.uuid+".json", contents, 0666)
+// path returns the name of the file for the job in datadir.
+func (j *job) path(datadir string) string {
+	return datadir + "/" + j.name()
 }
 
 type handler struct {
 	datadir    string
+	datatype   string
 	jobs       chan *job
 	annotators []annotator.Annotator
+	localIPs   *annotator.LocalIPSet
+	hashes     *hashSet
+	audit      asnannotator.ASNAnnotator
+	announced  asnannotator.ASNAnnotator
+	index      *uuidIndex
+	recent     *recentRing
+	omit       bool
+	errDetails bool
+	projection *annotator.Projection
+	ipHashKey  []byte
+	serverIP   bool
+	sameCC     bool
+	sampleN    uint32
+	wal        *WAL
+	side       Side
+
+	// If positive, Open waits up to blockTimeout for room in a full buffer.
+	blockTimeout time.Duration
+
+	// If stream is set, every annotation is also written to it as a line of
+	// JSON, and noFiles suppresses the files.
+	stream  io.Writer
+	noFiles bool
+
+	// The files are written to sink, which is the local datadir unless it is
+	// a gs:// URL.
+	sink Sink
+	gcs  stiface.Client
+
+	// If ndjson is set, the annotations are appended to its files instead.
+	ndjson *ndjsonWriter
+
+	// Once draining is set, Open only logs new jobs to the WAL, and the
+	// buffered jobs are processed for at most drainTimeout.
+	drainTimeout time.Duration
+	draining     atomic.Bool
+
+	// After maxWriteFailures consecutive files fail to be written, the handler
+	// is unhealthy until a file is written again.
+	maxWriteFailures int
+	writeFailures    int // Only used by ProcessIncomingRequests.
+	unhealthy        atomic.Bool
+}
+
+// uuidIndex maps a bounded number of recently written UUIDs to their files.
+// Once full, the oldest UUID is forgotten for every new one.
+type uuidIndex struct {
+	mu    sync.Mutex
+	paths map[string]string
+	order []string // A ring buffer of the UUIDs in paths, oldest at next.
+	next  int
+}
+
+func (x *uuidIndex) add(uuid, path string) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	if cap(x.order) == 0 {
+		return
+	}
+	if _, ok := x.paths[uuid]; ok {
+		x.paths[uuid] = path
+		return
+	}
+	if len(x.order) < cap(x.order) {
+		x.order = append(x.order, uuid)
+	} else {
+		delete(x.paths, x.order[x.next])
+		x.order[x.next] = uuid
+		x.next = (x.next + 1) % len(x.order)
+	}
+	x.paths[uuid] = path
+}
+
+func (x *uuidIndex) get(uuid string) (string, bool) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	path, ok := x.paths[uuid]
+	return path, ok
+}
+
+// recentRing holds the JSON of the most recent annotations, up to its
+// capacity. Once full, the oldest annotations are overwritten. The JSON is a
+// snapshot, so that annotations sharing structs with an annotator, or with
+// other annotations, are shown as they were when added.
+type recentRing struct {
+	mu   sync.Mutex
+	ann  []json.RawMessage
+	next int // The index of the oldest annotations once ann is full.
+}
+
+func (r *recentRing) add(a *annotator.Annotations) {
+	b, err := json.Marshal(a)
+	if err != nil {
+		log.Println("Could not remember the recent annotations:", err)
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.ann) < cap(r.ann) {
+		r.ann = append(r.ann, b)
+		return
+	}
+	r.ann[r.next] = b
+	r.next = (r.next + 1) % len(r.ann)
+}
+
+// get returns the annotations from oldest to newest.
+func (r *recentRing) get() []json.RawMessage {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append(append([]json.RawMessage{}, r.ann[r.next:]...), r.ann[:r.next]...)
+}
+
+// hashSet remembers a bounded number of recently seen payload hashes.
+type hashSet struct {
+	mu   sync.Mutex
+	max  int
+	seen map[string]struct{}
+}
+
+// add records the hash and returns true if it was already present. To bound
+// memory use, the set is cleared once it holds max hashes.
+func (s *hashSet) add(hash string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.seen[hash]; ok {
+		return true
+	}
+	if len(s.seen) >= s.max {
+		s.seen = make(map[string]struct{}, s.max)
+	}
+	s.seen[hash] = struct{}{}
+	return false
+}
+
+// Option configures optional handler behavior in New.
+type Option func(*handler)
+
+// WithLocalIPs lets the handler detect flows whose client IP is also a local
+// IP, e.g. because of misconfiguration or NAT hairpinning. Such flows break the
+// client/server distinction, so they are logged and counted.
+func WithLocalIPs(localIPs []net.IP) Option {
+	return func(h *handler) {
+		h.localIPs = annotator.NewLocalIPSet(localIPs)
+	}
+}
+
+// UpdateLocalIPs replaces the local IPs set by WithLocalIPs. It has no effect
+// if WithLocalIPs was not used.
+func (h *handler) UpdateLocalIPs(localIPs []net.IP) {
+	if h.localIPs != nil {
+		h.localIPs.Update(localIPs)
+	}
+}
+
+// UpdateLocalNets replaces the local netblocks used to find the direction of
+// connections without a local IP. It has no effect if WithLocalIPs was not
+// used.
+func (h *handler) UpdateLocalNets(localNets []net.IPNet) {
+	if h.localIPs != nil {
+		h.localIPs.UpdateNets(localNets)
+	}
+}
+
+// CheckDatatype returns an error unless datatype is a valid argument for
+// WithDatatype.
+func CheckDatatype(datatype string) error {
+	if !datatypeRE.MatchString(datatype) {
+		return fmt.Errorf("%w: %q", ErrInvalidDatatype, datatype)
+	}
+	return nil
+}
+
+// WithDatatype writes the files under a subdirectory of the datadir named for
+// the datatype, e.g. datadir/annotation2/2006/01/02/, for nodes that store
+// several datatypes in one directory. The datatype should be checked with
+// CheckDatatype.
+func WithDatatype(datatype string) Option {
+	return func(h *handler) {
+		h.datatype = datatype
+	}
+}
+
+// WithWAL logs every job in the given WAL before it is buffered, and marks it
+// done once it has been handled. ProcessIncomingRequests first annotates the
+// jobs that the WAL held when it was opened, e.g. because the process crashed
+// before handling them.
+func WithWAL(w *WAL) Option {
+	return func(h *handler) {
+		h.wal = w
+	}
+}
+
+// WithOmitMissing omits Geo and Network annotations that could not be
+// found, instead of writing them as objects with Missing set to true. Omitted
+// annotations save space, but make "not found" indistinguishable from "not
+// annotated", e.g. because an annotator is disabled or failed.
+func WithOmitMissing() Option {
+	return func(h *handler) {
+		h.omit = true
+	}
+}
+
+// WithErrorDetails records the failure of each annotator for a connection in
+// the Debug field of the written annotations, in addition to logging and
+// counting it.
+func WithErrorDetails() Option {
+	return func(h *handler) {
+		h.errDetails = true
+	}
+}
+
+// WithFieldAllowlist only writes the fields of the annotations kept by the
+// projection, to save space for consumers that only need some of them.
+func WithFieldAllowlist(p *annotator.Projection) Option {
+	return func(h *handler) {
+		h.projection = p
+	}
+}
+
+// Side selects the ends of each connection that are annotated.
+type Side int
+
+// The sides that may be annotated.
+const (
+	BothSides Side = iota
+	ClientSide
+	ServerSide
+)
+
+// WithSide only writes the annotations of the given side of each connection,
+// to save work and space for consumers that only need one of them. The other
+// side is written as an empty object, its post-processing (e.g. the client IP
+// hash or the server local IP) is skipped, and so is the direction audit,
+// which needs both sides. The caller should also leave out the annotators of
+// the other side, since the handler cannot skip their work.
+func WithSide(side Side) Option {
+	return func(h *handler) {
+		h.side = side
+	}
+}
+
+// dropOtherSide removes the annotations of the side that is not annotated.
+func (h *handler) dropOtherSide(data *annotator.Annotations) {
+	switch h.side {
+	case ClientSide:
+		data.Server = annotator.ServerAnnotations{}
+	case ServerSide:
+		data.Client = annotator.ClientAnnotations{}
+	}
+}
+
+// omitMissing removes the Geo and Network annotations with Missing set.
+func omitMissing(data *annotator.Annotations) {
+	if data.Client.Geo != nil && data.Client.Geo.Missing {
+		data.Client.Geo = nil
+	}
+	if data.Client.Network != nil && data.Client.Network.Missing {
+		data.Client.Network = nil
+	}
+	if data.Server.Geo != nil && data.Server.Geo.Missing {
+		data.Server.Geo = nil
+	}
+	if data.Server.Network != nil && data.Server.Network.Missing {
+		data.Server.Network = nil
+	}
+}
+
+// WithUUIDIndex remembers the files written for the most recent size UUIDs,
+// so their annotations can be retrieved with Lookup shortly after they are
+// produced.
+func WithUUIDIndex(size int) Option {
+	return func(h *handler) {
+		h.index = &uuidIndex{
+			paths: make(map[string]string, size),
+			order: make([]string, 0, size),
+		}
+	}
+}
+
+// Lookup returns the JSON annotation written for the given UUID, if the UUID is
+// in the index enabled by WithUUIDIndex.
+func (h *handler) Lookup(uuid string) ([]byte, error) {
+	if h.index == nil {
+		return nil, ErrUnknownUUID
+	}
+	path, ok := h.index.get(uuid)
+	if !ok {
+		return nil, ErrUnknownUUID
+	}
+	return fsutil.ReadFile(path)
+}
+
+// ServeLookup serves the annotation JSON that Lookup returns for the "uuid"
+// argument, or a 404 if it is not in the index.
+func (h *handler) ServeLookup(rw http.ResponseWriter, req *http.Request) {
+	contents, err := h.Lookup(req.URL.Query().Get("uuid"))
+	if errors.Is(err, ErrUnknownUUID) {
+		http.Error(rw, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Println("Could not read the indexed annotation:", err)
+		http.Error(rw, "could not read the annotation", http.StatusInternalServerError)
+		return
+	}
+	rw.Header().Set("Content-Type", "application/json")
+	rw.Write(contents)
+}
+
+// WithRecent remembers the annotations of the most recent size UUIDs, for
+// ServeRecent to show while debugging a live node.
+func WithRecent(size int) Option {
+	return func(h *handler) {
+		if size > 0 {
+			h.recent = &recentRing{ann: make([]json.RawMessage, 0, size)}
+		}
+	}
+}
+
+// ServeRecent responds with a JSON array of the annotations remembered by
+// WithRecent, from oldest to newest. The array is empty without WithRecent.
+func (h *handler) ServeRecent(rw http.ResponseWriter, req *http.Request) {
+	recent := []json.RawMessage{}
+	if h.recent != nil {
+		recent = h.recent.get()
+	}
+	rw.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(rw).Encode(recent); err != nil {
+		log.Println("Could not write the recent annotations:", err)
+	}
+}
+
+// WithDirectionAudit checks every flow for evidence that its direction was
+// misidentified, e.g. because the local IPs are misconfigured. The flow is
+// interpreted both ways, and if the IP treated as the client is in the
+// server's AS while the IP treated as the server is not, the discrepancy is
+// logged and counted. The audit never changes the annotations. It requires
+// WithLocalIPs and server Network annotations from siteinfo.
+func WithDirectionAudit(asn asnannotator.ASNAnnotator) Option {
+	return func(h *handler) {
+		h.audit = asn
+	}
+}
+
+// auditResult compares both interpretations of the flow's direction against
+// the server's known AS number.
+func (h *handler) auditResult(ID *inetdiag.SockID, ends *endpoints, annotations *annotator.Annotations) string {
+	if ends == nil || annotations.Server.Network == nil || annotations.Server.Network.ASNumber == 0 {
+		return "unknown"
+	}
+	want := annotations.Server.Network.ASNumber
+	asServer := h.audit.AnnotateIP(ends.server)
+	asClient := h.audit.AnnotateIP(ends.client)
+	if asServer.ASNumber != want && asClient.ASNumber == want {
+		log.Printf("Flow direction may be reversed: client %s is in server AS%d, server %s is in AS%d for %+v\n",
+			ends.client, want, ends.server, asServer.ASNumber, ID)
+		return "reversed"
+	}
+	return "consistent"
+}
+
+// WithAnnouncedServerCIDR adds the RouteViews prefix that contains the server
+// IP to the server Network annotations as AnnouncedCIDR. The server CIDR keeps
+// the site's allocation from siteinfo, which takes precedence because it is
+// what the site was actually assigned. It requires WithLocalIPs and server
+// Network annotations from siteinfo.
+func WithAnnouncedServerCIDR(asn asnannotator.ASNAnnotator) Option {
+	return func(h *handler) {
+		h.announced = asn
+	}
+}
+
+// annotateAnnouncedCIDR adds the server AnnouncedCIDR, if enabled.
+func (h *handler) annotateAnnouncedCIDR(ends *endpoints, annotations *annotator.Annotations) {
+	if h.announced == nil || ends == nil || annotations.Server.Network == nil {
+		return
+	}
+	n := h.announced.AnnotateIP(ends.server)
+	if n == nil || n.Missing {
+		return
+	}
+	// The siteannotator shares one Network between all annotations, so copy it
+	// before changing it.
+	network := *annotations.Server.Network
+	network.AnnouncedCIDR = n.CIDR
+	annotations.Server.Network = &network
+}
+
+// WithClientIPHash records the Client IPHash, the HMAC of the client IP with
+// the given secret key, in every file. The same IP and key always give the
+// same hash, so rows can be joined by client without exposing the IP. It
+// requires WithLocalIPs.
+func WithClientIPHash(key []byte) Option {
+	return func(h *handler) {
+		h.ipHashKey = key
+	}
+}
+
+// clientIPHash returns the hex HMAC-SHA256 of the canonical form of the IP.
+func clientIPHash(key []byte, ip net.IP) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(ip.String()))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// annotateClientIPHash adds the Client IPHash, if enabled.
+func (h *handler) annotateClientIPHash(ends *endpoints, annotations *annotator.Annotations) {
+	if h.ipHashKey == nil || ends == nil || h.side == ServerSide {
+		return
+	}
+	ip := net.ParseIP(ends.client)
+	if ip == nil {
+		return
+	}
+	annotations.Client.IPHash = clientIPHash(h.ipHashKey, ip)
+}
+
+// WithServerLocalIP records the local IP that matched the server end of each
+// connection as the Server LocalIP, to correlate misannotations with specific
+// addresses. It requires WithLocalIPs.
+func WithServerLocalIP() Option {
+	return func(h *handler) {
+		h.serverIP = true
+	}
+}
+
+// annotateServerLocalIP adds the Server LocalIP, if enabled.
+func (h *handler) annotateServerLocalIP(ends *endpoints, annotations *annotator.Annotations) {
+	if !h.serverIP || ends == nil || h.side == ClientSide {
+		return
+	}
+	annotations.Server.LocalIP = ends.server
+}
+
+// WithSameCountry records whether the client and server are in the same
+// country as SameCountry, for a quick domestic or international split without
+// joining the client and server countries downstream.
+func WithSameCountry() Option {
+	return func(h *handler) {
+		h.sameCC = true
+	}
+}
+
+// annotateSameCountry adds SameCountry, if enabled and both countries are
+// known.
+func (h *handler) annotateSameCountry(annotations *annotator.Annotations) {
+	if !h.sameCC {
+		return
+	}
+	client, server := annotations.Client.Geo, annotations.Server.Geo
+	if client == nil || server == nil || client.Missing || server.Missing ||
+		client.CountryCode == "" || server.CountryCode == "" {
+		return
+	}
+	same := client.CountryCode == server.CountryCode
+	annotations.SameCountry = &same
+}
+
+// auditDirection returns the result of the direction audit, or the empty
+// string if it is disabled.
+func (h *handler) auditDirection(ID *inetdiag.SockID, ends *endpoints, annotations *annotator.Annotations) string {
+	if h.audit == nil || ID == nil || h.side != BothSides {
+		return ""
+	}
+	return h.auditResult(ID, ends, annotations)
+}
+
+// WithPayloadHash records the annotator.Annotations PayloadHash in every file,
+// and counts how many payloads duplicate one of the last maxRecent payloads,
+// as a first step towards deduping identical annotations.
+func WithPayloadHash(maxRecent int) Option {
+	return func(h *handler) {
+		h.hashes = &hashSet{
+			max:  maxRecent,
+			seen: make(map[string]struct{}, maxRecent),
+		}
+	}
+}
+
+// payloadHash returns the hex SHA-256 of the JSON serialization of the given
+// annotations, excluding fields that are unique to each UUID, and the Metadata
+// and Debug fields, which are about the connection and its annotation rather
+// than annotations themselves.
+func payloadHash(data *annotator.Annotations) string {
+	payload := *data
+	payload.UUID = ""
+	payload.Timestamp = time.Time{}
+	payload.PayloadHash = ""
+	payload.Metadata = nil
+	payload.Debug = nil
+	contents, err := json.Marshal(&payload)
+	rtx.Must(err, "Could not serialize the Annotations struct to JSON. This should never happen.")
+	return fmt.Sprintf("%x", sha256.Sum256(contents))
+}
+
+// setPayloadHash sets the PayloadHash of the annotations, if enabled.
+func (h *handler) setPayloadHash(data *annotator.Annotations) {
+	if h.hashes == nil {
+		return
+	}
+	data.PayloadHash = payloadHash(data)
+}
+
+// countPayloadHash remembers the PayloadHash of saved annotations, and counts
+// whether it is a duplicate.
+func (h *handler) countPayloadHash(data *annotator.Annotations) {
+	if h.hashes == nil {
+		return
+	}
+	if h.hashes.add(data.PayloadHash) {
+		metrics.PayloadHashes.WithLabelValues("duplicate").Inc()
+	} else {
+		metrics.PayloadHashes.WithLabelValues("unique").Inc()
+	}
+}
+
+// WithDrainTimeout makes ProcessIncomingRequests keep processing the buffered
+// jobs after its context is canceled, for at most timeout, instead of returning
+// immediately. New jobs are dropped once draining starts. With a WAL, the jobs
+// left after the timeout, and the jobs opened while draining, are annotated at
+// the next start.
+func WithDrainTimeout(timeout time.Duration) Option {
+	return func(h *handler) {
+		h.drainTimeout = timeout
+	}
+}
+
+// drain processes the buffered jobs until none are left or the drain timeout
+// expires, and counts the jobs that were drained or abandoned.
+func (h *handler) drain() {
+	h.draining.Store(true)
+	timeout := time.NewTimer(h.drainTimeout)
+	defer timeout.Stop()
+	for {
+		// The timeout is checked first, since jobs may always be ready.
+		select {
+		case <-timeout.C:
+			metrics.DrainedJobs.WithLabelValues("abandoned").Add(float64(len(h.jobs)))
+			return
+		default:
+		}
+		select {
+		case j := <-h.jobs:
+			if j != nil {
+				h.annotateAndSave(j)
+				metrics.DrainedJobs.WithLabelValues("drained").Inc()
+			}
+		default:
+			return
+		}
+	}
+}
+
+// WithBlockingOpen makes Open wait up to timeout for room in the buffer when it
+// is full, slowing the event source down instead of dropping the job at once.
+// Jobs are still dropped once the timeout expires or the context of Open is
+// canceled. Non-positive timeouts keep the default of dropping immediately.
+func WithBlockingOpen(timeout time.Duration) Option {
+	return func(h *handler) {
+		h.blockTimeout = timeout
+	}
+}
+
+// enqueue buffers the job, and returns the reason it was dropped, if it was.
+func (h *handler) enqueue(ctx context.Context, j *job) string {
+	select {
+	case h.jobs <- j:
+		return ""
+	default:
+	}
+	if h.blockTimeout <= 0 {
+		return "pipefull"
+	}
+	timeout := time.NewTimer(h.blockTimeout)
+	defer timeout.Stop()
+	select {
+	case h.jobs <- j:
+		return ""
+	case <-timeout.C:
+		return "pipefull"
+	case <-ctx.Done():
+		return "canceled"
+	}
+}
+
+// WithGCSClient writes the files with the given client when the datadir is a
+// gs://bucket/prefix URL, as objects named like the files below a local
+// datadir, e.g. prefix/2009/03/18/UUID.json. Lookup finds no UUIDs in GCS.
+func WithGCSClient(client stiface.Client) Option {
+	return func(h *handler) {
+		h.gcs = client
+	}
+}
+
+// WithAggregation appends every annotation as a line to one newline-delimited
+// JSON file in the local datadir for every interval of the UUID timestamps,
+// e.g. datadir/2009/03/18/010000.ndjson for an hourly interval, instead of
+// writing a file per UUID. ProcessIncomingRequests closes the file it is
+// writing when it returns. Lookup finds no UUIDs in the aggregated files.
+func WithAggregation(interval time.Duration) Option {
+	return func(h *handler) {
+		if interval > 0 {
+			h.ndjson = &ndjsonWriter{interval: interval}
+		}
+	}
+}
+
+// writeFile writes the annotations to their own file in the sink, or to the
+// aggregated file, if enabled.
+func (h *handler) writeFile(j *job, annotations *annotator.Annotations) error {
+	if h.ndjson == nil {
+		return j.WriteFile(h.sink, annotations)
+	}
+	return withJSON(annotations, func(contents []byte) error {
+		return h.ndjson.write(j.timestamp, contents)
+	})
+}
+
+// WithMaxWriteFailures makes the handler unhealthy once n consecutive files
+// could not be written, e.g. because the disk is full or the datadir was
+// removed, so that the node can be drained instead of silently losing every
+// annotation. It is healthy again after the next file is written.
+func WithMaxWriteFailures(n int) Option {
+	return func(h *handler) {
+		h.maxWriteFailures = n
+	}
+}
+
+// recordWrite counts consecutive write failures, and sets the health of the
+// handler when they reach, or stop at, the maximum.
+func (h *handler) recordWrite(err error) {
+	if h.maxWriteFailures <= 0 {
+		return
+	}
+	if err == nil {
+		h.writeFailures = 0
+		if h.unhealthy.Swap(false) {
+			log.Println("Files are being written to", h.datadir, "again; the handler is healthy")
+			metrics.WritesFailing.Set(0)
+		}
+		return
+	}
+	h.writeFailures++
+	if h.writeFailures >= h.maxWriteFailures && !h.unhealthy.Swap(true) {
+		log.Printf("ERROR: the last %d files could not be written to %s, most recently because: %v. The handler is unhealthy, and the node should be drained.",
+			h.writeFailures, h.datadir, err)
+		metrics.WritesFailing.Set(1)
+	}
+}
+
+// Healthy returns false once WithMaxWriteFailures consecutive files could not
+// be written, until a file is written again.
+func (h *handler) Healthy() bool {
+	return !h.unhealthy.Load()
+}
+
+// ServeHealth responds with 200 OK while the handler is Healthy, and with 503
+// Service Unavailable otherwise, for a readiness check to drain the node.
+func (h *handler) ServeHealth(rw http.ResponseWriter, req *http.Request) {
+	if !h.Healthy() {
+		http.Error(rw, "annotation files can not be written", http.StatusServiceUnavailable)
+		return
+	}
+	fmt.Fprintln(rw, "ok")
+}
+
+// WithStream writes every annotation as one line of JSON to w, in addition to
+// its file, so that a process tailing w, e.g. stdout or a named pipe, sees the
+// annotations without polling the datadir. If w has a Flush method, it is
+// called after every line.
+func WithStream(w io.Writer) Option {
+	return func(h *handler) {
+		h.stream = w
+	}
+}
+
+// WithoutFiles writes no files, for handlers whose annotations are only needed
+// by the consumer of WithStream. Lookup finds no UUIDs without files.
+func WithoutFiles() Option {
+	return func(h *handler) {
+		h.noFiles = true
+	}
+}
+
+// writeLine writes the annotations to the stream, if enabled.
+func (h *handler) writeLine(annotations *annotator.Annotations) error {
+	if h.stream == nil {
+		return nil
+	}
+	err := withJSON(annotations, func(line []byte) error {
+		// A single write keeps every line whole, e.g. on a pipe.
+		_, err := h.stream.Write(append(line, '\n'))
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if f, ok := h.stream.(interface{ Flush() error }); ok {
+		return f.Flush()
+	}
+	return nil
+}
+
+// WithSampling annotates only one in n UUIDs, to reduce load on the busiest
+// nodes. UUIDs are chosen deterministically by their hash. Values of n less
+// than two annotate every UUID.
+func WithSampling(n int) Option {
+	return func(h *handler) {
+		if n > 1 {
+			h.sampleN = uint32(n)
+		}
+	}
+}
+
+// sampled returns true if the UUID should be annotated.
+func (h *handler) sampled(uuid string) bool {
+	if h.sampleN == 0 {
+		return true
+	}
+	f := fnv.New32a()
+	f.Write([]byte(uuid))
+	return f.Sum32()%h.sampleN == 0
 }
 
 // Open adds a new .json file to the work queue.
 func (h *handler) Open(ctx context.Context, timestamp time.Time, uuid string, ID *inetdiag.SockID) {
-	select {
-	case h.jobs <- &job{
+	h.OpenWithMetadata(ctx, timestamp, uuid, ID, nil)
+}
+
+// OpenWithMetadata is like Open, but also writes the given metadata, which may
+// be nil, in the annotations of the connection.
+func (h *handler) OpenWithMetadata(ctx context.Context, timestamp time.Time, uuid string, ID *inetdiag.SockID, metadata []annotator.Metadata) {
+	if !h.sampled(uuid) {
+		metrics.SampledOutJobs.Inc()
+		return
+	}
+	j := &job{
 		timestamp: timestamp,
 		uuid:      uuid,
 		id:        ID,
-	}:
-	default:
-		metrics.MissedJobs.WithLabelValues("pipefull").Inc()
+		// Copied, because the job outlives the call.
+		metadata: append([]annotator.Metadata(nil), metadata...),
+	}
+	h.wal.add(j)
+	if h.draining.Load() {
+		// Without a WAL, the job is lost. With one, it is annotated at the
+		// next start instead.
+		if h.wal == nil {
+			log.Println("Dropping the connection opened during shutdown:", uuid)
+			metrics.MissedJobs.WithLabelValues("draining").Inc()
+		} else {
+			metrics.DrainedJobs.WithLabelValues("deferred").Inc()
+		}
+		return
 	}
+	if reason := h.enqueue(ctx, j); reason != "" {
+		metrics.MissedJobs.WithLabelValues(reason).Inc()
+		h.wal.complete(uuid)
+	}
+	metrics.QueueDepth.Set(float64(len(h.jobs)))
 }
 
 // Close is a no-op, implemented here to ensure that handler implements all of eventsocket.Handler.
 func (*handler) Close(ctx context.Context, timestamp time.Time, uuid string) {}
 
-func (h *handler) annotateAndSave(j *job) {
+// errorReason classifies annotation errors for metrics.
+func errorReason(err error) string {
+	switch {
+	case errors.Is(err, annotator.ErrUnknownDirection):
+		return "unknown_direction"
+	case errors.Is(err, annotator.ErrInvalidIP):
+		return "invalid_ip"
+	case errors.Is(err, annotator.ErrLookupFailed):
+		return "lookup_failed"
+	case errors.Is(err, annotator.ErrNoAnnotation):
+		return "no_annotation"
+	default:
+		return "other"
+	}
+}
+
+// endpoints are the server and client IPs of a connection.
+type endpoints struct {
+	server, client string
+}
+
+// findEndpoints returns the server and client IPs of the connection, or nil
+// without WithLocalIPs or if its direction is unknown.
+func (h *handler) findEndpoints(ID *inetdiag.SockID) *endpoints {
+	if h.localIPs == nil || ID == nil {
+		return nil
+	}
+	dir, err := h.localIPs.FindDirection(ID)
+	if err != nil {
+		return nil
+	}
+	if dir == annotator.DstIsServer {
+		return &endpoints{server: ID.DstIP, client: ID.SrcIP}
+	}
+	return &endpoints{server: ID.SrcIP, client: ID.DstIP}
+}
+
+// checkClientIsLocal logs and counts flows with a client IP that is also local.
+func (h *handler) checkClientIsLocal(ID *inetdiag.SockID, ends *endpoints) {
+	if ends == nil {
+		return
+	}
+	if h.localIPs.Contains(ends.client) {
+		log.Printf("Client IP %s is also a local IP for %+v\n", ends.client, ID)
+		metrics.ClientIsLocal.Inc()
+	}
+}
+
+// Annotate runs all the annotators and configured post-processing for the
+// connection, and returns the annotations that would be written for it without
+// writing them, adding them to the index, or counting them in the metrics.
+// Annotator errors are logged, recorded as Debug errors if enabled, and
+// returned joined, along with the remaining annotations.
+func (h *handler) Annotate(ID *inetdiag.SockID, timestamp time.Time, uuid string) (*annotator.Annotations, error) {
+	annotations, out := h.annotate(ID, h.findEndpoints(ID), timestamp, uuid, nil)
+	return annotations, errors.Join(out.errs...)
+}
+
+// outcome is what annotate found out about a connection, and is counted in the
+// metrics only for connections that are saved.
+type outcome struct {
+	errs  []error // The errors of the annotators.
+	audit string  // The result of the direction audit, if enabled.
+}
+
+// count counts the outcome of annotating a connection.
+func (o *outcome) count() {
+	for _, err := range o.errs {
+		metrics.AnnotationErrors.WithLabelValues(errorReason(err)).Inc()
+	}
+	if o.audit != "" {
+		metrics.DirectionAudits.WithLabelValues(o.audit).Inc()
+	}
+}
+
+// annotate returns the annotations for a connection with the given endpoints
+// and metadata.
+func (h *handler) annotate(ID *inetdiag.SockID, ends *endpoints, timestamp time.Time, uuid string, metadata []annotator.Metadata) (*annotator.Annotations, outcome) {
+	var out outcome
 	annotations := &annotator.Annotations{
-		UUID:      j.uuid,
-		Timestamp: j.timestamp,
+		UUID:      uuid,
+		Timestamp: timestamp,
+		Metadata:  metadata,
 	}
 	for _, ann := range h.annotators {
-		err := ann.Annotate(j.id, annotations)
+		err := ann.Annotate(ID, annotations)
 		if err != nil {
 			log.Println(err)
-			metrics.AnnotationErrors.Inc()
+			out.errs = append(out.errs, err)
+			if h.errDetails {
+				if annotations.Debug == nil {
+					annotations.Debug = &annotator.Debug{}
+				}
+				annotations.Debug.Errors = append(annotations.Debug.Errors, annotator.AnnotatorError{
+					Annotator: annotator.NameOf(ann),
+					Error:     err.Error(),
+				})
+			}
 		}
 	}
+	h.dropOtherSide(annotations)
+	h.annotateAnnouncedCIDR(ends, annotations)
+	h.annotateClientIPHash(ends, annotations)
+	h.annotateServerLocalIP(ends, annotations)
+	h.annotateSameCountry(annotations)
+	// The audit needs the server Network, which may be projected away.
+	out.audit = h.auditDirection(ID, ends, annotations)
+	if h.omit {
+		omitMissing(annotations)
+	}
+	if h.projection != nil {
+		h.projection.Apply(annotations)
+	}
+	h.setPayloadHash(annotations)
+	return annotations, out
+}
 
-	if err := j.WriteFile(h.datadir, annotations); err != nil {
-		log.Println("Could not write metadata to file:", err)
-		metrics.MissedJobs.WithLabelValues("writefail").Inc()
+func (h *handler) annotateAndSave(j *job) {
+	defer h.wal.complete(j.uuid)
+	metrics.QueueDepth.Set(float64(len(h.jobs)))
+	start := time.Now()
+	defer func() { metrics.SaveDuration.Observe(time.Since(start).Seconds()) }()
+	ends := h.findEndpoints(j.id)
+	h.checkClientIsLocal(j.id, ends)
+	annotations, out := h.annotate(j.id, ends, j.timestamp, j.uuid, j.metadata)
+	out.count()
+	h.countPayloadHash(annotations)
+	if h.recent != nil {
+		h.recent.add(annotations)
+	}
+	if !h.noFiles {
+		err := h.writeFile(j, annotations)
+		h.recordWrite(err)
+		if err != nil {
+			log.Println("Could not write metadata to file:", err)
+			metrics.MissedJobs.WithLabelValues("writefail").Inc()
+			return
+		}
+		if h.index != nil && h.ndjson == nil && !IsGCS(h.datadir) {
+			h.index.add(j.uuid, j.path(h.datadir))
+		}
+	}
+	if err := h.writeLine(annotations); err != nil {
+		log.Println("Could not write metadata to the stream:", err)
+		metrics.MissedJobs.WithLabelValues("streamfail").Inc()
 	}
 }
 
 func (h *handler) ProcessIncomingRequests(ctx context.Context) {
+	// Jobs left in the WAL by a previous run are annotated first.
+	for _, j := range h.wal.pendingJobs() {
+		metrics.WALReplayedJobs.Inc()
+		h.annotateAndSave(j)
+	}
 	for ctx.Err() == nil {
 		select {
 		// As written, this will be a busy-loop if the jobs channel is
@@ -99,6 +1031,12 @@ func (h *handler) ProcessIncomingRequests(ctx context.Context) {
 		case <-ctx.Done():
 		}
 	}
+	if h.drainTimeout > 0 {
+		h.drain()
+	}
+	if err := h.ndjson.Close(); err != nil {
+		log.Println("Could not close the aggregated annotations file:", err)
+	}
 }
 
 // ThreadedHandler is an eventsocket.Handler that has a separate method for
@@ -109,16 +1047,74 @@ type ThreadedHandler interface {
 	ProcessIncomingRequests(ctx context.Context)
 }
 
+// The ThreadedHandler returned by New also implements the interfaces below.
+// They are separate from ThreadedHandler so that other implementations of it,
+// like the fakes of its users, need not implement every capability.
+
+// DryAnnotator annotates connections without saving the annotations.
+type DryAnnotator interface {
+	// Annotate returns the annotations for a connection without saving them,
+	// and the joined errors of the annotators that failed. The annotations
+	// are returned even with an error, since the remaining annotations are
+	// still useful.
+	Annotate(ID *inetdiag.SockID, timestamp time.Time, uuid string) (*annotator.Annotations, error)
+}
+
+// MetadataOpener is implemented by handlers that can record more about a
+// connection than its SockID.
+type MetadataOpener interface {
+	// OpenWithMetadata is like Open, for event sources that have more to say
+	// about the connection than its SockID.
+	OpenWithMetadata(ctx context.Context, timestamp time.Time, uuid string, ID *inetdiag.SockID, metadata []annotator.Metadata)
+}
+
+// UUIDLookup looks up the annotations recently written for a UUID.
+type UUIDLookup interface {
+	// Lookup returns the annotation JSON recently written for a UUID, and
+	// ServeLookup serves it over HTTP.
+	Lookup(uuid string) ([]byte, error)
+	ServeLookup(rw http.ResponseWriter, req *http.Request)
+}
+
+// RecentServer serves the most recent annotations.
+type RecentServer interface {
+	// ServeRecent serves the most recent annotations as JSON.
+	ServeRecent(rw http.ResponseWriter, req *http.Request)
+}
+
+// HealthReporter reports whether the handler can write files.
+type HealthReporter interface {
+	// Healthy returns false while files can not be written, and ServeHealth
+	// reports it over HTTP.
+	Healthy() bool
+	ServeHealth(rw http.ResponseWriter, req *http.Request)
+}
+
 // New creates an eventsocket.Handler that saves the metadata for each file. The
 // actual handling of each event is in a separate goroutine that should be
 // started by calling ProcessIncomingRequests. This two-part handling is there
 // to ensure that events arriving close together are not missed, even if disk IO
 // latency is high.
-func New(datadir string, buffersize int, annotators []annotator.Annotator) ThreadedHandler {
-	return &handler{
+func New(datadir string, buffersize int, annotators []annotator.Annotator, opts ...Option) ThreadedHandler {
+	h := &handler{
 		datadir:    datadir,
 		annotators: annotators,
 		// Buffer jobs in case a burst of IOps makes the disk slow.
 		jobs: make(chan *job, buffersize),
 	}
+	for _, opt := range opts {
+		opt(h)
+	}
+	if h.datatype != "" {
+		h.datadir += "/" + h.datatype
+	}
+	if h.ndjson != nil {
+		h.ndjson.dir = h.datadir
+	}
+	if IsGCS(h.datadir) {
+		h.sink = newGCSSink(h.gcs, h.datadir)
+	} else {
+		h.sink = localSink(h.datadir)
+	}
+	return h
 }
@@ -1,23 +1,38 @@
 package handler
 
 import (
+	"bufio"
+	"bytes"
 	"context"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"io/ioutil"
 	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"strings"
 	"sync"
 	"testing"
 	"time"
 
+	"github.com/go-test/deep"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
 	"github.com/spf13/afero"
 
 	"github.com/m-lab/tcp-info/inetdiag"
 
+	"github.com/m-lab/go/cloudtest/gcsfake"
 	"github.com/m-lab/go/rtx"
 	"github.com/m-lab/tcp-info/eventsocket"
 	"github.com/m-lab/uuid-annotator/annotator"
+	"github.com/m-lab/uuid-annotator/asnannotator"
+	"github.com/m-lab/uuid-annotator/geoannotator"
+	"github.com/m-lab/uuid-annotator/metrics"
 )
 
 func TestHandlerWithNoAnnotatorsE2E(t *testing.T) {
@@ -107,6 +122,8 @@ func TestHandlerWithNoAnnotatorsE2E(t *testing.T) {
 
 type badannotator struct{}
 
+func (badannotator) Name() string { return "bad" }
+
 func (badannotator) Annotate(ID *inetdiag.SockID, annotations *annotator.Annotations) error {
 	return errors.New("an error for testing")
 }
@@ -159,3 +176,1743 @@ func TestErrorCases(t *testing.T) {
 	h.ProcessIncomingRequests(ctx)
 	// No crash, successful termination and full coverage == success
 }
+
+// watchedFS fails the test if final exists while a file is being written, and
+// fails every write if failWrites is set.
+type watchedFS struct {
+	afero.Fs
+	t          *testing.T
+	final      string
+	failWrites bool
+}
+
+func (w *watchedFS) OpenFile(name string, flag int, perm os.FileMode) (afero.File, error) {
+	f, err := w.Fs.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return &watchedFile{File: f, fs: w}, nil
+}
+
+type watchedFile struct {
+	afero.File
+	fs *watchedFS
+}
+
+func (f *watchedFile) Write(b []byte) (int, error) {
+	if ok, _ := afero.Exists(f.fs.Fs, f.fs.final); ok {
+		f.fs.t.Errorf("%q exists before its contents were written", f.fs.final)
+	}
+	if f.fs.failWrites {
+		return 0, errForTesting
+	}
+	return f.File.Write(b)
+}
+
+func TestJobWriteFileIsAtomic(t *testing.T) {
+	j := &job{timestamp: time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC), uuid: "UUID"}
+	data := &annotator.Annotations{UUID: "UUID", Timestamp: j.timestamp}
+
+	for _, tt := range []struct {
+		name       string
+		failWrites bool
+	}{
+		{name: "success"},
+		{name: "write-error", failWrites: true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			w := &watchedFS{Fs: afero.NewMemMapFs(), t: t, final: j.path("/data"), failWrites: tt.failWrites}
+			defer setFs(w)()
+
+			err := j.WriteFile(localSink("/data"), data)
+			if (err != nil) != tt.failWrites {
+				t.Fatalf("WriteFile() error = %v, want error %v", err, tt.failWrites)
+			}
+			if ok, _ := afero.Exists(w.Fs, tmpName(w.final)); ok {
+				t.Errorf("WriteFile() left %q behind", tmpName(w.final))
+			}
+			b, err := afero.ReadFile(w.Fs, w.final)
+			if tt.failWrites {
+				if err == nil {
+					t.Errorf("WriteFile() created %q after a failed write", w.final)
+				}
+				return
+			}
+			rtx.Must(err, "Could not read %q", w.final)
+			got := &annotator.Annotations{}
+			rtx.Must(json.Unmarshal(b, got), "Could not unmarshal %q", string(b))
+			if diff := deep.Equal(got, data); diff != nil {
+				t.Errorf("WriteFile() wrote %v", diff)
+			}
+		})
+	}
+}
+
+// deadlineSink records the deadline of the context of each Put.
+type deadlineSink struct {
+	deadline time.Time
+	ok       bool
+}
+
+func (d *deadlineSink) Put(ctx context.Context, name string, contents []byte) error {
+	d.deadline, d.ok = ctx.Deadline()
+	return nil
+}
+
+func TestJob_WriteFileTimeout(t *testing.T) {
+	j := job{timestamp: time.Now(), uuid: "UUID"}
+	sink := &deadlineSink{}
+	rtx.Must(j.WriteFile(sink, &annotator.Annotations{}), "Could not write")
+	if !sink.ok || time.Until(sink.deadline) > putTimeout {
+		t.Errorf("WriteFile() deadline = %v, %v, want at most %v from now", sink.deadline, sink.ok, putTimeout)
+	}
+}
+
+func Test_errorReason(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want string
+	}{
+		{
+			name: "unknown-direction",
+			err:  fmt.Errorf("wrapped: %w", annotator.ErrUnknownDirection),
+			want: "unknown_direction",
+		},
+		{
+			name: "invalid-ip",
+			err:  fmt.Errorf("%w: %w", annotator.ErrNoAnnotation, annotator.ErrInvalidIP),
+			want: "invalid_ip",
+		},
+		{
+			name: "lookup-failed",
+			err:  fmt.Errorf("%w: %w", annotator.ErrNoAnnotation, annotator.ErrLookupFailed),
+			want: "lookup_failed",
+		},
+		{
+			name: "no-annotation",
+			err:  annotator.ErrNoAnnotation,
+			want: "no_annotation",
+		},
+		{
+			name: "other",
+			err:  errForTesting,
+			want: "other",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := errorReason(tt.err); got != tt.want {
+				t.Errorf("errorReason() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_handler_findEndpoints(t *testing.T) {
+	tests := []struct {
+		name string
+		ID   *inetdiag.SockID
+		want *endpoints
+	}{
+		{
+			name: "src-is-server",
+			ID:   &inetdiag.SockID{SrcIP: "1.0.0.1", DstIP: "9.0.0.9"},
+			want: &endpoints{server: "1.0.0.1", client: "9.0.0.9"},
+		},
+		{
+			name: "dst-is-server",
+			ID:   &inetdiag.SockID{SrcIP: "9.0.0.9", DstIP: "1.0.0.1"},
+			want: &endpoints{server: "1.0.0.1", client: "9.0.0.9"},
+		},
+		{
+			name: "unknown-direction",
+			ID:   &inetdiag.SockID{SrcIP: "8.0.0.8", DstIP: "9.0.0.9"},
+		},
+		{
+			name: "nil-id",
+		},
+	}
+	h := New("", 1, nil, WithLocalIPs([]net.IP{net.ParseIP("1.0.0.1")})).(*handler)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if diff := deep.Equal(h.findEndpoints(tt.ID), tt.want); diff != nil {
+				t.Errorf("findEndpoints() = %v", diff)
+			}
+		})
+	}
+}
+
+func TestClientIsLocal(t *testing.T) {
+	tests := []struct {
+		name string
+		ID   *inetdiag.SockID
+		want float64
+	}{
+		{
+			name: "same-ip",
+			ID:   &inetdiag.SockID{SrcIP: "1.0.0.1", DstIP: "1.0.0.1"},
+			want: 1,
+		},
+		{
+			name: "both-local",
+			ID:   &inetdiag.SockID{SrcIP: "1.0.0.1", DstIP: "2001:db8::1"},
+			want: 1,
+		},
+		{
+			name: "normal-flow",
+			ID:   &inetdiag.SockID{SrcIP: "1.0.0.1", DstIP: "9.0.0.9"},
+		},
+		{
+			name: "unknown-direction",
+			ID:   &inetdiag.SockID{SrcIP: "8.0.0.8", DstIP: "9.0.0.9"},
+		},
+	}
+	localIPs := []net.IP{net.ParseIP("1.0.0.1"), net.ParseIP("2001:db8::1")}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := New("", 1, nil, WithLocalIPs(localIPs)).(*handler)
+			before := testutil.ToFloat64(metrics.ClientIsLocal)
+			h.checkClientIsLocal(tt.ID, h.findEndpoints(tt.ID))
+			if got := testutil.ToFloat64(metrics.ClientIsLocal) - before; got != tt.want {
+				t.Errorf("checkClientIsLocal() counted %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_payloadHash(t *testing.T) {
+	base := annotator.Annotations{
+		UUID:      "UUID-1",
+		Timestamp: time.Date(2009, 3, 18, 1, 2, 3, 0, time.UTC),
+		Client: annotator.ClientAnnotations{
+			Network: &annotator.Network{ASNumber: 5},
+		},
+	}
+	// Same payload, but a different UUID, Timestamp, and stale hash.
+	same := base
+	same.UUID = "UUID-2"
+	same.Timestamp = time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	same.PayloadHash = "stale"
+	// Same payload, but with Metadata and Debug.
+	annotated := base
+	annotated.Metadata = []annotator.Metadata{{Key: "rtt", Value: "10"}}
+	annotated.Debug = &annotator.Debug{Errors: []annotator.AnnotatorError{{Annotator: "asn"}}}
+	// A different payload.
+	different := base
+	different.Client.Network = &annotator.Network{ASNumber: 9}
+
+	h := payloadHash(&base)
+	if h != payloadHash(&base) {
+		t.Error("payloadHash() is not stable for the same annotations")
+	}
+	if got := payloadHash(&same); got != h {
+		t.Errorf("payloadHash() of equal payloads = %q, want %q", got, h)
+	}
+	if got := payloadHash(&annotated); got != h {
+		t.Errorf("payloadHash() with Metadata and Debug = %q, want %q", got, h)
+	}
+	if got := payloadHash(&different); got == h {
+		t.Errorf("payloadHash() of different payloads should differ, both %q", got)
+	}
+	if base.UUID != "UUID-1" || same.PayloadHash != "stale" || annotated.Debug == nil {
+		t.Error("payloadHash() should not modify its argument")
+	}
+}
+
+func TestWithPayloadHash(t *testing.T) {
+	payloads := []annotator.Annotations{
+		{UUID: "a", Client: annotator.ClientAnnotations{Network: &annotator.Network{ASNumber: 5}}},
+		{UUID: "b", Client: annotator.ClientAnnotations{Network: &annotator.Network{ASNumber: 5}}},
+		{UUID: "c", Client: annotator.ClientAnnotations{Network: &annotator.Network{ASNumber: 9}}},
+		{UUID: "d", Client: annotator.ClientAnnotations{Network: &annotator.Network{ASNumber: 7}}},
+		// AS5 was forgotten when the set of two recent hashes filled up.
+		{UUID: "e", Client: annotator.ClientAnnotations{Network: &annotator.Network{ASNumber: 5}}},
+	}
+	h := New("", 1, nil, WithPayloadHash(2)).(*handler)
+	uniqueBefore := testutil.ToFloat64(metrics.PayloadHashes.WithLabelValues("unique"))
+	dupBefore := testutil.ToFloat64(metrics.PayloadHashes.WithLabelValues("duplicate"))
+	for i := range payloads {
+		h.setPayloadHash(&payloads[i])
+		if payloads[i].PayloadHash != payloadHash(&payloads[i]) {
+			t.Errorf("setPayloadHash() did not set the hash of %q", payloads[i].UUID)
+		}
+		h.countPayloadHash(&payloads[i])
+	}
+	if got := testutil.ToFloat64(metrics.PayloadHashes.WithLabelValues("unique")) - uniqueBefore; got != 4 {
+		t.Errorf("countPayloadHash() counted %v unique payloads, want 4", got)
+	}
+	if got := testutil.ToFloat64(metrics.PayloadHashes.WithLabelValues("duplicate")) - dupBefore; got != 1 {
+		t.Errorf("countPayloadHash() counted %v duplicate payloads, want 1", got)
+	}
+
+	// Without the option, no hash is recorded.
+	ann := &annotator.Annotations{UUID: "f"}
+	New("", 1, nil).(*handler).setPayloadHash(ann)
+	if ann.PayloadHash != "" {
+		t.Errorf("setPayloadHash() without WithPayloadHash() = %q, want empty", ann.PayloadHash)
+	}
+}
+
+// serverASN sets the server Network, like the siteannotator does.
+type serverASN uint32
+
+func (s serverASN) Annotate(ID *inetdiag.SockID, annotations *annotator.Annotations) error {
+	annotations.Server.Network = &annotator.Network{ASNumber: uint32(s)}
+	return nil
+}
+
+func TestDirectionAudit(t *testing.T) {
+	// The fake ASN annotator puts 1.2.3.4 in AS5 and 1111:2222:3333:4444:5555:6666:7777:8888 in AS9.
+	v4, v6 := "1.2.3.4", "1111:2222:3333:4444:5555:6666:7777:8888"
+	tests := []struct {
+		name     string
+		localIPs []net.IP
+		server   annotator.Annotator
+		ID       *inetdiag.SockID
+		want     string
+	}{
+		{
+			name:     "consistent",
+			localIPs: []net.IP{net.ParseIP(v4)},
+			server:   serverASN(5),
+			ID:       &inetdiag.SockID{SrcIP: v6, DstIP: v4},
+			want:     "consistent",
+		},
+		{
+			name:     "reversed",
+			localIPs: []net.IP{net.ParseIP(v6)}, // Misconfigured: the server is really v4.
+			server:   serverASN(5),
+			ID:       &inetdiag.SockID{SrcIP: v6, DstIP: v4},
+			want:     "reversed",
+		},
+		{
+			name:     "unknown-no-server-network",
+			localIPs: []net.IP{net.ParseIP(v4)},
+			server:   badannotator{},
+			ID:       &inetdiag.SockID{SrcIP: v6, DstIP: v4},
+			want:     "unknown",
+		},
+		{
+			name:   "unknown-direction",
+			server: serverASN(5),
+			ID:     &inetdiag.SockID{SrcIP: v6, DstIP: v4},
+			want:   "unknown",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "TestDirectionAudit")
+			rtx.Must(err, "Could not create tempdir")
+			defer os.RemoveAll(dir)
+
+			h := New(dir, 1, []annotator.Annotator{tt.server}, WithLocalIPs(tt.localIPs), WithDirectionAudit(asnannotator.NewFake())).(*handler)
+			before := testutil.ToFloat64(metrics.DirectionAudits.WithLabelValues(tt.want))
+			h.annotateAndSave(&job{timestamp: time.Now(), uuid: "UUID", id: tt.ID})
+			if got := testutil.ToFloat64(metrics.DirectionAudits.WithLabelValues(tt.want)) - before; got != 1 {
+				t.Errorf("annotateAndSave() counted %v %q audits, want 1", got, tt.want)
+			}
+		})
+	}
+}
+
+// siteNetwork sets the server Network with a site allocation.
+type siteNetwork string
+
+func (s siteNetwork) Annotate(ID *inetdiag.SockID, annotations *annotator.Annotations) error {
+	annotations.Server.Network = &annotator.Network{CIDR: string(s), ASNumber: 5}
+	return nil
+}
+
+func TestWithAnnouncedServerCIDR(t *testing.T) {
+	// The fake ASN annotator announces 1.2.3.4/32.
+	tests := []struct {
+		name  string
+		local string
+		ID    *inetdiag.SockID
+		want  string
+	}{
+		{
+			name:  "announced-src",
+			local: "1.2.3.4",
+			ID:    &inetdiag.SockID{SrcIP: "1.2.3.4", DstIP: "5.6.7.8"},
+			want:  "1.2.3.4/32",
+		},
+		{
+			name:  "announced-dst",
+			local: "1.2.3.4",
+			ID:    &inetdiag.SockID{SrcIP: "5.6.7.8", DstIP: "1.2.3.4"},
+			want:  "1.2.3.4/32",
+		},
+		{
+			name:  "not-announced",
+			local: "1.2.3.5",
+			ID:    &inetdiag.SockID{SrcIP: "1.2.3.5", DstIP: "5.6.7.8"},
+		},
+		{
+			name:  "unknown-direction",
+			local: "1.2.3.4",
+			ID:    &inetdiag.SockID{SrcIP: "5.6.7.8", DstIP: "5.6.7.9"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "TestWithAnnouncedServerCIDR")
+			rtx.Must(err, "Could not create tempdir")
+			defer os.RemoveAll(dir)
+
+			site := siteNetwork("1.2.3.0/28")
+			h := New(dir, 1, []annotator.Annotator{site}, WithLocalIPs([]net.IP{net.ParseIP(tt.local)}),
+				WithAnnouncedServerCIDR(asnannotator.NewFake())).(*handler)
+			tstamp := time.Date(2009, 3, 18, 1, 2, 3, 0, time.UTC)
+			h.annotateAndSave(&job{timestamp: tstamp, uuid: "UUID", id: tt.ID})
+
+			contents, err := ioutil.ReadFile(dir + "/2009/03/18/UUID.json")
+			rtx.Must(err, "Could not read file")
+			data := annotator.Annotations{}
+			rtx.Must(json.Unmarshal(contents, &data), "Could not unmarshal")
+			// The site allocation takes precedence for the CIDR.
+			if data.Server.Network.CIDR != string(site) {
+				t.Errorf("Server.Network.CIDR = %q, want %q", data.Server.Network.CIDR, site)
+			}
+			if data.Server.Network.AnnouncedCIDR != tt.want {
+				t.Errorf("Server.Network.AnnouncedCIDR = %q, want %q", data.Server.Network.AnnouncedCIDR, tt.want)
+			}
+		})
+	}
+}
+
+func Test_clientIPHash(t *testing.T) {
+	ip := net.ParseIP("5.6.7.8")
+	a := clientIPHash([]byte("key-a"), ip)
+	if again := clientIPHash([]byte("key-a"), net.ParseIP("::ffff:5.6.7.8")); again != a {
+		t.Errorf("clientIPHash() of the same IP and key = %q, want %q", again, a)
+	}
+	if b := clientIPHash([]byte("key-b"), ip); b == a {
+		t.Errorf("clientIPHash() with different keys = %q for both", a)
+	}
+	if other := clientIPHash([]byte("key-a"), net.ParseIP("5.6.7.9")); other == a {
+		t.Errorf("clientIPHash() of different IPs = %q for both", a)
+	}
+	if strings.Contains(a, "5.6.7.8") || len(a) != 64 {
+		t.Errorf("clientIPHash() = %q, want 64 hex digits", a)
+	}
+}
+
+func TestWithClientIPHash(t *testing.T) {
+	tests := []struct {
+		name     string
+		ID       *inetdiag.SockID
+		wantHash bool
+	}{
+		{
+			name:     "client-dst",
+			ID:       &inetdiag.SockID{SrcIP: "1.2.3.4", DstIP: "5.6.7.8"},
+			wantHash: true,
+		},
+		{
+			name:     "client-src",
+			ID:       &inetdiag.SockID{SrcIP: "5.6.7.8", DstIP: "1.2.3.4"},
+			wantHash: true,
+		},
+		{
+			name: "unknown-direction",
+			ID:   &inetdiag.SockID{SrcIP: "5.6.7.8", DstIP: "5.6.7.9"},
+		},
+	}
+	want := clientIPHash([]byte("secret"), net.ParseIP("5.6.7.8"))
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "TestWithClientIPHash")
+			rtx.Must(err, "Could not create tempdir")
+			defer os.RemoveAll(dir)
+
+			h := New(dir, 1, nil, WithLocalIPs([]net.IP{net.ParseIP("1.2.3.4")}),
+				WithClientIPHash([]byte("secret"))).(*handler)
+			tstamp := time.Date(2009, 3, 18, 1, 2, 3, 0, time.UTC)
+			h.annotateAndSave(&job{timestamp: tstamp, uuid: "UUID", id: tt.ID})
+
+			contents, err := ioutil.ReadFile(dir + "/2009/03/18/UUID.json")
+			rtx.Must(err, "Could not read file")
+			if strings.Contains(string(contents), "5.6.7.8") {
+				t.Errorf("The file contains the client IP: %s", contents)
+			}
+			data := annotator.Annotations{}
+			rtx.Must(json.Unmarshal(contents, &data), "Could not unmarshal")
+			if tt.wantHash && data.Client.IPHash != want {
+				t.Errorf("Client.IPHash = %q, want %q", data.Client.IPHash, want)
+			}
+			if !tt.wantHash && data.Client.IPHash != "" {
+				t.Errorf("Client.IPHash = %q, want none", data.Client.IPHash)
+			}
+		})
+	}
+}
+
+func TestWithServerLocalIP(t *testing.T) {
+	tests := []struct {
+		name string
+		ID   *inetdiag.SockID
+		want string
+	}{
+		{
+			name: "server-src",
+			ID:   &inetdiag.SockID{SrcIP: "1.2.3.4", DstIP: "5.6.7.8"},
+			want: "1.2.3.4",
+		},
+		{
+			name: "server-dst",
+			ID:   &inetdiag.SockID{SrcIP: "5.6.7.8", DstIP: "2001:db8::1"},
+			want: "2001:db8::1",
+		},
+		{
+			name: "unknown-direction",
+			ID:   &inetdiag.SockID{SrcIP: "5.6.7.8", DstIP: "5.6.7.9"},
+		},
+	}
+	localIPs := []net.IP{net.ParseIP("1.2.3.4"), net.ParseIP("2001:db8::1")}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "TestWithServerLocalIP")
+			rtx.Must(err, "Could not create tempdir")
+			defer os.RemoveAll(dir)
+
+			h := New(dir, 1, nil, WithLocalIPs(localIPs), WithServerLocalIP()).(*handler)
+			tstamp := time.Date(2009, 3, 18, 1, 2, 3, 0, time.UTC)
+			h.annotateAndSave(&job{timestamp: tstamp, uuid: "UUID", id: tt.ID})
+
+			contents, err := ioutil.ReadFile(dir + "/2009/03/18/UUID.json")
+			rtx.Must(err, "Could not read file")
+			data := annotator.Annotations{}
+			rtx.Must(json.Unmarshal(contents, &data), "Could not unmarshal")
+			if data.Server.LocalIP != tt.want {
+				t.Errorf("Server.LocalIP = %q, want %q", data.Server.LocalIP, tt.want)
+			}
+		})
+	}
+}
+
+// countries annotates the client and the server with the given country codes,
+// or leaves their Geo nil if the code is empty.
+type countries struct{ client, server string }
+
+func (c countries) Annotate(ID *inetdiag.SockID, annotations *annotator.Annotations) error {
+	if c.client != "" {
+		annotations.Client.Geo = &annotator.Geolocation{CountryCode: c.client}
+	}
+	if c.server != "" {
+		annotations.Server.Geo = &annotator.Geolocation{CountryCode: c.server}
+	}
+	return nil
+}
+
+func TestWithSameCountry(t *testing.T) {
+	yes, no := true, false
+	tests := []struct {
+		name string
+		ann  countries
+		opts []Option
+		want *bool
+	}{
+		{
+			name: "same-country",
+			ann:  countries{client: "US", server: "US"},
+			opts: []Option{WithSameCountry()},
+			want: &yes,
+		},
+		{
+			name: "cross-country",
+			ann:  countries{client: "GB", server: "US"},
+			opts: []Option{WithSameCountry()},
+			want: &no,
+		},
+		{
+			name: "unknown-client-country",
+			ann:  countries{server: "US"},
+			opts: []Option{WithSameCountry()},
+		},
+		{
+			name: "disabled",
+			ann:  countries{client: "US", server: "US"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := New("", 1, []annotator.Annotator{tt.ann}, tt.opts...).(DryAnnotator)
+			got, err := h.Annotate(&inetdiag.SockID{}, time.Now(), "UUID")
+			rtx.Must(err, "Could not annotate")
+			if diff := deep.Equal(got.SameCountry, tt.want); diff != nil {
+				t.Errorf("SameCountry = %v, want %v: %v", got.SameCountry, tt.want, diff)
+			}
+		})
+	}
+}
+
+func TestWithErrorDetails(t *testing.T) {
+	tests := []struct {
+		name string
+		opts []Option
+		want *annotator.Debug
+	}{
+		{
+			name: "enabled",
+			opts: []Option{WithErrorDetails()},
+			want: &annotator.Debug{
+				Errors: []annotator.AnnotatorError{
+					{Annotator: "bad", Error: "an error for testing"},
+				},
+			},
+		},
+		{
+			name: "disabled-by-default",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "TestWithErrorDetails")
+			rtx.Must(err, "Could not create tempdir")
+			defer os.RemoveAll(dir)
+
+			ok := serverASN(5)
+			h := New(dir, 1, []annotator.Annotator{ok, badannotator{}}, tt.opts...).(*handler)
+			tstamp := time.Date(2009, 3, 18, 1, 2, 3, 0, time.UTC)
+			h.annotateAndSave(&job{timestamp: tstamp, uuid: "UUID", id: &inetdiag.SockID{}})
+
+			contents, err := ioutil.ReadFile(dir + "/2009/03/18/UUID.json")
+			rtx.Must(err, "Could not read file")
+			data := annotator.Annotations{}
+			rtx.Must(json.Unmarshal(contents, &data), "Could not unmarshal")
+			if diff := deep.Equal(data.Debug, tt.want); diff != nil {
+				t.Errorf("annotateAndSave() wrote the wrong Debug: %v", diff)
+			}
+			if data.Server.Network == nil {
+				t.Error("annotateAndSave() should keep the annotations of successful annotators")
+			}
+		})
+	}
+}
+
+// fullClient sets every kind of client annotation.
+type fullClient struct{}
+
+func (fullClient) Annotate(ID *inetdiag.SockID, annotations *annotator.Annotations) error {
+	annotations.Client.Geo = &annotator.Geolocation{City: "Boston", CountryCode: "US", Latitude: 42.4}
+	annotations.Client.Network = &annotator.Network{CIDR: "1.0.0.0/8", ASNumber: 10, ASName: "Ten"}
+	return nil
+}
+
+func TestWithFieldAllowlist(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestWithFieldAllowlist")
+	rtx.Must(err, "Could not create tempdir")
+	defer os.RemoveAll(dir)
+
+	p, err := annotator.NewProjection([]string{"Client.Network.ASNumber", "Client.Geo.CountryCode"})
+	rtx.Must(err, "Could not create projection")
+	h := New(dir, 1, []annotator.Annotator{fullClient{}, serverASN(5)}, WithFieldAllowlist(p)).(*handler)
+	tstamp := time.Date(2009, 3, 18, 1, 2, 3, 0, time.UTC)
+	h.annotateAndSave(&job{timestamp: tstamp, uuid: "UUID", id: &inetdiag.SockID{}})
+
+	contents, err := ioutil.ReadFile(dir + "/2009/03/18/UUID.json")
+	rtx.Must(err, "Could not read file")
+	data := annotator.Annotations{}
+	rtx.Must(json.Unmarshal(contents, &data), "Could not unmarshal")
+	if data.Server.Network != nil {
+		t.Errorf("Server.Network = %+v, want it absent", data.Server.Network)
+	}
+	if data.UUID != "UUID" || data.Client.Network == nil || data.Client.Geo == nil {
+		t.Fatalf("annotateAndSave() wrote %s, want the UUID, ASN, and country", contents)
+	}
+	if diff := deep.Equal(*data.Client.Network, annotator.Network{ASNumber: 10}); diff != nil {
+		t.Errorf("Client.Network has fields outside the allowlist: %v", diff)
+	}
+	if *data.Client.Geo != (annotator.Geolocation{CountryCode: "US"}) {
+		t.Errorf("Client.Geo = %+v, want only the CountryCode", data.Client.Geo)
+	}
+}
+
+func TestWithDatatype(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestWithDatatype")
+	rtx.Must(err, "Could not create tempdir")
+	defer os.RemoveAll(dir)
+
+	rtx.Must(CheckDatatype("annotation2"), "Could not check a valid datatype")
+	h := New(dir, 1, nil, WithDatatype("annotation2"), WithUUIDIndex(1)).(*handler)
+	tstamp := time.Date(2009, 3, 18, 1, 2, 3, 0, time.UTC)
+	h.annotateAndSave(&job{timestamp: tstamp, uuid: "UUID", id: &inetdiag.SockID{}})
+
+	contents, err := ioutil.ReadFile(dir + "/annotation2/2009/03/18/UUID.json")
+	rtx.Must(err, "Could not read the file under the datatype directory")
+	indexed, err := h.Lookup("UUID")
+	rtx.Must(err, "Could not look up the UUID")
+	if string(indexed) != string(contents) {
+		t.Errorf("Lookup() = %s, want %s", indexed, contents)
+	}
+
+	for _, datatype := range []string{"", "a/b", "..", "-a", "a b", "annotation2/"} {
+		if err := CheckDatatype(datatype); !errors.Is(err, ErrInvalidDatatype) {
+			t.Errorf("CheckDatatype(%q) error = %v, want %v", datatype, err, ErrInvalidDatatype)
+		}
+	}
+}
+
+func TestAnnotate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestAnnotate")
+	rtx.Must(err, "Could not create tempdir")
+	defer os.RemoveAll(dir)
+
+	h := New(dir, 1, []annotator.Annotator{fullClient{}, badannotator{}}, WithOmitMissing(), WithErrorDetails(), WithUUIDIndex(1)).(*handler)
+	tstamp := time.Date(2009, 3, 18, 1, 2, 3, 0, time.UTC)
+	failed := testutil.ToFloat64(metrics.AnnotationErrors.WithLabelValues("other"))
+	got, err := h.Annotate(&inetdiag.SockID{}, tstamp, "UUID")
+	// The error of the bad annotator is returned with the other annotations.
+	if err == nil || err.Error() != "an error for testing" {
+		t.Errorf("Annotate() error = %v, want the error of the bad annotator", err)
+	}
+
+	want := &annotator.Annotations{
+		UUID:      "UUID",
+		Timestamp: tstamp,
+		Client: annotator.ClientAnnotations{
+			Geo:     &annotator.Geolocation{City: "Boston", CountryCode: "US", Latitude: 42.4},
+			Network: &annotator.Network{CIDR: "1.0.0.0/8", ASNumber: 10, ASName: "Ten"},
+		},
+		Debug: &annotator.Debug{
+			Errors: []annotator.AnnotatorError{
+				{Annotator: "bad", Error: "an error for testing"},
+			},
+		},
+	}
+	if diff := deep.Equal(got, want); diff != nil {
+		t.Errorf("Annotate() returned the wrong annotations: %v", diff)
+	}
+	// Nothing was written or indexed.
+	if _, err := os.Stat(dir + "/2009/03/18/UUID.json"); !os.IsNotExist(err) {
+		t.Errorf("Annotate() should not write a file, but Stat() error = %v", err)
+	}
+	if _, err := h.Lookup("UUID"); err != ErrUnknownUUID {
+		t.Errorf("Lookup() after Annotate() error = %v, want %v", err, ErrUnknownUUID)
+	}
+	// Nor counted.
+	if got := testutil.ToFloat64(metrics.AnnotationErrors.WithLabelValues("other")) - failed; got != 0 {
+		t.Errorf("Annotate() counted %v annotation errors, want 0", got)
+	}
+}
+
+func TestLookup(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestLookup")
+	rtx.Must(err, "Could not create tempdir")
+	defer os.RemoveAll(dir)
+
+	h := New(dir, 1, nil, WithUUIDIndex(2)).(*handler)
+	tstamp := time.Date(2009, 3, 18, 1, 2, 3, 0, time.UTC)
+	for _, uuid := range []string{"UUID1", "UUID2", "UUID3"} {
+		h.annotateAndSave(&job{timestamp: tstamp, uuid: uuid, id: &inetdiag.SockID{}})
+	}
+
+	// The two most recent UUIDs can be retrieved.
+	for _, uuid := range []string{"UUID2", "UUID3"} {
+		contents, err := h.Lookup(uuid)
+		rtx.Must(err, "Could not look up %s", uuid)
+		data := annotator.Annotations{}
+		rtx.Must(json.Unmarshal(contents, &data), "Could not unmarshal")
+		if data.UUID != uuid || data.Timestamp != tstamp {
+			t.Errorf("Lookup(%q) = %+v, want UUID %q and Timestamp %v", uuid, data, uuid, tstamp)
+		}
+	}
+	// The oldest was forgotten, and unknown UUIDs are not found.
+	for _, uuid := range []string{"UUID1", "NOTAUUID"} {
+		if _, err := h.Lookup(uuid); err != ErrUnknownUUID {
+			t.Errorf("Lookup(%q) error = %v, want %v", uuid, err, ErrUnknownUUID)
+		}
+	}
+
+	// ServeLookup serves the same files, and 404s for the others.
+	srv := httptest.NewServer(http.HandlerFunc(h.ServeLookup))
+	defer srv.Close()
+	for uuid, want := range map[string]int{"UUID3": http.StatusOK, "UUID1": http.StatusNotFound} {
+		resp, err := http.Get(srv.URL + "?uuid=" + uuid)
+		rtx.Must(err, "Could not get %s", uuid)
+		resp.Body.Close()
+		if resp.StatusCode != want {
+			t.Errorf("ServeLookup(%q) status = %d, want %d", uuid, resp.StatusCode, want)
+		}
+	}
+
+	// Without an index, nothing is found.
+	h = New(dir, 1, nil).(*handler)
+	h.annotateAndSave(&job{timestamp: tstamp, uuid: "UUID4", id: &inetdiag.SockID{}})
+	if _, err := h.Lookup("UUID4"); err != ErrUnknownUUID {
+		t.Errorf("Lookup() without WithUUIDIndex() error = %v, want %v", err, ErrUnknownUUID)
+	}
+}
+
+func Test_uuidIndex_add(t *testing.T) {
+	x := &uuidIndex{paths: map[string]string{}, order: make([]string, 0, 2)}
+	x.add("a", "1")
+	x.add("b", "2")
+	x.add("a", "3") // Re-adding updates the path without evicting.
+	if p, _ := x.get("a"); p != "3" {
+		t.Errorf("get(a) = %q, want 3", p)
+	}
+	if _, ok := x.get("b"); !ok {
+		t.Error("get(b) should be present")
+	}
+	x.add("c", "4")
+	if _, ok := x.get("a"); ok {
+		t.Error("get(a) should have been evicted")
+	}
+
+	// A zero-size index stores nothing.
+	empty := &uuidIndex{paths: map[string]string{}}
+	empty.add("a", "1")
+	if _, ok := empty.get("a"); ok {
+		t.Error("a zero-size index should store nothing")
+	}
+}
+
+// clientByIP annotates the destination IP of every flow as the client, using
+// the fake annotators, which know nothing about most IPs.
+type clientByIP struct{}
+
+func (clientByIP) Annotate(ID *inetdiag.SockID, annotations *annotator.Annotations) error {
+	annotations.Client.Network = asnannotator.NewFake().AnnotateIP(ID.DstIP)
+	return geoannotator.NewFake().AnnotateIP(net.ParseIP(ID.DstIP), &annotations.Client.Geo)
+}
+
+func TestWithOmitMissing(t *testing.T) {
+	tests := []struct {
+		name    string
+		opts    []Option
+		wantGeo bool
+		wantNet bool
+	}{
+		{
+			name:    "missing-objects",
+			wantGeo: true,
+			wantNet: true,
+		},
+		{
+			name: "omit-missing",
+			opts: []Option{WithOmitMissing()},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "TestWithOmitMissing")
+			rtx.Must(err, "Could not create tempdir")
+			defer os.RemoveAll(dir)
+
+			h := New(dir, 1, []annotator.Annotator{clientByIP{}}, tt.opts...).(*handler)
+			j := &job{timestamp: time.Now(), uuid: "UUID", id: &inetdiag.SockID{SrcIP: "127.0.0.1", DstIP: "9.0.0.9"}}
+			h.annotateAndSave(j)
+
+			contents, err := ioutil.ReadFile(j.path(dir))
+			rtx.Must(err, "Could not read file")
+			data := struct {
+				Client map[string]json.RawMessage
+			}{}
+			rtx.Must(json.Unmarshal(contents, &data), "Could not unmarshal")
+			if _, ok := data.Client["Geo"]; ok != tt.wantGeo {
+				t.Errorf("Client.Geo present = %v, want %v: %s", ok, tt.wantGeo, contents)
+			}
+			if _, ok := data.Client["Network"]; ok != tt.wantNet {
+				t.Errorf("Client.Network present = %v, want %v: %s", ok, tt.wantNet, contents)
+			}
+		})
+	}
+}
+
+func TestWithSampling(t *testing.T) {
+	tests := []struct {
+		name string
+		n    int
+		min  int
+		max  int
+	}{
+		{
+			name: "default-annotates-all",
+			n:    1,
+			min:  10000,
+			max:  10000,
+		},
+		{
+			name: "one-in-ten",
+			n:    10,
+			min:  900,
+			max:  1100,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := New("", 10000, nil, WithSampling(tt.n)).(*handler)
+			before := testutil.ToFloat64(metrics.SampledOutJobs)
+			for i := 0; i < 10000; i++ {
+				h.Open(context.Background(), time.Now(), fmt.Sprintf("host_1234567_%016X", i), &inetdiag.SockID{})
+			}
+			queued := len(h.jobs)
+			if queued < tt.min || queued > tt.max {
+				t.Errorf("Open() queued %d of 10000 UUIDs, want between %d and %d", queued, tt.min, tt.max)
+			}
+			if got := testutil.ToFloat64(metrics.SampledOutJobs) - before; int(got) != 10000-queued {
+				t.Errorf("Open() counted %v sampled out UUIDs, want %d", got, 10000-queued)
+			}
+			// Sampling is deterministic.
+			u := "host_1234567_0000000000000001"
+			if h.sampled(u) != h.sampled(u) {
+				t.Errorf("sampled(%q) is not deterministic", u)
+			}
+		})
+	}
+}
+
+func TestWALReplaysAfterCrash(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestWALReplaysAfterCrash")
+	rtx.Must(err, "Could not create tempdir")
+	defer os.RemoveAll(dir)
+	walPath := dir + "/wal"
+
+	wal, err := OpenWAL(walPath)
+	rtx.Must(err, "Could not open the WAL")
+	h := New(dir, 2, nil, WithWAL(wal)).(*handler)
+	tstamp := time.Date(2009, 3, 18, 1, 2, 3, 0, time.UTC)
+	h.Open(context.Background(), tstamp, "UUID1", &inetdiag.SockID{})
+	h.Open(context.Background(), tstamp.Add(time.Second), "UUID2", &inetdiag.SockID{})
+	// Only the first job is handled before the "crash", which also leaves a
+	// partial record at the end of the WAL.
+	h.annotateAndSave(<-h.jobs)
+	rtx.Must(wal.Close(), "Could not close the WAL")
+	f, err := os.OpenFile(walPath, os.O_WRONLY|os.O_APPEND, 0644)
+	rtx.Must(err, "Could not open the WAL")
+	_, err = f.WriteString(`{"UUID":"UUID3"`)
+	rtx.Must(err, "Could not write a partial record")
+	f.Close()
+	rtx.Must(os.Remove(dir+"/2009/03/18/UUID1.json"), "UUID1 was not written")
+
+	wal, err = OpenWAL(walPath)
+	rtx.Must(err, "Could not reopen the WAL")
+	defer wal.Close()
+	before := testutil.ToFloat64(metrics.WALReplayedJobs)
+	h = New(dir, 2, nil, WithWAL(wal)).(*handler)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	h.ProcessIncomingRequests(ctx)
+
+	if _, err := os.Stat(dir + "/2009/03/18/UUID2.json"); err != nil {
+		t.Error("UUID2 was not annotated after the restart:", err)
+	}
+	if _, err := os.Stat(dir + "/2009/03/18/UUID1.json"); err == nil {
+		t.Error("UUID1 was annotated again after the restart")
+	}
+	if got := testutil.ToFloat64(metrics.WALReplayedJobs) - before; got != 1 {
+		t.Errorf("WALReplayedJobs increased by %v, want 1", got)
+	}
+	contents, err := ioutil.ReadFile(walPath)
+	rtx.Must(err, "Could not read the WAL")
+	if len(contents) != 0 {
+		t.Errorf("WAL = %q, want it empty once every job is done", contents)
+	}
+}
+
+func TestWALCompaction(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestWALCompaction")
+	rtx.Must(err, "Could not create tempdir")
+	defer os.RemoveAll(dir)
+
+	wal, err := OpenWAL(dir + "/wal")
+	rtx.Must(err, "Could not open the WAL")
+	defer wal.Close()
+	wal.add(&job{uuid: "pending", id: &inetdiag.SockID{}})
+	for i := 0; i < walCompactAfter; i++ {
+		uuid := fmt.Sprint("UUID", i)
+		wal.add(&job{uuid: uuid, id: &inetdiag.SockID{}})
+		wal.complete(uuid)
+	}
+	contents, err := ioutil.ReadFile(dir + "/wal")
+	rtx.Must(err, "Could not read the WAL")
+	if lines := bytes.Count(contents, []byte("\n")); lines != 1 {
+		t.Errorf("WAL has %d records after compaction, want 1: %q", lines, contents)
+	}
+	if jobs := wal.pendingJobs(); len(jobs) != 1 || jobs[0].uuid != "pending" {
+		t.Errorf("pendingJobs() = %v, want only the pending job", jobs)
+	}
+	var nilWAL *WAL
+	nilWAL.add(&job{uuid: "x"})
+	nilWAL.complete("x")
+	if jobs := nilWAL.pendingJobs(); jobs != nil {
+		t.Errorf("pendingJobs() of a nil WAL = %v, want nil", jobs)
+	}
+}
+
+func TestWithSide(t *testing.T) {
+	ID := &inetdiag.SockID{SrcIP: "1.2.3.4", DstIP: "5.6.7.8"}
+	client := annotator.ClientAnnotations{
+		Geo:     &annotator.Geolocation{City: "Boston", CountryCode: "US", Latitude: 42.4},
+		Network: &annotator.Network{CIDR: "1.0.0.0/8", ASNumber: 10, ASName: "Ten"},
+		IPHash:  clientIPHash([]byte("secret"), net.ParseIP("5.6.7.8")),
+	}
+	server := annotator.ServerAnnotations{
+		Network: &annotator.Network{ASNumber: 5},
+		LocalIP: "1.2.3.4",
+	}
+	tests := []struct {
+		name       string
+		side       Side
+		wantClient annotator.ClientAnnotations
+		wantServer annotator.ServerAnnotations
+	}{
+		{
+			name:       "both",
+			side:       BothSides,
+			wantClient: client,
+			wantServer: server,
+		},
+		{
+			name:       "client",
+			side:       ClientSide,
+			wantClient: client,
+		},
+		{
+			name:       "server",
+			side:       ServerSide,
+			wantServer: server,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := New("", 1, []annotator.Annotator{fullClient{}, serverASN(5)},
+				WithLocalIPs([]net.IP{net.ParseIP("1.2.3.4")}), WithClientIPHash([]byte("secret")),
+				WithServerLocalIP(), WithSide(tt.side)).(DryAnnotator)
+			got, err := h.Annotate(ID, time.Date(2009, 3, 18, 1, 2, 3, 0, time.UTC), "UUID")
+			rtx.Must(err, "Could not annotate")
+			if diff := deep.Equal(got.Client, tt.wantClient); diff != nil {
+				t.Errorf("Annotate() returned the wrong client annotations: %v", diff)
+			}
+			if diff := deep.Equal(got.Server, tt.wantServer); diff != nil {
+				t.Errorf("Annotate() returned the wrong server annotations: %v", diff)
+			}
+		})
+	}
+}
+
+func TestOpenWithMetadata(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestOpenWithMetadata")
+	rtx.Must(err, "Could not create tempdir")
+	defer os.RemoveAll(dir)
+
+	wal, err := OpenWAL(dir + "/wal")
+	rtx.Must(err, "Could not open the WAL")
+	h := New(dir, 2, nil, WithWAL(wal)).(*handler)
+	tstamp := time.Date(2009, 3, 18, 1, 2, 3, 0, time.UTC)
+	metadata := []annotator.Metadata{{Key: "RTT", Value: "12ms"}, {Key: "Source", Value: "test"}}
+	h.OpenWithMetadata(context.Background(), tstamp, "UUID1", &inetdiag.SockID{}, metadata)
+	h.Open(context.Background(), tstamp, "UUID2", &inetdiag.SockID{})
+	metadata[0].Value = "changed by the caller"
+
+	// The metadata is logged in the WAL, to survive a crash.
+	rtx.Must(wal.Close(), "Could not close the WAL")
+	replayed, err := OpenWAL(dir + "/wal")
+	rtx.Must(err, "Could not reopen the WAL")
+	defer replayed.Close()
+	jobs := replayed.pendingJobs()
+	if len(jobs) != 2 || jobs[0].uuid != "UUID1" || len(jobs[0].metadata) != 2 {
+		t.Errorf("pendingJobs() = %+v, want both jobs, with the metadata of UUID1", jobs)
+	}
+
+	h.annotateAndSave(<-h.jobs)
+	h.annotateAndSave(<-h.jobs)
+	contents, err := ioutil.ReadFile(dir + "/2009/03/18/UUID1.json")
+	rtx.Must(err, "Could not read the file of UUID1")
+	data := annotator.Annotations{}
+	rtx.Must(json.Unmarshal(contents, &data), "Could not unmarshal")
+	want := []annotator.Metadata{{Key: "RTT", Value: "12ms"}, {Key: "Source", Value: "test"}}
+	if diff := deep.Equal(data.Metadata, want); diff != nil {
+		t.Errorf("Metadata did not round-trip: %v", diff)
+	}
+
+	contents, err = ioutil.ReadFile(dir + "/2009/03/18/UUID2.json")
+	rtx.Must(err, "Could not read the file of UUID2")
+	if strings.Contains(string(contents), "Metadata") {
+		t.Errorf("The file of a connection without metadata contains Metadata: %s", contents)
+	}
+}
+
+// slowAnnotator takes a while to annotate every connection.
+type slowAnnotator time.Duration
+
+func (s slowAnnotator) Annotate(ID *inetdiag.SockID, annotations *annotator.Annotations) error {
+	time.Sleep(time.Duration(s))
+	return nil
+}
+
+func TestWithDrainTimeout(t *testing.T) {
+	tests := []struct {
+		name          string
+		annotators    []annotator.Annotator
+		timeout       time.Duration
+		wantAbandoned bool
+	}{
+		{
+			name:    "drained",
+			timeout: time.Minute,
+		},
+		{
+			name:          "abandoned",
+			annotators:    []annotator.Annotator{slowAnnotator(20 * time.Millisecond)},
+			timeout:       30 * time.Millisecond,
+			wantAbandoned: true,
+		},
+	}
+	const n = 10
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "TestWithDrainTimeout")
+			rtx.Must(err, "Could not create tempdir")
+			defer os.RemoveAll(dir)
+
+			h := New(dir, n, tt.annotators, WithDrainTimeout(tt.timeout))
+			tstamp := time.Date(2009, 3, 18, 1, 2, 3, 0, time.UTC)
+			for i := 0; i < n; i++ {
+				h.Open(context.Background(), tstamp, fmt.Sprint("UUID", i), &inetdiag.SockID{})
+			}
+			drained := testutil.ToFloat64(metrics.DrainedJobs.WithLabelValues("drained"))
+			abandoned := testutil.ToFloat64(metrics.DrainedJobs.WithLabelValues("abandoned"))
+			ctx, cancel := context.WithCancel(context.Background())
+			cancel()
+			h.ProcessIncomingRequests(ctx)
+
+			files := 0
+			for i := 0; i < n; i++ {
+				if _, err := os.Stat(fmt.Sprintf("%s/2009/03/18/UUID%d.json", dir, i)); err == nil {
+					files++
+				}
+			}
+			drained = testutil.ToFloat64(metrics.DrainedJobs.WithLabelValues("drained")) - drained
+			abandoned = testutil.ToFloat64(metrics.DrainedJobs.WithLabelValues("abandoned")) - abandoned
+			if int(drained) != files || drained+abandoned != n {
+				t.Errorf("Wrote %d files, and counted %v drained and %v abandoned, want %d in all", files, drained, abandoned, n)
+			}
+			if tt.wantAbandoned != (abandoned > 0) {
+				t.Errorf("Abandoned %v jobs, want abandoned jobs %v", abandoned, tt.wantAbandoned)
+			}
+
+			// Jobs opened after the drain are dropped.
+			missed := testutil.ToFloat64(metrics.MissedJobs.WithLabelValues("draining"))
+			h.Open(context.Background(), tstamp, "late", &inetdiag.SockID{})
+			if got := testutil.ToFloat64(metrics.MissedJobs.WithLabelValues("draining")) - missed; got != 1 {
+				t.Errorf("Open() after draining missed %v jobs, want 1", got)
+			}
+		})
+	}
+}
+
+func TestWithDrainTimeout_WAL(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestWithDrainTimeout_WAL")
+	rtx.Must(err, "Could not create tempdir")
+	defer os.RemoveAll(dir)
+
+	wal, err := OpenWAL(dir + "/wal")
+	rtx.Must(err, "Could not open the WAL")
+	defer wal.Close()
+	h := New(dir, 2, nil, WithWAL(wal), WithDrainTimeout(time.Minute))
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	h.ProcessIncomingRequests(ctx)
+
+	// Jobs opened after the drain are logged to the WAL, to be annotated at
+	// the next start.
+	deferred := testutil.ToFloat64(metrics.DrainedJobs.WithLabelValues("deferred"))
+	tstamp := time.Date(2009, 3, 18, 1, 2, 3, 0, time.UTC)
+	h.Open(context.Background(), tstamp, "late", &inetdiag.SockID{})
+	if got := testutil.ToFloat64(metrics.DrainedJobs.WithLabelValues("deferred")) - deferred; got != 1 {
+		t.Errorf("Open() after draining deferred %v jobs, want 1", got)
+	}
+	if jobs := wal.pendingJobs(); len(jobs) != 1 || jobs[0].uuid != "late" {
+		t.Errorf("WAL pending jobs = %+v, want the job opened while draining", jobs)
+	}
+	if _, err := os.Stat(dir + "/2009/03/18/late.json"); err == nil {
+		t.Error("The job opened while draining should not be annotated")
+	}
+}
+
+func TestWithBlockingOpen(t *testing.T) {
+	tests := []struct {
+		name       string
+		opts       []Option
+		cancel     bool
+		consume    bool
+		wantReason string
+		wantQueued int
+	}{
+		{
+			name:       "drop-by-default",
+			consume:    true,
+			wantReason: "pipefull",
+		},
+		{
+			name:       "block-until-room",
+			opts:       []Option{WithBlockingOpen(time.Minute)},
+			consume:    true,
+			wantQueued: 1,
+		},
+		{
+			name:       "block-until-timeout",
+			opts:       []Option{WithBlockingOpen(10 * time.Millisecond)},
+			wantReason: "pipefull",
+			wantQueued: 1,
+		},
+		{
+			name:       "block-until-canceled",
+			opts:       []Option{WithBlockingOpen(time.Minute)},
+			cancel:     true,
+			wantReason: "canceled",
+			wantQueued: 1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := New("", 1, nil, tt.opts...).(*handler)
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			tstamp := time.Date(2009, 3, 18, 1, 2, 3, 0, time.UTC)
+
+			h.Open(ctx, tstamp, "UUID1", &inetdiag.SockID{})
+			if got := testutil.ToFloat64(metrics.QueueDepth); got != 1 {
+				t.Errorf("QueueDepth = %v, want 1", got)
+			}
+			if tt.cancel {
+				cancel()
+			}
+			var first *job
+			done := make(chan struct{})
+			if tt.consume {
+				go func() {
+					time.Sleep(20 * time.Millisecond)
+					first = <-h.jobs
+					close(done)
+				}()
+			} else {
+				close(done)
+			}
+			before := map[string]float64{}
+			for _, reason := range []string{"pipefull", "canceled"} {
+				before[reason] = testutil.ToFloat64(metrics.MissedJobs.WithLabelValues(reason))
+			}
+			h.Open(ctx, tstamp, "UUID2", &inetdiag.SockID{})
+			<-done
+
+			for reason, n := range before {
+				want := 0.0
+				if reason == tt.wantReason {
+					want = 1
+				}
+				if got := testutil.ToFloat64(metrics.MissedJobs.WithLabelValues(reason)) - n; got != want {
+					t.Errorf("MissedJobs(%q) increased by %v, want %v", reason, got, want)
+				}
+			}
+			if tt.consume && first.uuid != "UUID1" {
+				t.Errorf("First job = %q, want UUID1", first.uuid)
+			}
+			if len(h.jobs) != tt.wantQueued {
+				t.Errorf("len(jobs) = %d, want %d", len(h.jobs), tt.wantQueued)
+			}
+		})
+	}
+}
+
+// sampleCount returns the number of observations of the histogram.
+func sampleCount(o prometheus.Observer) uint64 {
+	m := &dto.Metric{}
+	rtx.Must(o.(prometheus.Metric).Write(m), "Could not read histogram")
+	return m.GetHistogram().GetSampleCount()
+}
+
+func TestQueueMetrics(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestQueueMetrics")
+	rtx.Must(err, "Could not create tempdir")
+	defer os.RemoveAll(dir)
+
+	const n = 3
+	h := New(dir, n, nil)
+	tstamp := time.Date(2009, 3, 18, 1, 2, 3, 0, time.UTC)
+	for i := 1; i <= n; i++ {
+		h.Open(context.Background(), tstamp, fmt.Sprint("UUID", i), &inetdiag.SockID{})
+		if got := testutil.ToFloat64(metrics.QueueDepth); got != float64(i) {
+			t.Errorf("QueueDepth after %d Open() = %v, want %d", i, got, i)
+		}
+	}
+
+	saves := sampleCount(metrics.SaveDuration)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		h.ProcessIncomingRequests(ctx)
+		close(done)
+	}()
+	// Wait for every file, since the last one is written after the last dequeue.
+	for i := 1; i <= n; i++ {
+		path := fmt.Sprintf("%s/2009/03/18/UUID%d.json", dir, i)
+		for _, err := os.Stat(path); err != nil; _, err = os.Stat(path) {
+			time.Sleep(time.Millisecond)
+		}
+	}
+	cancel()
+	<-done
+
+	if got := testutil.ToFloat64(metrics.QueueDepth); got != 0 {
+		t.Errorf("QueueDepth after processing = %v, want 0", got)
+	}
+	if got := sampleCount(metrics.SaveDuration) - saves; got != n {
+		t.Errorf("SaveDuration observed %d jobs, want %d", got, n)
+	}
+}
+
+func TestWithStream(t *testing.T) {
+	tests := []struct {
+		name      string
+		opts      []Option
+		wantFiles bool
+	}{
+		{
+			name:      "files-and-stream",
+			wantFiles: true,
+		},
+		{
+			name: "stream-only",
+			opts: []Option{WithoutFiles()},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "TestWithStream")
+			rtx.Must(err, "Could not create tempdir")
+			defer os.RemoveAll(dir)
+
+			// The stream is read like the stdout of the annotator would be.
+			r, w, err := os.Pipe()
+			rtx.Must(err, "Could not create pipe")
+			defer r.Close()
+			h := New(dir, 2, nil, append(tt.opts, WithStream(w))...).(*handler)
+			tstamp := time.Date(2009, 3, 18, 1, 2, 3, 0, time.UTC)
+			h.annotateAndSave(&job{timestamp: tstamp, uuid: "UUID1", id: &inetdiag.SockID{}})
+			h.annotateAndSave(&job{timestamp: tstamp, uuid: "UUID2", id: &inetdiag.SockID{}})
+			w.Close()
+
+			var uuids []string
+			s := bufio.NewScanner(r)
+			for s.Scan() {
+				data := annotator.Annotations{}
+				rtx.Must(json.Unmarshal(s.Bytes(), &data), "Could not unmarshal line %q", s.Text())
+				uuids = append(uuids, data.UUID)
+			}
+			if diff := deep.Equal(uuids, []string{"UUID1", "UUID2"}); diff != nil {
+				t.Errorf("Stream contains the wrong lines: %v", diff)
+			}
+			_, err = os.Stat(dir + "/2009/03/18/UUID1.json")
+			if (err == nil) != tt.wantFiles {
+				t.Errorf("Stat() error = %v, want file %v", err, tt.wantFiles)
+			}
+		})
+	}
+}
+
+func TestWithGCSClient(t *testing.T) {
+	tests := []struct {
+		name     string
+		datadir  string
+		failGCS  bool
+		noClient bool
+		wantObj  string
+	}{
+		{
+			name:    "success",
+			datadir: "gs://bucket/prefix/",
+			wantObj: "prefix/annotation2/2009/03/18/UUID.json",
+		},
+		{
+			name:    "no-prefix",
+			datadir: "gs://bucket",
+			wantObj: "annotation2/2009/03/18/UUID.json",
+		},
+		{
+			name:    "write-fails",
+			datadir: "gs://bucket/prefix",
+			failGCS: true,
+		},
+		{
+			name:     "no-client",
+			datadir:  "gs://bucket/prefix",
+			noClient: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			bucket := gcsfake.NewBucketHandle()
+			bucket.WritesMustFail = tt.failGCS
+			client := &gcsfake.GCSClient{}
+			client.AddTestBucket("bucket", bucket)
+			opts := []Option{WithDatatype("annotation2"), WithUUIDIndex(1)}
+			if !tt.noClient {
+				opts = append(opts, WithGCSClient(client))
+			}
+			// Nothing may be written to the local disk.
+			defer setFs(&errFS{func() {}})()
+
+			h := New(tt.datadir, 1, nil, opts...).(*handler)
+			tstamp := time.Date(2009, 3, 18, 1, 2, 3, 0, time.UTC)
+			failures := testutil.ToFloat64(metrics.MissedJobs.WithLabelValues("writefail"))
+			h.annotateAndSave(&job{timestamp: tstamp, uuid: "UUID", id: &inetdiag.SockID{}})
+
+			failures = testutil.ToFloat64(metrics.MissedJobs.WithLabelValues("writefail")) - failures
+			if (failures == 1) != (tt.wantObj == "") {
+				t.Errorf("MissedJobs(writefail) increased by %v, want a failure %v", failures, tt.wantObj == "")
+			}
+			if tt.wantObj == "" {
+				if len(bucket.Objs) != 0 {
+					t.Errorf("Objects = %v, want none", bucket.Objs)
+				}
+				return
+			}
+			obj, ok := bucket.Objs[tt.wantObj]
+			if !ok || len(bucket.Objs) != 1 {
+				t.Fatalf("Objects = %v, want only %q", bucket.Objs, tt.wantObj)
+			}
+			data := annotator.Annotations{}
+			rtx.Must(json.Unmarshal(obj.Data.Bytes(), &data), "Could not unmarshal")
+			if data.UUID != "UUID" {
+				t.Errorf("Object contains UUID %q, want UUID", data.UUID)
+			}
+			if _, err := h.Lookup("UUID"); err != ErrUnknownUUID {
+				t.Errorf("Lookup() error = %v, want %v", err, ErrUnknownUUID)
+			}
+		})
+	}
+}
+
+func TestCheckDatadir(t *testing.T) {
+	for _, datadir := range []string{".", "/var/spool/ndt", "gs://bucket", "gs://bucket/prefix"} {
+		if err := CheckDatadir(datadir); err != nil {
+			t.Errorf("CheckDatadir(%q) = %v, want nil", datadir, err)
+		}
+	}
+	for _, datadir := range []string{"gs://", "gs:///prefix"} {
+		if err := CheckDatadir(datadir); !errors.Is(err, ErrInvalidDatadir) {
+			t.Errorf("CheckDatadir(%q) = %v, want %v", datadir, err, ErrInvalidDatadir)
+		}
+	}
+}
+
+func TestWithRecent(t *testing.T) {
+	tests := []struct {
+		name string
+		opts []Option
+		want []string
+	}{
+		{
+			name: "disabled",
+			want: []string{},
+		},
+		{
+			name: "fewer-than-size",
+			opts: []Option{WithRecent(5)},
+			want: []string{"UUID1", "UUID2", "UUID3"},
+		},
+		{
+			name: "oldest-forgotten",
+			opts: []Option{WithRecent(2)},
+			want: []string{"UUID2", "UUID3"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "TestWithRecent")
+			rtx.Must(err, "Could not create tempdir")
+			defer os.RemoveAll(dir)
+
+			h := New(dir, 1, nil, tt.opts...).(*handler)
+			tstamp := time.Date(2009, 3, 18, 1, 2, 3, 0, time.UTC)
+			for i := 1; i <= 3; i++ {
+				h.annotateAndSave(&job{timestamp: tstamp, uuid: fmt.Sprint("UUID", i), id: &inetdiag.SockID{}})
+			}
+
+			srv := httptest.NewServer(http.HandlerFunc(h.ServeRecent))
+			defer srv.Close()
+			resp, err := http.Get(srv.URL + "/recent")
+			rtx.Must(err, "Could not get /recent")
+			defer resp.Body.Close()
+			var recent []annotator.Annotations
+			rtx.Must(json.NewDecoder(resp.Body).Decode(&recent), "Could not decode /recent")
+			got := []string{}
+			for _, a := range recent {
+				got = append(got, a.UUID)
+			}
+			if diff := deep.Equal(got, tt.want); diff != nil {
+				t.Errorf("/recent returned the wrong UUIDs: %v", diff)
+			}
+		})
+	}
+}
+
+// sharedAnnotator annotates every connection with the same Network, changing
+// its CIDR each time.
+type sharedAnnotator struct {
+	network *annotator.Network
+}
+
+func (s *sharedAnnotator) Annotate(ID *inetdiag.SockID, annotations *annotator.Annotations) error {
+	s.network.CIDR = ID.SrcIP + "/32"
+	annotations.Server.Network = s.network
+	return nil
+}
+
+func TestWithRecent_snapshot(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestWithRecent_snapshot")
+	rtx.Must(err, "Could not create tempdir")
+	defer os.RemoveAll(dir)
+
+	shared := &sharedAnnotator{network: &annotator.Network{}}
+	h := New(dir, 1, []annotator.Annotator{shared}, WithRecent(2)).(*handler)
+	tstamp := time.Date(2009, 3, 18, 1, 2, 3, 0, time.UTC)
+	for _, ip := range []string{"192.0.2.1", "192.0.2.2"} {
+		h.annotateAndSave(&job{timestamp: tstamp, uuid: ip, id: &inetdiag.SockID{SrcIP: ip}})
+	}
+
+	// Each annotation is shown as it was when it was added.
+	rw := httptest.NewRecorder()
+	h.ServeRecent(rw, httptest.NewRequest(http.MethodGet, "/recent", nil))
+	var recent []annotator.Annotations
+	rtx.Must(json.NewDecoder(rw.Body).Decode(&recent), "Could not decode /recent")
+	got := []string{}
+	for _, a := range recent {
+		got = append(got, a.Server.Network.CIDR)
+	}
+	if diff := deep.Equal(got, []string{"192.0.2.1/32", "192.0.2.2/32"}); diff != nil {
+		t.Errorf("/recent returned the wrong CIDRs: %v", diff)
+	}
+}
+
+func TestWithAggregation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestWithAggregation")
+	rtx.Must(err, "Could not create tempdir")
+	defer os.RemoveAll(dir)
+
+	jobs := []struct {
+		uuid string
+		ts   time.Time
+	}{
+		{"UUID1", time.Date(2009, 3, 18, 1, 2, 3, 0, time.UTC)},
+		{"UUID2", time.Date(2009, 3, 18, 1, 59, 59, 0, time.UTC)},
+		{"UUID3", time.Date(2009, 3, 18, 2, 0, 0, 0, time.UTC)},
+		{"UUID4", time.Date(2009, 3, 18, 1, 30, 0, 0, time.UTC)}, // Late for its hour.
+		{"UUID5", time.Date(2009, 3, 18, 2, 30, 0, 0, time.UTC)},
+	}
+	h := New(dir, len(jobs), nil, WithAggregation(time.Hour), WithDrainTimeout(time.Minute), WithUUIDIndex(10)).(*handler)
+	for _, j := range jobs {
+		h.Open(context.Background(), j.ts, j.uuid, &inetdiag.SockID{})
+	}
+	// A canceled context drains the jobs, and closes the file.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	h.ProcessIncomingRequests(ctx)
+	if f := h.ndjson.f; f != nil {
+		t.Errorf("ProcessIncomingRequests() left %q open", f.Name())
+	}
+
+	want := map[string][]string{
+		"2009/03/18/010000.ndjson": {"UUID1", "UUID2", "UUID4"},
+		"2009/03/18/020000.ndjson": {"UUID3", "UUID5"},
+	}
+	got := map[string][]string{}
+	files, err := ioutil.ReadDir(dir + "/2009/03/18")
+	rtx.Must(err, "Could not read the output dir")
+	for _, f := range files {
+		name := "2009/03/18/" + f.Name()
+		r, err := os.Open(dir + "/" + name)
+		rtx.Must(err, "Could not open %q", name)
+		s := bufio.NewScanner(r)
+		for s.Scan() {
+			data := annotator.Annotations{}
+			rtx.Must(json.Unmarshal(s.Bytes(), &data), "Could not unmarshal line %q of %q", s.Text(), name)
+			got[name] = append(got[name], data.UUID)
+		}
+		r.Close()
+	}
+	if diff := deep.Equal(got, want); diff != nil {
+		t.Errorf("The aggregated files contain the wrong UUIDs: %v", diff)
+	}
+	if _, err := h.Lookup("UUID1"); err != ErrUnknownUUID {
+		t.Errorf("Lookup() error = %v, want %v", err, ErrUnknownUUID)
+	}
+}
+
+func TestWithMaxWriteFailures(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestWithMaxWriteFailures")
+	rtx.Must(err, "Could not create tempdir")
+	defer os.RemoveAll(dir)
+
+	h := New(dir, 1, nil, WithMaxWriteFailures(3)).(*handler)
+	tstamp := time.Date(2009, 3, 18, 1, 2, 3, 0, time.UTC)
+	save := func(uuid string) {
+		h.annotateAndSave(&job{timestamp: tstamp, uuid: uuid, id: &inetdiag.SockID{}})
+	}
+	srv := httptest.NewServer(http.HandlerFunc(h.ServeHealth))
+	defer srv.Close()
+	check := func(want bool) {
+		t.Helper()
+		if h.Healthy() != want {
+			t.Errorf("Healthy() = %v, want %v", h.Healthy(), want)
+		}
+		resp, err := http.Get(srv.URL)
+		rtx.Must(err, "Could not get the health")
+		resp.Body.Close()
+		if got := resp.StatusCode == http.StatusOK; got != want {
+			t.Errorf("ServeHealth() status = %d, want healthy %v", resp.StatusCode, want)
+		}
+		wantMetric := 1.0
+		if want {
+			wantMetric = 0
+		}
+		if got := testutil.ToFloat64(metrics.WritesFailing); got != wantMetric {
+			t.Errorf("WritesFailing = %v, want %v", got, wantMetric)
+		}
+	}
+	check(true)
+
+	cleanup := setFs(&errFS{func() {}})
+	save("UUID1")
+	save("UUID2")
+	check(true) // Fewer than 3 failures are not sustained.
+	save("UUID3")
+	check(false)
+	save("UUID4")
+	check(false)
+
+	// The handler is healthy again once a file can be written.
+	cleanup()
+	save("UUID5")
+	check(true)
+
+	// Without the option, failures never make the handler unhealthy.
+	h = New(dir, 1, nil).(*handler)
+	defer setFs(&errFS{func() {}})()
+	for i := 0; i < 10; i++ {
+		save(fmt.Sprint("UUID", i))
+	}
+	if !h.Healthy() {
+		t.Error("Healthy() = false without WithMaxWriteFailures()")
+	}
+}
+
+// benchmarkAnnotations returns annotations like those of a busy node, with
+// every commonly populated field set.
+func benchmarkAnnotations() []*annotator.Annotations {
+	same := true
+	full := &annotator.Annotations{
+		UUID:      "ndt-knwp4_1583603744_000000000000590E",
+		Timestamp: time.Date(2009, 3, 18, 1, 2, 3, 456789000, time.UTC),
+		Server: annotator.ServerAnnotations{
+			Site:    "lga03",
+			Machine: "mlab1",
+			Geo: &annotator.Geolocation{
+				ContinentCode: "NA",
+				CountryCode:   "US",
+				City:          "New York",
+				Latitude:      40.7667,
+				Longitude:     -73.8667,
+			},
+			Network: &annotator.Network{
+				CIDR:     "64.86.148.128/26",
+				ASNumber: 6453,
+				ASName:   "TATA COMMUNICATIONS (AMERICA) INC",
+				Systems:  []annotator.System{{ASNs: []uint32{6453}}},
+			},
+		},
+		Client: annotator.ClientAnnotations{
+			Geo: &annotator.Geolocation{
+				ContinentCode:       "EU",
+				CountryCode:         "GB",
+				CountryName:         "United Kingdom",
+				Subdivision1ISOCode: "ENG",
+				Subdivision1Name:    "England",
+				City:                "Boxford",
+				PostalCode:          "OX1",
+				Latitude:            51.75,
+				Longitude:           -1.25,
+				AccuracyRadiusKm:    100,
+				TimeZone:            "Europe/London",
+			},
+			Network: &annotator.Network{
+				CIDR:     "2.120.0.0/13",
+				ASNumber: 5607,
+				ASName:   "Sky UK Limited",
+				Systems:  []annotator.System{{ASNs: []uint32{5607, 3356}}},
+			},
+		},
+		SameCountry: &same,
+	}
+	// Characters that json.Marshal escapes.
+	escaped := &annotator.Annotations{
+		UUID: "UUID<&> ",
+		Client: annotator.ClientAnnotations{
+			Network: &annotator.Network{ASName: "AT&T <Services>, \"Inc.\" – Zürich"},
+		},
+		Metadata: []annotator.Metadata{{Key: "key<&>", Value: "value\n\t "}},
+	}
+	return []*annotator.Annotations{full, escaped, {}}
+}
+
+func Test_withJSON(t *testing.T) {
+	for _, a := range benchmarkAnnotations() {
+		want, err := json.Marshal(a)
+		rtx.Must(err, "Could not marshal annotations")
+		// Twice, to also use a buffer returned to the pool.
+		for i := 0; i < 2; i++ {
+			rtx.Must(withJSON(a, func(got []byte) error {
+				if !bytes.Equal(got, want) {
+					t.Errorf("withJSON() = %s, want %s", got, want)
+				}
+				return nil
+			}), "Could not serialize annotations")
+		}
+	}
+	if err := withJSON(&annotator.Annotations{}, func([]byte) error { return errForTesting }); err != errForTesting {
+		t.Errorf("withJSON() error = %v, want %v", err, errForTesting)
+	}
+}
+
+// BenchmarkMarshal compares json.Marshal to withJSON, which reuses its buffers.
+func BenchmarkMarshal(b *testing.B) {
+	a := benchmarkAnnotations()[0]
+	b.Run("json.Marshal", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			if _, err := json.Marshal(a); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("withJSON", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			withJSON(a, func([]byte) error { return nil })
+		}
+	})
+}
+
+func TestNew_capabilities(t *testing.T) {
+	h := New("", 1, nil)
+	if _, ok := h.(DryAnnotator); !ok {
+		t.Error("New() should return a DryAnnotator")
+	}
+	if _, ok := h.(MetadataOpener); !ok {
+		t.Error("New() should return a MetadataOpener")
+	}
+	if _, ok := h.(UUIDLookup); !ok {
+		t.Error("New() should return a UUIDLookup")
+	}
+	if _, ok := h.(RecentServer); !ok {
+		t.Error("New() should return a RecentServer")
+	}
+	if _, ok := h.(HealthReporter); !ok {
+		t.Error("New() should return a HealthReporter")
+	}
+}
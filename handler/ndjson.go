@@ -0,0 +1,71 @@
+package handler
+
+import (
+	"os"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/spf13/afero"
+)
+
+// ndjsonWriter appends annotations as lines to one newline-delimited JSON file
+// for every interval, instead of writing one file per UUID. The file for the
+// interval starting at 01:00 on 2009-03-18 is 2009/03/18/010000.ndjson.
+type ndjsonWriter struct {
+	mu       sync.Mutex
+	dir      string
+	interval time.Duration
+	name     string // The name of f, relative to dir.
+	f        afero.File
+}
+
+// fileName returns the name of the file for annotations with the timestamp.
+func (w *ndjsonWriter) fileName(timestamp time.Time) string {
+	return timestamp.UTC().Truncate(w.interval).Format("2006/01/02/150405") + ".ndjson"
+}
+
+// write appends the contents, which must not contain a newline, as a line of
+// the file for the timestamp, closing the previous file if it is different.
+func (w *ndjsonWriter) write(timestamp time.Time, contents []byte) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	name := w.fileName(timestamp)
+	if name != w.name {
+		if err := w.closeHoldingLock(); err != nil {
+			return err
+		}
+		file := w.dir + "/" + name
+		if err := fs.MkdirAll(path.Dir(file), 0755); err != nil {
+			return err
+		}
+		// Late annotations for an earlier interval reopen its file.
+		f, err := fs.OpenFile(file, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0666)
+		if err != nil {
+			return err
+		}
+		w.name, w.f = name, f
+	}
+	// The file is not buffered, so every line is complete once written.
+	_, err := w.f.Write(append(contents, '\n'))
+	return err
+}
+
+func (w *ndjsonWriter) closeHoldingLock() error {
+	if w.f == nil {
+		return nil
+	}
+	err := w.f.Close()
+	w.name, w.f = "", nil
+	return err
+}
+
+// Close closes the current file, if any. Later writes open a new one.
+func (w *ndjsonWriter) Close() error {
+	if w == nil {
+		return nil
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.closeHoldingLock()
+}
@@ -0,0 +1,119 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/googleapis/google-cloud-go-testing/storage/stiface"
+)
+
+// ErrNoGCSClient is returned for writes to a gs:// datadir by a handler that
+// was not given a client with WithGCSClient.
+var ErrNoGCSClient = errors.New("a gs:// datadir requires a GCS client")
+
+// ErrInvalidDatadir is returned by CheckDatadir for gs:// datadirs that do
+// not name a bucket.
+var ErrInvalidDatadir = errors.New("datadir must be a directory or gs://bucket/prefix")
+
+// Sink stores the annotation files. Names are relative to the destination,
+// e.g. 2009/03/18/UUID.json, and use / as the separator.
+type Sink interface {
+	Put(ctx context.Context, name string, contents []byte) error
+}
+
+// localSink writes the files below a directory on the local disk.
+type localSink string
+
+// tmpName returns the name of the file that is renamed to file once it has
+// been written. It is hidden, and not a .json file, so that readers skip it.
+func tmpName(file string) string {
+	return path.Join(path.Dir(file), "."+path.Base(file)+".tmp")
+}
+
+func (s localSink) Put(ctx context.Context, name string, contents []byte) error {
+	file := string(s) + "/" + name
+
+	// Create the necessary subdirectories.
+	err := fs.MkdirAll(path.Dir(file), 0755)
+	if err != nil {
+		return err
+	}
+
+	// Write the serialized data to a temporary file, and rename it into place
+	// once it is complete, so that readers never see a partial file. The file
+	// is not synced, since readers only need it to be complete, and syncing
+	// every file would cost too much IO.
+	tmp := tmpName(file)
+	f, err := fs.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0666)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(contents)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = fs.Rename(tmp, file)
+	}
+	if err != nil {
+		fs.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+// gcsSink writes the files as objects of a bucket, below a prefix. An object
+// only appears once its writer is closed, so readers never see a partial one.
+type gcsSink struct {
+	client stiface.Client
+	bucket string
+	prefix string // Empty, or ending in a /.
+}
+
+// IsGCS returns true if the datadir is a gs:// URL rather than a directory.
+func IsGCS(datadir string) bool {
+	return strings.HasPrefix(datadir, "gs://")
+}
+
+// CheckDatadir returns an error unless datadir is a valid argument for New.
+func CheckDatadir(datadir string) error {
+	if IsGCS(datadir) && newGCSSink(nil, datadir).bucket == "" {
+		return fmt.Errorf("%w: %q", ErrInvalidDatadir, datadir)
+	}
+	return nil
+}
+
+// newGCSSink creates a sink for a gs://bucket/prefix datadir. Invalid
+// datadirs give a sink without a bucket, whose writes fail.
+func newGCSSink(client stiface.Client, datadir string) *gcsSink {
+	s := &gcsSink{client: client}
+	u, err := url.Parse(datadir)
+	if err != nil {
+		return s
+	}
+	s.bucket = u.Host
+	if p := strings.Trim(path.Clean("/"+u.Path), "/"); p != "" {
+		s.prefix = p + "/"
+	}
+	return s
+}
+
+func (s *gcsSink) Put(ctx context.Context, name string, contents []byte) error {
+	if s.client == nil {
+		return ErrNoGCSClient
+	}
+	if s.bucket == "" {
+		return ErrInvalidDatadir
+	}
+	w := s.client.Bucket(s.bucket).Object(s.prefix + name).NewWriter(ctx)
+	_, err := w.Write(contents)
+	if cerr := w.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
@@ -0,0 +1,202 @@
+package handler
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/m-lab/tcp-info/inetdiag"
+	"github.com/m-lab/uuid-annotator/annotator"
+	"github.com/spf13/afero"
+)
+
+// walCompactAfter is the number of completed jobs after which the WAL is
+// rewritten to hold only the pending jobs, to bound its size.
+const walCompactAfter = 1000
+
+// WAL is an append-only write-ahead log of the jobs received by a handler. Jobs
+// are logged before they are buffered, and marked done once they have been
+// handled, so that the jobs that were buffered but not yet written when the
+// process stopped can be annotated after a restart. Records are not synced to
+// disk, so they survive a crash of the process but not necessarily a crash of
+// the machine.
+type WAL struct {
+	mu      sync.Mutex
+	path    string
+	f       afero.File
+	pending map[string]walRecord
+	done    int // Jobs completed since the WAL was last rewritten.
+}
+
+// walRecord is one line of the WAL, which either adds a job or marks it done.
+type walRecord struct {
+	UUID      string
+	Done      bool                 `json:",omitempty"`
+	Timestamp time.Time            `json:",omitempty"`
+	ID        *inetdiag.SockID     `json:",omitempty"`
+	Metadata  []annotator.Metadata `json:",omitempty"`
+}
+
+// OpenWAL opens the WAL at path, creating it if it does not exist, and reads
+// the jobs that it holds that were never marked done. A handler created
+// WithWAL annotates these jobs when it starts processing requests.
+func OpenWAL(path string) (*WAL, error) {
+	w := &WAL{
+		path:    path,
+		pending: map[string]walRecord{},
+	}
+	data, err := fsutil.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	for _, line := range bytes.Split(data, []byte("\n")) {
+		if len(line) == 0 {
+			continue
+		}
+		r := walRecord{}
+		if err := json.Unmarshal(line, &r); err != nil {
+			// A crash may leave the last record incomplete.
+			log.Println("Skipping corrupt WAL record:", err)
+			continue
+		}
+		if r.Done {
+			delete(w.pending, r.UUID)
+		} else {
+			w.pending[r.UUID] = r
+		}
+	}
+	if err := w.rewriteHoldingLock(); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+// rewriteHoldingLock atomically replaces the WAL with one holding only the
+// pending jobs, and opens it for appending.
+func (w *WAL) rewriteHoldingLock() error {
+	if w.f != nil {
+		w.f.Close()
+		w.f = nil
+	}
+	buf := &bytes.Buffer{}
+	for _, r := range w.pending {
+		b, err := json.Marshal(r)
+		if err != nil {
+			return err
+		}
+		buf.Write(append(b, '\n'))
+	}
+	tmp := w.path + ".tmp"
+	if err := fsutil.WriteFile(tmp, buf.Bytes(), 0644); err != nil {
+		return err
+	}
+	if err := fs.Rename(tmp, w.path); err != nil {
+		return err
+	}
+	f, err := fs.OpenFile(w.path, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	w.f = f
+	w.done = 0
+	return nil
+}
+
+// appendHoldingLock writes a record to the end of the WAL.
+func (w *WAL) appendHoldingLock(r walRecord) {
+	if w.f == nil {
+		log.Println("Could not write to the closed WAL")
+		return
+	}
+	b, err := json.Marshal(r)
+	if err == nil {
+		_, err = w.f.Write(append(b, '\n'))
+	}
+	if err != nil {
+		log.Println("Could not write to the WAL:", err)
+	}
+}
+
+// add logs the job as pending. It has no effect on a nil WAL.
+func (w *WAL) add(j *job) {
+	if w == nil {
+		return
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	r := walRecord{UUID: j.uuid, Timestamp: j.timestamp, ID: j.id, Metadata: j.metadata}
+	w.pending[j.uuid] = r
+	w.appendHoldingLock(r)
+}
+
+// complete marks the job with the given UUID as done. Once no jobs are
+// pending, or after many completed jobs, the WAL is emptied or rewritten. It
+// has no effect on a nil WAL.
+func (w *WAL) complete(uuid string) {
+	if w == nil {
+		return
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if _, ok := w.pending[uuid]; !ok {
+		return
+	}
+	delete(w.pending, uuid)
+	w.done++
+	if len(w.pending) == 0 && w.f != nil {
+		if err := w.f.Truncate(0); err != nil {
+			log.Println("Could not truncate the WAL:", err)
+		}
+		w.done = 0
+		return
+	}
+	if w.done >= walCompactAfter {
+		if err := w.rewriteHoldingLock(); err != nil {
+			log.Println("Could not rewrite the WAL:", err)
+		}
+		return
+	}
+	w.appendHoldingLock(walRecord{UUID: uuid, Done: true})
+}
+
+// pendingJobs returns the jobs that are not done, oldest first. It returns
+// nothing for a nil WAL.
+func (w *WAL) pendingJobs() []*job {
+	if w == nil {
+		return nil
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	jobs := make([]*job, 0, len(w.pending))
+	for _, r := range w.pending {
+		id := r.ID
+		if id == nil {
+			id = &inetdiag.SockID{}
+		}
+		jobs = append(jobs, &job{timestamp: r.Timestamp, uuid: r.UUID, id: id, metadata: r.Metadata})
+	}
+	// Pending jobs are kept in a map, so break ties for a deterministic order.
+	sort.Slice(jobs, func(i, k int) bool {
+		if !jobs[i].timestamp.Equal(jobs[k].timestamp) {
+			return jobs[i].timestamp.Before(jobs[k].timestamp)
+		}
+		return jobs[i].uuid < jobs[k].uuid
+	})
+	return jobs
+}
+
+// Close closes the WAL file.
+func (w *WAL) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.f == nil {
+		return nil
+	}
+	err := w.f.Close()
+	w.f = nil
+	return err
+}
@@ -0,0 +1,165 @@
+package httpprovider
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/m-lab/go/content"
+	"github.com/m-lab/go/rtx"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"github.com/m-lab/uuid-annotator/metrics"
+)
+
+func TestProviderSendsHeaders(t *testing.T) {
+	var got http.Header
+	srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		got = req.Header.Clone()
+		rw.Write([]byte("data"))
+	}))
+	defer srv.Close()
+
+	u, err := url.Parse(srv.URL + "/file.gz")
+	rtx.Must(err, "Could not parse URL")
+	p := New(u, WithUserAgent("uuid-annotator-test"), WithHeader("Authorization", "Bearer secret"))
+	b, err := p.Get(context.Background())
+	rtx.Must(err, "Could not get data")
+	if string(b) != "data" {
+		t.Errorf("Get() = %q, want %q", string(b), "data")
+	}
+	if got.Get("User-Agent") != "uuid-annotator-test" {
+		t.Errorf("User-Agent = %q, want %q", got.Get("User-Agent"), "uuid-annotator-test")
+	}
+	if got.Get("Authorization") != "Bearer secret" {
+		t.Errorf("Authorization = %q, want %q", got.Get("Authorization"), "Bearer secret")
+	}
+}
+
+func TestProviderNoChange(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if req.Header.Get("If-None-Match") == `"v1"` {
+			rw.WriteHeader(http.StatusNotModified)
+			return
+		}
+		rw.Header().Set("ETag", `"v1"`)
+		rw.Write([]byte("data"))
+	}))
+	defer srv.Close()
+
+	u, err := url.Parse(srv.URL)
+	rtx.Must(err, "Could not parse URL")
+	p := New(u)
+	downloaded := testutil.ToFloat64(metrics.HTTPDownloads.WithLabelValues("downloaded"))
+	unchanged := testutil.ToFloat64(metrics.HTTPDownloads.WithLabelValues("unchanged"))
+	_, err = p.Get(context.Background())
+	rtx.Must(err, "Could not get data")
+	_, err = p.Get(context.Background())
+	if err != content.ErrNoChange {
+		t.Errorf("Get() error = %v, want %v", err, content.ErrNoChange)
+	}
+	if got := testutil.ToFloat64(metrics.HTTPDownloads.WithLabelValues("downloaded")) - downloaded; got != 1 {
+		t.Errorf("HTTPDownloads downloaded = %v, want 1", got)
+	}
+	if got := testutil.ToFloat64(metrics.HTTPDownloads.WithLabelValues("unchanged")) - unchanged; got != 1 {
+		t.Errorf("HTTPDownloads unchanged = %v, want 1", got)
+	}
+}
+
+func TestProviderNoChangeLastModified(t *testing.T) {
+	const modified = "Wed, 18 Mar 2009 01:02:03 GMT"
+	srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if req.Header.Get("If-Modified-Since") == modified {
+			rw.WriteHeader(http.StatusNotModified)
+			return
+		}
+		rw.Header().Set("Last-Modified", modified)
+		rw.Write([]byte("data"))
+	}))
+	defer srv.Close()
+
+	u, err := url.Parse(srv.URL)
+	rtx.Must(err, "Could not parse URL")
+	p := New(u)
+	b, err := p.Get(context.Background())
+	rtx.Must(err, "Could not get data")
+	if string(b) != "data" {
+		t.Errorf("Get() = %q, want %q", string(b), "data")
+	}
+	_, err = p.Get(context.Background())
+	if err != content.ErrNoChange {
+		t.Errorf("Get() error = %v, want %v", err, content.ErrNoChange)
+	}
+}
+
+func TestProviderErrors(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/slow":
+			time.Sleep(100 * time.Millisecond)
+		case "/broken":
+			rw.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		rw.WriteHeader(http.StatusForbidden)
+	}))
+	defer srv.Close()
+
+	if errors.Is(ErrUnexpectedStatus, content.ErrUnsupportedURLScheme) {
+		t.Fatal("ErrUnexpectedStatus should differ from content.ErrUnsupportedURLScheme")
+	}
+	tests := []struct {
+		name    string
+		path    string
+		opts    []Option
+		wantErr error
+	}{
+		{
+			name:    "forbidden",
+			opts:    []Option{WithHeader("Authorization", "Bearer secret")},
+			wantErr: ErrUnexpectedStatus,
+		},
+		{
+			name:    "server-error",
+			path:    "/broken",
+			wantErr: ErrUnexpectedStatus,
+		},
+		{
+			name:    "timeout",
+			path:    "/slow",
+			opts:    []Option{WithTimeout(time.Millisecond)},
+			wantErr: context.DeadlineExceeded,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			u, err := url.Parse(srv.URL + tt.path)
+			rtx.Must(err, "Could not parse URL")
+			p := New(u, tt.opts...)
+			failed := testutil.ToFloat64(metrics.HTTPDownloads.WithLabelValues("error"))
+			_, err = p.Get(context.Background())
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("Get() error = %v, want %v", err, tt.wantErr)
+			}
+			if errors.Is(err, content.ErrUnsupportedURLScheme) {
+				t.Errorf("Get() error = %v, should not be %v", err, content.ErrUnsupportedURLScheme)
+			}
+			if strings.Contains(err.Error(), "secret") {
+				t.Errorf("Get() error should never contain header values: %v", err)
+			}
+			if got := testutil.ToFloat64(metrics.HTTPDownloads.WithLabelValues("error")) - failed; got != 1 {
+				t.Errorf("HTTPDownloads error = %v, want 1", got)
+			}
+		})
+	}
+
+	p := New(&url.URL{Scheme: "http", Host: "bad host name"})
+	if _, err := p.Get(context.Background()); err == nil {
+		t.Error("Get() should have failed with a bad URL")
+	}
+}
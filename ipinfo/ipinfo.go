@@ -5,18 +5,66 @@ import (
 	"encoding/csv"
 	"log"
 	"strconv"
+	"strings"
 )
 
 // ASNames is the type holding a map from AS numbers to their names.
 type ASNames map[uint32]string
 
+// ASInfo is what the IPInfo.io AS data says about one AS. Domain and Type,
+// e.g. "isp", "hosting", "business" or "education", are empty unless the file
+// has "domain" and "type" columns.
+type ASInfo struct {
+	Name   string
+	Domain string
+	Type   string
+}
+
+// ASInfos is the type holding a map from AS numbers to their ASInfo.
+type ASInfos map[uint32]ASInfo
+
 // Parse the data read from the file given to us by the folks at IPInfo.io.
 func Parse(data []byte) (ASNames, error) {
-	newmap := make(ASNames)
+	infos, err := ParseInfo(data)
+	if err != nil {
+		return nil, err
+	}
+	newmap := make(ASNames, len(infos))
+	for asn, info := range infos {
+		newmap[asn] = info.Name
+	}
+	return newmap, nil
+}
+
+// ParseInfo is like Parse, but also keeps the domain and type of every AS, when
+// the header names those columns. The first two columns are always the ASN and
+// the name, as in the files that only have those.
+func ParseInfo(data []byte) (ASInfos, error) {
+	newmap := make(ASInfos)
 	rows, err := csv.NewReader(bytes.NewBuffer(data)).ReadAll()
 	if err != nil {
 		return nil, err
 	}
+	// An empty file, e.g. from a failed download, has no header to skip, and
+	// gives no names.
+	if len(rows) == 0 {
+		return newmap, nil
+	}
+	domain, typ := -1, -1
+	for i, name := range rows[0] {
+		switch name {
+		case "domain":
+			domain = i
+		case "type":
+			typ = i
+		}
+	}
+	get := func(row []string, i int) string {
+		if i < 0 || i >= len(row) {
+			return ""
+		}
+		return row[i]
+	}
 	// Start from row[1] not row[0] to skip the csv header.
 	for _, row := range rows[1:] {
 		if len(row) < 2 {
@@ -25,12 +73,20 @@ func Parse(data []byte) (ASNames, error) {
 		}
 		asnstring := row[0]
 		asname := row[1]
+		if !strings.HasPrefix(asnstring, "AS") {
+			log.Println("Bad CSV row (the ASN does not start with AS). This should never happen.", row)
+			continue
+		}
 		asn, err := strconv.ParseUint(asnstring[2:], 10, 32)
 		if err != nil {
 			log.Println("Parse error on a single CSV row (this should never happen):", err, row)
 			continue
 		}
-		newmap[uint32(asn)] = asname
+		newmap[uint32(asn)] = ASInfo{
+			Name:   asname,
+			Domain: get(row, domain),
+			Type:   get(row, typ),
+		}
 	}
 	return newmap, nil
 }
@@ -32,6 +32,23 @@ func TestParse(t *testing.T) {
 			data: []byte("asn\nAS0001\n"),
 			want: ASNames{},
 		},
+		{
+			name: "Empty file",
+			data: []byte{},
+			want: ASNames{},
+		},
+		{
+			name: "Header only",
+			data: []byte("asn,name\n"),
+			want: ASNames{},
+		},
+		{
+			name: "ASN without the AS prefix",
+			data: []byte("asn,name\n1,short\nAS0002,test\n"),
+			want: ASNames{
+				2: "test",
+			},
+		},
 		{
 			name:    "Not a CSV",
 			data:    []byte("two,records\nonerecord\n"),
@@ -51,3 +68,64 @@ func TestParse(t *testing.T) {
 		})
 	}
 }
+
+func TestParseInfo(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    []byte
+		want    ASInfos
+		wantErr bool
+	}{
+		{
+			name: "Two columns",
+			data: []byte("asn,name\nAS0001,test\n"),
+			want: ASInfos{
+				1: {Name: "test"},
+			},
+		},
+		{
+			name: "Current columns",
+			data: []byte("asn,name,country,registry\nAS1,\"Level 3 Parent, LLC\",US,arin\n"),
+			want: ASInfos{
+				1: {Name: "Level 3 Parent, LLC"},
+			},
+		},
+		{
+			name: "Extended columns",
+			data: []byte("asn,name,country,domain,type\nAS13335,\"Cloudflare, Inc.\",US,cloudflare.com,hosting\nAS2,test,US,,\n"),
+			want: ASInfos{
+				13335: {Name: "Cloudflare, Inc.", Domain: "cloudflare.com", Type: "hosting"},
+				2:     {Name: "test"},
+			},
+		},
+		{
+			name: "Extended columns in another order",
+			data: []byte("asn,name,type,domain\nAS7018,AT&T Services,isp,att.com\n"),
+			want: ASInfos{
+				7018: {Name: "AT&T Services", Domain: "att.com", Type: "isp"},
+			},
+		},
+		{
+			name: "Empty file",
+			data: []byte{},
+			want: ASInfos{},
+		},
+		{
+			name:    "Not a CSV",
+			data:    []byte("two,records\nonerecord\n"),
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseInfo(tt.data)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("ParseInfo() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ParseInfo() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,155 @@
+package ipinfo
+
+import (
+	"bytes"
+	"encoding/csv"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+var (
+	// ErrNoPrefixFound is returned when no prefix contains the given IP.
+	ErrNoPrefixFound = errors.New("no prefix found for address")
+
+	// ErrNoPrefixes is returned when a prefix file contains no usable rows.
+	ErrNoPrefixes = errors.New("no prefixes found in prefix file")
+
+	// ErrMissingColumn is returned when the header of a prefix file lacks a
+	// required column.
+	ErrMissingColumn = errors.New("missing column in prefix file header")
+)
+
+// Prefix is a single network from the IPInfo.io combined data, with its AS and
+// country. Start and End are inclusive and always 16 bytes long.
+type Prefix struct {
+	Network *net.IPNet
+	Start   net.IP
+	End     net.IP
+	ASN     uint32
+	ASName  string
+	Country string
+}
+
+// Prefixes is a sorted, searchable list of non-overlapping prefixes.
+type Prefixes []Prefix
+
+// ParsePrefixes reads a CSV file of prefixes from IPInfo.io, like the "lite"
+// or "country_asn" files, that maps each network to its ASN, AS name, and
+// country. Columns are found by name in the header: "network", "asn", and
+// "as_name" or "name", and "country_code" or "country". Rows without an ASN,
+// and malformed rows, are skipped, but ErrNoPrefixes is returned if no rows are
+// left.
+func ParsePrefixes(data []byte) (Prefixes, error) {
+	r := csv.NewReader(bytes.NewReader(data))
+	r.FieldsPerRecord = -1
+	header, err := r.Read()
+	if err != nil {
+		return nil, err
+	}
+	cols := map[string]int{}
+	for i, name := range header {
+		cols[name] = i
+	}
+	col := func(names ...string) int {
+		for _, name := range names {
+			if i, ok := cols[name]; ok {
+				return i
+			}
+		}
+		return -1
+	}
+	network, asn, name, country := col("network"), col("asn"), col("as_name", "name"), col("country_code", "country")
+	if network < 0 || asn < 0 {
+		return nil, ErrMissingColumn
+	}
+	get := func(row []string, i int) string {
+		if i < 0 || i >= len(row) {
+			return ""
+		}
+		return row[i]
+	}
+
+	p := Prefixes{}
+	for {
+		row, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if get(row, asn) == "" {
+			continue
+		}
+		prefix, err := parsePrefix(get(row, network), get(row, asn))
+		if err != nil {
+			log.Println("Bad prefix row:", err, row)
+			continue
+		}
+		prefix.ASName = get(row, name)
+		prefix.Country = get(row, country)
+		p = append(p, prefix)
+	}
+	if len(p) == 0 {
+		return nil, ErrNoPrefixes
+	}
+	sort.Slice(p, func(i, j int) bool { return bytes.Compare(p[i].Start, p[j].Start) < 0 })
+	return p, nil
+}
+
+// ASNames returns the name of every AS number of the prefixes. When prefixes
+// disagree, the name of the last one is kept.
+func (p Prefixes) ASNames() ASNames {
+	names := make(ASNames)
+	for _, prefix := range p {
+		if prefix.ASName != "" {
+			names[prefix.ASN] = prefix.ASName
+		}
+	}
+	return names
+}
+
+func parsePrefix(network, asn string) (Prefix, error) {
+	_, n, err := net.ParseCIDR(network)
+	if err != nil {
+		return Prefix{}, err
+	}
+	num, err := strconv.ParseUint(strings.TrimPrefix(asn, "AS"), 10, 32)
+	if err != nil {
+		return Prefix{}, err
+	}
+	mask := n.Mask
+	if len(mask) == net.IPv4len {
+		mask = append(net.CIDRMask(96, 128)[:12], mask...)
+	}
+	start := n.IP.To16()
+	end := make(net.IP, net.IPv6len)
+	for i := range end {
+		end[i] = start[i] | ^mask[i]
+	}
+	return Prefix{Network: n, Start: start, End: end, ASN: uint32(num)}, nil
+}
+
+// Search returns the prefix containing the given IP.
+func (p Prefixes) Search(ip net.IP) (Prefix, error) {
+	ip = ip.To16()
+	if ip == nil {
+		return Prefix{}, ErrNoPrefixFound
+	}
+	// Find the first prefix that starts after ip; the one before it is the
+	// only one that could contain ip.
+	i := sort.Search(len(p), func(i int) bool { return bytes.Compare(p[i].Start, ip) > 0 })
+	if i == 0 {
+		return Prefix{}, ErrNoPrefixFound
+	}
+	prefix := p[i-1]
+	if bytes.Compare(ip, prefix.End) > 0 {
+		return Prefix{}, ErrNoPrefixFound
+	}
+	return prefix, nil
+}
@@ -0,0 +1,83 @@
+package ipinfo
+
+import (
+	"io/ioutil"
+	"net"
+	"testing"
+
+	"github.com/m-lab/go/rtx"
+)
+
+func TestParsePrefixes(t *testing.T) {
+	data, err := ioutil.ReadFile("../testdata/ipinfo-lite.csv")
+	rtx.Must(err, "Could not read test data")
+	p, err := ParsePrefixes(data)
+	rtx.Must(err, "Could not parse prefixes")
+	// The rows without an ASN or with a bad network are skipped.
+	if len(p) != 3 {
+		t.Fatalf("ParsePrefixes() returned %d prefixes, want 3", len(p))
+	}
+
+	tests := []struct {
+		ip      string
+		want    string
+		asn     uint32
+		name    string
+		country string
+		wantErr error
+	}{
+		{ip: "1.0.0.1", want: "1.0.0.0/24", asn: 13335, name: "Cloudflare, Inc.", country: "AU"},
+		{ip: "2.125.191.255", want: "2.125.160.0/19", asn: 5607, name: "Sky UK Limited", country: "GB"},
+		{ip: "2001:200::1", want: "2001:200::/32", asn: 2500, name: "WIDE Project", country: "JP"},
+		{ip: "10.0.0.1", wantErr: ErrNoPrefixFound},
+		{ip: "2.125.192.0", wantErr: ErrNoPrefixFound},
+		{ip: "0.0.0.1", wantErr: ErrNoPrefixFound},
+	}
+	for _, tt := range tests {
+		got, err := p.Search(net.ParseIP(tt.ip))
+		if err != tt.wantErr {
+			t.Errorf("Search(%q) error = %v, want %v", tt.ip, err, tt.wantErr)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if got.Network.String() != tt.want || got.ASN != tt.asn || got.ASName != tt.name || got.Country != tt.country {
+			t.Errorf("Search(%q) = %+v, want %s AS%d %q %s", tt.ip, got, tt.want, tt.asn, tt.name, tt.country)
+		}
+	}
+	if _, err := p.Search(nil); err != ErrNoPrefixFound {
+		t.Errorf("Search(nil) error = %v, want %v", err, ErrNoPrefixFound)
+	}
+}
+
+func TestParsePrefixes_errors(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+	}{
+		{
+			name: "empty",
+			data: "",
+		},
+		{
+			name: "missing-columns",
+			data: "asn,name\nAS1,test\n",
+		},
+		{
+			name: "no-usable-rows",
+			data: "network,asn\n10.0.0.0/8,\nbad,AS1\n",
+		},
+		{
+			name: "bad-csv",
+			data: "network,asn\n\"1.0.0.0/24,AS1\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := ParsePrefixes([]byte(tt.data)); err == nil {
+				t.Error("ParsePrefixes() should have failed")
+			}
+		})
+	}
+}
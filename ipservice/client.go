@@ -1,15 +1,21 @@
 package ipservice
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"net"
 	"net/http"
 	"net/url"
+	"syscall"
+	"time"
 
+	"github.com/m-lab/go/rtx"
 	"github.com/m-lab/uuid-annotator/annotator"
 	"github.com/m-lab/uuid-annotator/metrics"
 )
@@ -26,54 +32,260 @@ import (
 type Client interface {
 	// Annotate gets the ClientAnnotations associated with each of the valid
 	// passed-in IP addresses. Invalid IPs will not be present in the returned
-	// map.
+	// map. IPs may include a port, as in "1.2.3.4:443" or "[::1]:443", and the
+	// returned map is keyed by the strings as passed in. If the server ran out
+	// of time, the partial results are returned with ErrTruncated.
 	Annotate(ctx context.Context, ips []string) (map[string]*annotator.ClientAnnotations, error)
 }
 
+// PairClient is a Client that also annotates pairs of endpoints. The Clients
+// returned by NewClient and NewGRPCClient implement it. Like ServerClient, it
+// is separate from Client so that other implementations of Client need not
+// implement AnnotatePairs.
+type PairClient interface {
+	Client
+
+	// AnnotatePairs gets the Network annotations of both endpoints of each
+	// valid (src, dst) pair, along with their relationship. Invalid pairs will
+	// not be present in the returned list. If the server ran out of time, the
+	// partial results are returned with ErrTruncated.
+	AnnotatePairs(ctx context.Context, pairs [][2]string) ([]*PairAnnotations, error)
+}
+
+// GroupClient is a Client that also annotates groups of IPs. The Clients
+// returned by NewClient and NewGRPCClient implement it. Like ServerClient, it
+// is separate from Client so that other implementations of Client need not
+// implement AnnotateGroups.
+type GroupClient interface {
+	Client
+
+	// AnnotateGroups gets the ClientAnnotations of the IPs of every group,
+	// e.g. the IPv4 and IPv6 addresses of a dual-stacked client, keyed by
+	// the caller-supplied group ID and then by the IPs as passed in. Invalid
+	// IPs, and groups without a valid IP, will not be present in the returned
+	// map. If the server ran out of time, the complete groups that it
+	// annotated are returned with ErrTruncated.
+	AnnotateGroups(ctx context.Context, groups map[string][]string) (map[string]map[string]*annotator.ClientAnnotations, error)
+}
+
+// ServerClient is a Client that also gets the server annotations of local IPs.
+// The Clients returned by NewClient and NewGRPCClient implement it. It is
+// separate from Client so that other implementations of Client, like the fakes
+// of its users, need not implement AnnotateServer.
+type ServerClient interface {
+	Client
+
+	// AnnotateServer gets the ServerAnnotations of a local IP of the server.
+	// If the server was started without a site annotator, it returns
+	// ErrNotImplemented.
+	AnnotateServer(ctx context.Context, ip string) (*annotator.ServerAnnotations, error)
+}
+
+// ErrTruncated is returned along with the annotations of a response that the
+// server truncated because the request exceeded its time budget.
+var ErrTruncated = errors.New("response truncated by the server")
+
+// ErrNotImplemented is returned for an RPC that the server does not support.
+var ErrNotImplemented = errors.New("not implemented by the server")
+
 // getter defines the subset of the interface of http.Client that we use, in an
 // effort to enable mocking and testing.
 type getter interface {
-	Get(url string) (resp *http.Response, err error)
+	Do(req *http.Request) (*http.Response, error)
 }
 
+// maxQueryIPs is the largest number of IPs that Annotate sends in the query
+// string of a GET. Larger lists are sent in the body of a POST instead.
+const maxQueryIPs = 100
+
 type client struct {
 	sockfilename string
 	httpc        getter
+
+	// Connection failures are retried attempts times, with backoff doubling
+	// after each retry. By default, there is a single attempt.
+	attempts int
+	backoff  time.Duration
 }
 
-func (c *client) Annotate(ctx context.Context, ips []string) (map[string]*annotator.ClientAnnotations, error) {
-	ipvalues := url.Values{}
-	for _, ip := range ips {
-		ipvalues.Add("ip", ip)
+// ClientOption configures optional behavior of the Client in NewClient.
+type ClientOption func(*client)
+
+// WithReconnect makes every RPC try up to attempts times to connect to the
+// server, waiting backoff after the first failure and doubling the wait after
+// each subsequent failure, e.g. while the server restarts. Only connection
+// failures are retried. Values of attempts less than one are treated as one.
+func WithReconnect(attempts int, backoff time.Duration) ClientOption {
+	return func(c *client) {
+		c.attempts = attempts
+		c.backoff = backoff
 	}
+}
+
+// connect makes the request, retrying connection failures as configured.
+func (c *client) connect(ctx context.Context, request func() (*http.Response, error)) (*http.Response, error) {
+	resp, err := request()
+	wait := c.backoff
+	for i := 1; err != nil && i < c.attempts; i++ {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		if !isConnectionError(err) {
+			return nil, err
+		}
+		metrics.ClientReconnects.WithLabelValues("attempt").Inc()
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		wait *= 2
+		resp, err = request()
+		if err == nil {
+			metrics.ClientReconnects.WithLabelValues("success").Inc()
+		}
+	}
+	if err != nil && ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	return resp, err
+}
+
+// isConnectionError returns true if the error is a failure to connect to the
+// server, or a connection closed by it, e.g. while it restarts, rather than an
+// error of the request itself.
+func isConnectionError(err error) bool {
+	var opErr *net.OpError
+	if errors.As(err, &opErr) && opErr.Op == "dial" {
+		return true
+	}
+	return errors.Is(err, syscall.ECONNREFUSED) || errors.Is(err, syscall.ECONNRESET) || errors.Is(err, io.EOF)
+}
+
+// get performs the RPC with the given path and arguments, and unmarshals the
+// response into v.
+func (c *client) get(ctx context.Context, path string, values url.Values, v interface{}) error {
 	u := url.URL{
 		Scheme:   "http",
 		Host:     "unix",
-		Path:     "/v1/annotate/ips",
-		RawQuery: ipvalues.Encode(),
+		Path:     path,
+		RawQuery: values.Encode(),
+	}
+	return c.do(ctx, func() (*http.Response, error) {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+		rtx.Must(err, "Could not create the request. This should never happen and is a bug.")
+		return c.httpc.Do(req)
+	}, v)
+}
+
+// post performs the RPC with the given path and the JSON of body as the
+// request body, and unmarshals the response into v.
+func (c *client) post(ctx context.Context, path string, body interface{}, v interface{}) error {
+	u := url.URL{
+		Scheme: "http",
+		Host:   "unix",
+		Path:   path,
 	}
-	resp, err := c.httpc.Get(u.String())
+	b, err := json.Marshal(body)
+	rtx.Must(err, "Could not marshal the request. This should never happen and is a bug.")
+	return c.do(ctx, func() (*http.Response, error) {
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, u.String(), bytes.NewReader(b))
+		rtx.Must(err, "Could not create the request. This should never happen and is a bug.")
+		req.Header.Set("Content-Type", "application/json")
+		return c.httpc.Do(req)
+	}, v)
+}
+
+// do makes the request, and unmarshals the response into v.
+func (c *client) do(ctx context.Context, request func() (*http.Response, error), v interface{}) error {
+	resp, err := c.connect(ctx, request)
 	if err != nil {
 		metrics.ClientRPCCount.WithLabelValues("get_error").Inc()
-		return nil, err
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotImplemented {
+		metrics.ClientRPCCount.WithLabelValues("not_implemented_error").Inc()
+		return ErrNotImplemented
 	}
 	if resp.StatusCode != 200 {
 		metrics.ClientRPCCount.WithLabelValues("http_status_error").Inc()
-		return nil, fmt.Errorf("Got HTTP %d, but wanted HTTP 200", resp.StatusCode)
+		return fmt.Errorf("Got HTTP %d, but wanted HTTP 200", resp.StatusCode)
 	}
 	b, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
 		metrics.ClientRPCCount.WithLabelValues("read_error").Inc()
-		return nil, err
+		return err
 	}
+	err = json.Unmarshal(b, v)
+	if err != nil {
+		metrics.ClientRPCCount.WithLabelValues("unmarshal_error").Inc()
+		return err
+	}
+	if resp.Header.Get(TruncatedHeader) == "true" {
+		metrics.ClientRPCCount.WithLabelValues("truncated").Inc()
+		return ErrTruncated
+	}
+	metrics.ClientRPCCount.WithLabelValues("success").Inc()
+	return nil
+}
+
+func (c *client) Annotate(ctx context.Context, ips []string) (map[string]*annotator.ClientAnnotations, error) {
 	ann := make(map[string]*annotator.ClientAnnotations)
-	err = json.Unmarshal(b, &ann)
-	if err == nil {
-		metrics.ClientRPCCount.WithLabelValues("success").Inc()
+	var err error
+	if len(ips) > maxQueryIPs {
+		err = c.post(ctx, "/v1/annotate/ips", ips, &ann)
 	} else {
-		metrics.ClientRPCCount.WithLabelValues("unmarshal_error").Inc()
+		ipvalues := url.Values{}
+		for _, ip := range ips {
+			ipvalues.Add("ip", ip)
+		}
+		err = c.get(ctx, "/v1/annotate/ips", ipvalues, &ann)
+	}
+	if err == ErrTruncated {
+		return ann, err
+	}
+	if err != nil {
+		return nil, err
+	}
+	return ann, nil
+}
+
+func (c *client) AnnotatePairs(ctx context.Context, pairs [][2]string) ([]*PairAnnotations, error) {
+	pairvalues := url.Values{}
+	for _, pair := range pairs {
+		pairvalues.Add("pair", pair[0]+","+pair[1])
+	}
+	ann := []*PairAnnotations{}
+	err := c.get(ctx, "/v1/annotate/pairs", pairvalues, &ann)
+	if err == ErrTruncated {
+		return ann, err
 	}
-	return ann, err
+	if err != nil {
+		return nil, err
+	}
+	return ann, nil
+}
+
+func (c *client) AnnotateGroups(ctx context.Context, groups map[string][]string) (map[string]map[string]*annotator.ClientAnnotations, error) {
+	ann := make(map[string]map[string]*annotator.ClientAnnotations)
+	err := c.post(ctx, "/v1/annotate/groups", groups, &ann)
+	if err == ErrTruncated {
+		return ann, err
+	}
+	if err != nil {
+		return nil, err
+	}
+	return ann, nil
+}
+
+func (c *client) AnnotateServer(ctx context.Context, ip string) (*annotator.ServerAnnotations, error) {
+	ann := &annotator.ServerAnnotations{}
+	err := c.get(ctx, "/v1/annotate/server", url.Values{"ip": {ip}}, ann)
+	if err != nil {
+		return nil, err
+	}
+	return ann, nil
 }
 
 // NewClient creates an RPC client for annotating IP addresses. The only RPC
@@ -83,19 +295,30 @@ func (c *client) Annotate(ctx context.Context, ips []string) (map[string]*annota
 //
 // The recommended value to pass into this function is the value of the
 // command-line flag `--ipservice.SocketFilename`, which is pointed to by
-// `ipservice.SocketFilename`.
-func NewClient(sockfilename string) Client {
+// `ipservice.SocketFilename`. The transport is selected by the value of
+// `ipservice.Network`.
+//
+// By default, every RPC fails immediately if the server is unavailable, e.g.
+// while it restarts. Pass WithReconnect to retry instead.
+func NewClient(sockfilename string, opts ...ClientOption) Client {
 	if sockfilename != *SocketFilename {
 		log.Printf("WARNING: socket filename of %q differs from command-line flag value of %q\n", sockfilename, *SocketFilename)
 	}
-	return &client{
+	network := *Network
+	c := &client{
 		sockfilename: sockfilename,
 		httpc: &http.Client{
 			Transport: &http.Transport{
 				DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
-					return net.Dial("unix", sockfilename)
+					var d net.Dialer
+					return d.DialContext(ctx, network, sockfilename)
 				},
 			},
 		},
+		attempts: 1,
+	}
+	for _, opt := range opts {
+		opt(c)
 	}
+	return c
 }
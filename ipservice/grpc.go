@@ -0,0 +1,339 @@
+package ipservice
+
+import (
+	"bufio"
+	"context"
+	"log"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+
+	"github.com/m-lab/uuid-annotator/annotator"
+	"github.com/m-lab/uuid-annotator/ipservice/ipservicepb"
+	"github.com/m-lab/uuid-annotator/metrics"
+)
+
+// The gRPC service shares the socket with the HTTP service. Every HTTP/2
+// connection, which includes every gRPC connection, starts with the client
+// preface, so the connections that start with it are served by gRPC, and all
+// others by HTTP/1.
+const http2Preface = "PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n"
+
+// prefaceTimeout bounds the wait for the first bytes of a new connection.
+const prefaceTimeout = 10 * time.Second
+
+// protocolListener is a listener for the connections of one protocol, which
+// are accepted from the shared listener by splitByProtocol.
+type protocolListener struct {
+	addr  net.Addr
+	conns chan net.Conn
+	done  chan struct{}
+	once  sync.Once
+}
+
+func newProtocolListener(addr net.Addr) *protocolListener {
+	return &protocolListener{
+		addr:  addr,
+		conns: make(chan net.Conn),
+		done:  make(chan struct{}),
+	}
+}
+
+func (l *protocolListener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.conns:
+		return c, nil
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *protocolListener) Close() error {
+	l.once.Do(func() { close(l.done) })
+	return nil
+}
+
+func (l *protocolListener) Addr() net.Addr {
+	return l.addr
+}
+
+// offer passes the connection to the listener, or closes it if the listener
+// is closed.
+func (l *protocolListener) offer(c net.Conn) {
+	select {
+	case l.conns <- c:
+	case <-l.done:
+		c.Close()
+	}
+}
+
+// peekedConn is a connection whose first bytes were read into r.
+type peekedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *peekedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+// splitByProtocol accepts the connections of l until it is closed, and passes
+// those that start with the HTTP/2 preface to the returned grpc listener, and
+// all others to the returned http listener. Both are closed once l is.
+func splitByProtocol(l net.Listener) (httpL, grpcL *protocolListener) {
+	httpL = newProtocolListener(l.Addr())
+	grpcL = newProtocolListener(l.Addr())
+	go func() {
+		defer httpL.Close()
+		defer grpcL.Close()
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go route(c, httpL, grpcL)
+		}
+	}()
+	return httpL, grpcL
+}
+
+// route reads as much of the preface as it takes to tell whether c is an
+// HTTP/2 connection, and passes c to the listener of its protocol.
+func route(c net.Conn, httpL, grpcL *protocolListener) {
+	r := bufio.NewReader(c)
+	c.SetReadDeadline(time.Now().Add(prefaceTimeout))
+	target := grpcL
+	for i := 1; i <= len(http2Preface); i++ {
+		b, err := r.Peek(i)
+		if err != nil {
+			c.Close()
+			return
+		}
+		if b[i-1] != http2Preface[i-1] {
+			target = httpL
+			break
+		}
+	}
+	c.SetReadDeadline(time.Time{})
+	target.offer(&peekedConn{Conn: c, r: r})
+}
+
+// grpcServer serves the gRPC Annotator service with the annotators of h.
+type grpcServer struct {
+	ipservicepb.UnimplementedAnnotatorServer
+	h *handler
+}
+
+func (s *grpcServer) AnnotateIPs(ctx context.Context, req *ipservicepb.AnnotateIPsRequest) (*ipservicepb.AnnotateIPsResponse, error) {
+	ann, truncated := s.h.annotateAll(req.GetIps())
+	if len(ann) == 0 {
+		log.Println("Could not process request ip argument(s)")
+		metrics.ServerRPCCount.WithLabelValues("bad_request_error").Inc()
+		return nil, status.Error(codes.InvalidArgument, "no valid IPs")
+	}
+	resp := &ipservicepb.AnnotateIPsResponse{
+		Annotations: make(map[string]*ipservicepb.ClientAnnotations, len(ann)),
+		Truncated:   truncated,
+	}
+	for ip, a := range ann {
+		resp.Annotations[ip] = clientToProto(a)
+	}
+	if truncated {
+		metrics.ServerRPCCount.WithLabelValues("truncated").Inc()
+	} else {
+		metrics.ServerRPCCount.WithLabelValues("success").Inc()
+	}
+	return resp, nil
+}
+
+// GRPCClient is the ServerClient, PairClient, and GroupClient returned by
+// NewGRPCClient. Close releases its gRPC connection.
+type GRPCClient interface {
+	ServerClient
+	PairClient
+	GroupClient
+	Close() error
+}
+
+// grpcClient is a Client that annotates IPs with gRPC, and performs all other
+// RPCs with HTTP on the same socket.
+type grpcClient struct {
+	*client
+	conn      *grpc.ClientConn
+	annotator ipservicepb.AnnotatorClient
+}
+
+// NewGRPCClient creates an RPC client like NewClient, whose Annotate uses the
+// gRPC service of the server instead of HTTP, to avoid the overhead of
+// encoding and decoding JSON. The gRPC connection is made in the background
+// and reconnects on its own, so WithReconnect only applies to the other RPCs.
+// Call Close when done with the client.
+func NewGRPCClient(sockfilename string, opts ...ClientOption) (GRPCClient, error) {
+	c := NewClient(sockfilename, opts...).(*client)
+	network := *Network
+	conn, err := grpc.Dial("passthrough:///unix",
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			d := net.Dialer{}
+			return d.DialContext(ctx, network, sockfilename)
+		}),
+	)
+	if err != nil {
+		return nil, err
+	}
+	return &grpcClient{
+		client:    c,
+		conn:      conn,
+		annotator: ipservicepb.NewAnnotatorClient(conn),
+	}, nil
+}
+
+// Close closes the gRPC connection, and the idle HTTP connections of the other
+// RPCs, which still work after Close.
+func (c *grpcClient) Close() error {
+	if h, ok := c.httpc.(*http.Client); ok {
+		h.CloseIdleConnections()
+	}
+	return c.conn.Close()
+}
+
+func (c *grpcClient) Annotate(ctx context.Context, ips []string) (map[string]*annotator.ClientAnnotations, error) {
+	resp, err := c.annotator.AnnotateIPs(ctx, &ipservicepb.AnnotateIPsRequest{Ips: ips})
+	if err != nil {
+		metrics.ClientRPCCount.WithLabelValues("grpc_error").Inc()
+		return nil, err
+	}
+	ann := make(map[string]*annotator.ClientAnnotations, len(resp.GetAnnotations()))
+	for ip, a := range resp.GetAnnotations() {
+		ann[ip] = clientFromProto(a)
+	}
+	if resp.GetTruncated() {
+		metrics.ClientRPCCount.WithLabelValues("truncated").Inc()
+		return ann, ErrTruncated
+	}
+	metrics.ClientRPCCount.WithLabelValues("success").Inc()
+	return ann, nil
+}
+
+// clientToProto converts the annotations to their protobuf message. Every
+// field of the annotations must be copied, and copied back by clientFromProto.
+func clientToProto(a *annotator.ClientAnnotations) *ipservicepb.ClientAnnotations {
+	p := &ipservicepb.ClientAnnotations{IpHash: a.IPHash}
+	if g := a.Geo; g != nil {
+		p.Geo = &ipservicepb.Geolocation{
+			ContinentCode:             g.ContinentCode,
+			CountryCode:               g.CountryCode,
+			CountryCode3:              g.CountryCode3,
+			CountryName:               g.CountryName,
+			Region:                    g.Region,
+			Subdivision1IsoCode:       g.Subdivision1ISOCode,
+			Subdivision1Name:          g.Subdivision1Name,
+			Subdivision2IsoCode:       g.Subdivision2ISOCode,
+			Subdivision2Name:          g.Subdivision2Name,
+			MetroCode:                 g.MetroCode,
+			City:                      g.City,
+			AreaCode:                  g.AreaCode,
+			PostalCode:                g.PostalCode,
+			Latitude:                  g.Latitude,
+			Longitude:                 g.Longitude,
+			AccuracyRadiusKm:          g.AccuracyRadiusKm,
+			CoordinatesAreApproximate: g.CoordinatesAreApproximate,
+			TimeZone:                  g.TimeZone,
+			ApproxUtcOffset:           g.ApproxUTCOffset,
+			Missing:                   g.Missing,
+			Reserved:                  g.Reserved,
+		}
+	}
+	if n := a.Network; n != nil {
+		p.Network = &ipservicepb.Network{
+			Cidr:              n.CIDR,
+			AsNumber:          n.ASNumber,
+			AsName:            n.ASName,
+			Missing:           n.Missing,
+			AnnouncedCidr:     n.AnnouncedCIDR,
+			AsNameSource:      n.ASNameSource,
+			AsNameAll:         n.ASNameAll,
+			Country:           n.Country,
+			TransitionAddress: n.TransitionAddress,
+			AllocatedCountry:  n.AllocatedCountry,
+			ConeSize:          n.ConeSize,
+			Visibility:        n.Visibility,
+			Organization:      n.Organization,
+			OrgId:             n.OrgID,
+			AsDomain:          n.ASDomain,
+			AsType:            n.ASType,
+			Reserved:          n.Reserved,
+			RouteViewDate:     n.RouteViewDate,
+			V4Cidr:            n.V4CIDR,
+			V6Cidr:            n.V6CIDR,
+		}
+		for _, s := range n.Systems {
+			p.Network.Systems = append(p.Network.Systems, &ipservicepb.System{Asns: s.ASNs})
+		}
+	}
+	return p
+}
+
+// clientFromProto converts the protobuf message back to annotations.
+func clientFromProto(p *ipservicepb.ClientAnnotations) *annotator.ClientAnnotations {
+	a := &annotator.ClientAnnotations{IPHash: p.GetIpHash()}
+	if g := p.GetGeo(); g != nil {
+		a.Geo = &annotator.Geolocation{
+			ContinentCode:             g.ContinentCode,
+			CountryCode:               g.CountryCode,
+			CountryCode3:              g.CountryCode3,
+			CountryName:               g.CountryName,
+			Region:                    g.Region,
+			Subdivision1ISOCode:       g.Subdivision1IsoCode,
+			Subdivision1Name:          g.Subdivision1Name,
+			Subdivision2ISOCode:       g.Subdivision2IsoCode,
+			Subdivision2Name:          g.Subdivision2Name,
+			MetroCode:                 g.MetroCode,
+			City:                      g.City,
+			AreaCode:                  g.AreaCode,
+			PostalCode:                g.PostalCode,
+			Latitude:                  g.Latitude,
+			Longitude:                 g.Longitude,
+			AccuracyRadiusKm:          g.AccuracyRadiusKm,
+			CoordinatesAreApproximate: g.CoordinatesAreApproximate,
+			TimeZone:                  g.TimeZone,
+			ApproxUTCOffset:           g.ApproxUtcOffset,
+			Missing:                   g.Missing,
+			Reserved:                  g.Reserved,
+		}
+	}
+	if n := p.GetNetwork(); n != nil {
+		a.Network = &annotator.Network{
+			CIDR:              n.Cidr,
+			ASNumber:          n.AsNumber,
+			ASName:            n.AsName,
+			Missing:           n.Missing,
+			AnnouncedCIDR:     n.AnnouncedCidr,
+			ASNameSource:      n.AsNameSource,
+			ASNameAll:         n.AsNameAll,
+			Country:           n.Country,
+			TransitionAddress: n.TransitionAddress,
+			AllocatedCountry:  n.AllocatedCountry,
+			ConeSize:          n.ConeSize,
+			Visibility:        n.Visibility,
+			Organization:      n.Organization,
+			OrgID:             n.OrgId,
+			ASDomain:          n.AsDomain,
+			ASType:            n.AsType,
+			Reserved:          n.Reserved,
+			RouteViewDate:     n.RouteViewDate,
+			V4CIDR:            n.V4Cidr,
+			V6CIDR:            n.V6Cidr,
+		}
+		for _, s := range n.Systems {
+			a.Network.Systems = append(a.Network.Systems, annotator.System{ASNs: s.GetAsns()})
+		}
+	}
+	return a
+}
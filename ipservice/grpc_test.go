@@ -0,0 +1,209 @@
+package ipservice
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"os"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-test/deep"
+	"github.com/m-lab/go/rtx"
+	"github.com/m-lab/uuid-annotator/annotator"
+)
+
+func TestServerAndGRPCClientE2E(t *testing.T) {
+	d, err := ioutil.TempDir("", "TestServerAndGRPCClientE2E")
+	rtx.Must(err, "Could not create tempdir")
+	defer os.RemoveAll(d)
+
+	sock := d + "/annotator.sock"
+	srv, err := NewServer(sock, asn, geo)
+	rtx.Must(err, "Could not create server")
+
+	wg := sync.WaitGroup{}
+	wg.Add(1)
+	go func() {
+		rtx.Must(srv.Serve(), "Could not serve the annotator")
+		wg.Done()
+	}()
+
+	c, err := NewGRPCClient(sock)
+	rtx.Must(err, "Could not create gRPC client")
+	ctx := context.Background()
+
+	for _, tt := range annotateTests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := c.Annotate(ctx, tt.ips)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Annotate() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if err != nil {
+				return
+			}
+			gotStr, _ := json.Marshal(got)
+			wantStr, _ := json.Marshal(tt.want)
+			if string(gotStr) != string(wantStr) {
+				t.Errorf("Annotate() = %q, want %q", string(gotStr), string(wantStr))
+			}
+		})
+	}
+
+	// The other RPCs still use HTTP on the same socket.
+	pairs, err := c.AnnotatePairs(ctx, [][2]string{{"2.125.160.216", "2.120.0.1"}})
+	if err != nil || len(pairs) != 1 || !pairs[0].SameASN {
+		t.Errorf("AnnotatePairs() = %v, %v, want one pair in the same AS", pairs, err)
+	}
+	rtx.Must(c.Close(), "Could not close the gRPC client")
+	if _, err := c.Annotate(ctx, []string{"2.125.160.216"}); err == nil {
+		t.Error("Annotate() after Close() should fail")
+	}
+
+	srv.Close()
+	wg.Wait()
+}
+
+func TestGRPCClientTruncated(t *testing.T) {
+	d, err := ioutil.TempDir("", "TestGRPCClientTruncated")
+	rtx.Must(err, "Could not create tempdir")
+	defer os.RemoveAll(d)
+
+	prev := *RequestBudget
+	*RequestBudget = time.Nanosecond
+	defer func() { *RequestBudget = prev }()
+
+	sock := d + "/annotator.sock"
+	srv, err := NewServer(sock, asn, geo)
+	rtx.Must(err, "Could not create server")
+	go srv.Serve()
+	defer srv.Close()
+
+	c, err := NewGRPCClient(sock)
+	rtx.Must(err, "Could not create gRPC client")
+	defer c.Close()
+	got, err := c.Annotate(context.Background(), []string{"2.125.160.216", "1.0.0.1", "127.0.0.1"})
+	if err != ErrTruncated {
+		t.Errorf("Annotate() error = %v, want %v", err, ErrTruncated)
+	}
+	if len(got) == 0 || len(got) == 3 {
+		t.Errorf("Annotate() returned %d annotations, want a partial response", len(got))
+	}
+}
+
+func TestSplitByProtocol(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	rtx.Must(err, "Could not listen")
+	httpL, grpcL := splitByProtocol(l)
+
+	for _, tt := range []struct {
+		prefix string
+		want   *protocolListener
+	}{
+		{prefix: http2Preface + "rest", want: grpcL},
+		{prefix: "GET / HTTP/1.0\r\n\r\n", want: httpL},
+		{prefix: "PRI * HTTP/1.1\r\n", want: httpL},
+	} {
+		c, err := net.Dial("tcp", l.Addr().String())
+		rtx.Must(err, "Could not dial")
+		_, err = c.Write([]byte(tt.prefix))
+		rtx.Must(err, "Could not write")
+		accepted, err := tt.want.Accept()
+		rtx.Must(err, "Could not accept %q", tt.prefix)
+		// The routed connection still reads from its first byte.
+		b := make([]byte, len(tt.prefix))
+		_, err = accepted.Read(b[:1])
+		rtx.Must(err, "Could not read")
+		if b[0] != tt.prefix[0] {
+			t.Errorf("Read() of %q = %q, want %q", tt.prefix, b[:1], tt.prefix[:1])
+		}
+		accepted.Close()
+		c.Close()
+	}
+
+	l.Close()
+	if _, err := httpL.Accept(); err != net.ErrClosed {
+		t.Errorf("Accept() after Close() error = %v, want %v", err, net.ErrClosed)
+	}
+	if _, err := grpcL.Accept(); err != net.ErrClosed {
+		t.Errorf("Accept() after Close() error = %v, want %v", err, net.ErrClosed)
+	}
+}
+
+// checkAllFieldsSet fails the test if any field of v, a struct or a pointer to
+// one, is its zero value.
+func checkAllFieldsSet(t *testing.T, v interface{}) {
+	rv := reflect.Indirect(reflect.ValueOf(v))
+	for i := 0; i < rv.NumField(); i++ {
+		if rv.Field(i).IsZero() {
+			t.Errorf("%s.%s is not set; it must be converted by clientToProto and clientFromProto", rv.Type().Name(), rv.Type().Field(i).Name)
+		}
+	}
+}
+
+func TestClientProtoRoundTrip(t *testing.T) {
+	want := &annotator.ClientAnnotations{
+		Geo: &annotator.Geolocation{
+			ContinentCode:             "EU",
+			CountryCode:               "GB",
+			CountryCode3:              "GBR",
+			CountryName:               "United Kingdom",
+			Region:                    "ENG",
+			Subdivision1ISOCode:       "ENG",
+			Subdivision1Name:          "England",
+			Subdivision2ISOCode:       "WBK",
+			Subdivision2Name:          "West Berkshire",
+			MetroCode:                 1,
+			City:                      "Boxford",
+			AreaCode:                  2,
+			PostalCode:                "OX1",
+			Latitude:                  51.75,
+			Longitude:                 -1.25,
+			AccuracyRadiusKm:          100,
+			CoordinatesAreApproximate: true,
+			TimeZone:                  "Europe/London",
+			ApproxUTCOffset:           "+00:00",
+			Missing:                   true,
+			Reserved:                  true,
+		},
+		Network: &annotator.Network{
+			CIDR:              "2.120.0.0/13",
+			ASNumber:          5607,
+			ASName:            "Sky UK Limited",
+			Missing:           true,
+			AnnouncedCIDR:     "2.112.0.0/12",
+			ASNameSource:      "ipinfo",
+			ASNameAll:         []string{"Sky UK Limited", "SKY"},
+			Country:           "GB",
+			TransitionAddress: "6to4",
+			AllocatedCountry:  "GB",
+			ConeSize:          3,
+			Visibility:        4,
+			Organization:      "Sky UK Limited",
+			OrgID:             "SKYUK-RIPE",
+			ASDomain:          "sky.com",
+			ASType:            "isp",
+			Reserved:          true,
+			RouteViewDate:     "2023-01-02",
+			V4CIDR:            "2.120.0.0/13",
+			V6CIDR:            "2a02:c7f::/32",
+			Systems:           []annotator.System{{ASNs: []uint32{5607, 5608}}, {ASNs: []uint32{1}}},
+		},
+		IPHash: "abc",
+	}
+	checkAllFieldsSet(t, want)
+	checkAllFieldsSet(t, want.Geo)
+	checkAllFieldsSet(t, want.Network)
+
+	got := clientFromProto(clientToProto(want))
+	if diff := deep.Equal(got, want); diff != nil {
+		t.Errorf("clientFromProto(clientToProto()) changed the annotations: %v", diff)
+	}
+	if got := clientFromProto(clientToProto(&annotator.ClientAnnotations{})); got.Geo != nil || got.Network != nil {
+		t.Errorf("clientFromProto(clientToProto()) of empty annotations = %+v, want empty", got)
+	}
+}
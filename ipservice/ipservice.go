@@ -7,4 +7,24 @@ import "flag"
 var SocketFilename = flag.String(
 	"ipservice.sock",
 	"",
-	"The filename to use as a UNIX domain socket for the local annotation service.")
+	"The filename to use as a UNIX domain socket for the local annotation service, or a loopback host:port with -ipservice.network=tcp.")
+
+// Network is a flag to allow both clients and servers to use the same
+// transport. When it is "tcp", the value of SocketFilename is instead a
+// host:port address, which must be on a loopback interface.
+var Network = flag.String(
+	"ipservice.network",
+	defaultNetwork,
+	"The transport for the local annotation service. Either \"unix\" or \"tcp\" (loopback only).")
+
+// RequestBudget is a flag for the total time the server may spend annotating a
+// single request. Once it is exceeded, the server stops annotating and returns
+// the annotations computed so far, with the TruncatedHeader set.
+var RequestBudget = flag.Duration(
+	"ipservice.request-budget",
+	0,
+	"The maximum time the local annotation service spends on each request, or 0 for no limit. Requests that exceed it get a partial response.")
+
+// TruncatedHeader is set to "true" in responses that only contain some of the
+// requested annotations, because the server exceeded its RequestBudget.
+const TruncatedHeader = "X-Annotation-Truncated"
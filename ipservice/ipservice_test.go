@@ -5,20 +5,29 @@ import (
 	"context"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"net"
 	"net/http"
+	"net/http/httptest"
 	"net/url"
 	"os"
+	"strings"
 	"sync"
+	"syscall"
 	"testing"
+	"time"
 
+	"github.com/go-test/deep"
 	"github.com/m-lab/go/content"
 	"github.com/m-lab/go/rtx"
 	"github.com/m-lab/uuid-annotator/annotator"
 	"github.com/m-lab/uuid-annotator/asnannotator"
 	"github.com/m-lab/uuid-annotator/geoannotator"
+	"github.com/m-lab/uuid-annotator/metrics"
+	"github.com/m-lab/uuid-annotator/siteannotator"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 )
 
 var (
@@ -57,6 +66,196 @@ func init() {
 	geo = geoannotator.New(ctx, localRawfile, localIPs)
 }
 
+// annotateTests are the cases of the E2E tests of every Client.
+var annotateTests = []struct {
+	name    string
+	ips     []string
+	want    map[string]*annotator.ClientAnnotations
+	wantErr bool
+}{
+	{
+		name:    "Nil ips",
+		ips:     nil,
+		wantErr: true,
+	},
+	{
+		name:    "Bad ips",
+		ips:     []string{"this is not an ip address"},
+		wantErr: true,
+	},
+	{
+		name: "Localhost-v4",
+		ips:  []string{"127.0.0.1"},
+		want: map[string]*annotator.ClientAnnotations{
+			"127.0.0.1": {
+				Network: &annotator.Network{
+					Missing:  true,
+					Reserved: true,
+				},
+				Geo: &annotator.Geolocation{
+					Missing:  true,
+					Reserved: true,
+				},
+			},
+		},
+	},
+	{
+		name: "Localhost-v6",
+		ips:  []string{"::1"},
+		want: map[string]*annotator.ClientAnnotations{
+			"::1": {
+				Network: &annotator.Network{
+					Missing:  true,
+					Reserved: true,
+				},
+				Geo: &annotator.Geolocation{
+					Missing:  true,
+					Reserved: true,
+				},
+			},
+		},
+	},
+	{
+		name: "IP that has everything",
+		ips:  []string{"2.125.160.216"},
+		want: map[string]*annotator.ClientAnnotations{
+			"2.125.160.216": {
+				Network: &annotator.Network{
+					CIDR:     "2.120.0.0/13",
+					ASNumber: 5607,
+					ASName:   "Sky UK Limited",
+					Systems: []annotator.System{
+						{ASNs: []uint32{5607}},
+					},
+				},
+				Geo: &annotator.Geolocation{
+					ContinentCode:       "EU",
+					CountryCode:         "GB",
+					CountryName:         "United Kingdom",
+					Subdivision1ISOCode: "ENG",
+					Subdivision1Name:    "England",
+					Subdivision2ISOCode: "WBK",
+					Subdivision2Name:    "West Berkshire",
+					City:                "Boxford",
+					PostalCode:          "OX1",
+					Latitude:            51.75,
+					Longitude:           -1.25,
+					AccuracyRadiusKm:    100,
+					TimeZone:            "Europe/London",
+				},
+			},
+		},
+	},
+	{
+		name: "IPs with ports",
+		ips:  []string{"127.0.0.1:443", "[::1]:443", "[::1]"},
+		want: map[string]*annotator.ClientAnnotations{
+			"127.0.0.1:443": {
+				Network: &annotator.Network{
+					Missing:  true,
+					Reserved: true,
+				},
+				Geo: &annotator.Geolocation{
+					Missing:  true,
+					Reserved: true,
+				},
+			},
+			"[::1]": {
+				Network: &annotator.Network{
+					Missing:  true,
+					Reserved: true,
+				},
+				Geo: &annotator.Geolocation{
+					Missing:  true,
+					Reserved: true,
+				},
+			},
+			"[::1]:443": {
+				Network: &annotator.Network{
+					Missing:  true,
+					Reserved: true,
+				},
+				Geo: &annotator.Geolocation{
+					Missing:  true,
+					Reserved: true,
+				},
+			},
+		},
+	},
+	{
+		name: "IP with port that has everything",
+		ips:  []string{"2.125.160.216:443"},
+		want: map[string]*annotator.ClientAnnotations{
+			"2.125.160.216:443": {
+				Network: &annotator.Network{
+					CIDR:     "2.120.0.0/13",
+					ASNumber: 5607,
+					ASName:   "Sky UK Limited",
+					Systems: []annotator.System{
+						{ASNs: []uint32{5607}},
+					},
+				},
+				Geo: &annotator.Geolocation{
+					ContinentCode:       "EU",
+					CountryCode:         "GB",
+					CountryName:         "United Kingdom",
+					Subdivision1ISOCode: "ENG",
+					Subdivision1Name:    "England",
+					Subdivision2ISOCode: "WBK",
+					Subdivision2Name:    "West Berkshire",
+					City:                "Boxford",
+					PostalCode:          "OX1",
+					Latitude:            51.75,
+					Longitude:           -1.25,
+					AccuracyRadiusKm:    100,
+					TimeZone:            "Europe/London",
+				},
+			},
+		},
+	},
+	{
+		name: "Multiple IPs",
+		ips:  []string{"2.125.160.216", "127.0.0.1"},
+		want: map[string]*annotator.ClientAnnotations{
+			"2.125.160.216": {
+				Network: &annotator.Network{
+					CIDR:     "2.120.0.0/13",
+					ASNumber: 5607,
+					ASName:   "Sky UK Limited",
+					Systems: []annotator.System{
+						{ASNs: []uint32{5607}},
+					},
+				},
+				Geo: &annotator.Geolocation{
+					ContinentCode:       "EU",
+					CountryCode:         "GB",
+					CountryName:         "United Kingdom",
+					Subdivision1ISOCode: "ENG",
+					Subdivision1Name:    "England",
+					Subdivision2ISOCode: "WBK",
+					Subdivision2Name:    "West Berkshire",
+					City:                "Boxford",
+					PostalCode:          "OX1",
+					Latitude:            51.75,
+					Longitude:           -1.25,
+					AccuracyRadiusKm:    100,
+					TimeZone:            "Europe/London",
+				},
+			},
+			"127.0.0.1": {
+				Network: &annotator.Network{
+					Missing:  true,
+					Reserved: true,
+				},
+				Geo: &annotator.Geolocation{
+					Missing:  true,
+					Reserved: true,
+				},
+			},
+		},
+	},
+}
+
 func TestServerAndClientE2E(t *testing.T) {
 	d, err := ioutil.TempDir("", "TestServerAndClientE2E")
 	rtx.Must(err, "Could not create tempdir")
@@ -76,119 +275,7 @@ func TestServerAndClientE2E(t *testing.T) {
 	c := NewClient(sock)
 	ctx := context.Background()
 
-	tests := []struct {
-		name    string
-		ips     []string
-		want    map[string]*annotator.ClientAnnotations
-		wantErr bool
-	}{
-		{
-			name:    "Nil ips",
-			ips:     nil,
-			wantErr: true,
-		},
-		{
-			name:    "Bad ips",
-			ips:     []string{"this is not an ip address"},
-			wantErr: true,
-		},
-		{
-			name: "Localhost-v4",
-			ips:  []string{"127.0.0.1"},
-			want: map[string]*annotator.ClientAnnotations{
-				"127.0.0.1": {
-					Network: &annotator.Network{
-						Missing: true,
-					},
-					Geo: &annotator.Geolocation{
-						Missing: true,
-					},
-				},
-			},
-		},
-		{
-			name: "Localhost-v6",
-			ips:  []string{"::1"},
-			want: map[string]*annotator.ClientAnnotations{
-				"::1": {
-					Network: &annotator.Network{
-						Missing: true,
-					},
-					Geo: &annotator.Geolocation{
-						Missing: true,
-					},
-				},
-			},
-		},
-		{
-			name: "IP that has everything",
-			ips:  []string{"2.125.160.216"},
-			want: map[string]*annotator.ClientAnnotations{
-				"2.125.160.216": {
-					Network: &annotator.Network{
-						CIDR:     "2.120.0.0/13",
-						ASNumber: 5607,
-						ASName:   "Sky UK Limited",
-						Systems: []annotator.System{
-							{ASNs: []uint32{5607}},
-						},
-					},
-					Geo: &annotator.Geolocation{
-						ContinentCode:       "EU",
-						CountryCode:         "GB",
-						CountryName:         "United Kingdom",
-						Subdivision1ISOCode: "ENG",
-						Subdivision1Name:    "England",
-						Subdivision2ISOCode: "WBK",
-						Subdivision2Name:    "West Berkshire",
-						City:                "Boxford",
-						PostalCode:          "OX1",
-						Latitude:            51.75,
-						Longitude:           -1.25,
-						AccuracyRadiusKm:    100,
-					},
-				},
-			},
-		},
-		{
-			name: "Multiple IPs",
-			ips:  []string{"2.125.160.216", "127.0.0.1"},
-			want: map[string]*annotator.ClientAnnotations{
-				"2.125.160.216": {
-					Network: &annotator.Network{
-						CIDR:     "2.120.0.0/13",
-						ASNumber: 5607,
-						ASName:   "Sky UK Limited",
-						Systems: []annotator.System{
-							{ASNs: []uint32{5607}},
-						},
-					},
-					Geo: &annotator.Geolocation{
-						ContinentCode:       "EU",
-						CountryCode:         "GB",
-						CountryName:         "United Kingdom",
-						Subdivision1ISOCode: "ENG",
-						Subdivision1Name:    "England",
-						Subdivision2ISOCode: "WBK",
-						Subdivision2Name:    "West Berkshire",
-						City:                "Boxford",
-						PostalCode:          "OX1",
-						Latitude:            51.75,
-						Longitude:           -1.25,
-						AccuracyRadiusKm:    100,
-					},
-				},
-				"127.0.0.1": {
-					Network: &annotator.Network{
-						Missing: true,
-					},
-					Geo: &annotator.Geolocation{
-						Missing: true,
-					},
-				},
-			},
-		},
-	}
+	tests := annotateTests
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			got, err := c.Annotate(ctx, tt.ips)
@@ -267,6 +354,111 @@ func TestNewClientWithNoServer(t *testing.T) {
 	}
 }
 
+func TestNewClientWithReconnect(t *testing.T) {
+	d, err := ioutil.TempDir("", "TestNewClientWithReconnect")
+	rtx.Must(err, "Could not create tempdir")
+	defer os.RemoveAll(d)
+
+	sock := d + "/annotator.sock"
+	attempts := testutil.ToFloat64(metrics.ClientReconnects.WithLabelValues("attempt"))
+	successes := testutil.ToFloat64(metrics.ClientReconnects.WithLabelValues("success"))
+
+	// Start the server after the client has already failed to connect.
+	started := make(chan Server, 1)
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		srv, err := NewServer(sock, asn, geo)
+		rtx.Must(err, "Could not create server")
+		started <- srv
+		srv.Serve()
+	}()
+	defer func() { (<-started).Close() }()
+
+	c := NewClient(sock, WithReconnect(10, 10*time.Millisecond))
+	_, err = c.Annotate(context.Background(), []string{"127.0.0.1"})
+	rtx.Must(err, "Could not annotate localhost after the server started")
+	if got := testutil.ToFloat64(metrics.ClientReconnects.WithLabelValues("attempt")) - attempts; got < 1 {
+		t.Errorf("ClientReconnects attempts = %v, want at least 1", got)
+	}
+	if got := testutil.ToFloat64(metrics.ClientReconnects.WithLabelValues("success")) - successes; got != 1 {
+		t.Errorf("ClientReconnects successes = %v, want 1", got)
+	}
+
+	// Without a server, the retries end with the last error.
+	c = NewClient(d+"/nothing.sock", WithReconnect(3, time.Millisecond))
+	if _, err = c.Annotate(context.Background(), []string{"127.0.0.1"}); err == nil {
+		t.Error("Annotate() without a server should fail after its retries")
+	}
+
+	// The retries stop when the context is canceled.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	c = NewClient(d+"/nothing.sock", WithReconnect(3, time.Hour))
+	if _, err = c.Annotate(ctx, []string{"127.0.0.1"}); err != context.Canceled {
+		t.Errorf("Annotate() with a canceled context = %v, want %v", err, context.Canceled)
+	}
+}
+
+func TestNewClientWithReconnect_onlyConnectionErrors(t *testing.T) {
+	tests := []struct {
+		name      string
+		err       error
+		wantCalls int
+	}{
+		{
+			name:      "dial",
+			err:       &url.Error{Op: "Get", Err: &net.OpError{Op: "dial", Err: errors.New("no such file or directory")}},
+			wantCalls: 3,
+		},
+		{
+			name:      "reset",
+			err:       &url.Error{Op: "Get", Err: &net.OpError{Op: "read", Err: syscall.ECONNRESET}},
+			wantCalls: 3,
+		},
+		{
+			name:      "other",
+			err:       &url.Error{Op: "Get", Err: errors.New("malformed HTTP response")},
+			wantCalls: 1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := NewClient("this does not exist and that is ok", WithReconnect(3, time.Millisecond))
+			g := &failingGetter{err: tt.err}
+			c.(*client).httpc = g
+			if _, err := c.Annotate(context.Background(), []string{"127.0.0.1"}); !errors.Is(err, tt.err) {
+				t.Errorf("Annotate() = %v, want %v", err, tt.err)
+			}
+			if g.calls != tt.wantCalls {
+				t.Errorf("Annotate() made %d requests, want %d", g.calls, tt.wantCalls)
+			}
+		})
+	}
+}
+
+func TestNewClient_cancel(t *testing.T) {
+	d, err := ioutil.TempDir("", "TestNewClient_cancel")
+	rtx.Must(err, "Could not create tempdir")
+	defer os.RemoveAll(d)
+
+	sock := d + "/annotator.sock"
+	srv, err := NewServer(sock, asn, geo)
+	rtx.Must(err, "Could not create server")
+	// The server never answers, until the test ends.
+	release := make(chan struct{})
+	srv.(*server).srv.Handler = http.HandlerFunc(func(http.ResponseWriter, *http.Request) { <-release })
+	go srv.Serve()
+	defer srv.Close()
+	defer close(release)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	c := NewClient(sock, WithReconnect(3, time.Hour))
+	if _, err = c.Annotate(ctx, []string{"127.0.0.1"}); err != context.DeadlineExceeded {
+		t.Errorf("Annotate() past its deadline = %v, want %v", err, context.DeadlineExceeded)
+	}
+}
+
 func TestNewClient404(t *testing.T) {
 	d, err := ioutil.TempDir("", "TestNewClient404")
 	rtx.Must(err, "Could not create tempdir")
@@ -302,7 +494,7 @@ type getterWithSpecificBody struct {
 	body io.ReadCloser
 }
 
-func (g *getterWithSpecificBody) Get(url string) (*http.Response, error) {
+func (g *getterWithSpecificBody) Do(req *http.Request) (*http.Response, error) {
 	resp := &http.Response{
 		StatusCode: 200,
 		Body:       g.body,
@@ -310,6 +502,17 @@ func (g *getterWithSpecificBody) Get(url string) (*http.Response, error) {
 	return resp, nil
 }
 
+// failingGetter counts its requests, and fails every one with err.
+type failingGetter struct {
+	err   error
+	calls int
+}
+
+func (g *failingGetter) Do(req *http.Request) (*http.Response, error) {
+	g.calls++
+	return nil, g.err
+}
+
 func TestNewClientWithUnreadableBody(t *testing.T) {
 	c := NewClient("this does not exist and that is ok")
 	c.(*client).httpc = &getterWithSpecificBody{&unreadableBody{}}
@@ -348,3 +551,650 @@ func TestServerWriteError(t *testing.T) {
 	h.ServeHTTP(&badResp{}, req)
 	// No crash and 100% coverage == success!
 }
+
+func TestServerAndClientTCP(t *testing.T) {
+	defer func(n string) { *Network = n }(*Network)
+	*Network = "tcp"
+
+	// Listen on an ephemeral loopback port and point the client at whatever
+	// port was chosen.
+	srv, err := NewServer("127.0.0.1:0", asn, geo)
+	rtx.Must(err, "Could not create server")
+	go srv.Serve()
+	defer srv.Close()
+	addr := srv.(*server).listener.Addr().String()
+
+	c := NewClient(addr)
+	got, err := c.Annotate(context.Background(), []string{"2.125.160.216"})
+	rtx.Must(err, "Could not annotate over tcp")
+	if got["2.125.160.216"] == nil || got["2.125.160.216"].Network.ASNumber != 5607 {
+		t.Errorf("Annotate() over tcp returned the wrong value: %+v", got)
+	}
+}
+
+func TestNewServerWithBadTransport(t *testing.T) {
+	defer func(n string) { *Network = n }(*Network)
+	tests := []struct {
+		name    string
+		network string
+		addr    string
+		want    error
+	}{
+		{
+			name:    "not-loopback",
+			network: "tcp",
+			addr:    "8.8.8.8:1234",
+			want:    ErrNotLoopback,
+		},
+		{
+			name:    "unsupported",
+			network: "udp",
+			addr:    "127.0.0.1:1234",
+			want:    ErrUnsupportedNetwork,
+		},
+		{
+			name:    "no-port",
+			network: "tcp",
+			addr:    "127.0.0.1",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			*Network = tt.network
+			_, err := NewServer(tt.addr, asn, geo)
+			if err == nil {
+				t.Fatal("NewServer() should have returned an error")
+			}
+			if tt.want != nil && !errors.Is(err, tt.want) {
+				t.Errorf("NewServer() error = %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestServerAndClientPairs(t *testing.T) {
+	d, err := ioutil.TempDir("", "TestServerAndClientPairs")
+	rtx.Must(err, "Could not create tempdir")
+	defer os.RemoveAll(d)
+
+	sock := d + "/annotator.sock"
+	srv, err := NewServer(sock, asn, geo)
+	rtx.Must(err, "Could not create server")
+	go srv.Serve()
+	defer srv.Close()
+
+	c := NewClient(sock).(PairClient)
+	ctx := context.Background()
+	tests := []struct {
+		name           string
+		pairs          [][2]string
+		wantSameASN    bool
+		wantSamePrefix bool
+		wantErr        bool
+	}{
+		{
+			name:           "same-as-pair",
+			pairs:          [][2]string{{"2.125.160.216", "2.120.0.1"}},
+			wantSameASN:    true,
+			wantSamePrefix: true,
+		},
+		{
+			name:  "cross-as-pair",
+			pairs: [][2]string{{"2.125.160.216", "1.0.0.1"}},
+		},
+		{
+			name:  "missing-endpoint",
+			pairs: [][2]string{{"127.0.0.1", "127.0.0.1"}},
+		},
+		{
+			name:    "bad-pair",
+			pairs:   [][2]string{{"2.125.160.216", "this is not an ip"}},
+			wantErr: true,
+		},
+		{
+			name:    "no-pairs",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := c.AnnotatePairs(ctx, tt.pairs)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("AnnotatePairs() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if len(got) != 1 {
+				t.Fatalf("AnnotatePairs() returned %d results, want 1", len(got))
+			}
+			p := got[0]
+			if p.SrcIP != tt.pairs[0][0] || p.DstIP != tt.pairs[0][1] || p.Src == nil || p.Dst == nil {
+				t.Errorf("AnnotatePairs() returned the wrong endpoints: %+v", p)
+			}
+			if p.SameASN != tt.wantSameASN || p.SamePrefix != tt.wantSamePrefix {
+				t.Errorf("AnnotatePairs() = SameASN %v SamePrefix %v, want %v %v", p.SameASN, p.SamePrefix, tt.wantSameASN, tt.wantSamePrefix)
+			}
+		})
+	}
+}
+
+func TestServerPairs_noASN(t *testing.T) {
+	h := handler{}
+	p := h.annotatePair("2.125.160.216", "2.120.0.1")
+	if p.Src != nil || p.Dst != nil || p.SameASN || p.SamePrefix {
+		t.Errorf("annotatePair() without an ASN annotator = %+v, want only IPs", p)
+	}
+}
+
+func TestServerPairsWriteError(t *testing.T) {
+	h := handler{
+		asn: asn,
+		geo: geo,
+	}
+	req, err := http.NewRequest("GET", "http://unix/pairs?pair=127.0.0.1,127.0.0.1", &bytes.Buffer{})
+	rtx.Must(err, "Could not create error")
+	h.servePairs(&badResp{}, req)
+	// No crash == success!
+}
+
+// slowASN is an ASNAnnotator whose AnnotateIP blocks until released.
+type slowASN struct {
+	asnannotator.ASNAnnotator
+	started chan struct{}
+	release chan struct{}
+}
+
+func (s *slowASN) AnnotateIP(src string) *annotator.Network {
+	s.started <- struct{}{}
+	<-s.release
+	return &annotator.Network{ASNumber: 1}
+}
+
+// panickyASN is an ASNAnnotator that panics when annotating one IP.
+type panickyASN struct {
+	asnannotator.ASNAnnotator
+	bad string
+}
+
+func (p *panickyASN) AnnotateIP(src string) *annotator.Network {
+	if src == p.bad {
+		panic("a panic for testing")
+	}
+	return &annotator.Network{ASNumber: 1}
+}
+
+func TestServerRecoversFromPanics(t *testing.T) {
+	h := &handler{asn: &panickyASN{ASNAnnotator: asnannotator.NewFake(), bad: "2.2.2.2"}}
+	before := testutil.ToFloat64(metrics.ServerRPCCount.WithLabelValues("panic_error"))
+
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "http://unix/?ip=1.1.1.1&ip=2.2.2.2&ip=3.3.3.3", nil)
+	h.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("ServeHTTP() status = %d, want %d", rec.Code, http.StatusOK)
+	}
+	resp := map[string]*annotator.ClientAnnotations{}
+	rtx.Must(json.Unmarshal(rec.Body.Bytes(), &resp), "Could not unmarshal response")
+	if _, ok := resp["2.2.2.2"]; ok || len(resp) != 2 || resp["1.1.1.1"] == nil || resp["3.3.3.3"] == nil {
+		t.Errorf("ServeHTTP() = %s, want only the IPs that did not panic", rec.Body.Bytes())
+	}
+	if got := testutil.ToFloat64(metrics.ServerRPCCount.WithLabelValues("panic_error")) - before; got != 1 {
+		t.Errorf("ServerRPCCount{panic_error} increased by %v, want 1", got)
+	}
+}
+
+func TestServerAndClientPost(t *testing.T) {
+	d, err := ioutil.TempDir("", "TestServerAndClientPost")
+	rtx.Must(err, "Could not create tempdir")
+	defer os.RemoveAll(d)
+
+	sock := d + "/annotator.sock"
+	srv, err := NewServer(sock, asn, geo)
+	rtx.Must(err, "Could not create server")
+	go srv.Serve()
+	defer srv.Close()
+
+	// A list too long for a query string is POSTed, with the same results.
+	ips := []string{}
+	for i := 0; i < 10*maxQueryIPs; i++ {
+		ips = append(ips, fmt.Sprintf("1.0.%d.%d", i/256, i%256))
+	}
+	ips = append(ips, "this-is-not-an-IP")
+	ctx := context.Background()
+	c := NewClient(sock)
+	ann, err := c.Annotate(ctx, ips)
+	rtx.Must(err, "Could not annotate a huge list of IPs")
+	if len(ann) != len(ips)-1 {
+		t.Errorf("Annotate() returned %d annotations, want %d", len(ann), len(ips)-1)
+	}
+	few, err := c.Annotate(ctx, ips[:2])
+	rtx.Must(err, "Could not annotate a short list of IPs")
+	for _, ip := range ips[:2] {
+		if diff := deep.Equal(few[ip], ann[ip]); diff != nil {
+			t.Errorf("Annotate(%q) differs between GET and POST: %v", ip, diff)
+		}
+	}
+}
+
+func TestServerPostErrors(t *testing.T) {
+	h := &handler{asn: asn, geo: geo}
+	tests := []struct {
+		name   string
+		body   string
+		status int
+	}{
+		{name: "empty-body", body: "", status: http.StatusBadRequest},
+		{name: "malformed-json", body: `["1.0.0.1",`, status: http.StatusBadRequest},
+		{name: "not-an-array", body: `{"ip": "1.0.0.1"}`, status: http.StatusBadRequest},
+		{name: "empty-array", body: `[]`, status: http.StatusBadRequest},
+		{name: "no-valid-ips", body: `["not-an-ip"]`, status: http.StatusBadRequest},
+		{name: "success", body: `["1.0.0.1"]`, status: http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			req := httptest.NewRequest("POST", "http://unix/v1/annotate/ips", strings.NewReader(tt.body))
+			h.ServeHTTP(rec, req)
+			if rec.Code != tt.status {
+				t.Errorf("ServeHTTP() status = %d, want %d", rec.Code, tt.status)
+			}
+		})
+	}
+}
+
+func TestServerAndClientGroups(t *testing.T) {
+	d, err := ioutil.TempDir("", "TestServerAndClientGroups")
+	rtx.Must(err, "Could not create tempdir")
+	defer os.RemoveAll(d)
+
+	sock := d + "/annotator.sock"
+	srv, err := NewServer(sock, asn, geo)
+	rtx.Must(err, "Could not create server")
+	go srv.Serve()
+	defer srv.Close()
+
+	ctx := context.Background()
+	c := NewClient(sock).(GroupClient)
+	groups := map[string][]string{
+		"dual-stack": {"2.125.160.216", "[2001:200::1]:443"},
+		"invalid":    {"this-is-not-an-IP"},
+		"partial":    {"1.0.0.1", "this-is-not-an-IP"},
+	}
+	got, err := c.AnnotateGroups(ctx, groups)
+	rtx.Must(err, "Could not annotate groups")
+
+	// Every group has the same annotations as its IPs on their own.
+	want := map[string]map[string]*annotator.ClientAnnotations{}
+	for _, id := range []string{"dual-stack", "partial"} {
+		ann, err := c.Annotate(ctx, groups[id])
+		rtx.Must(err, "Could not annotate %v", groups[id])
+		want[id] = ann
+	}
+	if diff := deep.Equal(got, want); diff != nil {
+		t.Errorf("AnnotateGroups() differs from Annotate(): %v", diff)
+	}
+	if n := got["dual-stack"]["[2001:200::1]:443"]; n == nil || n.Network == nil || n.Network.ASNumber != 2500 {
+		t.Errorf("AnnotateGroups() IPv6 of the dual-stack group = %+v, want AS2500", n)
+	}
+	if n := got["dual-stack"]["2.125.160.216"]; n == nil || n.Network == nil || n.Network.ASNumber != 5607 {
+		t.Errorf("AnnotateGroups() IPv4 of the dual-stack group = %+v, want AS5607", n)
+	}
+
+	if _, err := c.AnnotateGroups(ctx, map[string][]string{"invalid": {"not-an-ip"}}); err == nil {
+		t.Error("AnnotateGroups() without valid IPs should fail")
+	}
+}
+
+func TestServerGroupsErrors(t *testing.T) {
+	h := &handler{asn: asn, geo: geo}
+	tests := []struct {
+		name   string
+		method string
+		body   string
+		status int
+	}{
+		{name: "get", method: "GET", status: http.StatusMethodNotAllowed},
+		{name: "empty-body", method: "POST", body: "", status: http.StatusBadRequest},
+		{name: "not-an-object", method: "POST", body: `["1.0.0.1"]`, status: http.StatusBadRequest},
+		{name: "empty-object", method: "POST", body: `{}`, status: http.StatusBadRequest},
+		{name: "no-valid-ips", method: "POST", body: `{"a": ["not-an-ip"]}`, status: http.StatusBadRequest},
+		{name: "success", method: "POST", body: `{"a": ["1.0.0.1", "::1"]}`, status: http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			req := httptest.NewRequest(tt.method, "http://unix/v1/annotate/groups", strings.NewReader(tt.body))
+			h.serveGroups(rec, req)
+			if rec.Code != tt.status {
+				t.Errorf("serveGroups() status = %d, want %d", rec.Code, tt.status)
+			}
+		})
+	}
+}
+
+// noDataGeo is a GeoAnnotator that has not loaded any data.
+type noDataGeo struct {
+	geoannotator.GeoAnnotator
+}
+
+func (noDataGeo) AnnotateIP(ip net.IP, geo **annotator.Geolocation) error {
+	*geo = &annotator.Geolocation{Missing: true}
+	return geoannotator.ErrNoData
+}
+
+func TestServerWithoutGeoData(t *testing.T) {
+	h := &handler{asn: asnannotator.NewFake(), geo: noDataGeo{}}
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "http://unix/?ip=1.1.1.1", nil))
+
+	resp := map[string]*annotator.ClientAnnotations{}
+	rtx.Must(json.Unmarshal(rec.Body.Bytes(), &resp), "Could not unmarshal response")
+	if a := resp["1.1.1.1"]; a == nil || a.Geo == nil || !a.Geo.Missing {
+		t.Errorf("ServeHTTP() = %s, want a Missing Geo annotation", rec.Body.Bytes())
+	}
+}
+
+// errGeo is a GeoAnnotator that fails every annotation with err.
+type errGeo struct {
+	geoannotator.GeoAnnotator
+	err error
+}
+
+func (g errGeo) AnnotateIP(ip net.IP, geo **annotator.Geolocation) error {
+	*geo = &annotator.Geolocation{Missing: true}
+	return g.err
+}
+
+func TestServerGeoErrors(t *testing.T) {
+	tests := []struct {
+		name       string
+		err        error
+		wantIP     bool
+		wantBadIPs float64
+	}{
+		{
+			name:       "invalid-ip",
+			err:        fmt.Errorf("%w: %w", annotator.ErrNoAnnotation, annotator.ErrInvalidIP),
+			wantBadIPs: 2,
+		},
+		{
+			name:   "lookup-failed",
+			err:    fmt.Errorf("%w: %w", annotator.ErrNoAnnotation, annotator.ErrLookupFailed),
+			wantIP: true,
+		},
+		{
+			name:   "no-annotation",
+			err:    annotator.ErrNoAnnotation,
+			wantIP: true,
+		},
+		{
+			name:   "unknown-direction",
+			err:    fmt.Errorf("wrapped: %w", annotator.ErrUnknownDirection),
+			wantIP: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := &handler{asn: asnannotator.NewFake(), geo: errGeo{err: tt.err}}
+			before := testutil.ToFloat64(metrics.ServerRPCCount.WithLabelValues("badip_error"))
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, httptest.NewRequest("GET", "http://unix/?ip=1.1.1.1&ip=2.2.2.2", nil))
+
+			resp := map[string]*annotator.ClientAnnotations{}
+			if tt.wantIP {
+				rtx.Must(json.Unmarshal(rec.Body.Bytes(), &resp), "Could not unmarshal response")
+			}
+			if _, ok := resp["1.1.1.1"]; ok != tt.wantIP {
+				t.Errorf("ServeHTTP() = %s, want the IP: %v", rec.Body.Bytes(), tt.wantIP)
+			}
+			if got := testutil.ToFloat64(metrics.ServerRPCCount.WithLabelValues("badip_error")) - before; got != tt.wantBadIPs {
+				t.Errorf("ServerRPCCount{badip_error} increased by %v, want %v", got, tt.wantBadIPs)
+			}
+		})
+	}
+}
+
+func TestServerShutdownWaitsForInflightRequests(t *testing.T) {
+	d, err := ioutil.TempDir("", "TestServerShutdown")
+	rtx.Must(err, "Could not create tempdir")
+	defer os.RemoveAll(d)
+
+	sock := d + "/annotator.sock"
+	slow := &slowASN{
+		ASNAnnotator: asnannotator.NewFake(),
+		started:      make(chan struct{}),
+		release:      make(chan struct{}),
+	}
+	srv, err := NewServer(sock, slow, nil)
+	rtx.Must(err, "Could not create server")
+	go srv.Serve()
+
+	// Start a request, and wait until the server is processing it.
+	type result struct {
+		ann map[string]*annotator.ClientAnnotations
+		err error
+	}
+	done := make(chan result)
+	go func() {
+		ann, err := NewClient(sock).Annotate(context.Background(), []string{"1.2.3.4"})
+		done <- result{ann, err}
+	}()
+	<-slow.started
+
+	// Shut down while the request is in flight, then let the request finish.
+	shutdown := make(chan error)
+	go func() {
+		shutdown <- srv.Shutdown(context.Background())
+	}()
+	time.Sleep(10 * time.Millisecond)
+	close(slow.release)
+
+	r := <-done
+	rtx.Must(r.err, "In-flight request should have completed during graceful shutdown")
+	if r.ann["1.2.3.4"].Network.ASNumber != 1 {
+		t.Errorf("Annotate() = %+v, want ASNumber 1", r.ann["1.2.3.4"])
+	}
+	rtx.Must(<-shutdown, "Could not shut down cleanly")
+}
+
+func TestServerShutdownTimeout(t *testing.T) {
+	d, err := ioutil.TempDir("", "TestServerShutdownTimeout")
+	rtx.Must(err, "Could not create tempdir")
+	defer os.RemoveAll(d)
+
+	sock := d + "/annotator.sock"
+	slow := &slowASN{
+		ASNAnnotator: asnannotator.NewFake(),
+		started:      make(chan struct{}),
+		release:      make(chan struct{}),
+	}
+	srv, err := NewServer(sock, slow, nil)
+	rtx.Must(err, "Could not create server")
+	go srv.Serve()
+	defer close(slow.release)
+
+	go NewClient(sock).Annotate(context.Background(), []string{"1.2.3.4"})
+	<-slow.started
+
+	// A request that outlives the grace period causes Shutdown to give up.
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Errorf("Shutdown() error = %v, want %v", err, context.DeadlineExceeded)
+	}
+	srv.Close()
+}
+
+func TestServerRequestBudget(t *testing.T) {
+	d, err := ioutil.TempDir("", "TestServerRequestBudget")
+	rtx.Must(err, "Could not create tempdir")
+	defer os.RemoveAll(d)
+
+	*RequestBudget = time.Nanosecond
+	defer func() { *RequestBudget = 0 }()
+	sock := d + "/annotator.sock"
+	srv, err := NewServer(sock, asn, geo)
+	rtx.Must(err, "Could not create server")
+	go srv.Serve()
+	defer srv.Close()
+
+	ips := []string{}
+	pairs := [][2]string{}
+	for i := 0; i < 1000; i++ {
+		ip := fmt.Sprintf("1.0.%d.%d", i/256, i%256)
+		ips = append(ips, ip)
+		pairs = append(pairs, [2]string{ip, "1.0.0.1"})
+	}
+	c := NewClient(sock).(PairClient)
+	ctx := context.Background()
+
+	ann, err := c.Annotate(ctx, ips)
+	if err != ErrTruncated {
+		t.Errorf("Annotate() error = %v, want %v", err, ErrTruncated)
+	}
+	if len(ann) == 0 || len(ann) == len(ips) {
+		t.Errorf("Annotate() returned %d annotations, want a partial result of %d IPs", len(ann), len(ips))
+	}
+	if a, ok := ann[ips[0]]; !ok || a.Network == nil || a.Network.ASNumber != 13335 {
+		t.Errorf("Annotate() should always annotate the first IP; got %+v", a)
+	}
+
+	p, err := c.AnnotatePairs(ctx, pairs)
+	if err != ErrTruncated {
+		t.Errorf("AnnotatePairs() error = %v, want %v", err, ErrTruncated)
+	}
+	if len(p) == 0 || len(p) == len(pairs) {
+		t.Errorf("AnnotatePairs() returned %d pairs, want a partial result of %d pairs", len(p), len(pairs))
+	}
+}
+
+func TestServerAndClientServerE2E(t *testing.T) {
+	d, err := ioutil.TempDir("", "TestServerAndClientServerE2E")
+	rtx.Must(err, "Could not create tempdir")
+	defer os.RemoveAll(d)
+
+	u, err := url.Parse("file:../testdata/annotations.json")
+	rtx.Must(err, "Could not parse URL")
+	js, err := content.FromURL(context.Background(), u)
+	rtx.Must(err, "Could not create content.Provider")
+	site, siteIPs := siteannotator.New(context.Background(), "mlab1-lga03.mlab-sandbox.measurement-lab.org",
+		js, []net.IP{net.ParseIP("64.86.148.137")})
+	// A physical site keeps the machine's local IPs.
+	if len(siteIPs) != 1 || !siteIPs[0].Equal(net.ParseIP("64.86.148.137")) {
+		t.Fatalf("siteannotator.New() local IPs = %v, want 64.86.148.137", siteIPs)
+	}
+
+	sock := d + "/annotator.sock"
+	srv, err := NewServer(sock, asn, geo, WithSiteAnnotator(site))
+	rtx.Must(err, "Could not create server")
+	wg := sync.WaitGroup{}
+	wg.Add(1)
+	go func() {
+		rtx.Must(srv.Serve(), "Could not serve the annotator")
+		wg.Done()
+	}()
+
+	c := NewClient(sock).(ServerClient)
+	ctx := context.Background()
+	tests := []struct {
+		name    string
+		ip      string
+		want    *annotator.ServerAnnotations
+		wantErr bool
+	}{
+		{
+			name: "local-ip",
+			ip:   "64.86.148.137",
+			want: &annotator.ServerAnnotations{
+				Site:    "lga03",
+				Machine: "mlab1",
+				Geo: &annotator.Geolocation{
+					ContinentCode: "NA",
+					CountryCode:   "US",
+					City:          "New York",
+					Latitude:      40.7667,
+					Longitude:     -73.8667,
+				},
+				Network: &annotator.Network{
+					CIDR:     "64.86.148.128/26",
+					ASNumber: 6453,
+					ASName:   "TATA COMMUNICATIONS (AMERICA) INC",
+					Systems: []annotator.System{
+						{ASNs: []uint32{6453}},
+					},
+				},
+			},
+		},
+		{
+			name: "local-ip-with-port",
+			ip:   "64.86.148.137:443",
+			want: &annotator.ServerAnnotations{
+				Site:    "lga03",
+				Machine: "mlab1",
+				Geo: &annotator.Geolocation{
+					ContinentCode: "NA",
+					CountryCode:   "US",
+					City:          "New York",
+					Latitude:      40.7667,
+					Longitude:     -73.8667,
+				},
+				Network: &annotator.Network{
+					CIDR:     "64.86.148.128/26",
+					ASNumber: 6453,
+					ASName:   "TATA COMMUNICATIONS (AMERICA) INC",
+					Systems: []annotator.System{
+						{ASNs: []uint32{6453}},
+					},
+				},
+			},
+		},
+		{
+			name:    "nonlocal-ip",
+			ip:      "2.125.160.216",
+			wantErr: true,
+		},
+		{
+			name:    "bad-ip",
+			ip:      "this is not an ip address",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := c.AnnotateServer(ctx, tt.ip)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("AnnotateServer() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if diff := deep.Equal(got, tt.want); diff != nil {
+				t.Errorf("AnnotateServer() returned the wrong annotations: %v", diff)
+			}
+		})
+	}
+
+	srv.Close()
+	wg.Wait()
+}
+
+func TestServerAndClientServer_noSite(t *testing.T) {
+	d, err := ioutil.TempDir("", "TestServerAndClientServer_noSite")
+	rtx.Must(err, "Could not create tempdir")
+	defer os.RemoveAll(d)
+
+	sock := d + "/annotator.sock"
+	srv, err := NewServer(sock, asn, geo)
+	rtx.Must(err, "Could not create server")
+	go srv.Serve()
+	defer srv.Close()
+
+	c := NewClient(sock).(ServerClient)
+	before := testutil.ToFloat64(metrics.ServerRPCCount.WithLabelValues("not_implemented_error"))
+	_, err = c.AnnotateServer(context.Background(), "64.86.148.137")
+	if err != ErrNotImplemented {
+		t.Errorf("AnnotateServer() error = %v, want %v", err, ErrNotImplemented)
+	}
+	if got := testutil.ToFloat64(metrics.ServerRPCCount.WithLabelValues("not_implemented_error")) - before; got != 1 {
+		t.Errorf("not_implemented_error count increased by %v, want 1", got)
+	}
+}
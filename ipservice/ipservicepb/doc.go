@@ -0,0 +1,5 @@
+// Package ipservicepb contains the protobuf messages and gRPC service of the
+// ipservice. Use ipservice.NewGRPCClient instead of using it directly.
+package ipservicepb
+
+//go:generate protoc --proto_path=../.. --go_out=../.. --go_opt=paths=source_relative --go-grpc_out=../.. --go-grpc_opt=paths=source_relative ipservice/ipservicepb/ipservice.proto
@@ -0,0 +1,928 @@
+// Code generated by protoc-gen-go. DO NOT EDIT.
+// versions:
+// 	protoc-gen-go v1.28.0
+// 	protoc        (unknown)
+// source: ipservice/ipservicepb/ipservice.proto
+
+package ipservicepb
+
+import (
+	protoreflect "google.golang.org/protobuf/reflect/protoreflect"
+	protoimpl "google.golang.org/protobuf/runtime/protoimpl"
+	reflect "reflect"
+	sync "sync"
+)
+
+const (
+	// Verify that this generated code is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(20 - protoimpl.MinVersion)
+	// Verify that runtime/protoimpl is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(protoimpl.MaxVersion - 20)
+)
+
+// AnnotateIPsRequest lists the IPs to annotate, which may include a port.
+type AnnotateIPsRequest struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	Ips []string `protobuf:"bytes,1,rep,name=ips,proto3" json:"ips,omitempty"`
+}
+
+func (x *AnnotateIPsRequest) Reset() {
+	*x = AnnotateIPsRequest{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_ipservice_ipservicepb_ipservice_proto_msgTypes[0]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *AnnotateIPsRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*AnnotateIPsRequest) ProtoMessage() {}
+
+func (x *AnnotateIPsRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_ipservice_ipservicepb_ipservice_proto_msgTypes[0]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use AnnotateIPsRequest.ProtoReflect.Descriptor instead.
+func (*AnnotateIPsRequest) Descriptor() ([]byte, []int) {
+	return file_ipservice_ipservicepb_ipservice_proto_rawDescGZIP(), []int{0}
+}
+
+func (x *AnnotateIPsRequest) GetIps() []string {
+	if x != nil {
+		return x.Ips
+	}
+	return nil
+}
+
+// AnnotateIPsResponse holds the annotations of the valid IPs, keyed by the IPs
+// as passed in.
+type AnnotateIPsResponse struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	Annotations map[string]*ClientAnnotations `protobuf:"bytes,1,rep,name=annotations,proto3" json:"annotations,omitempty" protobuf_key:"bytes,1,opt,name=key,proto3" protobuf_val:"bytes,2,opt,name=value,proto3"`
+	// True when the server ran out of time, and only some IPs were annotated.
+	Truncated bool `protobuf:"varint,2,opt,name=truncated,proto3" json:"truncated,omitempty"`
+}
+
+func (x *AnnotateIPsResponse) Reset() {
+	*x = AnnotateIPsResponse{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_ipservice_ipservicepb_ipservice_proto_msgTypes[1]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *AnnotateIPsResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*AnnotateIPsResponse) ProtoMessage() {}
+
+func (x *AnnotateIPsResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_ipservice_ipservicepb_ipservice_proto_msgTypes[1]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use AnnotateIPsResponse.ProtoReflect.Descriptor instead.
+func (*AnnotateIPsResponse) Descriptor() ([]byte, []int) {
+	return file_ipservice_ipservicepb_ipservice_proto_rawDescGZIP(), []int{1}
+}
+
+func (x *AnnotateIPsResponse) GetAnnotations() map[string]*ClientAnnotations {
+	if x != nil {
+		return x.Annotations
+	}
+	return nil
+}
+
+func (x *AnnotateIPsResponse) GetTruncated() bool {
+	if x != nil {
+		return x.Truncated
+	}
+	return false
+}
+
+// ClientAnnotations mirrors annotator.ClientAnnotations.
+type ClientAnnotations struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	Geo     *Geolocation `protobuf:"bytes,1,opt,name=geo,proto3" json:"geo,omitempty"`
+	Network *Network     `protobuf:"bytes,2,opt,name=network,proto3" json:"network,omitempty"`
+	IpHash  string       `protobuf:"bytes,3,opt,name=ip_hash,json=ipHash,proto3" json:"ip_hash,omitempty"`
+}
+
+func (x *ClientAnnotations) Reset() {
+	*x = ClientAnnotations{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_ipservice_ipservicepb_ipservice_proto_msgTypes[2]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *ClientAnnotations) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ClientAnnotations) ProtoMessage() {}
+
+func (x *ClientAnnotations) ProtoReflect() protoreflect.Message {
+	mi := &file_ipservice_ipservicepb_ipservice_proto_msgTypes[2]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ClientAnnotations.ProtoReflect.Descriptor instead.
+func (*ClientAnnotations) Descriptor() ([]byte, []int) {
+	return file_ipservice_ipservicepb_ipservice_proto_rawDescGZIP(), []int{2}
+}
+
+func (x *ClientAnnotations) GetGeo() *Geolocation {
+	if x != nil {
+		return x.Geo
+	}
+	return nil
+}
+
+func (x *ClientAnnotations) GetNetwork() *Network {
+	if x != nil {
+		return x.Network
+	}
+	return nil
+}
+
+func (x *ClientAnnotations) GetIpHash() string {
+	if x != nil {
+		return x.IpHash
+	}
+	return ""
+}
+
+// Geolocation mirrors annotator.Geolocation.
+type Geolocation struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	ContinentCode             string  `protobuf:"bytes,1,opt,name=continent_code,json=continentCode,proto3" json:"continent_code,omitempty"`
+	CountryCode               string  `protobuf:"bytes,2,opt,name=country_code,json=countryCode,proto3" json:"country_code,omitempty"`
+	CountryCode3              string  `protobuf:"bytes,3,opt,name=country_code3,json=countryCode3,proto3" json:"country_code3,omitempty"`
+	CountryName               string  `protobuf:"bytes,4,opt,name=country_name,json=countryName,proto3" json:"country_name,omitempty"`
+	Region                    string  `protobuf:"bytes,5,opt,name=region,proto3" json:"region,omitempty"`
+	Subdivision1IsoCode       string  `protobuf:"bytes,6,opt,name=subdivision1_iso_code,json=subdivision1IsoCode,proto3" json:"subdivision1_iso_code,omitempty"`
+	Subdivision1Name          string  `protobuf:"bytes,7,opt,name=subdivision1_name,json=subdivision1Name,proto3" json:"subdivision1_name,omitempty"`
+	Subdivision2IsoCode       string  `protobuf:"bytes,8,opt,name=subdivision2_iso_code,json=subdivision2IsoCode,proto3" json:"subdivision2_iso_code,omitempty"`
+	Subdivision2Name          string  `protobuf:"bytes,9,opt,name=subdivision2_name,json=subdivision2Name,proto3" json:"subdivision2_name,omitempty"`
+	MetroCode                 int64   `protobuf:"varint,10,opt,name=metro_code,json=metroCode,proto3" json:"metro_code,omitempty"`
+	City                      string  `protobuf:"bytes,11,opt,name=city,proto3" json:"city,omitempty"`
+	AreaCode                  int64   `protobuf:"varint,12,opt,name=area_code,json=areaCode,proto3" json:"area_code,omitempty"`
+	PostalCode                string  `protobuf:"bytes,13,opt,name=postal_code,json=postalCode,proto3" json:"postal_code,omitempty"`
+	Latitude                  float64 `protobuf:"fixed64,14,opt,name=latitude,proto3" json:"latitude,omitempty"`
+	Longitude                 float64 `protobuf:"fixed64,15,opt,name=longitude,proto3" json:"longitude,omitempty"`
+	AccuracyRadiusKm          int64   `protobuf:"varint,16,opt,name=accuracy_radius_km,json=accuracyRadiusKm,proto3" json:"accuracy_radius_km,omitempty"`
+	CoordinatesAreApproximate bool    `protobuf:"varint,17,opt,name=coordinates_are_approximate,json=coordinatesAreApproximate,proto3" json:"coordinates_are_approximate,omitempty"`
+	ApproxUtcOffset           string  `protobuf:"bytes,18,opt,name=approx_utc_offset,json=approxUtcOffset,proto3" json:"approx_utc_offset,omitempty"`
+	Missing                   bool    `protobuf:"varint,19,opt,name=missing,proto3" json:"missing,omitempty"`
+	Reserved                  bool    `protobuf:"varint,20,opt,name=reserved,proto3" json:"reserved,omitempty"`
+	TimeZone                  string  `protobuf:"bytes,21,opt,name=time_zone,json=timeZone,proto3" json:"time_zone,omitempty"`
+}
+
+func (x *Geolocation) Reset() {
+	*x = Geolocation{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_ipservice_ipservicepb_ipservice_proto_msgTypes[3]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *Geolocation) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*Geolocation) ProtoMessage() {}
+
+func (x *Geolocation) ProtoReflect() protoreflect.Message {
+	mi := &file_ipservice_ipservicepb_ipservice_proto_msgTypes[3]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use Geolocation.ProtoReflect.Descriptor instead.
+func (*Geolocation) Descriptor() ([]byte, []int) {
+	return file_ipservice_ipservicepb_ipservice_proto_rawDescGZIP(), []int{3}
+}
+
+func (x *Geolocation) GetContinentCode() string {
+	if x != nil {
+		return x.ContinentCode
+	}
+	return ""
+}
+
+func (x *Geolocation) GetCountryCode() string {
+	if x != nil {
+		return x.CountryCode
+	}
+	return ""
+}
+
+func (x *Geolocation) GetCountryCode3() string {
+	if x != nil {
+		return x.CountryCode3
+	}
+	return ""
+}
+
+func (x *Geolocation) GetCountryName() string {
+	if x != nil {
+		return x.CountryName
+	}
+	return ""
+}
+
+func (x *Geolocation) GetRegion() string {
+	if x != nil {
+		return x.Region
+	}
+	return ""
+}
+
+func (x *Geolocation) GetSubdivision1IsoCode() string {
+	if x != nil {
+		return x.Subdivision1IsoCode
+	}
+	return ""
+}
+
+func (x *Geolocation) GetSubdivision1Name() string {
+	if x != nil {
+		return x.Subdivision1Name
+	}
+	return ""
+}
+
+func (x *Geolocation) GetSubdivision2IsoCode() string {
+	if x != nil {
+		return x.Subdivision2IsoCode
+	}
+	return ""
+}
+
+func (x *Geolocation) GetSubdivision2Name() string {
+	if x != nil {
+		return x.Subdivision2Name
+	}
+	return ""
+}
+
+func (x *Geolocation) GetMetroCode() int64 {
+	if x != nil {
+		return x.MetroCode
+	}
+	return 0
+}
+
+func (x *Geolocation) GetCity() string {
+	if x != nil {
+		return x.City
+	}
+	return ""
+}
+
+func (x *Geolocation) GetAreaCode() int64 {
+	if x != nil {
+		return x.AreaCode
+	}
+	return 0
+}
+
+func (x *Geolocation) GetPostalCode() string {
+	if x != nil {
+		return x.PostalCode
+	}
+	return ""
+}
+
+func (x *Geolocation) GetLatitude() float64 {
+	if x != nil {
+		return x.Latitude
+	}
+	return 0
+}
+
+func (x *Geolocation) GetLongitude() float64 {
+	if x != nil {
+		return x.Longitude
+	}
+	return 0
+}
+
+func (x *Geolocation) GetAccuracyRadiusKm() int64 {
+	if x != nil {
+		return x.AccuracyRadiusKm
+	}
+	return 0
+}
+
+func (x *Geolocation) GetCoordinatesAreApproximate() bool {
+	if x != nil {
+		return x.CoordinatesAreApproximate
+	}
+	return false
+}
+
+func (x *Geolocation) GetApproxUtcOffset() string {
+	if x != nil {
+		return x.ApproxUtcOffset
+	}
+	return ""
+}
+
+func (x *Geolocation) GetMissing() bool {
+	if x != nil {
+		return x.Missing
+	}
+	return false
+}
+
+func (x *Geolocation) GetReserved() bool {
+	if x != nil {
+		return x.Reserved
+	}
+	return false
+}
+
+func (x *Geolocation) GetTimeZone() string {
+	if x != nil {
+		return x.TimeZone
+	}
+	return ""
+}
+
+// System mirrors annotator.System.
+type System struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	Asns []uint32 `protobuf:"varint,1,rep,packed,name=asns,proto3" json:"asns,omitempty"`
+}
+
+func (x *System) Reset() {
+	*x = System{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_ipservice_ipservicepb_ipservice_proto_msgTypes[4]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *System) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*System) ProtoMessage() {}
+
+func (x *System) ProtoReflect() protoreflect.Message {
+	mi := &file_ipservice_ipservicepb_ipservice_proto_msgTypes[4]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use System.ProtoReflect.Descriptor instead.
+func (*System) Descriptor() ([]byte, []int) {
+	return file_ipservice_ipservicepb_ipservice_proto_rawDescGZIP(), []int{4}
+}
+
+func (x *System) GetAsns() []uint32 {
+	if x != nil {
+		return x.Asns
+	}
+	return nil
+}
+
+// Network mirrors annotator.Network.
+type Network struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	Cidr              string    `protobuf:"bytes,1,opt,name=cidr,proto3" json:"cidr,omitempty"`
+	AsNumber          uint32    `protobuf:"varint,2,opt,name=as_number,json=asNumber,proto3" json:"as_number,omitempty"`
+	AsName            string    `protobuf:"bytes,3,opt,name=as_name,json=asName,proto3" json:"as_name,omitempty"`
+	Missing           bool      `protobuf:"varint,4,opt,name=missing,proto3" json:"missing,omitempty"`
+	AnnouncedCidr     string    `protobuf:"bytes,5,opt,name=announced_cidr,json=announcedCidr,proto3" json:"announced_cidr,omitempty"`
+	AsNameSource      string    `protobuf:"bytes,6,opt,name=as_name_source,json=asNameSource,proto3" json:"as_name_source,omitempty"`
+	AsNameAll         []string  `protobuf:"bytes,7,rep,name=as_name_all,json=asNameAll,proto3" json:"as_name_all,omitempty"`
+	Country           string    `protobuf:"bytes,8,opt,name=country,proto3" json:"country,omitempty"`
+	TransitionAddress string    `protobuf:"bytes,9,opt,name=transition_address,json=transitionAddress,proto3" json:"transition_address,omitempty"`
+	AllocatedCountry  string    `protobuf:"bytes,10,opt,name=allocated_country,json=allocatedCountry,proto3" json:"allocated_country,omitempty"`
+	ConeSize          int64     `protobuf:"varint,11,opt,name=cone_size,json=coneSize,proto3" json:"cone_size,omitempty"`
+	Visibility        int64     `protobuf:"varint,12,opt,name=visibility,proto3" json:"visibility,omitempty"`
+	Systems           []*System `protobuf:"bytes,13,rep,name=systems,proto3" json:"systems,omitempty"`
+	Organization      string    `protobuf:"bytes,14,opt,name=organization,proto3" json:"organization,omitempty"`
+	OrgId             string    `protobuf:"bytes,15,opt,name=org_id,json=orgId,proto3" json:"org_id,omitempty"`
+	AsDomain          string    `protobuf:"bytes,16,opt,name=as_domain,json=asDomain,proto3" json:"as_domain,omitempty"`
+	AsType            string    `protobuf:"bytes,17,opt,name=as_type,json=asType,proto3" json:"as_type,omitempty"`
+	Reserved          bool      `protobuf:"varint,18,opt,name=reserved,proto3" json:"reserved,omitempty"`
+	RouteViewDate     string    `protobuf:"bytes,19,opt,name=route_view_date,json=routeViewDate,proto3" json:"route_view_date,omitempty"`
+	V4Cidr            string    `protobuf:"bytes,20,opt,name=v4_cidr,json=v4Cidr,proto3" json:"v4_cidr,omitempty"`
+	V6Cidr            string    `protobuf:"bytes,21,opt,name=v6_cidr,json=v6Cidr,proto3" json:"v6_cidr,omitempty"`
+}
+
+func (x *Network) Reset() {
+	*x = Network{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_ipservice_ipservicepb_ipservice_proto_msgTypes[5]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *Network) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*Network) ProtoMessage() {}
+
+func (x *Network) ProtoReflect() protoreflect.Message {
+	mi := &file_ipservice_ipservicepb_ipservice_proto_msgTypes[5]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use Network.ProtoReflect.Descriptor instead.
+func (*Network) Descriptor() ([]byte, []int) {
+	return file_ipservice_ipservicepb_ipservice_proto_rawDescGZIP(), []int{5}
+}
+
+func (x *Network) GetCidr() string {
+	if x != nil {
+		return x.Cidr
+	}
+	return ""
+}
+
+func (x *Network) GetAsNumber() uint32 {
+	if x != nil {
+		return x.AsNumber
+	}
+	return 0
+}
+
+func (x *Network) GetAsName() string {
+	if x != nil {
+		return x.AsName
+	}
+	return ""
+}
+
+func (x *Network) GetMissing() bool {
+	if x != nil {
+		return x.Missing
+	}
+	return false
+}
+
+func (x *Network) GetAnnouncedCidr() string {
+	if x != nil {
+		return x.AnnouncedCidr
+	}
+	return ""
+}
+
+func (x *Network) GetAsNameSource() string {
+	if x != nil {
+		return x.AsNameSource
+	}
+	return ""
+}
+
+func (x *Network) GetAsNameAll() []string {
+	if x != nil {
+		return x.AsNameAll
+	}
+	return nil
+}
+
+func (x *Network) GetCountry() string {
+	if x != nil {
+		return x.Country
+	}
+	return ""
+}
+
+func (x *Network) GetTransitionAddress() string {
+	if x != nil {
+		return x.TransitionAddress
+	}
+	return ""
+}
+
+func (x *Network) GetAllocatedCountry() string {
+	if x != nil {
+		return x.AllocatedCountry
+	}
+	return ""
+}
+
+func (x *Network) GetConeSize() int64 {
+	if x != nil {
+		return x.ConeSize
+	}
+	return 0
+}
+
+func (x *Network) GetVisibility() int64 {
+	if x != nil {
+		return x.Visibility
+	}
+	return 0
+}
+
+func (x *Network) GetSystems() []*System {
+	if x != nil {
+		return x.Systems
+	}
+	return nil
+}
+
+func (x *Network) GetOrganization() string {
+	if x != nil {
+		return x.Organization
+	}
+	return ""
+}
+
+func (x *Network) GetOrgId() string {
+	if x != nil {
+		return x.OrgId
+	}
+	return ""
+}
+
+func (x *Network) GetAsDomain() string {
+	if x != nil {
+		return x.AsDomain
+	}
+	return ""
+}
+
+func (x *Network) GetAsType() string {
+	if x != nil {
+		return x.AsType
+	}
+	return ""
+}
+
+func (x *Network) GetReserved() bool {
+	if x != nil {
+		return x.Reserved
+	}
+	return false
+}
+
+func (x *Network) GetRouteViewDate() string {
+	if x != nil {
+		return x.RouteViewDate
+	}
+	return ""
+}
+
+func (x *Network) GetV4Cidr() string {
+	if x != nil {
+		return x.V4Cidr
+	}
+	return ""
+}
+
+func (x *Network) GetV6Cidr() string {
+	if x != nil {
+		return x.V6Cidr
+	}
+	return ""
+}
+
+var File_ipservice_ipservicepb_ipservice_proto protoreflect.FileDescriptor
+
+var file_ipservice_ipservicepb_ipservice_proto_rawDesc = []byte{
+	0x0a, 0x25, 0x69, 0x70, 0x73, 0x65, 0x72, 0x76, 0x69, 0x63, 0x65, 0x2f, 0x69, 0x70, 0x73, 0x65,
+	0x72, 0x76, 0x69, 0x63, 0x65, 0x70, 0x62, 0x2f, 0x69, 0x70, 0x73, 0x65, 0x72, 0x76, 0x69, 0x63,
+	0x65, 0x2e, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x12, 0x09, 0x69, 0x70, 0x73, 0x65, 0x72, 0x76, 0x69,
+	0x63, 0x65, 0x22, 0x26, 0x0a, 0x12, 0x41, 0x6e, 0x6e, 0x6f, 0x74, 0x61, 0x74, 0x65, 0x49, 0x50,
+	0x73, 0x52, 0x65, 0x71, 0x75, 0x65, 0x73, 0x74, 0x12, 0x10, 0x0a, 0x03, 0x69, 0x70, 0x73, 0x18,
+	0x01, 0x20, 0x03, 0x28, 0x09, 0x52, 0x03, 0x69, 0x70, 0x73, 0x22, 0xe4, 0x01, 0x0a, 0x13, 0x41,
+	0x6e, 0x6e, 0x6f, 0x74, 0x61, 0x74, 0x65, 0x49, 0x50, 0x73, 0x52, 0x65, 0x73, 0x70, 0x6f, 0x6e,
+	0x73, 0x65, 0x12, 0x51, 0x0a, 0x0b, 0x61, 0x6e, 0x6e, 0x6f, 0x74, 0x61, 0x74, 0x69, 0x6f, 0x6e,
+	0x73, 0x18, 0x01, 0x20, 0x03, 0x28, 0x0b, 0x32, 0x2f, 0x2e, 0x69, 0x70, 0x73, 0x65, 0x72, 0x76,
+	0x69, 0x63, 0x65, 0x2e, 0x41, 0x6e, 0x6e, 0x6f, 0x74, 0x61, 0x74, 0x65, 0x49, 0x50, 0x73, 0x52,
+	0x65, 0x73, 0x70, 0x6f, 0x6e, 0x73, 0x65, 0x2e, 0x41, 0x6e, 0x6e, 0x6f, 0x74, 0x61, 0x74, 0x69,
+	0x6f, 0x6e, 0x73, 0x45, 0x6e, 0x74, 0x72, 0x79, 0x52, 0x0b, 0x61, 0x6e, 0x6e, 0x6f, 0x74, 0x61,
+	0x74, 0x69, 0x6f, 0x6e, 0x73, 0x12, 0x1c, 0x0a, 0x09, 0x74, 0x72, 0x75, 0x6e, 0x63, 0x61, 0x74,
+	0x65, 0x64, 0x18, 0x02, 0x20, 0x01, 0x28, 0x08, 0x52, 0x09, 0x74, 0x72, 0x75, 0x6e, 0x63, 0x61,
+	0x74, 0x65, 0x64, 0x1a, 0x5c, 0x0a, 0x10, 0x41, 0x6e, 0x6e, 0x6f, 0x74, 0x61, 0x74, 0x69, 0x6f,
+	0x6e, 0x73, 0x45, 0x6e, 0x74, 0x72, 0x79, 0x12, 0x10, 0x0a, 0x03, 0x6b, 0x65, 0x79, 0x18, 0x01,
+	0x20, 0x01, 0x28, 0x09, 0x52, 0x03, 0x6b, 0x65, 0x79, 0x12, 0x32, 0x0a, 0x05, 0x76, 0x61, 0x6c,
+	0x75, 0x65, 0x18, 0x02, 0x20, 0x01, 0x28, 0x0b, 0x32, 0x1c, 0x2e, 0x69, 0x70, 0x73, 0x65, 0x72,
+	0x76, 0x69, 0x63, 0x65, 0x2e, 0x43, 0x6c, 0x69, 0x65, 0x6e, 0x74, 0x41, 0x6e, 0x6e, 0x6f, 0x74,
+	0x61, 0x74, 0x69, 0x6f, 0x6e, 0x73, 0x52, 0x05, 0x76, 0x61, 0x6c, 0x75, 0x65, 0x3a, 0x02, 0x38,
+	0x01, 0x22, 0x84, 0x01, 0x0a, 0x11, 0x43, 0x6c, 0x69, 0x65, 0x6e, 0x74, 0x41, 0x6e, 0x6e, 0x6f,
+	0x74, 0x61, 0x74, 0x69, 0x6f, 0x6e, 0x73, 0x12, 0x28, 0x0a, 0x03, 0x67, 0x65, 0x6f, 0x18, 0x01,
+	0x20, 0x01, 0x28, 0x0b, 0x32, 0x16, 0x2e, 0x69, 0x70, 0x73, 0x65, 0x72, 0x76, 0x69, 0x63, 0x65,
+	0x2e, 0x47, 0x65, 0x6f, 0x6c, 0x6f, 0x63, 0x61, 0x74, 0x69, 0x6f, 0x6e, 0x52, 0x03, 0x67, 0x65,
+	0x6f, 0x12, 0x2c, 0x0a, 0x07, 0x6e, 0x65, 0x74, 0x77, 0x6f, 0x72, 0x6b, 0x18, 0x02, 0x20, 0x01,
+	0x28, 0x0b, 0x32, 0x12, 0x2e, 0x69, 0x70, 0x73, 0x65, 0x72, 0x76, 0x69, 0x63, 0x65, 0x2e, 0x4e,
+	0x65, 0x74, 0x77, 0x6f, 0x72, 0x6b, 0x52, 0x07, 0x6e, 0x65, 0x74, 0x77, 0x6f, 0x72, 0x6b, 0x12,
+	0x17, 0x0a, 0x07, 0x69, 0x70, 0x5f, 0x68, 0x61, 0x73, 0x68, 0x18, 0x03, 0x20, 0x01, 0x28, 0x09,
+	0x52, 0x06, 0x69, 0x70, 0x48, 0x61, 0x73, 0x68, 0x22, 0x91, 0x06, 0x0a, 0x0b, 0x47, 0x65, 0x6f,
+	0x6c, 0x6f, 0x63, 0x61, 0x74, 0x69, 0x6f, 0x6e, 0x12, 0x25, 0x0a, 0x0e, 0x63, 0x6f, 0x6e, 0x74,
+	0x69, 0x6e, 0x65, 0x6e, 0x74, 0x5f, 0x63, 0x6f, 0x64, 0x65, 0x18, 0x01, 0x20, 0x01, 0x28, 0x09,
+	0x52, 0x0d, 0x63, 0x6f, 0x6e, 0x74, 0x69, 0x6e, 0x65, 0x6e, 0x74, 0x43, 0x6f, 0x64, 0x65, 0x12,
+	0x21, 0x0a, 0x0c, 0x63, 0x6f, 0x75, 0x6e, 0x74, 0x72, 0x79, 0x5f, 0x63, 0x6f, 0x64, 0x65, 0x18,
+	0x02, 0x20, 0x01, 0x28, 0x09, 0x52, 0x0b, 0x63, 0x6f, 0x75, 0x6e, 0x74, 0x72, 0x79, 0x43, 0x6f,
+	0x64, 0x65, 0x12, 0x23, 0x0a, 0x0d, 0x63, 0x6f, 0x75, 0x6e, 0x74, 0x72, 0x79, 0x5f, 0x63, 0x6f,
+	0x64, 0x65, 0x33, 0x18, 0x03, 0x20, 0x01, 0x28, 0x09, 0x52, 0x0c, 0x63, 0x6f, 0x75, 0x6e, 0x74,
+	0x72, 0x79, 0x43, 0x6f, 0x64, 0x65, 0x33, 0x12, 0x21, 0x0a, 0x0c, 0x63, 0x6f, 0x75, 0x6e, 0x74,
+	0x72, 0x79, 0x5f, 0x6e, 0x61, 0x6d, 0x65, 0x18, 0x04, 0x20, 0x01, 0x28, 0x09, 0x52, 0x0b, 0x63,
+	0x6f, 0x75, 0x6e, 0x74, 0x72, 0x79, 0x4e, 0x61, 0x6d, 0x65, 0x12, 0x16, 0x0a, 0x06, 0x72, 0x65,
+	0x67, 0x69, 0x6f, 0x6e, 0x18, 0x05, 0x20, 0x01, 0x28, 0x09, 0x52, 0x06, 0x72, 0x65, 0x67, 0x69,
+	0x6f, 0x6e, 0x12, 0x32, 0x0a, 0x15, 0x73, 0x75, 0x62, 0x64, 0x69, 0x76, 0x69, 0x73, 0x69, 0x6f,
+	0x6e, 0x31, 0x5f, 0x69, 0x73, 0x6f, 0x5f, 0x63, 0x6f, 0x64, 0x65, 0x18, 0x06, 0x20, 0x01, 0x28,
+	0x09, 0x52, 0x13, 0x73, 0x75, 0x62, 0x64, 0x69, 0x76, 0x69, 0x73, 0x69, 0x6f, 0x6e, 0x31, 0x49,
+	0x73, 0x6f, 0x43, 0x6f, 0x64, 0x65, 0x12, 0x2b, 0x0a, 0x11, 0x73, 0x75, 0x62, 0x64, 0x69, 0x76,
+	0x69, 0x73, 0x69, 0x6f, 0x6e, 0x31, 0x5f, 0x6e, 0x61, 0x6d, 0x65, 0x18, 0x07, 0x20, 0x01, 0x28,
+	0x09, 0x52, 0x10, 0x73, 0x75, 0x62, 0x64, 0x69, 0x76, 0x69, 0x73, 0x69, 0x6f, 0x6e, 0x31, 0x4e,
+	0x61, 0x6d, 0x65, 0x12, 0x32, 0x0a, 0x15, 0x73, 0x75, 0x62, 0x64, 0x69, 0x76, 0x69, 0x73, 0x69,
+	0x6f, 0x6e, 0x32, 0x5f, 0x69, 0x73, 0x6f, 0x5f, 0x63, 0x6f, 0x64, 0x65, 0x18, 0x08, 0x20, 0x01,
+	0x28, 0x09, 0x52, 0x13, 0x73, 0x75, 0x62, 0x64, 0x69, 0x76, 0x69, 0x73, 0x69, 0x6f, 0x6e, 0x32,
+	0x49, 0x73, 0x6f, 0x43, 0x6f, 0x64, 0x65, 0x12, 0x2b, 0x0a, 0x11, 0x73, 0x75, 0x62, 0x64, 0x69,
+	0x76, 0x69, 0x73, 0x69, 0x6f, 0x6e, 0x32, 0x5f, 0x6e, 0x61, 0x6d, 0x65, 0x18, 0x09, 0x20, 0x01,
+	0x28, 0x09, 0x52, 0x10, 0x73, 0x75, 0x62, 0x64, 0x69, 0x76, 0x69, 0x73, 0x69, 0x6f, 0x6e, 0x32,
+	0x4e, 0x61, 0x6d, 0x65, 0x12, 0x1d, 0x0a, 0x0a, 0x6d, 0x65, 0x74, 0x72, 0x6f, 0x5f, 0x63, 0x6f,
+	0x64, 0x65, 0x18, 0x0a, 0x20, 0x01, 0x28, 0x03, 0x52, 0x09, 0x6d, 0x65, 0x74, 0x72, 0x6f, 0x43,
+	0x6f, 0x64, 0x65, 0x12, 0x12, 0x0a, 0x04, 0x63, 0x69, 0x74, 0x79, 0x18, 0x0b, 0x20, 0x01, 0x28,
+	0x09, 0x52, 0x04, 0x63, 0x69, 0x74, 0x79, 0x12, 0x1b, 0x0a, 0x09, 0x61, 0x72, 0x65, 0x61, 0x5f,
+	0x63, 0x6f, 0x64, 0x65, 0x18, 0x0c, 0x20, 0x01, 0x28, 0x03, 0x52, 0x08, 0x61, 0x72, 0x65, 0x61,
+	0x43, 0x6f, 0x64, 0x65, 0x12, 0x1f, 0x0a, 0x0b, 0x70, 0x6f, 0x73, 0x74, 0x61, 0x6c, 0x5f, 0x63,
+	0x6f, 0x64, 0x65, 0x18, 0x0d, 0x20, 0x01, 0x28, 0x09, 0x52, 0x0a, 0x70, 0x6f, 0x73, 0x74, 0x61,
+	0x6c, 0x43, 0x6f, 0x64, 0x65, 0x12, 0x1a, 0x0a, 0x08, 0x6c, 0x61, 0x74, 0x69, 0x74, 0x75, 0x64,
+	0x65, 0x18, 0x0e, 0x20, 0x01, 0x28, 0x01, 0x52, 0x08, 0x6c, 0x61, 0x74, 0x69, 0x74, 0x75, 0x64,
+	0x65, 0x12, 0x1c, 0x0a, 0x09, 0x6c, 0x6f, 0x6e, 0x67, 0x69, 0x74, 0x75, 0x64, 0x65, 0x18, 0x0f,
+	0x20, 0x01, 0x28, 0x01, 0x52, 0x09, 0x6c, 0x6f, 0x6e, 0x67, 0x69, 0x74, 0x75, 0x64, 0x65, 0x12,
+	0x2c, 0x0a, 0x12, 0x61, 0x63, 0x63, 0x75, 0x72, 0x61, 0x63, 0x79, 0x5f, 0x72, 0x61, 0x64, 0x69,
+	0x75, 0x73, 0x5f, 0x6b, 0x6d, 0x18, 0x10, 0x20, 0x01, 0x28, 0x03, 0x52, 0x10, 0x61, 0x63, 0x63,
+	0x75, 0x72, 0x61, 0x63, 0x79, 0x52, 0x61, 0x64, 0x69, 0x75, 0x73, 0x4b, 0x6d, 0x12, 0x3e, 0x0a,
+	0x1b, 0x63, 0x6f, 0x6f, 0x72, 0x64, 0x69, 0x6e, 0x61, 0x74, 0x65, 0x73, 0x5f, 0x61, 0x72, 0x65,
+	0x5f, 0x61, 0x70, 0x70, 0x72, 0x6f, 0x78, 0x69, 0x6d, 0x61, 0x74, 0x65, 0x18, 0x11, 0x20, 0x01,
+	0x28, 0x08, 0x52, 0x19, 0x63, 0x6f, 0x6f, 0x72, 0x64, 0x69, 0x6e, 0x61, 0x74, 0x65, 0x73, 0x41,
+	0x72, 0x65, 0x41, 0x70, 0x70, 0x72, 0x6f, 0x78, 0x69, 0x6d, 0x61, 0x74, 0x65, 0x12, 0x2a, 0x0a,
+	0x11, 0x61, 0x70, 0x70, 0x72, 0x6f, 0x78, 0x5f, 0x75, 0x74, 0x63, 0x5f, 0x6f, 0x66, 0x66, 0x73,
+	0x65, 0x74, 0x18, 0x12, 0x20, 0x01, 0x28, 0x09, 0x52, 0x0f, 0x61, 0x70, 0x70, 0x72, 0x6f, 0x78,
+	0x55, 0x74, 0x63, 0x4f, 0x66, 0x66, 0x73, 0x65, 0x74, 0x12, 0x18, 0x0a, 0x07, 0x6d, 0x69, 0x73,
+	0x73, 0x69, 0x6e, 0x67, 0x18, 0x13, 0x20, 0x01, 0x28, 0x08, 0x52, 0x07, 0x6d, 0x69, 0x73, 0x73,
+	0x69, 0x6e, 0x67, 0x12, 0x1a, 0x0a, 0x08, 0x72, 0x65, 0x73, 0x65, 0x72, 0x76, 0x65, 0x64, 0x18,
+	0x14, 0x20, 0x01, 0x28, 0x08, 0x52, 0x08, 0x72, 0x65, 0x73, 0x65, 0x72, 0x76, 0x65, 0x64, 0x12,
+	0x1b, 0x0a, 0x09, 0x74, 0x69, 0x6d, 0x65, 0x5f, 0x7a, 0x6f, 0x6e, 0x65, 0x18, 0x15, 0x20, 0x01,
+	0x28, 0x09, 0x52, 0x08, 0x74, 0x69, 0x6d, 0x65, 0x5a, 0x6f, 0x6e, 0x65, 0x22, 0x1c, 0x0a, 0x06,
+	0x53, 0x79, 0x73, 0x74, 0x65, 0x6d, 0x12, 0x12, 0x0a, 0x04, 0x61, 0x73, 0x6e, 0x73, 0x18, 0x01,
+	0x20, 0x03, 0x28, 0x0d, 0x52, 0x04, 0x61, 0x73, 0x6e, 0x73, 0x22, 0xa1, 0x05, 0x0a, 0x07, 0x4e,
+	0x65, 0x74, 0x77, 0x6f, 0x72, 0x6b, 0x12, 0x12, 0x0a, 0x04, 0x63, 0x69, 0x64, 0x72, 0x18, 0x01,
+	0x20, 0x01, 0x28, 0x09, 0x52, 0x04, 0x63, 0x69, 0x64, 0x72, 0x12, 0x1b, 0x0a, 0x09, 0x61, 0x73,
+	0x5f, 0x6e, 0x75, 0x6d, 0x62, 0x65, 0x72, 0x18, 0x02, 0x20, 0x01, 0x28, 0x0d, 0x52, 0x08, 0x61,
+	0x73, 0x4e, 0x75, 0x6d, 0x62, 0x65, 0x72, 0x12, 0x17, 0x0a, 0x07, 0x61, 0x73, 0x5f, 0x6e, 0x61,
+	0x6d, 0x65, 0x18, 0x03, 0x20, 0x01, 0x28, 0x09, 0x52, 0x06, 0x61, 0x73, 0x4e, 0x61, 0x6d, 0x65,
+	0x12, 0x18, 0x0a, 0x07, 0x6d, 0x69, 0x73, 0x73, 0x69, 0x6e, 0x67, 0x18, 0x04, 0x20, 0x01, 0x28,
+	0x08, 0x52, 0x07, 0x6d, 0x69, 0x73, 0x73, 0x69, 0x6e, 0x67, 0x12, 0x25, 0x0a, 0x0e, 0x61, 0x6e,
+	0x6e, 0x6f, 0x75, 0x6e, 0x63, 0x65, 0x64, 0x5f, 0x63, 0x69, 0x64, 0x72, 0x18, 0x05, 0x20, 0x01,
+	0x28, 0x09, 0x52, 0x0d, 0x61, 0x6e, 0x6e, 0x6f, 0x75, 0x6e, 0x63, 0x65, 0x64, 0x43, 0x69, 0x64,
+	0x72, 0x12, 0x24, 0x0a, 0x0e, 0x61, 0x73, 0x5f, 0x6e, 0x61, 0x6d, 0x65, 0x5f, 0x73, 0x6f, 0x75,
+	0x72, 0x63, 0x65, 0x18, 0x06, 0x20, 0x01, 0x28, 0x09, 0x52, 0x0c, 0x61, 0x73, 0x4e, 0x61, 0x6d,
+	0x65, 0x53, 0x6f, 0x75, 0x72, 0x63, 0x65, 0x12, 0x1e, 0x0a, 0x0b, 0x61, 0x73, 0x5f, 0x6e, 0x61,
+	0x6d, 0x65, 0x5f, 0x61, 0x6c, 0x6c, 0x18, 0x07, 0x20, 0x03, 0x28, 0x09, 0x52, 0x09, 0x61, 0x73,
+	0x4e, 0x61, 0x6d, 0x65, 0x41, 0x6c, 0x6c, 0x12, 0x18, 0x0a, 0x07, 0x63, 0x6f, 0x75, 0x6e, 0x74,
+	0x72, 0x79, 0x18, 0x08, 0x20, 0x01, 0x28, 0x09, 0x52, 0x07, 0x63, 0x6f, 0x75, 0x6e, 0x74, 0x72,
+	0x79, 0x12, 0x2d, 0x0a, 0x12, 0x74, 0x72, 0x61, 0x6e, 0x73, 0x69, 0x74, 0x69, 0x6f, 0x6e, 0x5f,
+	0x61, 0x64, 0x64, 0x72, 0x65, 0x73, 0x73, 0x18, 0x09, 0x20, 0x01, 0x28, 0x09, 0x52, 0x11, 0x74,
+	0x72, 0x61, 0x6e, 0x73, 0x69, 0x74, 0x69, 0x6f, 0x6e, 0x41, 0x64, 0x64, 0x72, 0x65, 0x73, 0x73,
+	0x12, 0x2b, 0x0a, 0x11, 0x61, 0x6c, 0x6c, 0x6f, 0x63, 0x61, 0x74, 0x65, 0x64, 0x5f, 0x63, 0x6f,
+	0x75, 0x6e, 0x74, 0x72, 0x79, 0x18, 0x0a, 0x20, 0x01, 0x28, 0x09, 0x52, 0x10, 0x61, 0x6c, 0x6c,
+	0x6f, 0x63, 0x61, 0x74, 0x65, 0x64, 0x43, 0x6f, 0x75, 0x6e, 0x74, 0x72, 0x79, 0x12, 0x1b, 0x0a,
+	0x09, 0x63, 0x6f, 0x6e, 0x65, 0x5f, 0x73, 0x69, 0x7a, 0x65, 0x18, 0x0b, 0x20, 0x01, 0x28, 0x03,
+	0x52, 0x08, 0x63, 0x6f, 0x6e, 0x65, 0x53, 0x69, 0x7a, 0x65, 0x12, 0x1e, 0x0a, 0x0a, 0x76, 0x69,
+	0x73, 0x69, 0x62, 0x69, 0x6c, 0x69, 0x74, 0x79, 0x18, 0x0c, 0x20, 0x01, 0x28, 0x03, 0x52, 0x0a,
+	0x76, 0x69, 0x73, 0x69, 0x62, 0x69, 0x6c, 0x69, 0x74, 0x79, 0x12, 0x2b, 0x0a, 0x07, 0x73, 0x79,
+	0x73, 0x74, 0x65, 0x6d, 0x73, 0x18, 0x0d, 0x20, 0x03, 0x28, 0x0b, 0x32, 0x11, 0x2e, 0x69, 0x70,
+	0x73, 0x65, 0x72, 0x76, 0x69, 0x63, 0x65, 0x2e, 0x53, 0x79, 0x73, 0x74, 0x65, 0x6d, 0x52, 0x07,
+	0x73, 0x79, 0x73, 0x74, 0x65, 0x6d, 0x73, 0x12, 0x22, 0x0a, 0x0c, 0x6f, 0x72, 0x67, 0x61, 0x6e,
+	0x69, 0x7a, 0x61, 0x74, 0x69, 0x6f, 0x6e, 0x18, 0x0e, 0x20, 0x01, 0x28, 0x09, 0x52, 0x0c, 0x6f,
+	0x72, 0x67, 0x61, 0x6e, 0x69, 0x7a, 0x61, 0x74, 0x69, 0x6f, 0x6e, 0x12, 0x15, 0x0a, 0x06, 0x6f,
+	0x72, 0x67, 0x5f, 0x69, 0x64, 0x18, 0x0f, 0x20, 0x01, 0x28, 0x09, 0x52, 0x05, 0x6f, 0x72, 0x67,
+	0x49, 0x64, 0x12, 0x1b, 0x0a, 0x09, 0x61, 0x73, 0x5f, 0x64, 0x6f, 0x6d, 0x61, 0x69, 0x6e, 0x18,
+	0x10, 0x20, 0x01, 0x28, 0x09, 0x52, 0x08, 0x61, 0x73, 0x44, 0x6f, 0x6d, 0x61, 0x69, 0x6e, 0x12,
+	0x17, 0x0a, 0x07, 0x61, 0x73, 0x5f, 0x74, 0x79, 0x70, 0x65, 0x18, 0x11, 0x20, 0x01, 0x28, 0x09,
+	0x52, 0x06, 0x61, 0x73, 0x54, 0x79, 0x70, 0x65, 0x12, 0x1a, 0x0a, 0x08, 0x72, 0x65, 0x73, 0x65,
+	0x72, 0x76, 0x65, 0x64, 0x18, 0x12, 0x20, 0x01, 0x28, 0x08, 0x52, 0x08, 0x72, 0x65, 0x73, 0x65,
+	0x72, 0x76, 0x65, 0x64, 0x12, 0x26, 0x0a, 0x0f, 0x72, 0x6f, 0x75, 0x74, 0x65, 0x5f, 0x76, 0x69,
+	0x65, 0x77, 0x5f, 0x64, 0x61, 0x74, 0x65, 0x18, 0x13, 0x20, 0x01, 0x28, 0x09, 0x52, 0x0d, 0x72,
+	0x6f, 0x75, 0x74, 0x65, 0x56, 0x69, 0x65, 0x77, 0x44, 0x61, 0x74, 0x65, 0x12, 0x17, 0x0a, 0x07,
+	0x76, 0x34, 0x5f, 0x63, 0x69, 0x64, 0x72, 0x18, 0x14, 0x20, 0x01, 0x28, 0x09, 0x52, 0x06, 0x76,
+	0x34, 0x43, 0x69, 0x64, 0x72, 0x12, 0x17, 0x0a, 0x07, 0x76, 0x36, 0x5f, 0x63, 0x69, 0x64, 0x72,
+	0x18, 0x15, 0x20, 0x01, 0x28, 0x09, 0x52, 0x06, 0x76, 0x36, 0x43, 0x69, 0x64, 0x72, 0x32, 0x59,
+	0x0a, 0x09, 0x41, 0x6e, 0x6e, 0x6f, 0x74, 0x61, 0x74, 0x6f, 0x72, 0x12, 0x4c, 0x0a, 0x0b, 0x41,
+	0x6e, 0x6e, 0x6f, 0x74, 0x61, 0x74, 0x65, 0x49, 0x50, 0x73, 0x12, 0x1d, 0x2e, 0x69, 0x70, 0x73,
+	0x65, 0x72, 0x76, 0x69, 0x63, 0x65, 0x2e, 0x41, 0x6e, 0x6e, 0x6f, 0x74, 0x61, 0x74, 0x65, 0x49,
+	0x50, 0x73, 0x52, 0x65, 0x71, 0x75, 0x65, 0x73, 0x74, 0x1a, 0x1e, 0x2e, 0x69, 0x70, 0x73, 0x65,
+	0x72, 0x76, 0x69, 0x63, 0x65, 0x2e, 0x41, 0x6e, 0x6e, 0x6f, 0x74, 0x61, 0x74, 0x65, 0x49, 0x50,
+	0x73, 0x52, 0x65, 0x73, 0x70, 0x6f, 0x6e, 0x73, 0x65, 0x42, 0x37, 0x5a, 0x35, 0x67, 0x69, 0x74,
+	0x68, 0x75, 0x62, 0x2e, 0x63, 0x6f, 0x6d, 0x2f, 0x6d, 0x2d, 0x6c, 0x61, 0x62, 0x2f, 0x75, 0x75,
+	0x69, 0x64, 0x2d, 0x61, 0x6e, 0x6e, 0x6f, 0x74, 0x61, 0x74, 0x6f, 0x72, 0x2f, 0x69, 0x70, 0x73,
+	0x65, 0x72, 0x76, 0x69, 0x63, 0x65, 0x2f, 0x69, 0x70, 0x73, 0x65, 0x72, 0x76, 0x69, 0x63, 0x65,
+	0x70, 0x62, 0x62, 0x06, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x33,
+}
+
+var (
+	file_ipservice_ipservicepb_ipservice_proto_rawDescOnce sync.Once
+	file_ipservice_ipservicepb_ipservice_proto_rawDescData = file_ipservice_ipservicepb_ipservice_proto_rawDesc
+)
+
+func file_ipservice_ipservicepb_ipservice_proto_rawDescGZIP() []byte {
+	file_ipservice_ipservicepb_ipservice_proto_rawDescOnce.Do(func() {
+		file_ipservice_ipservicepb_ipservice_proto_rawDescData = protoimpl.X.CompressGZIP(file_ipservice_ipservicepb_ipservice_proto_rawDescData)
+	})
+	return file_ipservice_ipservicepb_ipservice_proto_rawDescData
+}
+
+var file_ipservice_ipservicepb_ipservice_proto_msgTypes = make([]protoimpl.MessageInfo, 7)
+var file_ipservice_ipservicepb_ipservice_proto_goTypes = []interface{}{
+	(*AnnotateIPsRequest)(nil),  // 0: ipservice.AnnotateIPsRequest
+	(*AnnotateIPsResponse)(nil), // 1: ipservice.AnnotateIPsResponse
+	(*ClientAnnotations)(nil),   // 2: ipservice.ClientAnnotations
+	(*Geolocation)(nil),         // 3: ipservice.Geolocation
+	(*System)(nil),              // 4: ipservice.System
+	(*Network)(nil),             // 5: ipservice.Network
+	nil,                         // 6: ipservice.AnnotateIPsResponse.AnnotationsEntry
+}
+var file_ipservice_ipservicepb_ipservice_proto_depIdxs = []int32{
+	6, // 0: ipservice.AnnotateIPsResponse.annotations:type_name -> ipservice.AnnotateIPsResponse.AnnotationsEntry
+	3, // 1: ipservice.ClientAnnotations.geo:type_name -> ipservice.Geolocation
+	5, // 2: ipservice.ClientAnnotations.network:type_name -> ipservice.Network
+	4, // 3: ipservice.Network.systems:type_name -> ipservice.System
+	2, // 4: ipservice.AnnotateIPsResponse.AnnotationsEntry.value:type_name -> ipservice.ClientAnnotations
+	0, // 5: ipservice.Annotator.AnnotateIPs:input_type -> ipservice.AnnotateIPsRequest
+	1, // 6: ipservice.Annotator.AnnotateIPs:output_type -> ipservice.AnnotateIPsResponse
+	6, // [6:7] is the sub-list for method output_type
+	5, // [5:6] is the sub-list for method input_type
+	5, // [5:5] is the sub-list for extension type_name
+	5, // [5:5] is the sub-list for extension extendee
+	0, // [0:5] is the sub-list for field type_name
+}
+
+func init() { file_ipservice_ipservicepb_ipservice_proto_init() }
+func file_ipservice_ipservicepb_ipservice_proto_init() {
+	if File_ipservice_ipservicepb_ipservice_proto != nil {
+		return
+	}
+	if !protoimpl.UnsafeEnabled {
+		file_ipservice_ipservicepb_ipservice_proto_msgTypes[0].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*AnnotateIPsRequest); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_ipservice_ipservicepb_ipservice_proto_msgTypes[1].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*AnnotateIPsResponse); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_ipservice_ipservicepb_ipservice_proto_msgTypes[2].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*ClientAnnotations); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_ipservice_ipservicepb_ipservice_proto_msgTypes[3].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*Geolocation); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_ipservice_ipservicepb_ipservice_proto_msgTypes[4].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*System); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_ipservice_ipservicepb_ipservice_proto_msgTypes[5].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*Network); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+	}
+	type x struct{}
+	out := protoimpl.TypeBuilder{
+		File: protoimpl.DescBuilder{
+			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
+			RawDescriptor: file_ipservice_ipservicepb_ipservice_proto_rawDesc,
+			NumEnums:      0,
+			NumMessages:   7,
+			NumExtensions: 0,
+			NumServices:   1,
+		},
+		GoTypes:           file_ipservice_ipservicepb_ipservice_proto_goTypes,
+		DependencyIndexes: file_ipservice_ipservicepb_ipservice_proto_depIdxs,
+		MessageInfos:      file_ipservice_ipservicepb_ipservice_proto_msgTypes,
+	}.Build()
+	File_ipservice_ipservicepb_ipservice_proto = out.File
+	file_ipservice_ipservicepb_ipservice_proto_rawDesc = nil
+	file_ipservice_ipservicepb_ipservice_proto_goTypes = nil
+	file_ipservice_ipservicepb_ipservice_proto_depIdxs = nil
+}
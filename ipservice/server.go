@@ -1,29 +1,86 @@
 package ipservice
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"log"
 	"net"
 	"net/http"
-	"os"
+	"strings"
+	"time"
+
+	"google.golang.org/grpc"
 
 	"github.com/m-lab/go/errorx"
 	"github.com/m-lab/go/rtx"
+	"github.com/m-lab/tcp-info/inetdiag"
 	"github.com/m-lab/uuid-annotator/annotator"
 	"github.com/m-lab/uuid-annotator/asnannotator"
 	"github.com/m-lab/uuid-annotator/geoannotator"
+	"github.com/m-lab/uuid-annotator/ipservice/ipservicepb"
 	"github.com/m-lab/uuid-annotator/metrics"
+	"github.com/m-lab/uuid-annotator/siteannotator"
 )
 
 // Server provides the http-over-unix-domain-socket service that serves up annotated IP addresses on request.
 type Server interface {
 	Close() error
 	Serve() error
+
+	// Shutdown stops accepting new requests and waits for in-flight requests
+	// to complete, or for the context to be canceled, whichever comes first.
+	Shutdown(ctx context.Context) error
 }
 
 type handler struct {
-	asn asnannotator.ASNAnnotator
-	geo geoannotator.GeoAnnotator
+	asn    asnannotator.ASNAnnotator
+	geo    geoannotator.GeoAnnotator
+	site   siteannotator.SiteAnnotator
+	budget time.Duration
+}
+
+// ServerOption configures optional behavior of the Server in NewServer.
+type ServerOption func(*handler)
+
+// WithSiteAnnotator serves the ServerAnnotations of local IPs from the given
+// site annotator at /v1/annotate/server. Without it, that endpoint responds
+// with HTTP 501.
+func WithSiteAnnotator(site siteannotator.SiteAnnotator) ServerOption {
+	return func(h *handler) {
+		h.site = site
+	}
+}
+
+// deadline returns a function that reports whether the request budget, which
+// starts now, has been exceeded.
+func (h *handler) deadline() func() bool {
+	if h.budget <= 0 {
+		return func() bool { return false }
+	}
+	end := time.Now().Add(h.budget)
+	return func() bool { return time.Now().After(end) }
+}
+
+// writeResponse writes the JSON response, marking it as truncated if need be.
+func writeResponse(rw http.ResponseWriter, resp interface{}, truncated bool) {
+	b, err := json.Marshal(resp)
+	rtx.Must(err, "Could not marshal the response. This should never happen and is a bug.")
+
+	if truncated {
+		rw.Header().Set(TruncatedHeader, "true")
+	}
+	_, err = rw.Write(b)
+	if err != nil {
+		log.Println("Could not write response due to error:", err)
+		metrics.ServerRPCCount.WithLabelValues("write_error").Inc()
+		return
+	}
+	if truncated {
+		metrics.ServerRPCCount.WithLabelValues("truncated").Inc()
+		return
+	}
+	metrics.ServerRPCCount.WithLabelValues("success").Inc()
 }
 
 func logOnError(err error, args ...interface{}) {
@@ -38,68 +95,310 @@ func logOnNil(ptr interface{}, args ...interface{}) {
 	}
 }
 
+// parseHostIP parses an IP address that may have a port, in any of the forms
+// "1.2.3.4", "1.2.3.4:443", "::1", "[::1]", or "[::1]:443". It returns the
+// string form of the IP without the port, or nil if s is not one of these.
+func parseHostIP(s string) (string, net.IP) {
+	if ip := net.ParseIP(s); ip != nil {
+		return s, ip
+	}
+	host, _, err := net.SplitHostPort(s)
+	if err != nil {
+		host = strings.TrimSuffix(strings.TrimPrefix(s, "["), "]")
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		return host, ip
+	}
+	return "", nil
+}
+
+// annotateIP returns the annotations of a single IP, or nil if the IP should be
+// skipped. A panic while annotating is recovered and counted, so that a bug
+// triggered by one IP does not fail every other IP in the request.
+func (h *handler) annotateIP(ipstring, host string, ip net.IP) (a *annotator.ClientAnnotations) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Println("Panic while annotating", ipstring, ":", r)
+			metrics.ServerRPCCount.WithLabelValues("panic_error").Inc()
+			a = nil
+		}
+	}()
+	a = &annotator.ClientAnnotations{}
+	if h.asn != nil {
+		a.Network = h.asn.AnnotateIP(host) // Should nil returns be ignored?
+	}
+	if h.geo != nil {
+		err := h.geo.AnnotateIP(ip, &a.Geo)
+		if errors.Is(err, annotator.ErrInvalidIP) {
+			log.Println("Could not GEO annotate invalid IP", ipstring)
+			metrics.ServerRPCCount.WithLabelValues("badip_error").Inc()
+			return nil
+		}
+		// Other errors, e.g. ErrLookupFailed or ErrNoAnnotation, only mean
+		// that the geolocation is missing or incomplete, so the rest of the
+		// annotations are still returned.
+		logOnError(err, "Could not GEO annotate", ip)
+	}
+	return a
+}
+
+// maxPostBytes bounds the size of the body of a POST of IPs.
+const maxPostBytes = 32 << 20
+
+// ServeHTTP annotates the IPs of a GET request, which are its "ip" arguments,
+// or of a POST request, whose body is a JSON array of IP strings.
 func (h *handler) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
 	ipstrings := req.URL.Query()["ip"]
-	resp := make(map[string]*annotator.ClientAnnotations)
-	for _, ipstring := range ipstrings {
-		ip := net.ParseIP(ipstring)
-		if ip == nil {
-			log.Println("Could not parse IP", ipstring)
-			metrics.ServerRPCCount.WithLabelValues("badip_error").Inc()
-			continue
+	if req.Method == http.MethodPost {
+		ipstrings = nil
+		err := json.NewDecoder(http.MaxBytesReader(rw, req.Body, maxPostBytes)).Decode(&ipstrings)
+		if err != nil {
+			log.Println("Could not decode the IPs in the request body:", err)
+			rw.WriteHeader(http.StatusBadRequest)
+			metrics.ServerRPCCount.WithLabelValues("bad_body_error").Inc()
+			return
 		}
-		a := &annotator.ClientAnnotations{}
-		if h.asn != nil {
-			a.Network = h.asn.AnnotateIP(ipstring) // Should nil returns be ignored?
+	}
+	h.annotateIPs(rw, ipstrings)
+}
+
+// annotateIPs writes the response with the annotations of every valid IP.
+func (h *handler) annotateIPs(rw http.ResponseWriter, ipstrings []string) {
+	resp, truncated := h.annotateAll(ipstrings)
+	if len(resp) == 0 {
+		log.Println("Could not process request ip argument(s)")
+		rw.WriteHeader(http.StatusBadRequest)
+		metrics.ServerRPCCount.WithLabelValues("bad_request_error").Inc()
+		return
+	}
+	writeResponse(rw, resp, truncated)
+}
+
+// annotateAll returns the annotations of every valid IP, keyed by the IPs as
+// passed in, and whether the request budget cut them short.
+func (h *handler) annotateAll(ipstrings []string) (map[string]*annotator.ClientAnnotations, bool) {
+	resp := make(map[string]*annotator.ClientAnnotations)
+	exceeded := h.deadline()
+	truncated := false
+	for i, ipstring := range ipstrings {
+		// The budget is checked before every IP but the first, so that every
+		// request makes some progress.
+		if i > 0 && exceeded() {
+			truncated = true
+			break
 		}
-		if h.geo != nil {
-			err := h.geo.AnnotateIP(ip, &a.Geo)
-			logOnError(err, "Could not GEO annotate", ip)
+		if a := h.annotateString(ipstring); a != nil {
+			resp[ipstring] = a
 		}
-		resp[ipstring] = a
 	}
+	return resp, truncated
+}
+
+// annotateString returns the annotations of an IP that may include a port, or
+// nil if it is invalid or should be skipped.
+func (h *handler) annotateString(ipstring string) *annotator.ClientAnnotations {
+	host, ip := parseHostIP(ipstring)
+	if ip == nil {
+		log.Println("Could not parse IP", ipstring)
+		metrics.ServerRPCCount.WithLabelValues("badip_error").Inc()
+		return nil
+	}
+	return h.annotateIP(ipstring, host, ip)
+}
 
+// serveGroups annotates the IPs of a POST request, whose body is a JSON object
+// that maps caller-supplied group IDs to lists of IPs, e.g. the IPv4 and IPv6
+// addresses of a dual-stacked client. The response maps each group ID to the
+// annotations of its valid IPs, keyed by the IPs as passed in, so that the
+// annotations of a group always arrive together. Groups without a valid IP
+// are left out.
+func (h *handler) serveGroups(rw http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		rw.WriteHeader(http.StatusMethodNotAllowed)
+		metrics.ServerRPCCount.WithLabelValues("bad_method_error").Inc()
+		return
+	}
+	groups := map[string][]string{}
+	err := json.NewDecoder(http.MaxBytesReader(rw, req.Body, maxPostBytes)).Decode(&groups)
+	if err != nil {
+		log.Println("Could not decode the groups in the request body:", err)
+		rw.WriteHeader(http.StatusBadRequest)
+		metrics.ServerRPCCount.WithLabelValues("bad_body_error").Inc()
+		return
+	}
+	resp := make(map[string]map[string]*annotator.ClientAnnotations)
+	exceeded := h.deadline()
+	truncated := false
+	first := true
+	for id, ipstrings := range groups {
+		// The budget is only checked between groups, so that no group is
+		// returned with some of its IPs missing.
+		if !first && exceeded() {
+			truncated = true
+			break
+		}
+		first = false
+		group := make(map[string]*annotator.ClientAnnotations)
+		for _, ipstring := range ipstrings {
+			if a := h.annotateString(ipstring); a != nil {
+				group[ipstring] = a
+			}
+		}
+		if len(group) > 0 {
+			resp[id] = group
+		}
+	}
 	if len(resp) == 0 {
-		log.Println("Could not process request ip argument(s)")
+		log.Println("Could not process request group(s)")
 		rw.WriteHeader(http.StatusBadRequest)
 		metrics.ServerRPCCount.WithLabelValues("bad_request_error").Inc()
 		return
 	}
+	writeResponse(rw, resp, truncated)
+}
 
-	b, err := json.Marshal(resp)
-	rtx.Must(err, "Could not marshal the response. This should never happen and is a bug.")
+// PairAnnotations contains the Network annotations of both endpoints of a
+// (src, dst) pair, along with their relationship.
+type PairAnnotations struct {
+	SrcIP      string
+	DstIP      string
+	Src        *annotator.Network `json:",omitempty"`
+	Dst        *annotator.Network `json:",omitempty"`
+	SameASN    bool               // True when both endpoints were found and have the same first ASN.
+	SamePrefix bool               // True when both endpoints were found in the same RouteViews prefix.
+}
 
-	_, err = rw.Write(b)
+func (h *handler) annotatePair(src, dst string) *PairAnnotations {
+	p := &PairAnnotations{
+		SrcIP: src,
+		DstIP: dst,
+	}
+	if h.asn == nil {
+		return p
+	}
+	p.Src = h.asn.AnnotateIP(src)
+	p.Dst = h.asn.AnnotateIP(dst)
+	if p.Src == nil || p.Dst == nil || p.Src.Missing || p.Dst.Missing {
+		return p
+	}
+	p.SameASN = p.Src.ASNumber != 0 && p.Src.ASNumber == p.Dst.ASNumber
+	p.SamePrefix = p.Src.CIDR != "" && p.Src.CIDR == p.Dst.CIDR
+	return p
+}
+
+// servePairs annotates each "pair" argument, which must be of the form
+// "srcip,dstip". The response is a list in the same order as the valid pairs.
+func (h *handler) servePairs(rw http.ResponseWriter, req *http.Request) {
+	resp := []*PairAnnotations{}
+	exceeded := h.deadline()
+	truncated := false
+	for i, pair := range req.URL.Query()["pair"] {
+		if i > 0 && exceeded() {
+			truncated = true
+			break
+		}
+		ips := strings.Split(pair, ",")
+		if len(ips) != 2 || net.ParseIP(ips[0]) == nil || net.ParseIP(ips[1]) == nil {
+			log.Println("Could not parse pair", pair)
+			metrics.ServerRPCCount.WithLabelValues("badpair_error").Inc()
+			continue
+		}
+		resp = append(resp, h.annotatePair(ips[0], ips[1]))
+	}
+
+	if len(resp) == 0 {
+		log.Println("Could not process request pair argument(s)")
+		rw.WriteHeader(http.StatusBadRequest)
+		metrics.ServerRPCCount.WithLabelValues("bad_request_error").Inc()
+		return
+	}
+	writeResponse(rw, resp, truncated)
+}
+
+// serveServer annotates the local IP of the "ip" argument with the server
+// annotations of the site annotator.
+func (h *handler) serveServer(rw http.ResponseWriter, req *http.Request) {
+	if h.site == nil {
+		rw.WriteHeader(http.StatusNotImplemented)
+		metrics.ServerRPCCount.WithLabelValues("not_implemented_error").Inc()
+		return
+	}
+	ipstring := req.URL.Query().Get("ip")
+	host, ip := parseHostIP(ipstring)
+	if ip == nil {
+		log.Println("Could not parse IP", ipstring)
+		rw.WriteHeader(http.StatusBadRequest)
+		metrics.ServerRPCCount.WithLabelValues("badip_error").Inc()
+		return
+	}
+	// The site annotator only annotates connections, so the IP is annotated as
+	// the source of a connection to nowhere.
+	ann := &annotator.Annotations{}
+	err := h.site.Annotate(&inetdiag.SockID{SrcIP: host}, ann)
 	if err != nil {
-		log.Println("Could not write response due to error:", err)
-		metrics.ServerRPCCount.WithLabelValues("write_error").Inc()
+		log.Println("Could not annotate server IP", ipstring, ":", err)
+		rw.WriteHeader(http.StatusBadRequest)
+		metrics.ServerRPCCount.WithLabelValues("nonlocal_error").Inc()
 		return
 	}
-	metrics.ServerRPCCount.WithLabelValues("success").Inc()
+	writeResponse(rw, &ann.Server, false)
 }
 
 type server struct {
 	listener net.Listener
 	srv      *http.Server
+	grpc     *grpc.Server
 }
 
 func (s *server) Serve() error {
-	return errorx.Suppress(s.srv.Serve(s.listener), http.ErrServerClosed)
+	httpL, grpcL := splitByProtocol(s.listener)
+	go func() {
+		logOnError(s.grpc.Serve(grpcL), "Could not serve gRPC")
+	}()
+	return errorx.Suppress(s.srv.Serve(httpL), http.ErrServerClosed)
 }
 
 func (s *server) Close() error {
-	return s.srv.Close()
+	s.grpc.Stop()
+	err := s.srv.Close()
+	s.listener.Close()
+	return err
+}
+
+func (s *server) Shutdown(ctx context.Context) error {
+	stopped := make(chan struct{})
+	go func() {
+		s.grpc.GracefulStop()
+		close(stopped)
+	}()
+	err := s.srv.Shutdown(ctx)
+	select {
+	case <-stopped:
+	case <-ctx.Done():
+		s.grpc.Stop()
+		if err == nil {
+			err = ctx.Err()
+		}
+	}
+	s.listener.Close()
+	return err
 }
 
 // NewServer creates an RPC service for annotating IP addresses. The RPC service
 // can be called by the returned objects from NewClient.
 //
+// The server annotations of local IPs are only served if the server is created
+// WithSiteAnnotator.
+//
 // The returned object should have its Serve() method called, likely in a
-// goroutine. To stop the server, call Close().
+// goroutine. To stop the server, call Close(), or call Shutdown() to let
+// in-flight requests finish first.
 //
 // The recommended sockfilename value to pass into this function is the value of
 // the command-line flag `--ipservice.SocketFilename`, which is pointed to by
-// `ipservice.SocketFilename`.
+// `ipservice.SocketFilename`. The transport is selected by the value of
+// `ipservice.Network`, and defaults to a unix-domain socket. The time spent on
+// each request is bounded by the value of `ipservice.RequestBudget`.
 //
 // If you would like to set up a server for use in unit tests outside this
 // package, the easiest way of doing that is to pass in `nil` for `asn` and
@@ -107,33 +406,38 @@ func (s *server) Close() error {
 // deserialization logic, but it will never fill in any data. If you need the
 // server to contain dummy data for your test to work, then please file a bug
 // in this repo asking the maintainer of this package to build a fake.
-func NewServer(sockfilename string, asn asnannotator.ASNAnnotator, geo geoannotator.GeoAnnotator) (Server, error) {
+func NewServer(sockfilename string, asn asnannotator.ASNAnnotator, geo geoannotator.GeoAnnotator, opts ...ServerOption) (Server, error) {
 	if sockfilename != *SocketFilename {
 		log.Printf("WARNING: socket filename of %q differs from command-line flag value of %q\n", sockfilename, *SocketFilename)
 	}
-	// Unconditionally attempt to remove the file before you make a new one with
-	// that name. It is possible for race conditions in container starting to
-	// mean that prior start attempts have left an old bad socket file in the
-	// way.
-	os.Remove(sockfilename)
-	listener, err := net.Listen("unix", sockfilename)
+	listener, err := listen(*Network, sockfilename)
 	if err != nil {
 		return nil, err
 	}
 
 	h := &handler{
-		asn: asn,
-		geo: geo,
+		asn:    asn,
+		geo:    geo,
+		budget: *RequestBudget,
+	}
+	for _, opt := range opts {
+		opt(h)
 	}
 
 	mux := http.NewServeMux()
 	mux.Handle("/v1/annotate/ips", h)
+	mux.HandleFunc("/v1/annotate/pairs", h.servePairs)
+	mux.HandleFunc("/v1/annotate/groups", h.serveGroups)
+	mux.HandleFunc("/v1/annotate/server", h.serveServer)
 	srv := &http.Server{
 		Handler: mux,
 	}
+	gsrv := grpc.NewServer()
+	ipservicepb.RegisterAnnotatorServer(gsrv, &grpcServer{h: h})
 
 	return &server{
 		listener: listener,
 		srv:      srv,
+		grpc:     gsrv,
 	}, nil
 }
@@ -137,3 +137,31 @@ func ExampleServer_forTesting() {
 	// c := NewClient(*SocketFilename)
 	// and then you can call c.Annotate() and use the returned values.
 }
+
+func Test_parseHostIP(t *testing.T) {
+	tests := []struct {
+		name     string
+		s        string
+		wantHost string
+	}{
+		{name: "ipv4", s: "1.2.3.4", wantHost: "1.2.3.4"},
+		{name: "ipv4-port", s: "1.2.3.4:443", wantHost: "1.2.3.4"},
+		{name: "ipv6", s: "2001:db8::1", wantHost: "2001:db8::1"},
+		{name: "ipv6-brackets", s: "[2001:db8::1]", wantHost: "2001:db8::1"},
+		{name: "ipv6-brackets-port", s: "[2001:db8::1]:443", wantHost: "2001:db8::1"},
+		{name: "error-hostname-port", s: "localhost:443"},
+		{name: "error-not-an-ip", s: "this is not an ip"},
+		{name: "error-empty", s: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			host, ip := parseHostIP(tt.s)
+			if host != tt.wantHost {
+				t.Errorf("parseHostIP() host = %q, want %q", host, tt.wantHost)
+			}
+			if (ip == nil) != (tt.wantHost == "") {
+				t.Errorf("parseHostIP() ip = %v, want nil %v", ip, tt.wantHost == "")
+			}
+		})
+	}
+}
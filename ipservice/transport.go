@@ -0,0 +1,54 @@
+package ipservice
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+)
+
+var (
+	// ErrUnsupportedNetwork is returned when the requested transport is neither
+	// "unix" nor "tcp".
+	ErrUnsupportedNetwork = errors.New("unsupported network")
+
+	// ErrNotLoopback is returned when a "tcp" transport address is not on a
+	// loopback interface. The annotation service is a local service and should
+	// never be reachable from other machines.
+	ErrNotLoopback = errors.New("address is not a loopback address")
+)
+
+// checkAddress verifies that addr is usable with the given network.
+func checkAddress(network, addr string) error {
+	switch network {
+	case "unix":
+		return nil
+	case "tcp":
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			return err
+		}
+		ip := net.ParseIP(host)
+		if host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+			return fmt.Errorf("%w: %q", ErrNotLoopback, addr)
+		}
+		return nil
+	default:
+		return fmt.Errorf("%w: %q", ErrUnsupportedNetwork, network)
+	}
+}
+
+// listen creates a listener for the local annotation service.
+func listen(network, addr string) (net.Listener, error) {
+	if err := checkAddress(network, addr); err != nil {
+		return nil, err
+	}
+	if network == "unix" {
+		// Unconditionally attempt to remove the file before you make a new one
+		// with that name. It is possible for race conditions in container
+		// starting to mean that prior start attempts have left an old bad
+		// socket file in the way.
+		os.Remove(addr)
+	}
+	return net.Listen(network, addr)
+}
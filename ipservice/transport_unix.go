@@ -0,0 +1,6 @@
+//go:build !windows
+
+package ipservice
+
+// Unix-domain sockets are the default everywhere they are well supported.
+const defaultNetwork = "unix"
@@ -0,0 +1,7 @@
+//go:build windows
+
+package ipservice
+
+// Windows consumers reach the service over TCP on loopback, because unix-domain
+// sockets there do not behave the same way.
+const defaultNetwork = "tcp"
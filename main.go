@@ -1,14 +1,26 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"errors"
 	"flag"
+	"fmt"
 	"log"
 	"net"
+	"net/http"
+	"net/url"
 	"os"
+	"os/signal"
+	"path"
+	"sort"
+	"strings"
 	"sync"
+	"syscall"
 	"time"
 
+	"cloud.google.com/go/storage"
+	"github.com/googleapis/google-cloud-go-testing/storage/stiface"
 	"github.com/m-lab/go/content"
 	"github.com/m-lab/go/flagx"
 	"github.com/m-lab/go/host"
@@ -19,21 +31,117 @@ import (
 	"github.com/m-lab/tcp-info/eventsocket"
 	"github.com/m-lab/uuid-annotator/annotator"
 	"github.com/m-lab/uuid-annotator/asnannotator"
+	"github.com/m-lab/uuid-annotator/dirprovider"
 	"github.com/m-lab/uuid-annotator/geoannotator"
 	"github.com/m-lab/uuid-annotator/handler"
+	"github.com/m-lab/uuid-annotator/httpprovider"
 	"github.com/m-lab/uuid-annotator/ipservice"
+	"github.com/m-lab/uuid-annotator/metrics"
+	"github.com/m-lab/uuid-annotator/retryprovider"
 	"github.com/m-lab/uuid-annotator/siteannotator"
 )
 
 var (
-	datadir         = flag.String("datadir", ".", "The directory to put the data in")
+	datadir         = flag.String("datadir", ".", "The directory to put the data in, or a gs://bucket/prefix URL to write it to GCS")
+	datatype        = flag.String("datatype", "", "If set, put the data in a subdirectory of -datadir with this name, e.g. annotation2, for nodes with several datatypes")
 	hostname        = flagx.StringFile{}
 	maxmindurl      = flagx.URL{}
 	routeviewv4     = flagx.URL{}
 	routeviewv6     = flagx.URL{}
 	asnameurl       = flagx.URL{}
+	asnameExtra     = flagx.StringArray{}
 	siteinfo        = flagx.URL{}
+	siteinfoExtra   = flagx.StringArray{}
+	rirurl          = flagx.URL{}
+	asrankurl       = flagx.URL{}
+	as2orgurl       = flagx.URL{}
+	maxmindASNurl   = flagx.URL{}
+	ipinfoPrefixes  = flagx.URL{}
 	eventbuffersize = flag.Int("eventbuffersize", 1000, "How many events should we buffer before dropping them?")
+	drainTimeout    = flag.Duration("eventbuffer.drain-timeout", 5*time.Second, "How long to keep annotating the buffered events during shutdown, or 0 to drop them")
+	blockTimeout    = flag.Duration("eventbuffer.block-timeout", 0, "How long to wait for room in a full event buffer before dropping the event, or 0 to drop it immediately")
+	sitePrivateIPs  = flag.String("siteinfo.private-server-ips", "10.0.0.0/8,172.16.0.0/12,192.168.0.0/16,fc00::/7", "Comma-separated CIDRs of the private server IPs, e.g. the internal IPs of cloud machines, to annotate with siteinfo although they are outside the site's blocks. Other private IPs outside those blocks are not annotated. Empty allows none")
+	localCIDRs      = flag.String("annotation.local-nets", "", "Comma-separated CIDRs of local netblocks, e.g. behind a load balancer or NAT. Connections with neither IP a local IP have their server end in one of these blocks")
+	bothSiteCIDRs   = flag.Bool("annotation.both-site-cidrs", false, "Add both the IPv4 and IPv6 blocks of the site from siteinfo to the server Network as V4CIDR and V6CIDR, whatever the family of the connection")
+	announcedCIDR   = flag.Bool("annotation.announced-server-cidr", false, "Add the RouteViews prefix containing the server IP to the server Network as AnnouncedCIDR, alongside the siteinfo CIDR")
+	serverLocalIP   = flag.Bool("annotation.server-local-ip", false, "Record the local IP that matched the server end of each connection as Server.LocalIP, to debug direction issues")
+	sameCountry     = flag.Bool("annotation.same-country", false, "Record whether the client and server geolocations have the same country code as SameCountry")
+	failClosed      = flag.Bool("annotation.fail-closed", false, "Fail the geo and ASN annotations of a connection, counted as lookup_failed, when their data can not be searched, instead of annotating it as Missing")
+	auditDirection  = flag.Bool("audit.direction", false, "Log and count flows whose ASNs suggest the client and server were swapped, to catch misconfigured local IPs")
+	errorDetails    = flag.Bool("annotation.error-details", false, "Record the error of every annotator that fails for a connection in the Debug field of its annotations")
+	fieldAllowlist  = flagx.StringArray{}
+	clientIPKeyFile = flag.String("annotation.client-ip-hash-key", "", "A file containing a secret key. When set, every annotation includes a Client.IPHash, the HMAC of the client IP with the key, so rows can be joined by client without storing IPs. Surrounding whitespace is ignored")
+	omitMissing     = flag.Bool("annotation.omit-missing", false, "Omit Geo and Network annotations that could not be found, instead of writing them with Missing=true")
+	sampleOneIn     = flag.Int("annotation.sample-one-in", 1, "Annotate only one in this many UUIDs, chosen by UUID hash, to reduce load on the busiest nodes")
+	payloadHashes   = flag.Int("annotation.hash-recent", 0, "If positive, record a hash of each annotation payload, and count duplicates among this many recent payloads")
+	maxWriteFails   = flag.Int("datadir.max-write-failures", 0, "If positive, respond to /ready on the -prometheusx.listen-address with 503 once this many consecutive annotation files could not be written, until one is written again")
+	uuidIndexSize   = flag.Int("debug.uuid-index", 0, "If positive, remember the files written for this many recent UUIDs, and serve their annotations at /annotation?uuid=<uuid> on the -prometheusx.listen-address. Not for -output.aggregate or gs:// datadirs")
+	recentSize      = flag.Int("debug.recent", 0, "If positive, serve the annotations of this many recent UUIDs as JSON at /recent on the -prometheusx.listen-address")
+	aggregate       = flag.Duration("output.aggregate", 0, "If positive, append the annotations to one newline-delimited JSON file per this interval, e.g. 1h, instead of writing a file per UUID")
+	streamPath      = flag.String("output.stream", "", "If set, also write every annotation as a line of JSON to this file or named pipe, or to stdout if it is -")
+	streamOnly      = flag.Bool("output.stream-only", false, "Write annotations only to -output.stream, and no files to -datadir")
+	walPath         = flag.String("wal.path", "", "If set, log every UUID to this write-ahead log until it is annotated, and annotate the UUIDs left in it by a crash at startup")
+
+	// Individual annotators may be disabled for debugging or for
+	// reduced-footprint deployments. A disabled annotator does not load its
+	// backing data and its fields are absent from all output.
+	enableGeo  = flag.Bool("enable.geo", true, "Annotate with geolocation data from MaxMind")
+	enableASN  = flag.Bool("enable.asn", true, "Annotate with ASN data from RouteViews and IPinfo.io")
+	enableSite = flag.Bool("enable.site", true, "Annotate with server metadata from siteinfo")
+
+	// The two ways of serving annotations may also be disabled, e.g. for nodes
+	// that only serve the ipservice and should never write any files.
+	enableFiles     = flag.Bool("enable.files", true, "Write a JSON file of annotations for every UUID from the -tcpinfo.eventsocket")
+	enableIPService = flag.Bool("enable.ipservice", true, "Serve IP annotations on the -ipservice.sock")
+
+	// Some deployments only have the CSV distribution of the MaxMind data, and
+	// the most constrained only have room for continents.
+	maxmindFormat = flagx.Enum{
+		Options: []string{"mmdb", "csv", "continent"},
+		Value:   "mmdb",
+	}
+	mmdbName = flag.String("maxmind.mmdb-name", "", "The name of the mmdb file in the -maxmind.url archive. By default, GeoLite2-City.mmdb or GeoIP2-City.mmdb. Only for -maxmind.format=mmdb")
+
+	// Place names may be localized for research on non-English datasets.
+	geoLanguage = flag.String("maxmind.language", "en", "The language of the MaxMind country, city and subdivision names, e.g. de or zh-CN, with a fallback to English for names without a translation. Only for -maxmind.format=mmdb")
+
+	// Consumers of only one side of each connection may skip the other.
+	annotationSide = flagx.Enum{
+		Options: []string{"both", "client", "server"},
+		Value:   "both",
+	}
+
+	// Memory-constrained nodes may store the RouteViews data compactly, and
+	// busy nodes may cache the Networks of repeated IPs.
+	routeviewCompact = flag.Bool("routeview.compact", false, "Store RouteViews data in a compact in-memory index that uses much less RAM")
+	routeviewCache   = flag.Int("routeview.cache-size", 0, "If positive, remember the Networks of this many recently annotated IPs, to skip searching the RouteViews data for IPs that are seen repeatedly")
+	routeviewDates   = flag.Bool("routeview.dates", false, "Record the date in the name of the RouteViews file that each Network was found in as its RouteViewDate")
+	prefixLengths    = flag.Bool("metrics.prefix-lengths", false, "Export a histogram of the lengths of the RouteViews prefixes matched by ASN annotations")
+	transitionAddrs  = flag.Bool("annotation.transition-addresses", false, "Annotate the ASN of Teredo and 6to4 IPv6 addresses using their embedded IPv4 address")
+	asnameUnnamed    = flag.String("asname.unnamed", "", "If set, the ASName of Networks whose ASN has no name, e.g. AS0, so that they are distinguishable from Missing Networks, which have no ASName. Not for -ipinfo.prefixes-url")
+	asnameDNS        = flag.Duration("asname.dns-timeout", 0, "When positive, look up AS names missing from -asname.url in the asn.cymru.com DNS zone, waiting at most this long for each AS")
+
+	// Off by default, because it adds a column to every row.
+	dataVersions = flag.Bool("annotation.dataversions", false, "Record the MaxMind and RouteViews snapshot versions used in every annotation")
+	approxOffset = flag.Bool("annotation.approx-utc-offset", false, "Add an ApproxUTCOffset computed from the longitude to locations without a MaxMind time zone. Only for -maxmind.format=mmdb")
+
+	// Mirrors and MaxMind both want requests to identify themselves, and some
+	// need an API token header.
+	httpUserAgent = flag.String("http.useragent", "uuid-annotator", "The User-Agent sent when downloading http:// and https:// URLs")
+	httpHeaders   = flagx.KeyValue{}
+
+	// Disconnected and air-gapped test deployments should never try to reach
+	// the network for their data.
+	offline = flag.Bool("offline", false, "Only allow file: URLs for data sources, and fail at startup if any of the files are missing")
+
+	// Data sources may be briefly unavailable when a node boots, so the initial
+	// load of each dataset is retried before giving up.
+	loadAttempts = flag.Int("load.attempts", 5, "How many times to try the initial load of each dataset before giving up")
+	loadBackoff  = flag.Duration("load.backoff", time.Second, "How long to wait after the first failed initial load, doubled after each further failure")
+
+	// Fast links can load the datasets concurrently, but constrained links
+	// should not be saturated by them.
+	loadConcurrency = flag.Int("load.concurrency", 1, "How many datasets to load concurrently at startup. Values less than 1 mean no limit")
 
 	// Reloading relatively frequently should be fine as long as (a) download
 	// failure is non-fatal for reloads and (b) cache-checking actually works so
@@ -42,6 +150,13 @@ var (
 	reloadMin  = flag.Duration("reloadmin", time.Hour, "Minimum time to wait between reloads of backing data")
 	reloadTime = flag.Duration("reloadtime", 5*time.Hour, "Expected time to wait between reloads of backing data")
 	reloadMax  = flag.Duration("reloadmax", 24*time.Hour, "Maximum time to wait between reloads of backing data")
+	reloadGap  = flag.Duration("reload.min-interval", time.Minute, "Skip any reload of an annotator's backing data sooner than this after its previous reload")
+
+	// The AS names change less often than RouteViews, so they may be checked
+	// less often.
+	asnameReloadTime = flag.Duration("asname.reloadtime", 0, "If positive, the expected time to wait between reloads of the AS names files, which are then no longer reloaded along with the RouteViews data. At least -reloadmin")
+
+	ipserviceShutdownTimeout = flag.Duration("ipservice.shutdown-timeout", 5*time.Second, "How long to wait for in-flight ipservice requests to finish during shutdown")
 
 	// Context, cancellation, and a channel all in support of testing.
 	mainCtx, mainCancel = context.WithCancel(context.Background())
@@ -50,14 +165,207 @@ var (
 
 func init() {
 	flag.Var(&hostname, "hostname", "Server hostname to lookup annotations, may be read from file with @<file>")
+	flag.Var(&annotationSide, "annotation.side", "The side of each connection to annotate in the files: both, client (geo and asn), or server (site). The other side is written empty")
+	flag.Var(&maxmindFormat, "maxmind.format", "The format of the -maxmind.url data: mmdb for a .tar.gz of GeoLite2-City.mmdb or GeoIP2-City.mmdb, csv for the zip of the City CSV distribution, or continent for a CSV of network and continent_code columns")
 	flag.Var(&maxmindurl, "maxmind.url", "The URL for the file containing MaxMind IP metadata.  Accepted URL schemes currently are: gs://bucket/file and file:./relativepath/file")
 	flag.Var(&routeviewv4, "routeview-v4.url", "The URL for the RouteViewIPv4 file containing ASN metadata. gs:// and file:// schemes accepted.")
 	flag.Var(&routeviewv6, "routeview-v6.url", "The URL for the RouteViewIPv6 file containing ASN metadata. gs:// and file:// schemes accepted.")
 	flag.Var(&asnameurl, "asname.url", "The URL for the ASName CSV file containing a mapping of AS numbers to AS names provided by IPInfo.io")
+	flag.Var(&asnameExtra, "asname.extra-url", "Additional AS names URLs, in the format of -asname.url. When set, every Network includes ASNameAll, the distinct names of its ASN from all sources, in order. May be repeated.")
+	flag.Var(&fieldAllowlist, "annotation.fields", "Only write these fields of the annotations, named by their path like Client.Network.ASNumber. May be comma-separated or repeated. Default is all fields.")
+	flag.Var(&siteinfoExtra, "siteinfo.extra-url", "Additional siteinfo JSON URLs, merged with -siteinfo.url. On hostname collisions, later URLs take precedence. May be repeated.")
+	flag.Var(&ipinfoPrefixes, "ipinfo.prefixes-url", "Optional URL for an IPInfo.io CSV file, like the lite or country_asn files, mapping networks to ASN, AS name, and country. When set, it is used instead of the RouteViews and AS names URLs.")
+	flag.Var(&asrankurl, "asrank.url", "Optional URL for a CAIDA AS Rank ppdc-ases customer cone file, used to annotate the cone size of each ASN.")
+	flag.Var(&as2orgurl, "as2org.url", "Optional URL for a CAIDA AS-to-Organization file, used to annotate the organization of each ASN.")
+	flag.Var(&maxmindASNurl, "maxmind.asn-url", "Optional URL for a MaxMind GeoLite2-ASN .mmdb file or .tar.gz, used to annotate the ASN of IPs that are not in the RouteViews data.")
+	flag.Var(&rirurl, "rir.url", "Optional URL for an RIR delegated-extended stats file, used to annotate the country each prefix was allocated to.")
 	flag.Var(&siteinfo, "siteinfo.url", "The URL for the Siteinfo JSON file containing server location and ASN metadata. gs:// and file:// schemes accepted.")
+	flag.Var(&httpHeaders, "http.header", "Extra request headers sent when downloading http:// and https:// URLs, as key=value pairs. Values may be read from a file with key=@<file>")
 	log.SetFlags(log.LstdFlags | log.LUTC | log.Llongfile)
 }
 
+// errNotLocal is returned for URLs that are not local files in offline mode.
+var errNotLocal = errors.New("only file: URLs are allowed with -offline")
+
+// checkLocal returns an error if the URL does not name an existing local file.
+func checkLocal(u *url.URL) error {
+	if u.Scheme != "file" {
+		return fmt.Errorf("%w: %s", errNotLocal, u.Redacted())
+	}
+	_, err := os.Stat(localPath(u))
+	return err
+}
+
+// localPath returns the path named by a file: URL.
+func localPath(u *url.URL) string {
+	// Relative paths like file:./data/file are opaque.
+	if u.Opaque != "" {
+		return u.Opaque
+	}
+	return u.Path
+}
+
+// providerFromURL returns a content.Provider for the given URL. HTTP(S) URLs
+// use the configured User-Agent and request headers. The initial load from
+// every provider is retried as configured. With -offline, only URLs naming
+// existing local files are allowed.
+func providerFromURL(ctx context.Context, u *url.URL) (content.Provider, error) {
+	if *offline {
+		if err := checkLocal(u); err != nil {
+			return nil, err
+		}
+	}
+	// A pattern, as in file:./data/?pattern=RouteViewIPv4.*.gz, selects the
+	// newest matching file of a directory.
+	if pattern := u.Query().Get("pattern"); u.Scheme == "file" && pattern != "" {
+		p, err := dirprovider.New(localPath(u), pattern)
+		if err != nil {
+			return nil, err
+		}
+		return retryprovider.New(p, *loadAttempts, *loadBackoff), nil
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		p, err := content.FromURL(ctx, u)
+		if err != nil {
+			return nil, err
+		}
+		return retryprovider.New(namedProvider{p, path.Base(localPath(u))}, *loadAttempts, *loadBackoff), nil
+	}
+	opts := []httpprovider.Option{}
+	if *httpUserAgent != "" {
+		opts = append(opts, httpprovider.WithUserAgent(*httpUserAgent))
+	}
+	for k, v := range httpHeaders.Get() {
+		opts = append(opts, httpprovider.WithHeader(k, v))
+	}
+	return retryprovider.New(namedProvider{httpprovider.New(u, opts...), path.Base(u.Path)}, *loadAttempts, *loadBackoff), nil
+}
+
+// namedProvider is a provider of the file at a URL, whose Name is the name of
+// that file, like the providers of dirprovider, for annotators that take the
+// date of their data from its name.
+type namedProvider struct {
+	content.Provider
+	name string
+}
+
+func (n namedProvider) Name() string {
+	return n.name
+}
+
+// checkLocalIPs records the number of local IPs, and warns if there are none.
+// Without local IPs, the direction of every connection is unknown, so nothing
+// is annotated even though the process looks healthy.
+func checkLocalIPs(localIPs []net.IP) bool {
+	n := 0
+	for _, ip := range localIPs {
+		if ip != nil {
+			n++
+		}
+	}
+	metrics.LocalIPs.Set(float64(n))
+	if n == 0 {
+		log.Println("WARNING: No local IPs found, so no connection can be annotated. Check the network interfaces, or the siteinfo of virtual sites.")
+		return false
+	}
+	return true
+}
+
+// equalIPs returns true when both lists contain the same IPs in the same order.
+func equalIPs(a, b []net.IP) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if !a[i].Equal(b[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// updateLocalIPs gives the new local IPs to the handler and every annotator
+// that can use them.
+func updateLocalIPs(localIPs []net.IP, h handler.ThreadedHandler, annotators []annotator.Annotator) {
+	if u, ok := h.(annotator.LocalIPUpdater); ok {
+		u.UpdateLocalIPs(localIPs)
+	}
+	for _, a := range annotators {
+		if u, ok := a.(annotator.LocalIPUpdater); ok {
+			u.UpdateLocalIPs(localIPs)
+		}
+	}
+}
+
+// updateLocalNets gives the local netblocks to the handler and every annotator
+// that can use them.
+func updateLocalNets(localNets []net.IPNet, h handler.ThreadedHandler, annotators []annotator.Annotator) {
+	if u, ok := h.(annotator.LocalNetUpdater); ok {
+		u.UpdateLocalNets(localNets)
+	}
+	for _, a := range annotators {
+		if u, ok := a.(annotator.LocalNetUpdater); ok {
+			u.UpdateLocalNets(localNets)
+		}
+	}
+}
+
+// limitReloads sets the minimum reload interval of every annotator that
+// supports one.
+func limitReloads(d time.Duration, annotators ...annotator.Annotator) {
+	for _, a := range annotators {
+		if l, ok := a.(annotator.ReloadLimiter); ok {
+			l.SetMinReloadInterval(d)
+		}
+	}
+}
+
+// forceReloads makes the next reload of every annotator that supports it run
+// regardless of its minimum reload interval.
+func forceReloads(annotators ...annotator.Annotator) {
+	for _, a := range annotators {
+		if f, ok := a.(annotator.ReloadForcer); ok {
+			f.ForceReload()
+		}
+	}
+}
+
+// readKey returns the secret key in the named file, without surrounding
+// whitespace. The file is read here, rather than by a flag.Value, so that the
+// key is never logged with the flags.
+func readKey(path string) ([]byte, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	key := bytes.TrimSpace(b)
+	if len(key) == 0 {
+		return nil, fmt.Errorf("no key in %q", path)
+	}
+	return key, nil
+}
+
+// runLoads calls every load, running at most limit of them at once, and
+// returns when they are all done. A limit less than 1 means no limit. Loads
+// are expected to exit the program on failure.
+func runLoads(limit int, loads []func()) {
+	if limit < 1 {
+		limit = len(loads)
+	}
+	sem := make(chan struct{}, limit)
+	wg := sync.WaitGroup{}
+	for _, load := range loads {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(load func()) {
+			defer wg.Done()
+			load()
+			<-sem
+		}(load)
+	}
+	wg.Wait()
+}
+
 func findLocalIPs(localAddrs []net.Addr) []net.IP {
 	localIPs := []net.IP{}
 	for _, addr := range localAddrs {
@@ -70,13 +378,44 @@ func findLocalIPs(localAddrs []net.Addr) []net.IP {
 	return localIPs
 }
 
+// buildAnnotators returns the enabled built-in annotators, where disabled
+// annotators are nil, followed by an annotator from each custom constructor in
+// order of name.
+func buildAnnotators(ctx context.Context, localIPs []net.IP, builtin []annotator.Annotator, custom map[string]annotator.Constructor) ([]annotator.Annotator, error) {
+	annotators := []annotator.Annotator{}
+	for _, a := range builtin {
+		if a != nil {
+			annotators = append(annotators, a)
+		}
+	}
+	names := make([]string, 0, len(custom))
+	for name := range custom {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		a, err := custom[name](ctx, localIPs)
+		if err != nil {
+			return nil, fmt.Errorf("could not create annotator %q: %w", name, err)
+		}
+		log.Println("Using custom annotator", name)
+		annotators = append(annotators, a)
+	}
+	return annotators, nil
+}
+
 func main() {
 	flag.Parse()
 	rtx.Must(flagx.ArgsFromEnv(flag.CommandLine), "Could not get args from environment variables")
 
 	// Create the datatype directory immediately, since pusher will crash
-	// without it.
-	rtx.Must(os.MkdirAll(*datadir, 0755), "Could not create datatype dir %s", datadir)
+	// without it. Without files, there is nothing for pusher to upload, and
+	// files written directly to GCS need no pusher.
+	rtx.Must(handler.CheckDatadir(*datadir), "Bad -datadir")
+	gcsDatadir := handler.IsGCS(*datadir)
+	if *enableFiles && !gcsDatadir {
+		rtx.Must(os.MkdirAll(*datadir, 0755), "Could not create datatype dir %s", datadir)
+	}
 
 	// Parse the node's name into its constituent parts. This ensures that the
 	// value of the -hostname flag is actually valid. Additionally, virtual
@@ -92,6 +431,11 @@ func main() {
 	mlabHostname := h.StringWithService()
 
 	defer mainCancel()
+	// SIGTERM, e.g. from the kubelet, and interrupts cancel the context too, so
+	// that the buffered events are drained and the WAL is flushed before main
+	// returns.
+	mainCtx, stop := signal.NotifyContext(mainCtx, syscall.SIGTERM, os.Interrupt)
+	defer stop()
 	// A waitgroup that waits for every component goroutine to complete before main exits.
 	wg := sync.WaitGroup{}
 
@@ -110,48 +454,302 @@ func main() {
 	localIPs := findLocalIPs(localAddrs)
 
 	// Load the siteinfo annotations for "site" specific metadata. Additionally,
-	// if this is a virtual site, New() will append the public IP of the
-	// managed instance group's load balancer to localIPs. If uuid-annotator
-	// does not know about the public IP of the load balancer, then it will fail
-	// to annotate anything because it doesn't recognize its own public address
-	// in either the Src or Dest of incoming tcp-info events.
-	js, err := content.FromURL(mainCtx, siteinfo.URL)
-	rtx.Must(err, "Could not load siteinfo URL")
-	site, localIPs := siteannotator.New(mainCtx, mlabHostname, js, localIPs)
-
-	p, err := content.FromURL(mainCtx, maxmindurl.URL)
-	rtx.Must(err, "Could not get maxmind data from url")
-	geo := geoannotator.New(mainCtx, p, localIPs)
-
-	p4, err := content.FromURL(mainCtx, routeviewv4.URL)
-	rtx.Must(err, "Could not load routeview v4 URL")
-	p6, err := content.FromURL(mainCtx, routeviewv6.URL)
-	rtx.Must(err, "Could not load routeview v6 URL")
-	asnames, err := content.FromURL(mainCtx, asnameurl.URL)
-	rtx.Must(err, "Could not load AS names URL")
-	asn := asnannotator.New(mainCtx, p4, p6, asnames, localIPs)
+	// if this is a virtual site, New() will return the public IP of the
+	// managed instance group's load balancer in addition to localIPs. If
+	// uuid-annotator does not know about the public IP of the load balancer,
+	// then it will fail to annotate anything because it doesn't recognize its
+	// own public address in either the Src or Dest of incoming tcp-info events.
+	//
+	// The datasets are loaded concurrently, so the other annotators are given
+	// the new local IPs once every load is done.
+	loads := []func(){}
+	var site siteannotator.SiteAnnotator
+	var siteIPs []net.IP
+	if *enableSite {
+		loads = append(loads, func() {
+			js, err := providerFromURL(mainCtx, siteinfo.URL)
+			rtx.Must(err, "Could not load siteinfo URL")
+			sources := []content.Provider{js}
+			for _, extra := range siteinfoExtra {
+				u, err := url.Parse(extra)
+				rtx.Must(err, "Could not parse siteinfo URL %q", extra)
+				js, err := providerFromURL(mainCtx, u)
+				rtx.Must(err, "Could not load siteinfo URL %q", extra)
+				sources = append(sources, js)
+			}
+			var siteOpts []siteannotator.Option
+			var allowed []*net.IPNet
+			if *sitePrivateIPs != "" {
+				for _, s := range strings.Split(*sitePrivateIPs, ",") {
+					_, n, err := net.ParseCIDR(strings.TrimSpace(s))
+					rtx.Must(err, "Bad -siteinfo.private-server-ips")
+					allowed = append(allowed, n)
+				}
+			}
+			siteOpts = append(siteOpts, siteannotator.WithPrivateServerIPs(allowed...))
+			if *bothSiteCIDRs {
+				siteOpts = append(siteOpts, siteannotator.WithBothCIDRs())
+			}
+			site, siteIPs = siteannotator.NewMulti(mainCtx, mlabHostname, sources, localIPs, siteOpts...)
+		})
+	}
 
-	// Reload the IP annotation config on a randomized schedule.
-	wg.Add(1)
-	go func() {
-		reloadConfig := memoryless.Config{
-			Min:      *reloadMin,
-			Max:      *reloadMax,
-			Expected: *reloadTime,
-		}
-		tick, err := memoryless.NewTicker(mainCtx, reloadConfig)
-		rtx.Must(err, "Could not create ticker for reloading")
-		for range tick.C {
-			geo.Reload(mainCtx)
-			asn.Reload(mainCtx)
+	var geo geoannotator.GeoAnnotator
+	if *enableGeo {
+		loads = append(loads, func() {
+			p, err := providerFromURL(mainCtx, maxmindurl.URL)
+			rtx.Must(err, "Could not get maxmind data from url")
+			switch maxmindFormat.Value {
+			case "csv":
+				geo = geoannotator.NewCSV(mainCtx, p, localIPs)
+			case "continent":
+				geo = geoannotator.NewContinent(mainCtx, p, localIPs)
+			default:
+				opts := []geoannotator.Option{}
+				if *dataVersions {
+					opts = append(opts, geoannotator.WithDataVersions())
+				}
+				if *approxOffset {
+					opts = append(opts, geoannotator.WithApproxUTCOffset())
+				}
+				if *failClosed {
+					opts = append(opts, geoannotator.WithFailClosed())
+				}
+				if *mmdbName != "" {
+					opts = append(opts, geoannotator.WithMMDBName(*mmdbName))
+				}
+				if *geoLanguage != "en" {
+					opts = append(opts, geoannotator.WithLanguage(*geoLanguage))
+				}
+				geo = geoannotator.New(mainCtx, p, localIPs, opts...)
+			}
+		})
+	}
+
+	var asn asnannotator.ASNAnnotator
+	if *enableASN && ipinfoPrefixes.URL != nil {
+		loads = append(loads, func() {
+			p, err := providerFromURL(mainCtx, ipinfoPrefixes.URL)
+			rtx.Must(err, "Could not load IPInfo.io prefixes URL")
+			asn = asnannotator.NewIPInfo(mainCtx, p, localIPs)
+		})
+	} else if *enableASN {
+		loads = append(loads, func() {
+			p4, err := providerFromURL(mainCtx, routeviewv4.URL)
+			rtx.Must(err, "Could not load routeview v4 URL")
+			p6, err := providerFromURL(mainCtx, routeviewv6.URL)
+			rtx.Must(err, "Could not load routeview v6 URL")
+			// AS names are optional. Without them, AS numbers are still annotated.
+			var asnames content.Provider
+			if asnameurl.URL != nil {
+				asnames, err = providerFromURL(mainCtx, asnameurl.URL)
+				if err != nil {
+					log.Println("WARNING: Could not load AS names URL, AS names will be blank:", err)
+					asnames = nil
+				}
+			}
+			opts := []asnannotator.Option{}
+			if *routeviewCompact {
+				opts = append(opts, asnannotator.WithCompactRouteViews())
+			}
+			if *dataVersions {
+				opts = append(opts, asnannotator.WithDataVersions())
+			}
+			if *transitionAddrs {
+				opts = append(opts, asnannotator.WithTransitionAddresses())
+			}
+			if *prefixLengths {
+				opts = append(opts, asnannotator.WithPrefixLengthMetrics())
+			}
+			if *failClosed {
+				opts = append(opts, asnannotator.WithFailClosed())
+			}
+			if *routeviewCache > 0 {
+				opts = append(opts, asnannotator.WithCache(*routeviewCache))
+			}
+			if *routeviewDates {
+				opts = append(opts, asnannotator.WithRouteViewDates())
+			}
+			if *asnameDNS > 0 {
+				if *offline {
+					log.Println("WARNING: -offline is set, ignoring -asname.dns-timeout")
+				} else {
+					opts = append(opts, asnannotator.WithNameResolver(asnannotator.NewCymruResolver(), *asnameDNS))
+				}
+			}
+			if *asnameUnnamed != "" {
+				opts = append(opts, asnannotator.WithUnnamedPlaceholder(*asnameUnnamed))
+			}
+			if len(asnameExtra) > 0 {
+				extra := []content.Provider{}
+				for _, e := range asnameExtra {
+					u, err := url.Parse(e)
+					rtx.Must(err, "Could not parse AS names URL %q", e)
+					p, err := providerFromURL(mainCtx, u)
+					rtx.Must(err, "Could not load AS names URL %q", e)
+					extra = append(extra, p)
+				}
+				opts = append(opts, asnannotator.WithAllASNames(extra...))
+			}
+			if rirurl.URL != nil {
+				rirdata, err := providerFromURL(mainCtx, rirurl.URL)
+				rtx.Must(err, "Could not load RIR delegations URL")
+				opts = append(opts, asnannotator.WithRIRDelegations(rirdata))
+			}
+			if asrankurl.URL != nil {
+				conedata, err := providerFromURL(mainCtx, asrankurl.URL)
+				rtx.Must(err, "Could not load customer cone URL")
+				opts = append(opts, asnannotator.WithConeSizes(conedata))
+			}
+			if as2orgurl.URL != nil {
+				orgdata, err := providerFromURL(mainCtx, as2orgurl.URL)
+				rtx.Must(err, "Could not load AS organization URL")
+				opts = append(opts, asnannotator.WithOrganizations(orgdata))
+			}
+			if maxmindASNurl.URL != nil {
+				mmasndata, err := providerFromURL(mainCtx, maxmindASNurl.URL)
+				rtx.Must(err, "Could not load MaxMind ASN URL")
+				opts = append(opts, asnannotator.WithMaxMindASN(mmasndata))
+			}
+			asn = asnannotator.New(mainCtx, p4, p6, asnames, localIPs, opts...)
+		})
+	}
+	runLoads(*loadConcurrency, loads)
+	if site != nil && !equalIPs(localIPs, siteIPs) {
+		localIPs = siteIPs
+		updateLocalIPs(localIPs, nil, []annotator.Annotator{geo, asn})
+	}
+	checkLocalIPs(localIPs)
+	limitReloads(*reloadGap, geo, asn, site)
+
+	// The geo and asn annotators only annotate the client, and the site
+	// annotator only annotates the server.
+	builtin := []annotator.Annotator{geo, asn, site}
+	side := handler.BothSides
+	switch annotationSide.Value {
+	case "client":
+		builtin = []annotator.Annotator{geo, asn}
+		side = handler.ClientSide
+	case "server":
+		builtin = []annotator.Annotator{site}
+		side = handler.ServerSide
+	}
+	annotators, err := buildAnnotators(mainCtx, localIPs, builtin, annotator.Registered())
+	rtx.Must(err, "Could not create custom annotators")
+	var nets []net.IPNet
+	if *localCIDRs != "" {
+		for _, s := range strings.Split(*localCIDRs, ",") {
+			_, n, err := net.ParseCIDR(strings.TrimSpace(s))
+			rtx.Must(err, "Bad -annotation.local-nets")
+			nets = append(nets, *n)
 		}
-		wg.Done()
-	}()
+		updateLocalNets(nets, nil, annotators)
+	}
 
-	if *eventsocket.Filename != "" {
+	var uuidHandler handler.ThreadedHandler
+	if *enableFiles && *eventsocket.Filename != "" {
 
 		// Generate .json files for every UUID discovered.
-		h := handler.New(*datadir, *eventbuffersize, []annotator.Annotator{geo, asn, site})
+		handlerOpts := []handler.Option{handler.WithLocalIPs(localIPs), handler.WithSide(side), handler.WithDrainTimeout(*drainTimeout), handler.WithBlockingOpen(*blockTimeout)}
+		if *datatype != "" {
+			rtx.Must(handler.CheckDatatype(*datatype), "Bad -datatype")
+			handlerOpts = append(handlerOpts, handler.WithDatatype(*datatype))
+		}
+		if *auditDirection && asn != nil {
+			handlerOpts = append(handlerOpts, handler.WithDirectionAudit(asn))
+		}
+		if *announcedCIDR && asn != nil {
+			handlerOpts = append(handlerOpts, handler.WithAnnouncedServerCIDR(asn))
+		}
+		if *serverLocalIP {
+			handlerOpts = append(handlerOpts, handler.WithServerLocalIP())
+		}
+		if *sameCountry {
+			handlerOpts = append(handlerOpts, handler.WithSameCountry())
+		}
+		if *sampleOneIn > 1 {
+			handlerOpts = append(handlerOpts, handler.WithSampling(*sampleOneIn))
+		}
+		if *omitMissing {
+			handlerOpts = append(handlerOpts, handler.WithOmitMissing())
+		}
+		if len(fieldAllowlist) > 0 {
+			p, err := annotator.NewProjection(fieldAllowlist)
+			rtx.Must(err, "Bad -annotation.fields")
+			handlerOpts = append(handlerOpts, handler.WithFieldAllowlist(p))
+		}
+		if *clientIPKeyFile != "" {
+			key, err := readKey(*clientIPKeyFile)
+			rtx.Must(err, "Bad -annotation.client-ip-hash-key")
+			handlerOpts = append(handlerOpts, handler.WithClientIPHash(key))
+		}
+		if *errorDetails {
+			handlerOpts = append(handlerOpts, handler.WithErrorDetails())
+		}
+		if *payloadHashes > 0 {
+			handlerOpts = append(handlerOpts, handler.WithPayloadHash(*payloadHashes))
+		}
+		if *walPath != "" {
+			wal, err := handler.OpenWAL(*walPath)
+			rtx.Must(err, "Could not open the write-ahead log %s", *walPath)
+			defer wal.Close()
+			handlerOpts = append(handlerOpts, handler.WithWAL(wal))
+		}
+		switch *streamPath {
+		case "":
+		case "-":
+			handlerOpts = append(handlerOpts, handler.WithStream(os.Stdout))
+		default:
+			// Opening a named pipe blocks until its reader opens it.
+			stream, err := os.OpenFile(*streamPath, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+			rtx.Must(err, "Could not open the annotation stream %s", *streamPath)
+			defer stream.Close()
+			handlerOpts = append(handlerOpts, handler.WithStream(stream))
+		}
+		if *aggregate > 0 {
+			if gcsDatadir {
+				log.Fatal("-output.aggregate requires a local -datadir")
+			}
+			handlerOpts = append(handlerOpts, handler.WithAggregation(*aggregate))
+		}
+		if gcsDatadir {
+			// The client outlives mainCtx, so that the buffered events can
+			// still be written while they are drained.
+			client, err := storage.NewClient(context.Background())
+			rtx.Must(err, "Could not create the GCS client for %s", *datadir)
+			defer client.Close()
+			handlerOpts = append(handlerOpts, handler.WithGCSClient(stiface.AdaptClient(client)))
+		}
+		if *streamOnly {
+			if *streamPath == "" {
+				log.Fatal("-output.stream-only requires -output.stream")
+			}
+			handlerOpts = append(handlerOpts, handler.WithoutFiles())
+		}
+		if *recentSize > 0 {
+			handlerOpts = append(handlerOpts, handler.WithRecent(*recentSize))
+		}
+		if *uuidIndexSize > 0 {
+			handlerOpts = append(handlerOpts, handler.WithUUIDIndex(*uuidIndexSize))
+		}
+		if *maxWriteFails > 0 {
+			handlerOpts = append(handlerOpts, handler.WithMaxWriteFailures(*maxWriteFails))
+		}
+		h := handler.New(*datadir, *eventbuffersize, annotators, handlerOpts...)
+		uuidHandler = h
+		if nets != nil {
+			updateLocalNets(nets, h, nil)
+		}
+		if *recentSize > 0 {
+			// The metrics server always uses a ServeMux.
+			srv.Handler.(*http.ServeMux).HandleFunc("/recent", h.(handler.RecentServer).ServeRecent)
+		}
+		if *maxWriteFails > 0 {
+			srv.Handler.(*http.ServeMux).HandleFunc("/ready", h.(handler.HealthReporter).ServeHealth)
+		}
+		if *uuidIndexSize > 0 {
+			srv.Handler.(*http.ServeMux).HandleFunc("/annotation", h.(handler.UUIDLookup).ServeLookup)
+		}
 		wg.Add(1)
 		go func() {
 			h.ProcessIncomingRequests(mainCtx)
@@ -166,10 +764,124 @@ func main() {
 		}()
 	}
 
+	// Reload the AS names on their own randomized schedule, if requested.
+	var names asnannotator.SplitReloader
+	if asn != nil && *asnameReloadTime > 0 {
+		var ok bool
+		if names, ok = asn.(asnannotator.SplitReloader); !ok {
+			log.Println("WARNING: the ASN annotator can not reload its AS names separately, ignoring -asname.reloadtime")
+		}
+	}
+
+	// Reloads on the schedules and on SIGHUP hold reloadMu, so that they never
+	// overlap. The AS names are reloaded with everything else unless they
+	// have their own schedule. A forced reload, on SIGHUP, always reloads the
+	// AS names, and runs however recent the last reload was. Scheduled reloads
+	// sooner than -reload.min-interval after the last are skipped here, as
+	// the annotators would skip them, so that only reloads that ran are
+	// counted.
+	var reloadMu sync.Mutex
+	var lastReload, lastNames time.Time
+	reload := func(trigger string, force bool) {
+		reloadMu.Lock()
+		defer reloadMu.Unlock()
+		if !force && time.Since(lastReload) < *reloadGap {
+			return
+		}
+		if force {
+			forceReloads(geo, asn, site)
+		}
+		metrics.Reloads.WithLabelValues(trigger).Inc()
+		if site != nil {
+			site.Reload(mainCtx)
+			if next := site.LocalIPs(); !equalIPs(next, localIPs) {
+				log.Println("Local IPs changed from", localIPs, "to", next)
+				localIPs = next
+				checkLocalIPs(localIPs)
+				updateLocalIPs(localIPs, uuidHandler, annotators)
+			}
+		}
+		if geo != nil {
+			geo.Reload(mainCtx)
+		}
+		if names != nil {
+			names.ReloadPrefixes(mainCtx)
+			if force {
+				names.ReloadNames(mainCtx)
+				lastNames = time.Now()
+			}
+		} else if asn != nil {
+			asn.Reload(mainCtx)
+		}
+		lastReload = time.Now()
+	}
+
+	if names != nil {
+		namesConfig := memoryless.Config{
+			Min:      *reloadMin,
+			Expected: *asnameReloadTime,
+		}
+		tick, err := memoryless.NewTicker(mainCtx, namesConfig)
+		rtx.Must(err, "Could not create ticker for reloading AS names")
+		wg.Add(1)
+		go func() {
+			for range tick.C {
+				reloadMu.Lock()
+				if time.Since(lastNames) >= *reloadGap {
+					metrics.Reloads.WithLabelValues("asname-schedule").Inc()
+					names.ReloadNames(mainCtx)
+					lastNames = time.Now()
+				}
+				reloadMu.Unlock()
+			}
+			wg.Done()
+		}()
+	}
+
+	// Reload the IP annotation config on a randomized schedule.
+	wg.Add(1)
+	go func() {
+		reloadConfig := memoryless.Config{
+			Min:      *reloadMin,
+			Max:      *reloadMax,
+			Expected: *reloadTime,
+		}
+		tick, err := memoryless.NewTicker(mainCtx, reloadConfig)
+		rtx.Must(err, "Could not create ticker for reloading")
+		for range tick.C {
+			reload("schedule", false)
+		}
+		wg.Done()
+	}()
+
+	// Reload everything on SIGHUP, so that new data can be picked up without
+	// waiting for the schedule. Signals received during a reload are merged
+	// into one more reload.
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		defer signal.Stop(hup)
+		for {
+			select {
+			case <-mainCtx.Done():
+				return
+			case <-hup:
+				log.Println("Received SIGHUP, reloading the backing data")
+				reload("sighup", true)
+			}
+		}
+	}()
+
 	// Set up the local service to serve IP annotations as a local service on a
 	// local unix-domain socket.
-	if *ipservice.SocketFilename != "" {
-		ipsrv, err := ipservice.NewServer(*ipservice.SocketFilename, asn, geo)
+	if *enableIPService && *ipservice.SocketFilename != "" {
+		var ipsrvOpts []ipservice.ServerOption
+		if site != nil {
+			ipsrvOpts = append(ipsrvOpts, ipservice.WithSiteAnnotator(site))
+		}
+		ipsrv, err := ipservice.NewServer(*ipservice.SocketFilename, asn, geo, ipsrvOpts...)
 		rtx.Must(err, "Could not start up the local IP annotation service")
 		wg.Add(2)
 		go func() {
@@ -178,7 +890,13 @@ func main() {
 		}()
 		go func() {
 			<-mainCtx.Done()
-			ipsrv.Close()
+			// Let outstanding requests finish, but not forever.
+			ctx, cancel := context.WithTimeout(context.Background(), *ipserviceShutdownTimeout)
+			defer cancel()
+			if err := ipsrv.Shutdown(ctx); err != nil {
+				log.Println("Could not shut down the local IP annotation service cleanly:", err)
+				ipsrv.Close()
+			}
 			wg.Done()
 		}()
 	}
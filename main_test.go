@@ -1,18 +1,54 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
 	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
 	"os"
 	"reflect"
+	"strings"
+	"sync/atomic"
+	"syscall"
 	"testing"
 	"time"
 
+	"github.com/m-lab/go/flagx"
+	"github.com/m-lab/go/prometheusx"
 	"github.com/m-lab/go/rtx"
 	"github.com/m-lab/tcp-info/eventsocket"
+	"github.com/m-lab/tcp-info/inetdiag"
+	"github.com/m-lab/uuid-annotator/annotator"
 	"github.com/m-lab/uuid-annotator/ipservice"
+	"github.com/m-lab/uuid-annotator/metrics"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
 )
 
+// customRuns counts the calls to the custom annotator registered for testing.
+var customRuns int64
+
+type customAnnotator struct{}
+
+func (customAnnotator) Annotate(ID *inetdiag.SockID, annotations *annotator.Annotations) error {
+	atomic.AddInt64(&customRuns, 1)
+	return nil
+}
+
+func init() {
+	annotator.Register("test-custom", func(ctx context.Context, localIPs []net.IP) (annotator.Annotator, error) {
+		return customAnnotator{}, nil
+	})
+}
+
 func TestMainSmokeTest(t *testing.T) {
 	tests := []struct {
 		name  string
@@ -53,6 +89,8 @@ func TestMainSmokeTest(t *testing.T) {
 			rtx.Must(routeviewv6.Set("file:./testdata/RouteViewIPv6.tiny.gz"), "Failed to set routeview v6 url for testing")
 			rtx.Must(asnameurl.Set("file:./data/asnames.ipinfo.csv"), "Failed to set ipinfo ASName url for testing")
 			rtx.Must(siteinfo.Set("file:./testdata/annotations.json"), "Failed to set siteinfo annotations url for testing")
+			siteinfoExtra = flagx.StringArray{"file:./testdata/annotations-extra.json"}
+			defer func() { siteinfoExtra = flagx.StringArray{} }()
 			os.Setenv("HOSTNAME", tt.value)
 
 			// Now start up a fake eventsocket.
@@ -76,6 +114,409 @@ func TestMainSmokeTest(t *testing.T) {
 	}
 }
 
+func TestMainWithDisabledAnnotator(t *testing.T) {
+	dir, err := os.MkdirTemp("", "TestMainWithDisabledAnnotator")
+	rtx.Must(err, "Could not create tempdir")
+	defer os.RemoveAll(dir)
+	testCtx, testCancel := context.WithCancel(context.Background())
+	defer testCancel()
+
+	// Set up global variables, with the geo annotator disabled.
+	mainCtx, mainCancel = context.WithCancel(testCtx)
+	mainRunning = make(chan struct{}, 1)
+	*datadir = dir
+	*enableGeo = false
+	defer func() {
+		*datadir = "."
+		*enableGeo = true
+	}()
+	*eventsocket.Filename = dir + "/eventsocket.sock"
+	*ipservice.SocketFilename = dir + "/ipannotator.sock"
+	rtx.Must(maxmindurl.Set("file:./testdata/fake.tar.gz"), "Failed to set maxmind url for testing")
+	rtx.Must(routeviewv4.Set("file:./testdata/RouteViewIPv4.tiny.gz"), "Failed to set routeview v4 url for testing")
+	rtx.Must(routeviewv6.Set("file:./testdata/RouteViewIPv6.tiny.gz"), "Failed to set routeview v6 url for testing")
+	rtx.Must(asnameurl.Set("file:./data/asnames.ipinfo.csv"), "Failed to set ipinfo ASName url for testing")
+	rtx.Must(siteinfo.Set("file:./testdata/annotations.json"), "Failed to set siteinfo annotations url for testing")
+	os.Setenv("HOSTNAME", "mlab1-lga03.mlab-sandbox.measurement-lab.org")
+
+	srv := eventsocket.New(*eventsocket.Filename)
+	rtx.Must(srv.Listen(), "Could not listen")
+	go srv.Serve(testCtx)
+
+	// Once main is running, send a flow from a local IP and wait for the
+	// resulting annotation file to appear.
+	tstamp := time.Date(2009, 3, 18, 1, 2, 3, 0, time.UTC)
+	fname := dir + "/2009/03/18/DISABLEDGEO.json"
+	go func() {
+		<-mainRunning
+		time.Sleep(100 * time.Millisecond)
+		srv.FlowCreated(tstamp, "DISABLEDGEO", inetdiag.SockID{
+			SrcIP: "127.0.0.1",
+			SPort: 1,
+			DstIP: "2.125.160.216",
+			DPort: 2,
+		})
+		for _, err := os.Stat(fname); err != nil; _, err = os.Stat(fname) {
+			time.Sleep(time.Millisecond)
+		}
+		mainCancel()
+	}()
+
+	main()
+
+	b, err := os.ReadFile(fname)
+	rtx.Must(err, "Could not read annotation file")
+	ann := annotator.Annotations{}
+	rtx.Must(json.Unmarshal(b, &ann), "Could not unmarshal annotation file")
+	if ann.Client.Geo != nil {
+		t.Errorf("Client.Geo should be absent when geo is disabled; got %+v", ann.Client.Geo)
+	}
+	if ann.Client.Network == nil {
+		t.Error("Client.Network should be present when asn is enabled")
+	}
+	if atomic.LoadInt64(&customRuns) == 0 {
+		t.Error("The registered custom annotator should have run in the handler chain")
+	}
+}
+
+func TestMainUUIDIndex(t *testing.T) {
+	dir, err := os.MkdirTemp("", "TestMainUUIDIndex")
+	rtx.Must(err, "Could not create tempdir")
+	defer os.RemoveAll(dir)
+	testCtx, testCancel := context.WithCancel(context.Background())
+	defer testCancel()
+
+	// Serve the metrics, and so the index, on a free port.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	rtx.Must(err, "Could not find a free port")
+	addr := l.Addr().String()
+	l.Close()
+	oldAddr := *prometheusx.ListenAddress
+	*prometheusx.ListenAddress = addr
+	defer func() { *prometheusx.ListenAddress = oldAddr }()
+
+	// Set up global variables, with the UUID index enabled.
+	mainCtx, mainCancel = context.WithCancel(testCtx)
+	mainRunning = make(chan struct{}, 1)
+	*datadir = dir
+	*uuidIndexSize = 10
+	defer func() {
+		*datadir = "."
+		*uuidIndexSize = 0
+	}()
+	*eventsocket.Filename = dir + "/eventsocket.sock"
+	*ipservice.SocketFilename = dir + "/ipannotator.sock"
+	rtx.Must(maxmindurl.Set("file:./testdata/fake.tar.gz"), "Failed to set maxmind url for testing")
+	rtx.Must(routeviewv4.Set("file:./testdata/RouteViewIPv4.tiny.gz"), "Failed to set routeview v4 url for testing")
+	rtx.Must(routeviewv6.Set("file:./testdata/RouteViewIPv6.tiny.gz"), "Failed to set routeview v6 url for testing")
+	rtx.Must(asnameurl.Set("file:./data/asnames.ipinfo.csv"), "Failed to set ipinfo ASName url for testing")
+	rtx.Must(siteinfo.Set("file:./testdata/annotations.json"), "Failed to set siteinfo annotations url for testing")
+	os.Setenv("HOSTNAME", "mlab1-lga03.mlab-sandbox.measurement-lab.org")
+
+	srv := eventsocket.New(*eventsocket.Filename)
+	rtx.Must(srv.Listen(), "Could not listen")
+	go srv.Serve(testCtx)
+
+	// Once the annotation file of a flow is written, it should be served by
+	// its UUID.
+	tstamp := time.Date(2009, 3, 18, 1, 2, 3, 0, time.UTC)
+	fname := dir + "/2009/03/18/INDEXED.json"
+	var body []byte
+	var status int
+	go func() {
+		defer mainCancel()
+		<-mainRunning
+		time.Sleep(100 * time.Millisecond)
+		srv.FlowCreated(tstamp, "INDEXED", inetdiag.SockID{
+			SrcIP: "127.0.0.1",
+			SPort: 1,
+			DstIP: "2.125.160.216",
+			DPort: 2,
+		})
+		for _, err := os.Stat(fname); err != nil; _, err = os.Stat(fname) {
+			time.Sleep(time.Millisecond)
+		}
+		resp, err := http.Get("http://" + addr + "/annotation?uuid=INDEXED")
+		if err != nil {
+			t.Error("Could not get the indexed annotation:", err)
+			return
+		}
+		defer resp.Body.Close()
+		status = resp.StatusCode
+		body, _ = io.ReadAll(resp.Body)
+	}()
+
+	main()
+
+	if status != http.StatusOK {
+		t.Fatalf("GET /annotation status = %d, want %d", status, http.StatusOK)
+	}
+	ann := annotator.Annotations{}
+	rtx.Must(json.Unmarshal(body, &ann), "Could not unmarshal the indexed annotation")
+	if ann.UUID != "INDEXED" {
+		t.Errorf("GET /annotation UUID = %q, want INDEXED", ann.UUID)
+	}
+}
+
+func TestMainSIGTERM(t *testing.T) {
+	dir, err := os.MkdirTemp("", "TestMainSIGTERM")
+	rtx.Must(err, "Could not create tempdir")
+	defer os.RemoveAll(dir)
+	testCtx, testCancel := context.WithCancel(context.Background())
+	defer testCancel()
+
+	// Set up global variables, with a WAL to see which events were received.
+	mainCtx, mainCancel = context.WithCancel(testCtx)
+	defer mainCancel()
+	mainRunning = make(chan struct{}, 1)
+	// The goroutine below uses wal, not the flag, which is reset by the
+	// deferred function.
+	wal := dir + "/wal"
+	*datadir = dir
+	*walPath = wal
+	defer func() {
+		*datadir = "."
+		*walPath = ""
+	}()
+	*eventsocket.Filename = dir + "/eventsocket.sock"
+	*ipservice.SocketFilename = dir + "/ipannotator.sock"
+	rtx.Must(maxmindurl.Set("file:./testdata/fake.tar.gz"), "Failed to set maxmind url for testing")
+	rtx.Must(routeviewv4.Set("file:./testdata/RouteViewIPv4.tiny.gz"), "Failed to set routeview v4 url for testing")
+	rtx.Must(routeviewv6.Set("file:./testdata/RouteViewIPv6.tiny.gz"), "Failed to set routeview v6 url for testing")
+	rtx.Must(asnameurl.Set("file:./data/asnames.ipinfo.csv"), "Failed to set ipinfo ASName url for testing")
+	rtx.Must(siteinfo.Set("file:./testdata/annotations.json"), "Failed to set siteinfo annotations url for testing")
+	os.Setenv("HOSTNAME", "mlab1-lga03.mlab-sandbox.measurement-lab.org")
+
+	srv := eventsocket.New(*eventsocket.Filename)
+	rtx.Must(srv.Listen(), "Could not listen")
+	go srv.Serve(testCtx)
+
+	// Once the last event has been received, and so every event is buffered
+	// or done, a SIGTERM should stop main only after every event is written.
+	const events = 20
+	tstamp := time.Date(2009, 3, 18, 1, 2, 3, 0, time.UTC)
+	stopped := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		select {
+		case <-mainRunning:
+		case <-stopped:
+			return
+		}
+		time.Sleep(100 * time.Millisecond)
+		for i := 0; i < events; i++ {
+			srv.FlowCreated(tstamp, fmt.Sprintf("TERM%d", i), inetdiag.SockID{
+				SrcIP: "127.0.0.1",
+				SPort: 1,
+				DstIP: "2.125.160.216",
+				DPort: uint16(i),
+			})
+		}
+		last := fmt.Sprintf("TERM%d", events-1)
+		for i := 0; i < 500; i++ {
+			// The last event is in the WAL until its file is written.
+			b, _ := os.ReadFile(wal)
+			if _, err := os.Stat(dir + "/2009/03/18/" + last + ".json"); err == nil || bytes.Contains(b, []byte(last)) {
+				break
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		rtx.Must(syscall.Kill(os.Getpid(), syscall.SIGTERM), "Could not send SIGTERM")
+	}()
+
+	main()
+	close(stopped)
+	<-done
+
+	for i := 0; i < events; i++ {
+		if _, err := os.Stat(fmt.Sprintf("%s/2009/03/18/TERM%d.json", dir, i)); err != nil {
+			t.Errorf("Event %d was not written before main returned: %v", i, err)
+		}
+	}
+	// The WAL is emptied once no events are pending.
+	b, err := os.ReadFile(wal)
+	rtx.Must(err, "Could not read the WAL")
+	if len(b) != 0 {
+		t.Errorf("WAL = %q, want no pending events", b)
+	}
+}
+
+func TestMainIPServiceOnly(t *testing.T) {
+	dir, err := os.MkdirTemp("", "TestMainIPServiceOnly")
+	rtx.Must(err, "Could not create tempdir")
+	defer os.RemoveAll(dir)
+	testCtx, testCancel := context.WithCancel(context.Background())
+	defer testCancel()
+
+	// Set up global variables, with files disabled. Nothing listens on the
+	// event socket, so main would fail if it tried to connect to it.
+	mainCtx, mainCancel = context.WithCancel(testCtx)
+	mainRunning = make(chan struct{}, 1)
+	*datadir = dir + "/annotation"
+	*enableFiles = false
+	defer func() {
+		*datadir = "."
+		*enableFiles = true
+	}()
+	*eventsocket.Filename = dir + "/eventsocket.sock"
+	*ipservice.SocketFilename = dir + "/ipannotator.sock"
+	rtx.Must(maxmindurl.Set("file:./testdata/fake.tar.gz"), "Failed to set maxmind url for testing")
+	rtx.Must(routeviewv4.Set("file:./testdata/RouteViewIPv4.tiny.gz"), "Failed to set routeview v4 url for testing")
+	rtx.Must(routeviewv6.Set("file:./testdata/RouteViewIPv6.tiny.gz"), "Failed to set routeview v6 url for testing")
+	rtx.Must(asnameurl.Set("file:./data/asnames.ipinfo.csv"), "Failed to set ipinfo ASName url for testing")
+	rtx.Must(siteinfo.Set("file:./testdata/annotations.json"), "Failed to set siteinfo annotations url for testing")
+	os.Setenv("HOSTNAME", "mlab1-lga03.mlab-sandbox.measurement-lab.org")
+
+	// Once main is running, the ipservice should answer.
+	var annotateErr error
+	go func() {
+		<-mainRunning
+		client := ipservice.NewClient(*ipservice.SocketFilename)
+		for i := 0; i < 100; i++ {
+			if _, annotateErr = client.Annotate(testCtx, []string{"2.125.160.216"}); annotateErr == nil {
+				break
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		mainCancel()
+	}()
+
+	main()
+
+	if annotateErr != nil {
+		t.Error("The ipservice should serve annotations with -enable.files=false:", annotateErr)
+	}
+	if _, err := os.Stat(*datadir); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("The datadir should not be created with -enable.files=false; Stat() = %v", err)
+	}
+}
+
+func TestMainReloadOnSIGHUP(t *testing.T) {
+	dir, err := os.MkdirTemp("", "TestMainReloadOnSIGHUP")
+	rtx.Must(err, "Could not create tempdir")
+	defer os.RemoveAll(dir)
+	testCtx, testCancel := context.WithCancel(context.Background())
+	defer testCancel()
+
+	// Set up global variables, with files disabled so that no event socket
+	// is needed.
+	mainCtx, mainCancel = context.WithCancel(testCtx)
+	mainRunning = make(chan struct{}, 1)
+	*enableFiles = false
+	defer func() { *enableFiles = true }()
+	*eventsocket.Filename = dir + "/eventsocket.sock"
+	*ipservice.SocketFilename = dir + "/ipannotator.sock"
+	rtx.Must(maxmindurl.Set("file:./testdata/fake.tar.gz"), "Failed to set maxmind url for testing")
+	rtx.Must(routeviewv4.Set("file:./testdata/RouteViewIPv4.tiny.gz"), "Failed to set routeview v4 url for testing")
+	rtx.Must(routeviewv6.Set("file:./testdata/RouteViewIPv6.tiny.gz"), "Failed to set routeview v6 url for testing")
+	rtx.Must(asnameurl.Set("file:./data/asnames.ipinfo.csv"), "Failed to set ipinfo ASName url for testing")
+	rtx.Must(siteinfo.Set("file:./testdata/annotations.json"), "Failed to set siteinfo annotations url for testing")
+	os.Setenv("HOSTNAME", "mlab1-lga03.mlab-sandbox.measurement-lab.org")
+
+	// Once main is running, two signals in quick succession should reload
+	// once, or twice if the first reload was done before the second signal.
+	// Another signal after that reload should reload again, although it is
+	// sooner than -reload.min-interval after the first.
+	reloads := metrics.Reloads.WithLabelValues("sighup")
+	geoReloads := metrics.ReloadDuration.WithLabelValues("geo")
+	before := testutil.ToFloat64(reloads)
+	geoBefore := sampleCount(geoReloads)
+	var first, second uint64
+	go func() {
+		<-mainRunning
+		rtx.Must(syscall.Kill(os.Getpid(), syscall.SIGHUP), "Could not send SIGHUP")
+		rtx.Must(syscall.Kill(os.Getpid(), syscall.SIGHUP), "Could not send SIGHUP")
+		for i := 0; i < 500 && sampleCount(geoReloads) == geoBefore; i++ {
+			time.Sleep(10 * time.Millisecond)
+		}
+		// Let any reload for the second signal finish.
+		time.Sleep(100 * time.Millisecond)
+		first = sampleCount(geoReloads) - geoBefore
+		rtx.Must(syscall.Kill(os.Getpid(), syscall.SIGHUP), "Could not send SIGHUP")
+		for i := 0; i < 500 && sampleCount(geoReloads)-geoBefore == first; i++ {
+			time.Sleep(10 * time.Millisecond)
+		}
+		second = sampleCount(geoReloads) - geoBefore - first
+		mainCancel()
+	}()
+
+	main()
+
+	if first < 1 || first > 2 {
+		t.Errorf("geo reloads for the first two SIGHUPs = %d, want 1 or 2", first)
+	}
+	if second != 1 {
+		t.Errorf("geo reloads for the third SIGHUP = %d, want 1", second)
+	}
+	if got := testutil.ToFloat64(reloads) - before; got != float64(first+second) {
+		t.Errorf("SIGHUP reloads = %v, want %d", got, first+second)
+	}
+}
+
+// sampleCount returns the number of observations of the histogram.
+func sampleCount(o prometheus.Observer) uint64 {
+	m := &dto.Metric{}
+	rtx.Must(o.(prometheus.Metric).Write(m), "Could not read histogram")
+	return m.GetHistogram().GetSampleCount()
+}
+
+type nameAnnotator string
+
+func (n nameAnnotator) Annotate(ID *inetdiag.SockID, annotations *annotator.Annotations) error {
+	return nil
+}
+
+func Test_buildAnnotators(t *testing.T) {
+	constructor := func(name string) annotator.Constructor {
+		return func(ctx context.Context, localIPs []net.IP) (annotator.Annotator, error) {
+			return nameAnnotator(name), nil
+		}
+	}
+	tests := []struct {
+		name    string
+		builtin []annotator.Annotator
+		custom  map[string]annotator.Constructor
+		want    []annotator.Annotator
+		wantErr bool
+	}{
+		{
+			name:    "builtin-only-skips-disabled",
+			builtin: []annotator.Annotator{nameAnnotator("geo"), nil, nameAnnotator("site")},
+			want:    []annotator.Annotator{nameAnnotator("geo"), nameAnnotator("site")},
+		},
+		{
+			name:    "custom-after-builtin-in-name-order",
+			builtin: []annotator.Annotator{nameAnnotator("geo")},
+			custom: map[string]annotator.Constructor{
+				"b": constructor("b"),
+				"a": constructor("a"),
+			},
+			want: []annotator.Annotator{nameAnnotator("geo"), nameAnnotator("a"), nameAnnotator("b")},
+		},
+		{
+			name: "error-custom-constructor",
+			custom: map[string]annotator.Constructor{
+				"bad": func(ctx context.Context, localIPs []net.IP) (annotator.Annotator, error) {
+					return nil, errors.New("fake constructor error")
+				},
+			},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := buildAnnotators(context.Background(), nil, tt.builtin, tt.custom)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("buildAnnotators() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("buildAnnotators() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
 func Test_findLocalIPs(t *testing.T) {
 	tests := []struct {
 		name  string
@@ -118,3 +559,296 @@ func Test_findLocalIPs(t *testing.T) {
 		})
 	}
 }
+
+func Test_providerFromURL(t *testing.T) {
+	var got http.Header
+	srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		got = req.Header.Clone()
+	}))
+	defer srv.Close()
+	rtx.Must(httpHeaders.Set("Authorization=Bearer token"), "Could not set headers")
+
+	u, err := url.Parse(srv.URL)
+	rtx.Must(err, "Could not parse URL")
+	p, err := providerFromURL(context.Background(), u)
+	rtx.Must(err, "Could not create provider")
+	_, err = p.Get(context.Background())
+	rtx.Must(err, "Could not get data")
+	if got.Get("User-Agent") != *httpUserAgent || got.Get("Authorization") != "Bearer token" {
+		t.Errorf("providerFromURL() sent the wrong headers: %v", got)
+	}
+
+	u, err = url.Parse("file:./testdata/hostname")
+	rtx.Must(err, "Could not parse URL")
+	p, err = providerFromURL(context.Background(), u)
+	rtx.Must(err, "Could not create provider")
+	_, err = p.Get(context.Background())
+	rtx.Must(err, "Could not get data from file provider")
+
+	// A pattern selects the newest matching file of the directory.
+	u, err = url.Parse("file:./testdata/?pattern=RouteViewIPv6.*.gz")
+	rtx.Must(err, "Could not parse URL")
+	p, err = providerFromURL(context.Background(), u)
+	rtx.Must(err, "Could not create provider")
+	b, err := p.Get(context.Background())
+	rtx.Must(err, "Could not get data from directory provider")
+	want, err := os.ReadFile("testdata/RouteViewIPv6.tiny.gz")
+	rtx.Must(err, "Could not read file")
+	if !bytes.Equal(b, want) {
+		t.Errorf("providerFromURL() with a pattern did not read RouteViewIPv6.tiny.gz")
+	}
+}
+
+func Test_providerFromURL_offline(t *testing.T) {
+	*offline = true
+	defer func() { *offline = false }()
+	wd, err := os.Getwd()
+	rtx.Must(err, "Could not get working directory")
+	tests := []struct {
+		name    string
+		url     string
+		wantErr error
+	}{
+		{
+			name:    "gcs-rejected",
+			url:     "gs://bucket/file",
+			wantErr: errNotLocal,
+		},
+		{
+			name:    "https-rejected",
+			url:     "https://example.com/file",
+			wantErr: errNotLocal,
+		},
+		{
+			name:    "missing-file",
+			url:     "file:./testdata/this-file-does-not-exist",
+			wantErr: os.ErrNotExist,
+		},
+		{
+			name: "relative-file",
+			url:  "file:./testdata/hostname",
+		},
+		{
+			name: "absolute-file",
+			url:  "file://" + wd + "/testdata/hostname",
+		},
+		{
+			name: "directory-pattern",
+			url:  "file:./testdata/?pattern=RouteViewIPv4.*.gz",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			u, err := url.Parse(tt.url)
+			rtx.Must(err, "Could not parse URL")
+			_, err = providerFromURL(context.Background(), u)
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("providerFromURL() error = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+// updatingAnnotator records the local IPs it is given.
+type updatingAnnotator struct {
+	nameAnnotator
+	got []net.IP
+}
+
+func (u *updatingAnnotator) UpdateLocalIPs(localIPs []net.IP) {
+	u.got = localIPs
+}
+
+// netsAnnotator records the local netblocks it is given.
+type netsAnnotator struct {
+	nameAnnotator
+	got []net.IPNet
+}
+
+func (u *netsAnnotator) UpdateLocalNets(localNets []net.IPNet) {
+	u.got = localNets
+}
+
+func Test_checkLocalIPs(t *testing.T) {
+	tests := []struct {
+		name     string
+		localIPs []net.IP
+		want     bool
+		wantN    float64
+	}{
+		{
+			name:     "no-usable-interfaces",
+			localIPs: findLocalIPs([]net.Addr{&net.UnixAddr{Name: "fake-unix", Net: "unix"}}),
+		},
+		{
+			// A virtual site without IPv6 adds a nil IP.
+			name:     "only-nil-ips",
+			localIPs: []net.IP{nil},
+		},
+		{
+			name:     "success",
+			localIPs: []net.IP{net.ParseIP("10.0.0.1"), nil},
+			want:     true,
+			wantN:    1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := checkLocalIPs(tt.localIPs); got != tt.want {
+				t.Errorf("checkLocalIPs() = %v, want %v", got, tt.want)
+			}
+			if got := testutil.ToFloat64(metrics.LocalIPs); got != tt.wantN {
+				t.Errorf("checkLocalIPs() set metric to %v, want %v", got, tt.wantN)
+			}
+		})
+	}
+}
+
+func Test_updateLocalIPs(t *testing.T) {
+	ips := []net.IP{net.ParseIP("10.0.0.1"), net.ParseIP("35.2.2.2")}
+	u := &updatingAnnotator{}
+	// Annotators that can't update their local IPs, and a nil handler, are skipped.
+	updateLocalIPs(ips, nil, []annotator.Annotator{nameAnnotator("site"), u})
+	if !equalIPs(u.got, ips) {
+		t.Errorf("updateLocalIPs() gave %v, want %v", u.got, ips)
+	}
+	if equalIPs(ips, ips[:1]) || equalIPs(ips, []net.IP{ips[1], ips[0]}) {
+		t.Error("equalIPs() should compare lengths and order")
+	}
+}
+
+func Test_updateLocalNets(t *testing.T) {
+	_, n, err := net.ParseCIDR("10.0.0.0/26")
+	rtx.Must(err, "Could not parse CIDR")
+	nets := []net.IPNet{*n}
+	u := &netsAnnotator{}
+	// Annotators that can't use netblocks, and a nil handler, are skipped.
+	updateLocalNets(nets, nil, []annotator.Annotator{nameAnnotator("site"), u})
+	if len(u.got) != 1 || u.got[0].String() != "10.0.0.0/26" {
+		t.Errorf("updateLocalNets() gave %v, want %v", u.got, nets)
+	}
+}
+
+func Test_runLoads(t *testing.T) {
+	tests := []struct {
+		name  string
+		limit int
+		loads int
+		want  int32
+	}{
+		{name: "sequential", limit: 1, loads: 4, want: 1},
+		{name: "limited", limit: 2, loads: 5, want: 2},
+		{name: "limit-above-loads", limit: 10, loads: 3, want: 3},
+		{name: "unlimited", limit: 0, loads: 4, want: 4},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var active, peak, done int32
+			loads := []func(){}
+			for i := 0; i < tt.loads; i++ {
+				loads = append(loads, func() {
+					n := atomic.AddInt32(&active, 1)
+					for {
+						p := atomic.LoadInt32(&peak)
+						if n <= p || atomic.CompareAndSwapInt32(&peak, p, n) {
+							break
+						}
+					}
+					// A slow download.
+					time.Sleep(50 * time.Millisecond)
+					atomic.AddInt32(&active, -1)
+					atomic.AddInt32(&done, 1)
+				})
+			}
+			runLoads(tt.limit, loads)
+			if done != int32(tt.loads) {
+				t.Errorf("runLoads() finished %d loads, want %d", done, tt.loads)
+			}
+			if peak != tt.want {
+				t.Errorf("runLoads() ran %d loads concurrently, want %d", peak, tt.want)
+			}
+		})
+	}
+}
+
+// limitedAnnotator records its minimum reload interval, and whether its next
+// reload was forced.
+type limitedAnnotator struct {
+	nameAnnotator
+	min    time.Duration
+	forced bool
+}
+
+func (l *limitedAnnotator) SetMinReloadInterval(d time.Duration) {
+	l.min = d
+}
+
+func (l *limitedAnnotator) ForceReload() {
+	l.forced = true
+}
+
+func Test_limitReloads(t *testing.T) {
+	l := &limitedAnnotator{nameAnnotator: "limited"}
+	// Annotators without a limit, and nil annotators, are skipped.
+	limitReloads(time.Minute, nameAnnotator("site"), nil, l)
+	if l.min != time.Minute {
+		t.Errorf("limitReloads() set %v, want %v", l.min, time.Minute)
+	}
+}
+
+func Test_forceReloads(t *testing.T) {
+	l := &limitedAnnotator{nameAnnotator: "limited"}
+	// Annotators that can not be forced, and nil annotators, are skipped.
+	forceReloads(nameAnnotator("site"), nil, l)
+	if !l.forced {
+		t.Error("forceReloads() did not force the reload")
+	}
+}
+
+func Test_readKey(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, content string) string {
+		path := dir + "/" + name
+		rtx.Must(os.WriteFile(path, []byte(content), 0600), "Could not write %q", path)
+		return path
+	}
+	tests := []struct {
+		name    string
+		path    string
+		want    string
+		wantErr bool
+	}{
+		{
+			name: "trimmed",
+			path: write("key", "  secret\n"),
+			want: "secret",
+		},
+		{
+			name:    "error-empty",
+			path:    write("empty", " \n"),
+			wantErr: true,
+		},
+		{
+			name:    "error-missing",
+			path:    dir + "/missing",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := readKey(tt.path)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("readKey() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if string(got) != tt.want {
+				t.Errorf("readKey() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+	// The flag holds only the path, so logging the flags can not leak the key.
+	rtx.Must(flag.Set("annotation.client-ip-hash-key", write("logged", "secret")), "Could not set flag")
+	defer flag.Set("annotation.client-ip-hash-key", "")
+	if got := flag.Lookup("annotation.client-ip-hash-key").Value.String(); strings.Contains(got, "secret") {
+		t.Errorf("The -annotation.client-ip-hash-key flag value %q contains the key", got)
+	}
+}
@@ -5,6 +5,9 @@
 package metrics
 
 import (
+	"sync/atomic"
+	"time"
+
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
 )
@@ -18,11 +21,76 @@ var (
 		},
 		[]string{"reason"},
 	)
-	AnnotationErrors = promauto.NewCounter(
+	DrainedJobs = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "uuid_annotator_shutdown_uuids_total",
+			Help: "The number of UUIDs still buffered at shutdown, by whether they were drained or abandoned when the drain timed out, or opened during shutdown and deferred to the WAL.",
+		},
+		[]string{"result"},
+	)
+	SampledOutJobs = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Name: "uuid_annotator_sampled_out_uuids_total",
+			Help: "The number of UUIDs that were deliberately not annotated because of sampling",
+		},
+	)
+	WALReplayedJobs = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Name: "uuid_annotator_wal_replayed_uuids_total",
+			Help: "The number of UUIDs that were received by a previous run, but only annotated after a restart from the write-ahead log",
+		},
+	)
+	AnnotationErrors = promauto.NewCounterVec(
 		prometheus.CounterOpts{
 			Name: "uuid_annotator_annotation_errors_total",
 			Help: "The number of times annotation returned an error",
 		},
+		[]string{"reason"},
+	)
+	QueueDepth = promauto.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "uuid_annotator_queue_depth",
+			Help: "The number of UUIDs waiting in the buffer to be annotated. Jobs are dropped or delayed once it reaches -eventbuffersize.",
+		},
+	)
+	SaveDuration = promauto.NewHistogram(
+		prometheus.HistogramOpts{
+			Name:    "uuid_annotator_save_duration_seconds",
+			Help:    "How long it took to annotate each UUID and write its file",
+			Buckets: []float64{.0001, .00025, .0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5},
+		},
+	)
+	WritesFailing = promauto.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "uuid_annotator_writes_failing",
+			Help: "1 while the last -datadir.max-write-failures annotation files could not be written, and 0 otherwise. The node should be drained while it is 1.",
+		},
+	)
+	LocalIPs = promauto.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "uuid_annotator_local_ips",
+			Help: "The number of local IPs used to tell servers from clients. Should never be zero.",
+		},
+	)
+	ClientIsLocal = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Name: "uuid_annotator_client_is_local_total",
+			Help: "The number of flows whose client IP is also a local IP. Should always be zero.",
+		},
+	)
+	PayloadHashes = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "uuid_annotator_payload_hashes_total",
+			Help: "The number of hashed annotation payloads, and whether the payload was recently seen",
+		},
+		[]string{"status"},
+	)
+	DirectionAudits = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "uuid_annotator_direction_audits_total",
+			Help: "The number of flows whose direction was audited, and whether the ASNs agree with the direction. Reversed should always be zero.",
+		},
+		[]string{"result"},
 	)
 	GCSFilesLoaded = promauto.NewGaugeVec(
 		prometheus.GaugeOpts{
@@ -31,6 +99,13 @@ var (
 		},
 		[]string{"md5"},
 	)
+	HTTPDownloads = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "uuid_annotator_http_downloads_total",
+			Help: "The number of HTTP(S) data source requests, and whether they downloaded fresh data, found it unchanged, or failed",
+		},
+		[]string{"status"},
+	)
 	ServerRPCCount = promauto.NewCounterVec(
 		prometheus.CounterOpts{
 			Name: "uuid_annotator_server_rpcs_total",
@@ -45,6 +120,27 @@ var (
 		},
 		[]string{"status"},
 	)
+	ClientReconnects = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "uuid_annotator_client_reconnects_total",
+			Help: "The number of times the client-side of the RPC service retried connecting to the server, and how many of those retries succeeded",
+		},
+		[]string{"status"},
+	)
+	ASNPrefixLengths = promauto.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "uuid_annotator_asn_matched_prefix_length",
+			Help:    "The length of the RouteViews prefixes matched by ASN annotations, by address family",
+			Buckets: []float64{8, 12, 16, 20, 22, 23, 24, 28, 32, 40, 44, 48, 56, 64, 128},
+		},
+		[]string{"family"},
+	)
+	SiteinfoUnknownTypes = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Name: "uuid_annotator_siteinfo_unknown_type_total",
+			Help: "The number of times the siteinfo of this machine had a Type other than physical or virtual. Should always be zero.",
+		},
+	)
 	RouteViewRows = promauto.NewCounterVec(
 		prometheus.CounterOpts{
 			Name: "uuid_annotator_routeview_rows_total",
@@ -58,6 +154,13 @@ var (
 			Help: "The number of times a routeview file has been parsed",
 		},
 	)
+	ASNCacheLookups = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "uuid_annotator_asn_cache_lookups_total",
+			Help: "The number of IPs looked up in the ASN annotator cache, by whether they were a hit or a miss",
+		},
+		[]string{"result"},
+	)
 	ASNSearches = promauto.NewCounterVec(
 		prometheus.CounterOpts{
 			Name: "uuid_annotator_asn_search_total",
@@ -65,4 +168,69 @@ var (
 		},
 		[]string{"status"},
 	)
+	Reloads = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "uuid_annotator_reloads_total",
+			Help: "The number of reloads of the backing data, by trigger: schedule, asname-schedule, or sighup",
+		},
+		[]string{"trigger"},
+	)
+	ReloadDuration = promauto.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "uuid_annotator_reload_duration_seconds",
+			Help:    "How long each reload of the backing data took, by annotator: geo, asn, or asname",
+			Buckets: []float64{.01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 25, 50, 100},
+		},
+		[]string{"annotator"},
+	)
+
+	// The ages of the datasets of the geo and asn annotators, and of the AS
+	// names, which may be reloaded separately.
+	GeoDatasetAge    = mustRegisterDatasetAge("geo")
+	ASNDatasetAge    = mustRegisterDatasetAge("asn")
+	ASNameDatasetAge = mustRegisterDatasetAge("asname")
 )
+
+// DatasetAge is a gauge of the seconds since the dataset of an annotator was
+// last loaded or reloaded without error, whether or not it had changed. It is
+// only exported once the dataset has been loaded.
+type DatasetAge struct {
+	desc   *prometheus.Desc
+	loaded atomic.Int64 // Unix nanoseconds, or 0 before the first load.
+}
+
+// newDatasetAge returns an unregistered DatasetAge for the annotator.
+func newDatasetAge(annotator string) *DatasetAge {
+	return &DatasetAge{
+		desc: prometheus.NewDesc(
+			"uuid_annotator_dataset_age_seconds",
+			"The seconds since the dataset of each annotator was last loaded successfully",
+			nil, prometheus.Labels{"annotator": annotator},
+		),
+	}
+}
+
+// mustRegisterDatasetAge returns a DatasetAge for the annotator, registered
+// with the default registry.
+func mustRegisterDatasetAge(annotator string) *DatasetAge {
+	d := newDatasetAge(annotator)
+	prometheus.MustRegister(d)
+	return d
+}
+
+// Loaded records that the dataset was loaded successfully now.
+func (d *DatasetAge) Loaded() {
+	d.loaded.Store(time.Now().UnixNano())
+}
+
+// Describe implements prometheus.Collector.
+func (d *DatasetAge) Describe(ch chan<- *prometheus.Desc) {
+	ch <- d.desc
+}
+
+// Collect implements prometheus.Collector.
+func (d *DatasetAge) Collect(ch chan<- prometheus.Metric) {
+	if t := d.loaded.Load(); t != 0 {
+		ch <- prometheus.MustNewConstMetric(d.desc, prometheus.GaugeValue, time.Since(time.Unix(0, t)).Seconds())
+	}
+}
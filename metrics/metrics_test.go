@@ -2,14 +2,53 @@ package metrics
 
 import (
 	"testing"
+	"time"
 
 	"github.com/m-lab/go/prometheusx/promtest"
+	"github.com/m-lab/go/rtx"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 )
 
 func TestMetrics(t *testing.T) {
 	MissedJobs.WithLabelValues("x").Inc()
+	DrainedJobs.WithLabelValues("x").Inc()
+	AnnotationErrors.WithLabelValues("x").Inc()
+	PayloadHashes.WithLabelValues("x").Inc()
+	DirectionAudits.WithLabelValues("x").Inc()
+	ASNCacheLookups.WithLabelValues("x").Inc()
+	Reloads.WithLabelValues("x").Inc()
 	GCSFilesLoaded.WithLabelValues("x").Inc()
+	HTTPDownloads.WithLabelValues("x").Inc()
 	ServerRPCCount.WithLabelValues("x").Inc()
 	ClientRPCCount.WithLabelValues("x").Inc()
+	ClientReconnects.WithLabelValues("x").Inc()
+	ASNPrefixLengths.WithLabelValues("x").Observe(24)
+	SaveDuration.Observe(0.01)
+	ReloadDuration.WithLabelValues("x").Observe(1)
+	GeoDatasetAge.Loaded()
+	ASNDatasetAge.Loaded()
+	ASNameDatasetAge.Loaded()
 	promtest.LintMetrics(t)
 }
+
+func TestDatasetAge(t *testing.T) {
+	// A local registry, so that the test can run more than once.
+	reg := prometheus.NewRegistry()
+	d := newDatasetAge("test")
+	rtx.Must(reg.Register(d), "Could not register DatasetAge")
+	if n, err := testutil.GatherAndCount(reg); err != nil || n != 0 {
+		t.Errorf("DatasetAge exported %d metrics before the first load, want 0 (%v)", n, err)
+	}
+	d.loaded.Store(time.Now().Add(-time.Hour).UnixNano())
+	if age := testutil.ToFloat64(d); age < 3600 || age > 3660 {
+		t.Errorf("DatasetAge = %v an hour after loading, want about 3600", age)
+	}
+	if n, err := testutil.GatherAndCount(reg); err != nil || n != 1 {
+		t.Errorf("DatasetAge exported %d metrics after loading, want 1 (%v)", n, err)
+	}
+	d.Loaded()
+	if age := testutil.ToFloat64(d); age < 0 || age > 60 {
+		t.Errorf("DatasetAge = %v after Loaded(), want about 0", age)
+	}
+}
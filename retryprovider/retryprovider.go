@@ -0,0 +1,69 @@
+// Package retryprovider provides a content.Provider that retries the initial
+// Get of another provider, so that a momentarily unavailable data source at
+// startup does not crash the annotator.
+package retryprovider
+
+import (
+	"context"
+	"log"
+	"sync/atomic"
+	"time"
+
+	"github.com/m-lab/go/content"
+)
+
+// provider wraps a content.Provider. Until its first successful Get, failed
+// calls to Get are retried with exponential backoff. After that, Get errors are
+// returned immediately, because reloads are already retried on a schedule.
+type provider struct {
+	p        content.Provider
+	attempts int
+	backoff  time.Duration
+	loaded   atomic.Bool // Get may be called concurrently, e.g. by Reload and Warm.
+}
+
+// New returns a content.Provider that makes up to attempts calls to p.Get for
+// the initial load, waiting backoff after the first failure and doubling the
+// wait after each subsequent failure. Values of attempts less than one are
+// treated as one.
+func New(p content.Provider, attempts int, backoff time.Duration) content.Provider {
+	return &provider{
+		p:        p,
+		attempts: attempts,
+		backoff:  backoff,
+	}
+}
+
+// Name returns the result of the wrapped provider's Name, if it has one, so
+// that the name of the file it read is not hidden by the retries.
+func (r *provider) Name() string {
+	if n, ok := r.p.(interface{ Name() string }); ok {
+		return n.Name()
+	}
+	return ""
+}
+
+// Get returns the result of the wrapped provider's Get.
+func (r *provider) Get(ctx context.Context) ([]byte, error) {
+	if r.loaded.Load() {
+		return r.p.Get(ctx)
+	}
+	wait := r.backoff
+	for i := 1; ; i++ {
+		data, err := r.p.Get(ctx)
+		if err == nil || err == content.ErrNoChange {
+			r.loaded.Store(true)
+			return data, err
+		}
+		if i >= r.attempts {
+			return nil, err
+		}
+		log.Printf("Initial load failed (attempt %d of %d), retrying in %v: %v\n", i, r.attempts, wait, err)
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		wait *= 2
+	}
+}
@@ -0,0 +1,151 @@
+package retryprovider
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/m-lab/go/content"
+)
+
+// flakyProvider fails the first failures calls to Get.
+type flakyProvider struct {
+	failures int
+	calls    int
+}
+
+func (f *flakyProvider) Get(ctx context.Context) ([]byte, error) {
+	f.calls++
+	if f.calls <= f.failures {
+		return nil, errors.New("fake transient error")
+	}
+	return []byte("data"), nil
+}
+
+func TestProvider_Get(t *testing.T) {
+	tests := []struct {
+		name      string
+		failures  int
+		attempts  int
+		wantErr   bool
+		wantCalls int
+	}{
+		{
+			name:      "success-first-try",
+			attempts:  3,
+			wantCalls: 1,
+		},
+		{
+			name:      "success-after-two-failures",
+			failures:  2,
+			attempts:  3,
+			wantCalls: 3,
+		},
+		{
+			name:      "error-too-many-failures",
+			failures:  3,
+			attempts:  3,
+			wantErr:   true,
+			wantCalls: 3,
+		},
+		{
+			name:      "error-zero-attempts-tries-once",
+			failures:  1,
+			attempts:  0,
+			wantErr:   true,
+			wantCalls: 1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := &flakyProvider{failures: tt.failures}
+			p := New(f, tt.attempts, time.Millisecond)
+			data, err := p.Get(context.Background())
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Get() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && string(data) != "data" {
+				t.Errorf("Get() = %q, want %q", data, "data")
+			}
+			if f.calls != tt.wantCalls {
+				t.Errorf("Get() called the provider %d times, want %d", f.calls, tt.wantCalls)
+			}
+		})
+	}
+}
+
+func TestProvider_GetOnlyRetriesInitialLoad(t *testing.T) {
+	f := &flakyProvider{}
+	p := New(f, 3, time.Millisecond)
+	if _, err := p.Get(context.Background()); err != nil {
+		t.Fatal("Get() failed:", err)
+	}
+	// Make every later call fail.
+	f.failures = 100
+	if _, err := p.Get(context.Background()); err == nil {
+		t.Error("Get() after the initial load should return errors")
+	}
+	if f.calls != 2 {
+		t.Errorf("Get() after the initial load should not retry; got %d calls, want 2", f.calls)
+	}
+}
+
+func TestProvider_GetConcurrent(t *testing.T) {
+	p := New(noChange{}, 3, time.Millisecond)
+	// Run with -race.
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := p.Get(context.Background()); err != content.ErrNoChange {
+				t.Errorf("Get() error = %v, want %v", err, content.ErrNoChange)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestProvider_GetNoChange(t *testing.T) {
+	p := New(noChange{}, 3, time.Millisecond)
+	if _, err := p.Get(context.Background()); err != content.ErrNoChange {
+		t.Errorf("Get() error = %v, want %v", err, content.ErrNoChange)
+	}
+}
+
+type noChange struct{}
+
+func (noChange) Get(ctx context.Context) ([]byte, error) {
+	return nil, content.ErrNoChange
+}
+
+func TestProvider_GetCanceled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	p := New(&flakyProvider{failures: 1}, 3, time.Hour)
+	if _, err := p.Get(ctx); err != context.Canceled {
+		t.Errorf("Get() error = %v, want %v", err, context.Canceled)
+	}
+}
+
+// namedProvider is a flakyProvider with a file name.
+type namedProvider struct {
+	flakyProvider
+}
+
+func (n *namedProvider) Name() string {
+	return "RouteViewIPv4.20230102.gz"
+}
+
+func TestProvider_Name(t *testing.T) {
+	n := New(&namedProvider{}, 1, time.Millisecond).(*provider)
+	if got := n.Name(); got != "RouteViewIPv4.20230102.gz" {
+		t.Errorf("Name() = %q, want the name of the wrapped provider", got)
+	}
+	p := New(&flakyProvider{}, 1, time.Millisecond).(*provider)
+	if got := p.Name(); got != "" {
+		t.Errorf("Name() without a named provider = %q, want \"\"", got)
+	}
+}
@@ -0,0 +1,116 @@
+// Package rir parses the delegated-extended statistics files published by the
+// Regional Internet Registries, which record the country each block of
+// addresses was allocated or assigned to. See the format documentation at:
+// https://www.apnic.net/about-apnic/corporate-documents/documents/resource-guidelines/rir-statistics-exchange-format/
+package rir
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"log"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// ErrNoDelegationFound is returned when no delegation contains the given IP.
+var ErrNoDelegationFound = errors.New("no delegation found for address")
+
+// Delegation is a single contiguous block of addresses and the country it was
+// delegated to. Start and End are inclusive and always 16 bytes long.
+type Delegation struct {
+	Start   net.IP
+	End     net.IP
+	Country string
+}
+
+// Index is a sorted, searchable list of non-overlapping delegations.
+type Index []Delegation
+
+// Parse reads the given delegated-extended file and returns an Index of all
+// allocated or assigned IPv4 and IPv6 delegations. Header, summary, comment,
+// and malformed lines are skipped.
+func Parse(data []byte) (Index, error) {
+	ix := Index{}
+	s := bufio.NewScanner(bytes.NewReader(data))
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Split(line, "|")
+		// Version lines have fewer fields, and summary lines have a "*" country.
+		if len(fields) < 7 || fields[1] == "*" || fields[1] == "" {
+			continue
+		}
+		if fields[6] != "allocated" && fields[6] != "assigned" {
+			continue
+		}
+		d, err := parseRange(fields[2], fields[3], fields[4])
+		if err != nil {
+			log.Println("Bad delegation row:", err, line)
+			continue
+		}
+		d.Country = fields[1]
+		ix = append(ix, d)
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	sort.Slice(ix, func(i, j int) bool { return bytes.Compare(ix[i].Start, ix[j].Start) < 0 })
+	return ix, nil
+}
+
+var errBadRange = errors.New("bad delegation range")
+
+// parseRange computes the inclusive range of a delegation. IPv4 delegations are
+// given as a start address and a count of addresses, while IPv6 delegations are
+// given as a start address and a prefix length.
+func parseRange(kind, start, value string) (Delegation, error) {
+	ip := net.ParseIP(start)
+	n, err := strconv.ParseUint(value, 10, 64)
+	if ip == nil || err != nil {
+		return Delegation{}, errBadRange
+	}
+	switch {
+	case kind == "ipv4" && ip.To4() != nil && n > 0 && n <= 1<<32:
+		first := uint64(binary.BigEndian.Uint32(ip.To4()))
+		last := first + n - 1
+		if last > 0xffffffff {
+			return Delegation{}, errBadRange
+		}
+		end := make(net.IP, 4)
+		binary.BigEndian.PutUint32(end, uint32(last))
+		return Delegation{Start: ip.To16(), End: end.To16()}, nil
+	case kind == "ipv6" && ip.To4() == nil && n <= 128:
+		mask := net.CIDRMask(int(n), 128)
+		end := make(net.IP, 16)
+		for i := range end {
+			end[i] = ip[i] | ^mask[i]
+		}
+		return Delegation{Start: ip.Mask(mask), End: end}, nil
+	}
+	return Delegation{}, errBadRange
+}
+
+// Search returns the delegation containing the given IP.
+func (ix Index) Search(ip net.IP) (Delegation, error) {
+	ip = ip.To16()
+	if ip == nil {
+		return Delegation{}, ErrNoDelegationFound
+	}
+	// Find the first delegation that starts after ip; the one before it is the
+	// only one that could contain ip.
+	i := sort.Search(len(ix), func(i int) bool { return bytes.Compare(ix[i].Start, ip) > 0 })
+	if i == 0 {
+		return Delegation{}, ErrNoDelegationFound
+	}
+	d := ix[i-1]
+	if bytes.Compare(ip, d.End) > 0 {
+		return Delegation{}, ErrNoDelegationFound
+	}
+	return d, nil
+}
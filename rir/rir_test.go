@@ -0,0 +1,67 @@
+package rir
+
+import (
+	"net"
+	"os"
+	"testing"
+
+	"github.com/m-lab/go/rtx"
+)
+
+func TestParseAndSearch(t *testing.T) {
+	data, err := os.ReadFile("../testdata/delegated-extended.txt")
+	rtx.Must(err, "Could not read testdata")
+	ix, err := Parse(data)
+	rtx.Must(err, "Could not parse delegations")
+	if len(ix) != 3 {
+		t.Fatalf("Parse() returned %d delegations, want 3", len(ix))
+	}
+
+	tests := []struct {
+		name    string
+		ip      string
+		want    string
+		wantErr bool
+	}{
+		{name: "ipv4-first", ip: "2.0.0.0", want: "FR"},
+		{name: "ipv4-last", ip: "2.15.255.255", want: "FR"},
+		{name: "ipv4-second-block", ip: "2.125.160.216", want: "GB"},
+		{name: "ipv4-end-of-second-block", ip: "2.127.255.255", want: "GB"},
+		{name: "ipv4-after-all-blocks", ip: "2.128.0.0", wantErr: true},
+		{name: "ipv4-before-all-blocks", ip: "1.0.0.1", wantErr: true},
+		{name: "ipv4-between-blocks", ip: "2.16.0.0", wantErr: true},
+		{name: "ipv4-available-is-skipped", ip: "3.0.0.1", wantErr: true},
+		{name: "ipv6", ip: "2001:200::1", want: "JP"},
+		{name: "ipv6-outside", ip: "2001:201::1", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d, err := ix.Search(net.ParseIP(tt.ip))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Search(%q) error = %v, wantErr %v", tt.ip, err, tt.wantErr)
+			}
+			if d.Country != tt.want {
+				t.Errorf("Search(%q) = %q, want %q", tt.ip, d.Country, tt.want)
+			}
+		})
+	}
+
+	if _, err := ix.Search(nil); err != ErrNoDelegationFound {
+		t.Errorf("Search(nil) error = %v, want %v", err, ErrNoDelegationFound)
+	}
+}
+
+func TestParseBadRows(t *testing.T) {
+	data := []byte(
+		"arin|US|ipv4|not-an-ip|256|20000101|allocated\n" +
+			"arin|US|ipv4|1.0.0.0|0|20000101|allocated\n" +
+			"arin|US|ipv4|255.255.255.0|512|20000101|allocated\n" +
+			"arin|US|ipv6|2001::|129|20000101|allocated\n" +
+			"arin|US|ipv6|1.0.0.0|32|20000101|allocated\n" +
+			"arin|US|ipv4|8.8.8.0|256|20000101|assigned\n")
+	ix, err := Parse(data)
+	rtx.Must(err, "Could not parse delegations")
+	if len(ix) != 1 || ix[0].Country != "US" {
+		t.Errorf("Parse() = %v, want only the one good row", ix)
+	}
+}
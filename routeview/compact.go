@@ -0,0 +1,156 @@
+package routeview
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"sort"
+)
+
+// Searcher is implemented by both Index and CompactIndex.
+type Searcher interface {
+	Search(s string) (IPNet, error)
+}
+
+// CompactIndex is a searchable, memory-efficient alternative to Index. Every
+// entry in an Index holds a full net.IPNet, which costs two slice headers plus
+// their backing arrays per prefix. A CompactIndex instead groups prefixes by
+// address family and prefix length, so each IPv4 prefix is stored as only a
+// 4-byte start address and each IPv6 prefix as a 16-byte start address, along
+// with a 4-byte index into a table of interned systems strings.
+type CompactIndex struct {
+	tiers   []compactTier
+	systems []string
+}
+
+// compactTier holds all prefixes of one address family and prefix length,
+// sorted by start address. The visibilities are nil unless the data has them.
+type compactTier struct {
+	bits         int
+	v4starts     []uint32
+	v6starts     [][16]byte
+	systems      []uint32
+	visibilities []uint32
+}
+
+// add appends the visibility of the i-th prefix of the tier, only allocating
+// visibilities once a prefix has one.
+func (t *compactTier) add(i, visibility int) {
+	if visibility == 0 && t.visibilities == nil {
+		return
+	}
+	if t.visibilities == nil {
+		t.visibilities = make([]uint32, i, i+1)
+	}
+	t.visibilities = append(t.visibilities, uint32(visibility))
+}
+
+// visibility returns the visibility of the i-th prefix of the tier.
+func (t *compactTier) visibility(i int) int {
+	if i >= len(t.visibilities) {
+		return 0
+	}
+	return int(t.visibilities[i])
+}
+
+// Compact converts the Index into an equivalent CompactIndex.
+func (ix Index) Compact() CompactIndex {
+	c := CompactIndex{}
+	interned := map[string]uint32{}
+	intern := func(s string) uint32 {
+		if i, ok := interned[s]; ok {
+			return i
+		}
+		i := uint32(len(c.systems))
+		interned[s] = i
+		c.systems = append(c.systems, s)
+		return i
+	}
+	// The Index is ordered from longest to shortest prefix, and each NetIndex
+	// is sorted, so the tiers built here inherit both orderings.
+	for _, ns := range ix.tiers {
+		var v4, v6 compactTier
+		for _, n := range ns {
+			bits, _ := n.Mask.Size()
+			if ip4 := n.IP.To4(); ip4 != nil && len(n.IP) == net.IPv4len {
+				v4.bits = bits
+				v4.add(len(v4.v4starts), n.Visibility)
+				v4.v4starts = append(v4.v4starts, binary.BigEndian.Uint32(ip4))
+				v4.systems = append(v4.systems, intern(n.Systems))
+			} else {
+				var start [16]byte
+				copy(start[:], n.IP.To16())
+				v6.bits = bits
+				v6.add(len(v6.v6starts), n.Visibility)
+				v6.v6starts = append(v6.v6starts, start)
+				v6.systems = append(v6.systems, intern(n.Systems))
+			}
+		}
+		if len(v4.v4starts) > 0 {
+			c.tiers = append(c.tiers, v4)
+		}
+		if len(v6.v6starts) > 0 {
+			c.tiers = append(c.tiers, v6)
+		}
+	}
+	return c
+}
+
+// ParseRouteViewCompact reads the given csv file and generates a CompactIndex.
+func ParseRouteViewCompact(file []byte) CompactIndex {
+	return ParseRouteView(file).Compact()
+}
+
+// Search attempts to find the given IP in the CompactIndex. It returns the same
+// results as Index.Search on the Index the CompactIndex was built from.
+func (c CompactIndex) Search(s string) (IPNet, error) {
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return IPNet{}, ErrNoASNFound
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		addr := binary.BigEndian.Uint32(ip4)
+		// Search each tier from longest to shortest, returning the first (longest) match.
+		for _, t := range c.tiers {
+			if t.v4starts == nil {
+				continue
+			}
+			mask := uint32(0xffffffff) << (32 - t.bits)
+			if t.bits == 0 {
+				mask = 0
+			}
+			net4 := addr & mask
+			i := sort.Search(len(t.v4starts), func(i int) bool { return t.v4starts[i] >= net4 })
+			if i < len(t.v4starts) && t.v4starts[i] == net4 {
+				start := make(net.IP, net.IPv4len)
+				binary.BigEndian.PutUint32(start, net4)
+				return c.entry(start, t.bits, 32, t.systems[i], t.visibility(i)), nil
+			}
+		}
+		return IPNet{}, ErrNoASNFound
+	}
+	for _, t := range c.tiers {
+		if t.v6starts == nil {
+			continue
+		}
+		mask := net.CIDRMask(t.bits, 128)
+		var net6 [16]byte
+		copy(net6[:], ip.Mask(mask))
+		i := sort.Search(len(t.v6starts), func(i int) bool { return bytes.Compare(t.v6starts[i][:], net6[:]) >= 0 })
+		if i < len(t.v6starts) && t.v6starts[i] == net6 {
+			return c.entry(net.IP(net6[:]), t.bits, 128, t.systems[i], t.visibility(i)), nil
+		}
+	}
+	return IPNet{}, ErrNoASNFound
+}
+
+func (c CompactIndex) entry(start net.IP, bits, size int, systems uint32, visibility int) IPNet {
+	return IPNet{
+		IPNet: net.IPNet{
+			IP:   start,
+			Mask: net.CIDRMask(bits, size),
+		},
+		Systems:    c.systems[systems],
+		Visibility: visibility,
+	}
+}
@@ -0,0 +1,119 @@
+package routeview
+
+import (
+	"encoding/binary"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"reflect"
+	"runtime"
+	"testing"
+
+	"github.com/m-lab/go/rtx"
+	"github.com/m-lab/uuid-annotator/tarreader"
+)
+
+func readRouteView(filename string) []byte {
+	gz, err := ioutil.ReadFile(filename)
+	rtx.Must(err, "Failed to read routeview data")
+	raw, err := tarreader.FromGZ(gz)
+	rtx.Must(err, "Failed to decompress routeview")
+	return raw
+}
+
+// lastIP returns the last address in n.
+func lastIP(n net.IPNet) net.IP {
+	last := make(net.IP, len(n.IP))
+	for i := range n.IP {
+		last[i] = n.IP[i] | ^n.Mask[i]
+	}
+	return last
+}
+
+func TestCompactIndex_Search(t *testing.T) {
+	for _, filename := range []string{"../testdata/RouteViewIPv4.pfx2as.gz", "../testdata/RouteViewIPv6.pfx2as.gz"} {
+		t.Run(filename, func(t *testing.T) {
+			ix := ParseRouteView(readRouteView(filename))
+			c := ix.Compact()
+
+			// Search for the first and last address of a sample of prefixes, and
+			// for a set of random addresses, most of which will be in some
+			// shorter prefix or missing entirely.
+			src := []string{"", "not-an-ip", "9.0.0.9", "2001:ff00::1", "0.0.0.0", "::"}
+			for i, ns := range ix.tiers {
+				for j := 0; j < len(ns); j += 97 + i {
+					src = append(src, ns[j].IP.String(), lastIP(ns[j].IPNet).String())
+				}
+			}
+			r := rand.New(rand.NewSource(1))
+			for i := 0; i < 10000; i++ {
+				v4 := make(net.IP, 4)
+				binary.BigEndian.PutUint32(v4, r.Uint32())
+				v6 := make(net.IP, 16)
+				binary.BigEndian.PutUint64(v6, 0x2000000000000000|r.Uint64()>>4)
+				src = append(src, v4.String(), v6.String())
+			}
+
+			for _, s := range src {
+				want, wantErr := ix.Search(s)
+				got, err := c.Search(s)
+				if err != wantErr {
+					t.Fatalf("CompactIndex.Search(%q) error = %v, want %v", s, err, wantErr)
+				}
+				if !reflect.DeepEqual(got, want) {
+					t.Fatalf("CompactIndex.Search(%q) = %v, want %v", s, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestCompactIndex_Empty(t *testing.T) {
+	c := Index{}.Compact()
+	if _, err := c.Search("1.0.0.1"); err != ErrNoASNFound {
+		t.Errorf("CompactIndex.Search() error = %v, want %v", err, ErrNoASNFound)
+	}
+	c = ParseRouteViewCompact([]byte("0.0.0.0\t0\t1\n"))
+	got, err := c.Search("1.0.0.1")
+	rtx.Must(err, "Could not find the default route")
+	if got.String() != "0.0.0.0/0" || got.Systems != "1" {
+		t.Errorf("CompactIndex.Search() = %v, want the default route", got)
+	}
+}
+
+// heapAfterGC returns the number of live heap bytes.
+func heapAfterGC() uint64 {
+	runtime.GC()
+	m := runtime.MemStats{}
+	runtime.ReadMemStats(&m)
+	return m.HeapAlloc
+}
+
+// BenchmarkIndexMemory reports the heap used by an Index and a CompactIndex of
+// the full IPv4 RouteViews file.
+func BenchmarkIndexMemory(b *testing.B) {
+	raw := readRouteView("../testdata/RouteViewIPv4.pfx2as.gz")
+	for i := 0; i < b.N; i++ {
+		before := heapAfterGC()
+		ix := ParseRouteView(raw)
+		indexBytes := heapAfterGC() - before
+		c := ix.Compact()
+		ix = Index{}
+		compactBytes := heapAfterGC() - before
+		b.ReportMetric(float64(indexBytes), "index-bytes")
+		b.ReportMetric(float64(compactBytes), "compact-bytes")
+		runtime.KeepAlive(ix)
+		runtime.KeepAlive(c)
+	}
+}
+
+func BenchmarkCompactSearch(b *testing.B) {
+	c := ParseRouteViewCompact(readRouteView("../testdata/RouteViewIPv4.pfx2as.gz"))
+	src := []string{"1.0.192.1", "12.189.157.193"}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for _, s := range src {
+			c.Search(s)
+		}
+	}
+}
@@ -0,0 +1,22 @@
+package routeview
+
+import (
+	"path"
+	"regexp"
+	"time"
+)
+
+// dateDigits matches the digits of a date like 20230101.
+var dateDigits = regexp.MustCompile(`\d{8}`)
+
+// FileDate returns the generation date, as YYYY-MM-DD, in the name of a
+// RouteViews file, like routeviews-rv2-20230101-1200.pfx2as.gz, or "" if
+// the name has no date.
+func FileDate(name string) string {
+	for _, digits := range dateDigits.FindAllString(path.Base(name), -1) {
+		if t, err := time.Parse("20060102", digits); err == nil {
+			return t.Format("2006-01-02")
+		}
+	}
+	return ""
+}
@@ -0,0 +1,25 @@
+package routeview
+
+import "testing"
+
+func TestFileDate(t *testing.T) {
+	tests := []struct {
+		name string
+		want string
+	}{
+		{name: "routeviews-rv2-20230101-1200.pfx2as.gz", want: "2023-01-01"},
+		{name: "routeviews-rv6-20221231-1200.pfx2as.gz", want: "2022-12-31"},
+		{name: "/data/2023/01/RouteViewIPv4.20230115.gz", want: "2023-01-15"},
+		{name: "20230101/RouteViewIPv4.pfx2as.gz", want: ""},
+		{name: "RouteViewIPv4.99999999-20230102.gz", want: "2023-01-02"},
+		{name: "RouteViewIPv4.pfx2as.gz", want: ""},
+		{name: "", want: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := FileDate(tt.name); got != tt.want {
+				t.Errorf("FileDate(%q) = %q, want %q", tt.name, got, tt.want)
+			}
+		})
+	}
+}
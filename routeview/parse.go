@@ -20,13 +20,36 @@ import (
 type IPNet struct {
 	net.IPNet
 	Systems string
+
+	// Visibility is the number of RouteViews peers that observed the prefix,
+	// from the optional fourth column, or zero when the file does not have it.
+	Visibility int
 }
 
 // NetIndex is a sortable and searchable array of IPNets.
 type NetIndex []IPNet
 
-// Index is searchable array of NetIndexes.
-type Index []NetIndex
+// Index is a searchable set of RouteViews prefixes. Besides the prefixes, which
+// are grouped in tiers from longest to shortest prefix, it holds a
+// longest-prefix-match table for each address family. The tables split the
+// address space into disjoint ranges, each labeled with the most specific
+// prefix containing it, so Search is a single binary search instead of one per
+// prefix length.
+type Index struct {
+	nets  NetIndex
+	tiers []NetIndex
+	v4    lpmTable
+	v6    lpmTable
+}
+
+// lpmTable maps disjoint ranges of addresses to their longest matching prefix.
+// Each range starts at its start address and ends just before the start of the
+// next range. Ranges that are not in any prefix map to -1. IPv4 addresses are
+// right-aligned in the 16 bytes of the start.
+type lpmTable struct {
+	starts [][16]byte
+	nets   []int32
+}
 
 // Len, Less, and Swap make Index sortable.
 func (ns NetIndex) Len() int {
@@ -80,7 +103,7 @@ func ParseRouteView(file []byte) Index {
 	r.Comma = '\t'
 	r.ReuseRecord = true
 
-	nim := map[int64]NetIndex{}
+	nets := []IPNet{}
 
 	for {
 		record, err := r.Read()
@@ -92,7 +115,7 @@ func ParseRouteView(file []byte) Index {
 			metrics.RouteViewRows.WithLabelValues("missing-fields").Inc()
 			continue
 		}
-		nb, err := strconv.ParseInt(record[1], 10, 32)
+		_, err = strconv.ParseInt(record[1], 10, 32)
 		if err != nil {
 			// Skip malformed line.
 			skip++
@@ -112,53 +135,231 @@ func ParseRouteView(file []byte) Index {
 			// Break string connection to underlying RAM allocated by the CSV reader.
 			sm[record[2]] = strings.Repeat(record[2], 1)
 		}
+		visibility := 0
+		if len(record) > 3 {
+			// A malformed visibility is ignored, since the prefix is still valid.
+			v, err := strconv.Atoi(record[3])
+			if err != nil || v < 0 {
+				metrics.RouteViewRows.WithLabelValues("corrupt-visibility").Inc()
+			} else {
+				visibility = v
+			}
+		}
 		parsed++
 		metrics.RouteViewRows.WithLabelValues("parsed").Inc()
-		nim[nb] = append(nim[nb], IPNet{IPNet: *n, Systems: sm[record[2]]})
+		nets = append(nets, IPNet{IPNet: *n, Systems: sm[record[2]], Visibility: visibility})
 	}
 	logx.Debug.Println("Skipped:", skip, "routeview netblocks of", parsed+skip)
 
-	// For each netblock, sort each NetIndex array.
-	netblocks := []int64{}
-	for k := range nim {
-		netblocks = append(netblocks, k)
-		sort.Sort(nim[k])
-	}
-	// Sort descending order.
-	sort.Slice(netblocks, func(i, j int) bool { return netblocks[i] > netblocks[j] })
+	return NewIndex(nets)
+}
 
-	// Construct the final index, from largest to smallest netblock.
+// NewIndex creates an Index of the given prefixes. When several prefixes
+// contain an address, Search returns the longest.
+func NewIndex(nets []IPNet) Index {
 	ix := Index{}
-	for _, k := range netblocks {
-		ix = append(ix, nim[k])
+	if len(nets) == 0 {
+		return ix
+	}
+	// Sort the spans of each address family once. The order is shared by the
+	// tables and the tiers, which are built from it without sorting again.
+	v4Count := 0
+	for _, n := range nets {
+		if len(n.IP) == net.IPv4len {
+			v4Count++
+		}
+	}
+	v4 := make([]span, 0, v4Count)
+	v6 := make([]span, 0, len(nets)-v4Count)
+	for i, n := range nets {
+		if len(n.IP) == net.IPv4len {
+			v4 = append(v4, newSpan(n.IPNet, int32(i)))
+		} else {
+			v6 = append(v6, newSpan(n.IPNet, int32(i)))
+		}
+	}
+	sortSpans(v4)
+	sortSpans(v6)
+
+	// Construct the tiers, from largest to smallest netblock, in one array so
+	// the tables can refer to prefixes by their position. Each tier holds the
+	// sorted IPv4 prefixes, then the sorted IPv6 prefixes, of its length.
+	var counts [129]int
+	for _, n := range nets {
+		bits, _ := n.Mask.Size()
+		counts[bits]++
+	}
+	var offsets [129]int
+	all := make(NetIndex, len(nets))
+	for bits, start := 128, 0; bits >= 0; bits-- {
+		if counts[bits] == 0 {
+			continue
+		}
+		offsets[bits] = start
+		ix.tiers = append(ix.tiers, all[start:start+counts[bits]:start+counts[bits]])
+		start += counts[bits]
+	}
+	for _, spans := range [][]span{v4, v6} {
+		for k := range spans {
+			i := offsets[spans[k].bits]
+			offsets[spans[k].bits]++
+			all[i] = nets[spans[k].net]
+			// The position in the tiers keeps the order of the spans, so they
+			// stay sorted.
+			spans[k].net = int32(i)
+		}
 	}
+	ix.v4 = newLPMTable(v4, lastV4)
+	ix.v6 = newLPMTable(v6, lastV6)
+	ix.nets = all
 	return ix
 }
 
+// span is the range of addresses of the prefix at position net in an Index.
+type span struct {
+	start, end [16]byte
+	bits       int
+	net        int32
+}
+
+var (
+	lastV4 = [16]byte{12: 0xff, 13: 0xff, 14: 0xff, 15: 0xff}
+	lastV6 = [16]byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}
+)
+
+// newSpan returns the span of the prefix n. IPv4 prefixes are right-aligned,
+// so that their spans can be compared as 128-bit numbers.
+func newSpan(n net.IPNet, i int32) span {
+	s := span{net: i}
+	s.bits, _ = n.Mask.Size()
+	offset := 16 - len(n.IP)
+	for j := range n.IP {
+		s.start[offset+j] = n.IP[j] & n.Mask[j]
+		s.end[offset+j] = n.IP[j] | ^n.Mask[j]
+	}
+	return s
+}
+
+// spansByStart sorts spans by start, and shortest prefix first, so that nested
+// prefixes come after the prefixes containing them. Duplicates stay in the
+// order they were given to NewIndex, which is also their order in the tiers,
+// so that the first wins, as it would with a search of each tier. The order
+// is total, so that an unstable sort gives the same result as a stable one.
+type spansByStart []span
+
+func (s spansByStart) Len() int      { return len(s) }
+func (s spansByStart) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s spansByStart) Less(i, j int) bool {
+	if c := bytes.Compare(s[i].start[:], s[j].start[:]); c != 0 {
+		return c < 0
+	}
+	if s[i].bits != s[j].bits {
+		return s[i].bits < s[j].bits
+	}
+	return s[i].net < s[j].net
+}
+
+// sortSpans sorts the spans by spansByStart. RouteViews files are already in
+// that order, which is checked first, since checking is much faster than even
+// sorting sorted spans.
+func sortSpans(spans []span) {
+	if s := spansByStart(spans); !sort.IsSorted(s) {
+		sort.Sort(s)
+	}
+}
+
+// next returns the address after a, which must not be the last address.
+func next(a [16]byte) [16]byte {
+	for i := len(a) - 1; i >= 0; i-- {
+		a[i]++
+		if a[i] != 0 {
+			break
+		}
+	}
+	return a
+}
+
+// newLPMTable builds the table of the spans of one address family, whose last
+// address is last, sorted by spansByStart. Because prefixes are either nested
+// or disjoint, sweeping the spans in order of start address while keeping a
+// stack of the prefixes that contain the current address finds every boundary
+// between ranges.
+func newLPMTable(spans []span, last [16]byte) lpmTable {
+	// Every span starts a range, and most prefixes are not nested, so few
+	// more ranges follow their ends.
+	t := lpmTable{
+		starts: make([][16]byte, 0, len(spans)),
+		nets:   make([]int32, 0, len(spans)),
+	}
+	emit := func(start [16]byte, n int32) {
+		// A later range starting at the same address is more specific.
+		if k := len(t.starts); k > 0 && t.starts[k-1] == start {
+			t.nets[k-1] = n
+			return
+		}
+		t.starts = append(t.starts, start)
+		t.nets = append(t.nets, n)
+	}
+	stack := []span{}
+	pop := func() {
+		top := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		if top.end == last {
+			return
+		}
+		parent := int32(-1)
+		if len(stack) > 0 {
+			parent = stack[len(stack)-1].net
+		}
+		emit(next(top.end), parent)
+	}
+	for _, s := range spans {
+		for len(stack) > 0 && bytes.Compare(stack[len(stack)-1].end[:], s.start[:]) < 0 {
+			pop()
+		}
+		if k := len(stack); k > 0 && stack[k-1].start == s.start && stack[k-1].bits == s.bits {
+			continue
+		}
+		emit(s.start, s.net)
+		stack = append(stack, s)
+	}
+	for len(stack) > 0 {
+		pop()
+	}
+	return t
+}
+
+// search returns the position of the longest prefix containing a, if any.
+func (t *lpmTable) search(a [16]byte) (int32, bool) {
+	// Find the first range that starts after a; the one before it contains a.
+	i := sort.Search(len(t.starts), func(i int) bool { return bytes.Compare(t.starts[i][:], a[:]) > 0 })
+	if i == 0 || t.nets[i-1] < 0 {
+		return 0, false
+	}
+	return t.nets[i-1], true
+}
+
 // ErrNoASNFound is returned when search fails to identify a network for the given src IP.
 var ErrNoASNFound = errors.New("no ASN found for address")
 
-// Search attempts to find the given IP in the Index.
+// Search attempts to find the given IP in the Index, returning the longest
+// prefix that contains it.
 func (ix Index) Search(s string) (IPNet, error) {
-	// bytes.Compare will only work correctly when both net.IPs have the same byte count.
 	ip := net.ParseIP(s)
-	if ip.To4() != nil {
-		ip = ip.To4()
-	}
-	// Search each set of NetIndexes from longest to shortest, returning the first (longest) match.
-	for i := range ix {
-		ns := ix[i]
-		node := sort.Search(len(ns), func(i int) bool {
-			if ns[i].Contains(ip) {
-				// Becaue sort.Search finds the lowest index where f(i) is true, we must return
-				// true when the IPNet contains the given IP to prevent off by 1 errors.
-				return true
-			}
-			return bytes.Compare(ns[i].IP, ip) >= 0
-		})
-		if node < len(ns) && ns[node].Contains(ip) {
-			return ns[node], nil
-		}
+	if ip == nil {
+		return IPNet{}, ErrNoASNFound
+	}
+	var a [16]byte
+	t := &ix.v6
+	if ip4 := ip.To4(); ip4 != nil {
+		copy(a[12:], ip4)
+		t = &ix.v4
+	} else {
+		copy(a[:], ip)
+	}
+	i, ok := t.search(a)
+	if !ok {
+		return IPNet{}, ErrNoASNFound
 	}
-	return IPNet{}, ErrNoASNFound
+	return ix.nets[i], nil
 }
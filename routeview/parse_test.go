@@ -1,9 +1,11 @@
 package routeview
 
 import (
+	"encoding/binary"
 	"fmt"
 	"io/ioutil"
 	"log"
+	"math/rand"
 	"net"
 	"reflect"
 	"testing"
@@ -60,8 +62,8 @@ func TestParseRouteView(t *testing.T) {
 // Count returns the total number of networks in the index.
 func countIndex(ix Index) int {
 	total := 0
-	for i := range ix {
-		total += len(ix[i])
+	for i := range ix.tiers {
+		total += len(ix.tiers[i])
 	}
 	return total
 }
@@ -181,6 +183,119 @@ func TestIndex_Search(t *testing.T) {
 			if got.Systems != tt.want.Systems {
 				t.Errorf("Index.Search() returned wrong Systems = %q, want %q", got.Systems, tt.want.Systems)
 			}
+			// These files have no visibility column.
+			if got.Visibility != 0 {
+				t.Errorf("Index.Search() returned Visibility = %d, want 0", got.Visibility)
+			}
+		})
+	}
+}
+
+func TestNewIndex(t *testing.T) {
+	nets := []IPNet{}
+	for _, row := range [][2]string{
+		{"0.0.0.0/0", "1"},
+		{"10.0.0.0/8", "2"},
+		{"10.1.0.0/16", "3"},
+		{"10.1.0.0/24", "4"},
+		{"10.255.255.0/24", "5"},
+		{"255.255.255.255/32", "6"},
+		{"2001:db8::/32", "7"},
+		{"2001:db8::/48", "8"},
+		{"ffff::/16", "9"},
+	} {
+		_, n, err := net.ParseCIDR(row[0])
+		rtx.Must(err, "Could not parse %q", row[0])
+		nets = append(nets, IPNet{IPNet: *n, Systems: row[1]})
+	}
+	// The prefixes need not be sorted.
+	reversed := make([]IPNet, len(nets))
+	for i, n := range nets {
+		reversed[len(nets)-1-i] = n
+	}
+	tests := []struct {
+		src  string
+		want string
+	}{
+		{src: "9.255.255.255", want: "1"},
+		{src: "10.0.0.1", want: "2"},
+		{src: "10.1.0.255", want: "4"},
+		{src: "10.1.1.0", want: "3"},
+		{src: "10.2.0.0", want: "2"},
+		{src: "10.255.255.255", want: "5"},
+		{src: "11.0.0.0", want: "1"},
+		{src: "255.255.255.254", want: "1"},
+		{src: "255.255.255.255", want: "6"},
+		{src: "2001:db8::1", want: "8"},
+		{src: "2001:db8:1::", want: "7"},
+		{src: "2001:db9::", want: ""},
+		{src: "ffff:ffff:ffff:ffff:ffff:ffff:ffff:ffff", want: "9"},
+		{src: "::ffff:10.1.0.1", want: "4"},
+	}
+	for _, ix := range []Index{NewIndex(nets), NewIndex(reversed)} {
+		for _, tt := range tests {
+			got, err := ix.Search(tt.src)
+			if tt.want == "" {
+				if err != ErrNoASNFound {
+					t.Errorf("Index.Search(%q) = %v, %v; want %v", tt.src, got, err, ErrNoASNFound)
+				}
+				continue
+			}
+			if err != nil || got.Systems != tt.want {
+				t.Errorf("Index.Search(%q) = %v, %v; want Systems %q", tt.src, got, err, tt.want)
+			}
+		}
+	}
+	// Of duplicate prefixes, the first wins.
+	dup := NewIndex([]IPNet{nets[2], {IPNet: nets[2].IPNet, Systems: "dup"}})
+	if got, err := dup.Search("10.1.0.1"); err != nil || got.Systems != "3" {
+		t.Errorf("Index.Search() of a duplicate = %v, %v; want Systems %q", got, err, "3")
+	}
+	if _, err := (Index{}).Search("1.0.0.1"); err != ErrNoASNFound {
+		t.Errorf("Index{}.Search() error = %v, want %v", err, ErrNoASNFound)
+	}
+}
+
+func TestParseRouteView_visibility(t *testing.T) {
+	ix := ParseRouteView(readRouteView("../testdata/RouteViewVisibility.pfx2as.gz"))
+	tests := []struct {
+		name string
+		src  string
+		want int
+	}{
+		{
+			name: "with-visibility",
+			src:  "1.0.0.1",
+			want: 42,
+		},
+		{
+			name: "shorter-prefix-with-visibility",
+			src:  "1.0.5.1",
+			want: 7,
+		},
+		{
+			name: "without-visibility",
+			src:  "1.0.4.1",
+		},
+		{
+			name: "corrupt-visibility",
+			src:  "1.0.16.1",
+		},
+		{
+			name: "ipv6",
+			src:  "2001:200::1",
+			want: 17,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for name, s := range map[string]Searcher{"Index": ix, "CompactIndex": ix.Compact()} {
+				got, err := s.Search(tt.src)
+				rtx.Must(err, "Failed to find %s", tt.src)
+				if got.Visibility != tt.want {
+					t.Errorf("%s.Search(%q).Visibility = %d, want %d", name, tt.src, got.Visibility, tt.want)
+				}
+			}
 		})
 	}
 }
@@ -209,3 +324,41 @@ func BenchmarkSearch(b *testing.B) {
 	}
 	fmt.Println("f:", found, "m:", missing)
 }
+
+// BenchmarkSearchRandom compares the single lookup of an Index with the search
+// of every prefix length of a CompactIndex, for random IPv4 addresses in the
+// full IPv4 dataset.
+func BenchmarkSearchRandom(b *testing.B) {
+	ix := ParseRouteView(readRouteView("../testdata/RouteViewIPv4.pfx2as.gz"))
+	r := rand.New(rand.NewSource(1))
+	src := make([]string, 1024)
+	for i := range src {
+		v4 := make(net.IP, 4)
+		binary.BigEndian.PutUint32(v4, r.Uint32())
+		src[i] = v4.String()
+	}
+	searchers := []struct {
+		name string
+		s    Searcher
+	}{
+		{"Index", ix},
+		{"CompactIndex", ix.Compact()},
+	}
+	for _, tt := range searchers {
+		b.Run(tt.name, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				tt.s.Search(src[i%len(src)])
+			}
+		})
+	}
+}
+
+// BenchmarkParseRouteView measures loading the full IPv4 dataset, including
+// building its longest-prefix-match table.
+func BenchmarkParseRouteView(b *testing.B) {
+	raw := readRouteView("../testdata/RouteViewIPv4.pfx2as.gz")
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		ParseRouteView(raw)
+	}
+}
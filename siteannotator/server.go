@@ -4,6 +4,8 @@ import (
 	"context"
 	"encoding/json"
 	"errors"
+	"fmt"
+	"log"
 	"net"
 	"sync"
 
@@ -12,42 +14,153 @@ import (
 
 	"github.com/m-lab/tcp-info/inetdiag"
 	"github.com/m-lab/uuid-annotator/annotator"
+	"github.com/m-lab/uuid-annotator/metrics"
 )
 
+// SiteAnnotator is the server Annotator, whose siteinfo can be reloaded.
+type SiteAnnotator interface {
+	annotator.Annotator
+
+	// Reload reloads the siteinfo, and replaces the server annotations and
+	// local IPs if it loaded successfully.
+	Reload(ctx context.Context)
+
+	// LocalIPs returns the current local IPs, including the public IPs of a
+	// virtual site, which may change on Reload.
+	LocalIPs() []net.IP
+}
+
 // siteAnnotator is the central struct for this module.
 type siteAnnotator struct {
-	m              sync.RWMutex
-	localIPs       []net.IP
-	siteinfoSource content.Provider
-	hostname       string
-	server         *annotator.ServerAnnotations
-	v4             net.IPNet
-	v6             net.IPNet
+	m               sync.RWMutex
+	localIPs        *annotator.LocalIPSet
+	siteinfoSources []content.Provider
+	hostname        string
+	server          *annotator.ServerAnnotations
+	v4              net.IPNet
+	v6              net.IPNet
+
+	// machineIPs are the local IPs passed to New, and ips are those plus the
+	// public IPs of a virtual site.
+	machineIPs []net.IP
+	ips        []net.IP
+
+	// siteinfo holds the last data from each source, for sources that report
+	// no change on reload.
+	siteinfo [][]byte
+
+	// bothCIDRs enables annotating V4CIDR and V6CIDR.
+	bothCIDRs bool
+
+	// limitPrivate restricts the private server IPs outside the site's blocks
+	// that are annotated to those in private.
+	limitPrivate bool
+	private      []*net.IPNet
+
+	annotator.ReloadGuard
 }
 
 // ErrHostnameNotFound is generated when the given hostname cannot be found in the
 // downloaded siteinfo annotations.
 var ErrHostnameNotFound = errors.New("hostname not found")
 
+// Option configures optional behavior in New.
+type Option func(*siteAnnotator)
+
+// WithBothCIDRs annotates the server Network with both the IPv4 and IPv6
+// blocks of the site, as V4CIDR and V6CIDR, in addition to the CIDR of the
+// connection's address family.
+func WithBothCIDRs() Option {
+	return func(g *siteAnnotator) {
+		g.bothCIDRs = true
+	}
+}
+
+// WithPrivateServerIPs limits the private server IPs (10.0.0.0/8,
+// 172.16.0.0/12, 192.168.0.0/16, and fc00::/7) outside the site's blocks that
+// are annotated, like the internal IPs of cloud machines, to those in the
+// allowed blocks. With no blocks, none of them are. By default, every such IP
+// is annotated. IPs in the site's blocks and public IPs are always annotated.
+func WithPrivateServerIPs(allowed ...*net.IPNet) Option {
+	return func(g *siteAnnotator) {
+		g.limitPrivate = true
+		g.private = append(g.private, allowed...)
+	}
+}
+
 // New makes a new server Annotator using metadata from siteinfo JSON.
-func New(ctx context.Context, hostname string, js content.Provider, localIPs []net.IP) (annotator.Annotator, []net.IP) {
+func New(ctx context.Context, hostname string, js content.Provider, localIPs []net.IP, opts ...Option) (SiteAnnotator, []net.IP) {
+	return NewMulti(ctx, hostname, []content.Provider{js}, localIPs, opts...)
+}
+
+// NewMulti is like New, but the siteinfo may be split across several sources,
+// which are merged before the hostname is looked up. When a hostname appears
+// in more than one source, the entry from the later source takes precedence.
+func NewMulti(ctx context.Context, hostname string, js []content.Provider, localIPs []net.IP, opts ...Option) (SiteAnnotator, []net.IP) {
 	g := &siteAnnotator{
-		siteinfoSource: js,
-		hostname:       hostname,
+		siteinfoSources: js,
+		hostname:        hostname,
+		machineIPs:      localIPs,
+	}
+	for _, opt := range opts {
+		opt(g)
 	}
 	var err error
 	g.server, localIPs, err = g.load(ctx, localIPs)
-	g.localIPs = localIPs
+	g.localIPs = annotator.NewLocalIPSet(localIPs)
+	g.ips = localIPs
 	rtx.Must(err, "Could not load annotation db")
 	return g, localIPs
 }
 
+// Reload reloads the siteinfo. If the public IPs of a virtual site changed,
+// the old IPs are removed from the local IPs and the new ones are added. Other
+// annotators do not see the change until they are given the new LocalIPs.
+func (g *siteAnnotator) Reload(ctx context.Context) {
+	if !g.AllowReload() {
+		return
+	}
+	s, err := g.fetch(ctx)
+	if err != nil {
+		log.Println("Could not reload siteinfo:", err)
+		g.ReloadFailed()
+		return
+	}
+	g.m.Lock()
+	defer g.m.Unlock()
+	server, localIPs, err := g.lookup(s, g.machineIPs)
+	if err != nil {
+		log.Println("Could not reload siteinfo:", err)
+		g.ReloadFailed()
+		return
+	}
+	g.server = server
+	g.localIPs.Update(localIPs)
+	g.ips = localIPs
+}
+
+// UpdateLocalNets replaces the local netblocks used to find the server of
+// connections without a local IP.
+func (g *siteAnnotator) UpdateLocalNets(localNets []net.IPNet) {
+	g.localIPs.UpdateNets(localNets)
+}
+
+// LocalIPs returns the current local IPs.
+func (g *siteAnnotator) LocalIPs() []net.IP {
+	g.m.RLock()
+	defer g.m.RUnlock()
+	return g.ips
+}
+
+// Name returns "siteinfo".
+func (*siteAnnotator) Name() string { return "siteinfo" }
+
 // Annotate assigns the server geolocation and ASN metadata.
 func (g *siteAnnotator) Annotate(ID *inetdiag.SockID, annotations *annotator.Annotations) error {
 	g.m.RLock()
 	defer g.m.RUnlock()
 
-	dir, err := annotator.FindDirection(ID, g.localIPs)
+	dir, err := g.localIPs.FindDirection(ID)
 	if err != nil {
 		return err
 	}
@@ -65,21 +178,49 @@ func (g *siteAnnotator) Annotate(ID *inetdiag.SockID, annotations *annotator.Ann
 // different netblocks. The siteinfo configuration only knows about the public
 // IP address. Rather than exclude annotations for these cases, `annotate()`
 // uses the v4 config (if present) for IPv4 src addresses, and the v6 config (if
-// present) for IPv6 src addresses.
+// present) for IPv6 src addresses. Private addresses outside the configured
+// blocks are annotated unless WithPrivateServerIPs does not allow them.
 func (g *siteAnnotator) annotate(src string, server *annotator.ServerAnnotations) {
 	n := net.ParseIP(src)
+	if !g.allowedHoldingLock(n) {
+		return
+	}
 	switch {
 	case n.To4() != nil && g.v4.IP != nil:
 		// If src and config are IPv4 addresses.
-		*server = *g.server
-		(*server).Network.CIDR = g.v4.String()
+		g.annotateWithCIDR(g.v4.String(), server)
 	case n.To4() == nil && g.v6.IP != nil:
 		// If src and config are IPv6 addresses.
-		*server = *g.server
-		(*server).Network.CIDR = g.v6.String()
+		g.annotateWithCIDR(g.v6.String(), server)
 	}
 }
 
+// annotateWithCIDR copies the server annotations with the given CIDR. The
+// Network is copied too, since g.server is shared by every caller.
+func (g *siteAnnotator) annotateWithCIDR(cidr string, server *annotator.ServerAnnotations) {
+	*server = *g.server
+	network := annotator.Network{}
+	if g.server.Network != nil {
+		network = *g.server.Network
+	}
+	network.CIDR = cidr
+	server.Network = &network
+}
+
+// allowedHoldingLock returns false for private IPs that are neither in the
+// site's blocks nor allowed by WithPrivateServerIPs, when it was given.
+func (g *siteAnnotator) allowedHoldingLock(ip net.IP) bool {
+	if !g.limitPrivate || ip == nil || !ip.IsPrivate() || g.v4.Contains(ip) || g.v6.Contains(ip) {
+		return true
+	}
+	for _, p := range g.private {
+		if p.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
 type siteinfoAnnotation struct {
 	Annotation annotator.ServerAnnotations
 	Network    struct {
@@ -93,14 +234,14 @@ func parseCIDR(v4, v6 string) (net.IPNet, net.IPNet, error) {
 	var v4ret, v6ret net.IPNet
 	_, v4net, err := net.ParseCIDR(v4)
 	if err != nil && v4 != "" {
-		return v4ret, v6ret, err
+		return v4ret, v6ret, fmt.Errorf("%w: %w", annotator.ErrInvalidIP, err)
 	}
 	if v4 != "" {
 		v4ret = *v4net
 	}
 	_, v6net, err := net.ParseCIDR(v6)
 	if err != nil && v6 != "" {
-		return v4ret, v6ret, err
+		return v4ret, v6ret, fmt.Errorf("%w: %w", annotator.ErrInvalidIP, err)
 	}
 	if v6 != "" {
 		v6ret = *v6net
@@ -110,31 +251,79 @@ func parseCIDR(v4, v6 string) (net.IPNet, net.IPNet, error) {
 
 // load unconditionally loads siteinfo dataset and returns them.
 func (g *siteAnnotator) load(ctx context.Context, localIPs []net.IP) (*annotator.ServerAnnotations, []net.IP, error) {
-	js, err := g.siteinfoSource.Get(ctx)
+	s, err := g.fetch(ctx)
 	if err != nil {
 		return nil, nil, err
 	}
-	var s map[string]siteinfoAnnotation
-	err = json.Unmarshal(js, &s)
-	if err != nil {
-		return nil, nil, err
+	return g.lookup(s, localIPs)
+}
+
+// fetch gets and merges the siteinfo from every source.
+func (g *siteAnnotator) fetch(ctx context.Context) (map[string]siteinfoAnnotation, error) {
+	raw := make([][]byte, len(g.siteinfoSources))
+	s := map[string]siteinfoAnnotation{}
+	for i, src := range g.siteinfoSources {
+		js, err := src.Get(ctx)
+		if err == content.ErrNoChange && i < len(g.siteinfo) {
+			js, err = g.siteinfo[i], nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		raw[i] = js
+		// Unmarshaling into a non-empty map replaces colliding keys, so later
+		// sources take precedence.
+		err = json.Unmarshal(js, &s)
+		if err != nil {
+			return nil, err
+		}
 	}
+	g.siteinfo = raw
+	return s, nil
+}
+
+// lookup finds the hostname in the siteinfo, sets the site's networks, and
+// returns its annotations and the local IPs.
+func (g *siteAnnotator) lookup(s map[string]siteinfoAnnotation, localIPs []net.IP) (*annotator.ServerAnnotations, []net.IP, error) {
 	if v, ok := s[g.hostname]; ok {
-		g.v4, g.v6, err = parseCIDR(v.Network.IPv4, v.Network.IPv6)
+		v4, v6, err := parseCIDR(v.Network.IPv4, v.Network.IPv6)
 		if err != nil {
 			return nil, nil, err
 		}
+		g.v4, g.v6 = v4, v6
 		// If this is a virtual site, append the site's public IP addresses to
 		// localIPs. The public addresses of the load balancer are not known on
 		// any interface on the machine. Without adding them to localIPs,
 		// uuid-annotator will fail to recognize its own public addresses in
 		// either the Src or Dest fields of incoming tcp-info events, and will
 		// fail to annotate anything.
-		if v.Type == "virtual" {
-			localIPs = append(localIPs, g.v4.IP, g.v6.IP)
+		switch v.Type {
+		case "virtual":
+			// Never append in place, so that the machine IPs are reused
+			// unchanged on reload.
+			localIPs = append(localIPs[:len(localIPs):len(localIPs)], g.v4.IP, g.v6.IP)
+		case "physical", "":
+			// The public IPs are on the interfaces of the machine. Older
+			// siteinfo has no Type, and only physical sites.
+		default:
+			// A new deployment model may need its own handling, so it is
+			// treated as physical until that is decided, but not silently.
+			log.Printf("Unknown siteinfo Type %q for %q, treating it as physical", v.Type, g.hostname)
+			metrics.SiteinfoUnknownTypes.Inc()
 		}
 
+		if g.bothCIDRs {
+			if v.Annotation.Network == nil {
+				v.Annotation.Network = &annotator.Network{}
+			}
+			if g.v4.IP != nil {
+				v.Annotation.Network.V4CIDR = g.v4.String()
+			}
+			if g.v6.IP != nil {
+				v.Annotation.Network.V6CIDR = g.v6.String()
+			}
+		}
 		return &v.Annotation, localIPs, nil
 	}
-	return nil, nil, ErrHostnameNotFound
+	return nil, nil, fmt.Errorf("%w: %q", ErrHostnameNotFound, g.hostname)
 }
@@ -2,6 +2,7 @@ package siteannotator
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"net"
 	"net/url"
@@ -14,6 +15,8 @@ import (
 	"github.com/m-lab/go/rtx"
 	"github.com/m-lab/tcp-info/inetdiag"
 	"github.com/m-lab/uuid-annotator/annotator"
+	"github.com/m-lab/uuid-annotator/metrics"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 )
 
 type badProvider struct {
@@ -339,8 +342,8 @@ func Test_srvannotator_load(t *testing.T) {
 			setUp()
 			bad = &badProvider{fmt.Errorf("Fake load error")}
 			g := &siteAnnotator{
-				siteinfoSource: *tt.provider,
-				hostname:       tt.hostname,
+				siteinfoSources: []content.Provider{*tt.provider},
+				hostname:        tt.hostname,
 			}
 			ctx := context.Background()
 			an, localIPs, err := g.load(ctx, testLocalIPs)
@@ -356,3 +359,345 @@ func Test_srvannotator_load(t *testing.T) {
 		})
 	}
 }
+
+func Test_srvannotator_load_errorsIs(t *testing.T) {
+	ctx := context.Background()
+	tests := []struct {
+		name     string
+		hostname string
+		want     error
+	}{
+		{
+			name:     "hostname-not-found",
+			hostname: "mlab1-abc01.mlab-sandbox.measurement-lab.org",
+			want:     ErrHostnameNotFound,
+		},
+		{
+			name:     "invalid-ipv4",
+			hostname: "mlab1-bad04.mlab-sandbox.measurement-lab.org",
+			want:     annotator.ErrInvalidIP,
+		},
+		{
+			name:     "invalid-ipv6",
+			hostname: "mlab1-bad06.mlab-sandbox.measurement-lab.org",
+			want:     annotator.ErrInvalidIP,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setUp()
+			g := &siteAnnotator{
+				siteinfoSources: []content.Provider{localRawfile},
+				hostname:        tt.hostname,
+			}
+			_, _, err := g.load(ctx, nil)
+			if !errors.Is(err, tt.want) {
+				t.Errorf("srvannotator.load() error = %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestAnnotate_errorsIs(t *testing.T) {
+	setUp()
+	g, _ := New(context.Background(), "mlab1-lga03.mlab-sandbox.measurement-lab.org", localRawfile, []net.IP{net.ParseIP("64.86.148.137")})
+	ID := &inetdiag.SockID{SrcIP: "2.0.0.2", DstIP: "1.0.0.1"}
+	err := g.Annotate(ID, &annotator.Annotations{})
+	if !errors.Is(err, annotator.ErrUnknownDirection) {
+		t.Errorf("srvannotator.Annotate() error = %v, want %v", err, annotator.ErrUnknownDirection)
+	}
+}
+
+func Test_srvannotator_loadMerged(t *testing.T) {
+	extra := func() content.Provider {
+		u, err := url.Parse("file:../testdata/annotations-extra.json")
+		rtx.Must(err, "Could not parse URL")
+		p, err := content.FromURL(context.Background(), u)
+		rtx.Must(err, "Could not create content.Provider")
+		return p
+	}
+	tests := []struct {
+		name     string
+		hostname string
+		want     *annotator.ServerAnnotations
+	}{
+		{
+			name:     "hostname-only-in-second",
+			hostname: "mlab1-abc01.mlab-sandbox.measurement-lab.org",
+			want: &annotator.ServerAnnotations{
+				Site:    "abc01",
+				Machine: "mlab1",
+				Geo: &annotator.Geolocation{
+					City: "Albany",
+				},
+				Network: &annotator.Network{
+					ASName: "TEST NETWORK",
+				},
+			},
+		},
+		{
+			name:     "hostname-only-in-first",
+			hostname: "mlab1-six02.mlab-sandbox.measurement-lab.org",
+			want: &annotator.ServerAnnotations{
+				Site:    "six02",
+				Machine: "mlab1",
+				Geo: &annotator.Geolocation{
+					City: "New York",
+				},
+				Network: &annotator.Network{
+					ASName: "TATA COMMUNICATIONS (AMERICA) INC",
+				},
+			},
+		},
+		{
+			name:     "later-source-takes-precedence",
+			hostname: "mlab1-six01.mlab-sandbox.measurement-lab.org",
+			want: &annotator.ServerAnnotations{
+				Site:    "six01",
+				Machine: "mlab1",
+				Geo: &annotator.Geolocation{
+					City: "Override City",
+				},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setUp()
+			g := &siteAnnotator{
+				siteinfoSources: []content.Provider{localRawfile, extra()},
+				hostname:        tt.hostname,
+			}
+			an, _, err := g.load(context.Background(), nil)
+			rtx.Must(err, "Could not load merged siteinfo")
+			if diff := deep.Equal(an, tt.want); diff != nil {
+				t.Errorf("load() failed; %s", strings.Join(diff, "\n"))
+			}
+		})
+	}
+
+	// A failure of any source is a failure to load.
+	g := &siteAnnotator{
+		siteinfoSources: []content.Provider{extra(), &badProvider{errors.New("fake load error")}},
+		hostname:        "mlab1-abc01.mlab-sandbox.measurement-lab.org",
+	}
+	if _, _, err := g.load(context.Background(), nil); err == nil {
+		t.Error("load() should fail when any source fails")
+	}
+}
+
+// seqProvider returns each of its contents in turn, and then ErrNoChange.
+type seqProvider struct {
+	contents [][]byte
+}
+
+func (p *seqProvider) Get(_ context.Context) ([]byte, error) {
+	if len(p.contents) == 0 {
+		return nil, content.ErrNoChange
+	}
+	b := p.contents[0]
+	p.contents = p.contents[1:]
+	return b, nil
+}
+
+func TestReload_virtualPublicIPChanged(t *testing.T) {
+	siteinfo := func(v4 string) []byte {
+		return []byte(`{"mlab1-abc0t.mlab-sandbox.measurement-lab.org": {
+			"Annotation": {"Site": "abc0t", "Machine": "mlab1", "Network": {"ASNumber": 15169}},
+			"Network": {"IPv4": "` + v4 + `", "IPv6": ""},
+			"Type": "virtual"}}`)
+	}
+	p := &seqProvider{contents: [][]byte{
+		siteinfo("35.1.1.1/32"),
+		siteinfo("35.2.2.2/32"),
+	}}
+	machine := []net.IP{net.ParseIP("10.0.0.1")}
+	site, localIPs := New(context.Background(), "mlab1-abc0t.mlab-sandbox.measurement-lab.org", p, machine)
+	if !reflect.DeepEqual(localIPs, site.LocalIPs()) || len(localIPs) != 3 || !localIPs[1].Equal(net.ParseIP("35.1.1.1")) {
+		t.Fatalf("New() localIPs = %v, want the machine IP and the initial public IP", localIPs)
+	}
+
+	annotate := func(server string) error {
+		ID := &inetdiag.SockID{SrcIP: server, DstIP: "1.0.0.1"}
+		ann := &annotator.Annotations{}
+		if err := site.Annotate(ID, ann); err != nil {
+			return err
+		}
+		if ann.Server.Site != "abc0t" {
+			t.Errorf("Annotate() Server = %+v, want site abc0t", ann.Server)
+		}
+		return nil
+	}
+	rtx.Must(annotate("35.1.1.1"), "Could not annotate the initial public IP")
+
+	// The old public IP is replaced by the new one.
+	site.Reload(context.Background())
+	want := []net.IP{net.ParseIP("10.0.0.1"), net.ParseIP("35.2.2.2").To4(), nil}
+	if got := site.LocalIPs(); !reflect.DeepEqual(got, want) {
+		t.Errorf("LocalIPs() after Reload() = %v, want %v", got, want)
+	}
+	if err := annotate("35.1.1.1"); !errors.Is(err, annotator.ErrUnknownDirection) {
+		t.Errorf("Annotate() old public IP error = %v, want %v", err, annotator.ErrUnknownDirection)
+	}
+	rtx.Must(annotate("35.2.2.2"), "Could not annotate the new public IP")
+	if len(machine) != 1 {
+		t.Errorf("Reload() changed the machine IPs passed to New: %v", machine)
+	}
+
+	// Unchanged siteinfo keeps the current data.
+	site.Reload(context.Background())
+	rtx.Must(annotate("35.2.2.2"), "Could not annotate after an unchanged Reload()")
+
+	// A failed reload keeps the current data.
+	site.(*siteAnnotator).siteinfoSources = []content.Provider{&badProvider{errors.New("fake load error")}}
+	site.Reload(context.Background())
+	rtx.Must(annotate("35.2.2.2"), "Could not annotate after a failed Reload()")
+}
+
+func TestNew_unknownType(t *testing.T) {
+	p := &seqProvider{contents: [][]byte{[]byte(`{"mlab1-abc0t.mlab-sandbox.measurement-lab.org": {
+		"Annotation": {"Site": "abc0t", "Machine": "mlab1"},
+		"Network": {"IPv4": "35.1.1.1/32", "IPv6": ""},
+		"Type": "satellite"}}`)}}
+	machine := []net.IP{net.ParseIP("10.0.0.1")}
+	before := testutil.ToFloat64(metrics.SiteinfoUnknownTypes)
+	_, localIPs := New(context.Background(), "mlab1-abc0t.mlab-sandbox.measurement-lab.org", p, machine)
+	if got := testutil.ToFloat64(metrics.SiteinfoUnknownTypes) - before; got != 1 {
+		t.Errorf("SiteinfoUnknownTypes increased by %v, want 1", got)
+	}
+	if !reflect.DeepEqual(localIPs, machine) {
+		t.Errorf("New() localIPs = %v, want only the machine IPs %v", localIPs, machine)
+	}
+}
+
+func TestWithBothCIDRs(t *testing.T) {
+	tests := []struct {
+		name   string
+		opts   []Option
+		wantV4 string
+		wantV6 string
+	}{
+		{
+			name:   "both",
+			opts:   []Option{WithBothCIDRs()},
+			wantV4: "64.86.148.128/26",
+			wantV6: "2001:5a0:4300::/64",
+		},
+		{
+			name: "default",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setUp()
+			g, _ := New(context.Background(), "mlab1-lga03.mlab-sandbox.measurement-lab.org", localRawfile, []net.IP{net.ParseIP("64.86.148.137")}, tt.opts...)
+			ann := &annotator.Annotations{}
+			rtx.Must(g.Annotate(&inetdiag.SockID{SrcIP: "64.86.148.137", DstIP: "1.0.0.1"}, ann), "Failed to annotate")
+			if ann.Server.Network == nil {
+				t.Fatal("Annotate() did not set the server Network")
+			}
+			if got := ann.Server.Network.CIDR; got != "64.86.148.128/26" {
+				t.Errorf("Annotate() CIDR = %q, want 64.86.148.128/26", got)
+			}
+			if got := ann.Server.Network.V4CIDR; got != tt.wantV4 {
+				t.Errorf("Annotate() V4CIDR = %q, want %q", got, tt.wantV4)
+			}
+			if got := ann.Server.Network.V6CIDR; got != tt.wantV6 {
+				t.Errorf("Annotate() V6CIDR = %q, want %q", got, tt.wantV6)
+			}
+		})
+	}
+}
+
+func TestAnnotate_copiesNetwork(t *testing.T) {
+	setUp()
+	g, _ := New(context.Background(), "mlab1-lga03.mlab-sandbox.measurement-lab.org", localRawfile, []net.IP{net.ParseIP("64.86.148.137"), net.ParseIP("2001:5a0:4300::137")})
+	v4 := &annotator.Annotations{}
+	rtx.Must(g.Annotate(&inetdiag.SockID{SrcIP: "64.86.148.137", DstIP: "1.0.0.1"}, v4), "Failed to annotate")
+	v6 := &annotator.Annotations{}
+	rtx.Must(g.Annotate(&inetdiag.SockID{SrcIP: "2001:5a0:4300::137", DstIP: "2001:200::1"}, v6), "Failed to annotate")
+	// Annotating the IPv6 connection must not change the IPv4 annotation.
+	if got := v4.Server.Network.CIDR; got != "64.86.148.128/26" {
+		t.Errorf("IPv4 Annotate() CIDR = %q, want 64.86.148.128/26", got)
+	}
+	if got := v6.Server.Network.CIDR; got != "2001:5a0:4300::/64" {
+		t.Errorf("IPv6 Annotate() CIDR = %q, want 2001:5a0:4300::/64", got)
+	}
+}
+
+func TestWithPrivateServerIPs(t *testing.T) {
+	_, private, err := net.ParseCIDR("10.0.0.0/8")
+	rtx.Must(err, "Could not parse CIDR")
+	_, other, err := net.ParseCIDR("192.168.0.0/16")
+	rtx.Must(err, "Could not parse CIDR")
+	tests := []struct {
+		name     string
+		serverIP string
+		opts     []Option
+		wantSite string
+	}{
+		{
+			name:     "private-allowed",
+			serverIP: "10.0.0.1",
+			opts:     []Option{WithPrivateServerIPs(private)},
+			wantSite: "lga03",
+		},
+		{
+			name:     "private-without-option",
+			serverIP: "10.0.0.1",
+			wantSite: "lga03",
+		},
+		{
+			name:     "private-not-in-allowlist",
+			serverIP: "10.0.0.1",
+			opts:     []Option{WithPrivateServerIPs(other)},
+		},
+		{
+			name:     "private-empty-allowlist",
+			serverIP: "10.0.0.1",
+			opts:     []Option{WithPrivateServerIPs()},
+		},
+		{
+			name:     "public-outside-site-block-empty-allowlist",
+			serverIP: "35.1.1.1",
+			opts:     []Option{WithPrivateServerIPs()},
+			wantSite: "lga03",
+		},
+		{
+			name:     "public-in-site-block",
+			serverIP: "64.86.148.137",
+			wantSite: "lga03",
+		},
+		{
+			name:     "public-outside-site-block",
+			serverIP: "35.1.1.1",
+			wantSite: "lga03",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setUp()
+			g, _ := New(context.Background(), "mlab1-lga03.mlab-sandbox.measurement-lab.org", localRawfile, []net.IP{net.ParseIP(tt.serverIP)}, tt.opts...)
+			ann := &annotator.Annotations{}
+			rtx.Must(g.Annotate(&inetdiag.SockID{SrcIP: tt.serverIP, DstIP: "1.0.0.1"}, ann), "Failed to annotate")
+			if ann.Server.Site != tt.wantSite {
+				t.Errorf("Annotate() Site = %q, want %q", ann.Server.Site, tt.wantSite)
+			}
+		})
+	}
+}
+
+func TestNewMulti(t *testing.T) {
+	setUp()
+	u, err := url.Parse("file:../testdata/annotations-extra.json")
+	rtx.Must(err, "Could not parse URL")
+	extra, err := content.FromURL(context.Background(), u)
+	rtx.Must(err, "Could not create content.Provider")
+	// The host is only in the extra source.
+	g, _ := NewMulti(context.Background(), "mlab1-abc01.mlab-sandbox.measurement-lab.org", []content.Provider{localRawfile, extra}, []net.IP{net.ParseIP("192.0.2.1")})
+	ann := &annotator.Annotations{}
+	rtx.Must(g.Annotate(&inetdiag.SockID{SrcIP: "192.0.2.1", DstIP: "1.0.0.1"}, ann), "Failed to annotate")
+	if ann.Server.Site != "abc01" {
+		t.Errorf("Annotate() Site = %q, want abc01", ann.Server.Site)
+	}
+}
@@ -2,9 +2,11 @@ package tarreader
 
 import (
 	"archive/tar"
+	"archive/zip"
 	"bytes"
 	"compress/gzip"
 	"errors"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"strings"
@@ -13,6 +15,10 @@ import (
 // ErrFileNotFound is returned when the given name is not found in the archive.
 var ErrFileNotFound = errors.New("file not found")
 
+// ErrNotRegularFile is returned when the only entries in the archive matching
+// the given name are not regular files, e.g. directories or symlinks.
+var ErrNotRegularFile = errors.New("not a regular file")
+
 // FromGZ decompresses the given data.
 func FromGZ(gz []byte) ([]byte, error) {
 	gr, err := gzip.NewReader(bytes.NewReader(gz))
@@ -33,6 +39,28 @@ func FromTarGZ(tgz []byte, name string) ([]byte, error) {
 	return d, err
 }
 
+// FromZip reads the named file from the zip archive in data. Like FromTarGZ,
+// the name matches any file whose path in the archive ends with name, because
+// archives often put every file in a dated directory.
+func FromZip(data []byte, name string) ([]byte, error) {
+	zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range zr.File {
+		if !strings.HasSuffix(f.Name, name) {
+			continue
+		}
+		rc, err := f.Open()
+		if err != nil {
+			return nil, err
+		}
+		defer rc.Close()
+		return ioutil.ReadAll(rc)
+	}
+	return nil, ErrFileNotFound
+}
+
 // Helper functions for reading a target file from a .tar.gz archive.
 type tarReader struct {
 	*tar.Reader
@@ -51,15 +79,26 @@ func newTarReader(rdr io.Reader) (*tarReader, error) {
 	return t, nil
 }
 
+// readFile returns the first regular file whose name ends with name, skipping
+// directories, symlinks, and other entries with no content of their own.
 // NOTE: readFile is not guaranteed to work on more than one file.
 func (tr *tarReader) readFile(name string) ([]byte, error) {
+	notFound := ErrFileNotFound
 	for {
 		h, err := tr.Next()
 		if err == io.EOF {
-			return nil, ErrFileNotFound
+			return nil, notFound
+		}
+		if err != nil {
+			return nil, err
+		}
+		if !strings.HasSuffix(h.Name, name) {
+			continue
 		}
-		if strings.HasSuffix(h.Name, name) {
-			return ioutil.ReadAll(tr)
+		if h.Typeflag != tar.TypeReg {
+			notFound = fmt.Errorf("%w: %q has type %q", ErrNotRegularFile, h.Name, h.Typeflag)
+			continue
 		}
+		return ioutil.ReadAll(tr)
 	}
 }
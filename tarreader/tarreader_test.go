@@ -1,6 +1,10 @@
 package tarreader
 
 import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"errors"
 	"io/ioutil"
 	"reflect"
 	"testing"
@@ -58,6 +62,44 @@ func TestFromTarGZ(t *testing.T) {
 	}
 }
 
+// tgzOf returns a .tar.gz archive of the given entries, in order.
+func tgzOf(entries ...*tar.Header) []byte {
+	buf := &bytes.Buffer{}
+	gw := gzip.NewWriter(buf)
+	tw := tar.NewWriter(gw)
+	for _, h := range entries {
+		rtx.Must(tw.WriteHeader(h), "Could not write header %q", h.Name)
+		if h.Size > 0 {
+			_, err := tw.Write(bytes.Repeat([]byte("x"), int(h.Size)))
+			rtx.Must(err, "Could not write %q", h.Name)
+		}
+	}
+	rtx.Must(tw.Close(), "Could not close tar")
+	rtx.Must(gw.Close(), "Could not close gzip")
+	return buf.Bytes()
+}
+
+func TestFromTarGZ_nonRegularFiles(t *testing.T) {
+	dir := &tar.Header{Name: "20200101/data.csv", Typeflag: tar.TypeDir, Mode: 0755}
+	link := &tar.Header{Name: "latest/data.csv", Typeflag: tar.TypeSymlink, Linkname: "../20200101/data.csv"}
+	file := &tar.Header{Name: "20200102/data.csv", Typeflag: tar.TypeReg, Mode: 0644, Size: 3}
+
+	got, err := FromTarGZ(tgzOf(dir, link, file), "data.csv")
+	rtx.Must(err, "Could not read the regular file after a directory and symlink")
+	if string(got) != "xxx" {
+		t.Errorf("FromTarGZ() = %q, want %q", got, "xxx")
+	}
+
+	_, err = FromTarGZ(tgzOf(dir, link), "data.csv")
+	if !errors.Is(err, ErrNotRegularFile) {
+		t.Errorf("FromTarGZ() error = %v, want %v", err, ErrNotRegularFile)
+	}
+	_, err = FromTarGZ(tgzOf(dir), "other.csv")
+	if err != ErrFileNotFound {
+		t.Errorf("FromTarGZ() error = %v, want %v", err, ErrFileNotFound)
+	}
+}
+
 func TestFromGZ(t *testing.T) {
 	tests := []struct {
 		name    string
@@ -89,3 +131,47 @@ func TestFromGZ(t *testing.T) {
 		})
 	}
 }
+
+func TestFromZip(t *testing.T) {
+	tests := []struct {
+		name     string
+		data     []byte
+		filename string
+		wantLen  int
+		wantErr  error
+	}{
+		{
+			name:     "success",
+			data:     mustRead("../testdata/GeoLite2City.zip"),
+			filename: "GeoLite2-City-Blocks-IPv4.csv",
+			wantLen:  335,
+		},
+		{
+			name:     "success-in-directory",
+			data:     mustRead("../testdata/GeoLite2-City-CSV.zip"),
+			filename: "GeoLite2-City-Locations-en.csv",
+			wantLen:  513,
+		},
+		{
+			name:     "file-not-found",
+			data:     mustRead("../testdata/GeoLite2City.zip"),
+			filename: "not-a-file",
+			wantErr:  ErrFileNotFound,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := FromZip(tt.data, tt.filename)
+			if err != tt.wantErr {
+				t.Errorf("FromZip() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if len(got) != tt.wantLen {
+				t.Errorf("FromZip() returned %d bytes, want %d", len(got), tt.wantLen)
+			}
+		})
+	}
+	if _, err := FromZip([]byte("not a zip"), "anything"); err == nil {
+		t.Error("FromZip() should fail when the data is not a zip archive")
+	}
+}
@@ -0,0 +1,94 @@
+package testsupport
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+var (
+	// ErrNotInSchema is for when a field of the JSON has no schema column.
+	ErrNotInSchema = errors.New("field is not in the schema")
+
+	// ErrSchemaMismatch is for when a field of the JSON has a schema column of
+	// an incompatible type or mode.
+	ErrSchemaMismatch = errors.New("field does not match the schema")
+)
+
+// SchemaField is a column of a BigQuery schema, in the JSON format written by
+// cmd/generate-schemas.
+type SchemaField struct {
+	Name   string
+	Type   string
+	Mode   string
+	Fields []SchemaField
+}
+
+// CheckSchema verifies that every field of the given annotation JSON maps to a
+// column of the given BigQuery schema JSON, as written by cmd/generate-schemas.
+// Column names are matched without regard to case, like BigQuery does. All
+// mismatches are returned, joined in a single error.
+func CheckSchema(annotation, schema []byte) error {
+	var fields []SchemaField
+	if err := json.Unmarshal(schema, &fields); err != nil {
+		return fmt.Errorf("could not parse schema: %w", err)
+	}
+	var row map[string]interface{}
+	if err := json.Unmarshal(annotation, &row); err != nil {
+		return fmt.Errorf("could not parse annotation: %w", err)
+	}
+	return errors.Join(checkRecord("", row, fields)...)
+}
+
+// checkRecord checks the fields of a JSON object against the columns of a
+// RECORD, using prefix to name the fields in errors.
+func checkRecord(prefix string, row map[string]interface{}, fields []SchemaField) []error {
+	var errs []error
+	for name, value := range row {
+		path := prefix + name
+		f, ok := findField(fields, name)
+		if !ok {
+			errs = append(errs, fmt.Errorf("%w: %s", ErrNotInSchema, path))
+			continue
+		}
+		errs = append(errs, checkValue(path, value, f, f.Mode == "REPEATED")...)
+	}
+	return errs
+}
+
+// checkValue checks a single JSON value against its column. repeated is true
+// when an array is permitted, i.e. the value is not already an array element.
+func checkValue(path string, value interface{}, f SchemaField, repeated bool) []error {
+	switch v := value.(type) {
+	case []interface{}:
+		if !repeated {
+			return []error{fmt.Errorf("%w: %s is an array, but the column is not REPEATED", ErrSchemaMismatch, path)}
+		}
+		var errs []error
+		for i, elem := range v {
+			errs = append(errs, checkValue(fmt.Sprintf("%s[%d]", path, i), elem, f, false)...)
+		}
+		return errs
+	case map[string]interface{}:
+		if f.Type != "RECORD" {
+			return []error{fmt.Errorf("%w: %s is an object, but the column is %s", ErrSchemaMismatch, path, f.Type)}
+		}
+		return checkRecord(path+".", v, f.Fields)
+	case nil:
+		return nil
+	}
+	if f.Type == "RECORD" {
+		return []error{fmt.Errorf("%w: %s is not an object, but the column is a RECORD", ErrSchemaMismatch, path)}
+	}
+	return nil
+}
+
+func findField(fields []SchemaField, name string) (SchemaField, bool) {
+	for _, f := range fields {
+		if strings.EqualFold(f.Name, name) {
+			return f, true
+		}
+	}
+	return SchemaField{}, false
+}
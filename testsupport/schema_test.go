@@ -0,0 +1,138 @@
+package testsupport
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/m-lab/go/rtx"
+
+	"github.com/m-lab/uuid-annotator/annotator"
+)
+
+// fill sets every field of v to a non-zero value, so that no field is
+// omitted from its JSON.
+func fill(v reflect.Value) {
+	switch v.Kind() {
+	case reflect.Ptr:
+		v.Set(reflect.New(v.Type().Elem()))
+		fill(v.Elem())
+	case reflect.Slice:
+		v.Set(reflect.MakeSlice(v.Type(), 1, 1))
+		fill(v.Index(0))
+	case reflect.Struct:
+		if v.Type() == reflect.TypeOf(time.Time{}) {
+			v.Set(reflect.ValueOf(time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)))
+			return
+		}
+		for i := 0; i < v.NumField(); i++ {
+			fill(v.Field(i))
+		}
+	case reflect.String:
+		v.SetString("x")
+	case reflect.Bool:
+		v.SetBool(true)
+	case reflect.Int, reflect.Int64:
+		v.SetInt(1)
+	case reflect.Uint32:
+		v.SetUint(1)
+	case reflect.Float64:
+		v.SetFloat(1.5)
+	}
+}
+
+// TestCheckSchema_annotations checks that the JSON of annotations with every
+// field set matches the schema in testdata. If it fails after adding a field,
+// regenerate the schema with cmd/generate-schemas, built against this tree:
+//
+//	generate-schemas -ann2 testdata/annotation2-schema.json -hop2 /dev/null
+func TestCheckSchema_annotations(t *testing.T) {
+	schema, err := os.ReadFile("../testdata/annotation2-schema.json")
+	rtx.Must(err, "Could not read schema")
+	a := annotator.Annotations{}
+	fill(reflect.ValueOf(&a).Elem())
+	b, err := json.Marshal(a)
+	rtx.Must(err, "Could not marshal annotations")
+	if err := CheckSchema(b, schema); err != nil {
+		t.Errorf("CheckSchema() = %v, want nil", err)
+	}
+}
+
+func TestCheckSchema(t *testing.T) {
+	schema := []byte(`[
+		{"name": "UUID", "type": "STRING"},
+		{"name": "server", "type": "RECORD", "fields": [
+			{"name": "Site", "type": "STRING"},
+			{"name": "Systems", "type": "RECORD", "mode": "REPEATED", "fields": [
+				{"name": "ASNs", "type": "INTEGER", "mode": "REPEATED"}
+			]}
+		]}
+	]`)
+	tests := []struct {
+		name       string
+		annotation string
+		schema     []byte
+		wantErr    bool
+		wantIs     error
+	}{
+		{
+			name:       "success",
+			annotation: `{"UUID": "x", "Server": {"Site": "lga03", "Systems": [{"ASNs": [1, 2]}]}}`,
+			schema:     schema,
+		},
+		{
+			name:       "not-in-schema",
+			annotation: `{"UUID": "x", "Server": {"Machine": "mlab1"}}`,
+			schema:     schema,
+			wantErr:    true,
+			wantIs:     ErrNotInSchema,
+		},
+		{
+			name:       "object-for-scalar",
+			annotation: `{"UUID": {"Value": "x"}}`,
+			schema:     schema,
+			wantErr:    true,
+			wantIs:     ErrSchemaMismatch,
+		},
+		{
+			name:       "scalar-for-record",
+			annotation: `{"Server": "lga03"}`,
+			schema:     schema,
+			wantErr:    true,
+			wantIs:     ErrSchemaMismatch,
+		},
+		{
+			name:       "array-for-nullable",
+			annotation: `{"UUID": ["x"]}`,
+			schema:     schema,
+			wantErr:    true,
+			wantIs:     ErrSchemaMismatch,
+		},
+		{
+			name:       "bad-schema",
+			annotation: `{}`,
+			schema:     []byte(`{`),
+			wantErr:    true,
+		},
+		{
+			name:       "bad-annotation",
+			annotation: `[`,
+			schema:     schema,
+			wantErr:    true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := CheckSchema([]byte(tt.annotation), tt.schema)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("CheckSchema() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantIs != nil && !errors.Is(err, tt.wantIs) {
+				t.Errorf("CheckSchema() = %v, want %v", err, tt.wantIs)
+			}
+		})
+	}
+}
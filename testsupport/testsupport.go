@@ -0,0 +1,69 @@
+// Package testsupport wires the annotators to the fixtures in the testdata
+// directory, for integration tests that need real annotations.
+package testsupport
+
+import (
+	"context"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+
+	"github.com/m-lab/go/content"
+
+	"github.com/m-lab/uuid-annotator/annotator"
+	"github.com/m-lab/uuid-annotator/asnannotator"
+	"github.com/m-lab/uuid-annotator/geoannotator"
+	"github.com/m-lab/uuid-annotator/siteannotator"
+)
+
+// Hostname is the server in the siteinfo fixture that the annotators are
+// configured for.
+const Hostname = "mlab1-lga03.mlab-sandbox.measurement-lab.org"
+
+// Annotators holds annotators loaded from the testdata fixtures.
+type Annotators struct {
+	Geo  geoannotator.GeoAnnotator
+	ASN  asnannotator.ASNAnnotator
+	Site annotator.Annotator
+
+	// LocalIPs are the local IPs used by the annotators, as returned by
+	// siteannotator.New.
+	LocalIPs []net.IP
+}
+
+// All returns the annotators in the order that main runs them.
+func (a *Annotators) All() []annotator.Annotator {
+	return []annotator.Annotator{a.Geo, a.ASN, a.Site}
+}
+
+// New loads the annotators from the fixtures in the given testdata directory,
+// e.g. "../testdata". The annotators treat the given IPs as those of Hostname.
+//
+// The annotator constructors exit the process when their data can not be
+// loaded, so New checks that every fixture exists before loading any of them.
+func New(ctx context.Context, testdata string, localIPs []net.IP) (*Annotators, error) {
+	p := map[string]content.Provider{}
+	for _, path := range []string{
+		filepath.Join(testdata, "fake.tar.gz"),
+		filepath.Join(testdata, "RouteViewIPv4.pfx2as.gz"),
+		filepath.Join(testdata, "RouteViewIPv6.pfx2as.gz"),
+		filepath.Join(testdata, "annotations.json"),
+		filepath.Join(testdata, "..", "data", "asnames.ipinfo.csv"), // Not part of testdata.
+	} {
+		if _, err := os.Stat(path); err != nil {
+			return nil, err
+		}
+		var err error
+		p[filepath.Base(path)], err = content.FromURL(ctx, &url.URL{Scheme: "file", Path: path})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	a := &Annotators{}
+	a.Site, a.LocalIPs = siteannotator.New(ctx, Hostname, p["annotations.json"], localIPs)
+	a.Geo = geoannotator.New(ctx, p["fake.tar.gz"], a.LocalIPs)
+	a.ASN = asnannotator.New(ctx, p["RouteViewIPv4.pfx2as.gz"], p["RouteViewIPv6.pfx2as.gz"], p["asnames.ipinfo.csv"], a.LocalIPs)
+	return a, nil
+}
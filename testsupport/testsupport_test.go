@@ -0,0 +1,48 @@
+package testsupport
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"testing"
+
+	"github.com/m-lab/go/rtx"
+	"github.com/m-lab/tcp-info/inetdiag"
+
+	"github.com/m-lab/uuid-annotator/annotator"
+)
+
+func TestNew(t *testing.T) {
+	local := []net.IP{net.ParseIP("64.86.148.130")} // mlab1-lga03
+	a, err := New(context.Background(), "../testdata", local)
+	rtx.Must(err, "Could not load annotators")
+
+	id := &inetdiag.SockID{
+		SrcIP: "64.86.148.130",
+		SPort: 443,
+		DstIP: "2.125.160.216",
+		DPort: 1234,
+	}
+	ann := &annotator.Annotations{}
+	for _, an := range a.All() {
+		rtx.Must(an.Annotate(id, ann), "Could not annotate")
+	}
+
+	if ann.Server.Site != "lga03" || ann.Server.Machine != "mlab1" {
+		t.Errorf("Annotate() wrong server: %+v", ann.Server)
+	}
+	if ann.Client.Geo == nil || ann.Client.Geo.CountryCode != "GB" {
+		t.Errorf("Annotate() wrong client geo: %+v", ann.Client.Geo)
+	}
+	if ann.Client.Network == nil || ann.Client.Network.ASNumber != 5607 || ann.Client.Network.ASName == "" {
+		t.Errorf("Annotate() wrong client network: %+v", ann.Client.Network)
+	}
+}
+
+func TestNew_missingTestdata(t *testing.T) {
+	_, err := New(context.Background(), "/this/directory/does/not/exist", nil)
+	if !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("New() error = %v, want %v", err, os.ErrNotExist)
+	}
+}